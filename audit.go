@@ -0,0 +1,369 @@
+package certinject
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" // #nosec G505
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var auditLogPath = cflag.String(flagGroup, "auditlog", "",
+	"Path to an append-only JSON lines log of every change certinject "+
+		"makes to the trust stores.  Each record holds the hash of the one "+
+		"before it, so that the audit verify command can detect tampering")
+
+var (
+	ErrAudit         = errors.New("audit log error")
+	ErrAuditTampered = fmt.Errorf("audit log doesn't verify: %w", ErrAudit)
+)
+
+// Operations recorded in the audit log.
+const (
+	auditInject   = "inject"
+	auditRemove   = "remove"
+	auditClean    = "clean"
+	auditRepair   = "repair"
+	auditRollback = "rollback"
+	auditRestore  = "restore"
+)
+
+// auditRecord is one line of the audit log.  User is the serve client the
+// change was made for, or else the user certinject runs as.  Before and
+// After are digests of what the store held for the cert, in the store's own
+// form, before and after the change; either is empty if the cert wasn't
+// there.  Hash is the
+// SHA-256 of the record's JSON with Hash empty, and Prev is the Hash of the
+// record before it, so editing or removing a record breaks the chain.
+type auditRecord struct {
+	Seq          uint64            `json:"seq"`
+	Time         string            `json:"time"`
+	User         string            `json:"user"`
+	Operation    string            `json:"operation"`
+	Store        string            `json:"store"`
+	Fingerprints map[string]string `json:"fingerprints"`
+	Before       string            `json:"before,omitempty"`
+	After        string            `json:"after,omitempty"`
+	Prev         string            `json:"prev"`
+	Hash         string            `json:"hash"`
+}
+
+// auditMutex keeps records written by this process in order.  Other
+// processes are kept out by a lock on the log file itself.
+var auditMutex sync.Mutex
+
+// auditEnabled reports whether changes are being recorded.  Callers only
+// gather the state to record when it is, since that can be slow.
+func auditEnabled() bool {
+	return auditLogPath.Value() != "" && !dryRun.Value()
+}
+
+// auditChange reads the state of a store's entry for a cert, before an
+// operation changes it, and returns a function to call afterwards, which
+// records the change in the audit log.  requester is the serve client the
+// operation is for, or empty.  state returns nil if the store has no entry
+// for the cert.
+func auditChange(operation, requester, store string, fingerprints map[string]string, state func() []byte) func() {
+	if !auditEnabled() {
+		return func() {}
+	}
+
+	before := state()
+
+	return func() {
+		recordAudit(operation, requester, store, fingerprints, before, state())
+	}
+}
+
+// auditStateFile returns a function that reads a file, for auditChange.
+func auditStateFile(path string) func() []byte {
+	return func() []byte {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		return data
+	}
+}
+
+// recordAudit appends a record of a change to the audit log, if there is
+// one.  The change has already happened, so a failure is logged rather
+// than returned.
+func recordAudit(operation, requester, store string, fingerprints map[string]string, before, after []byte) {
+	// Rewriting an entry with what it already held isn't a change.
+	if !auditEnabled() || bytes.Equal(before, after) {
+		return
+	}
+
+	user := requester
+	if user == "" {
+		user = auditUser()
+	}
+
+	record := &auditRecord{
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		User:         user,
+		Operation:    operation,
+		Store:        store,
+		Fingerprints: fingerprints,
+		Before:       auditDigest(before),
+		After:        auditDigest(after),
+	}
+
+	err := appendAudit(auditLogPath.Value(), record)
+	if err != nil {
+		log.Errorf("Couldn't record %s of %v in %s: %s", operation, fingerprints, store, err)
+	}
+}
+
+// auditFingerprints returns the SHA-256 and SHA-1 fingerprints of a cert.
+// The SHA-1 one is what CryptoAPI names it by.
+func auditFingerprints(derBytes []byte) map[string]string {
+	sha256Fingerprint := sha256.Sum256(derBytes)
+	sha1Fingerprint := sha1.Sum(derBytes) // #nosec G401
+
+	return map[string]string{
+		"sha256": hex.EncodeToString(sha256Fingerprint[:]),
+		"sha1":   hex.EncodeToString(sha1Fingerprint[:]),
+	}
+}
+
+func auditDigest(data []byte) string {
+	if data == nil {
+		return ""
+	}
+
+	digest := sha256.Sum256(data)
+
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
+
+func auditUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return strconv.Itoa(os.Getuid())
+	}
+
+	return current.Username
+}
+
+// appendAudit chains record to the last record in the log at path, and
+// appends it.
+func appendAudit(path string, record *auditRecord) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't open %s: %w", err, path, ErrAudit)
+	}
+	defer f.Close()
+
+	// Otherwise two processes could both chain a record to the same last
+	// one.
+	unlock, err := lockAuditFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't lock %s: %w", err, path, ErrAudit)
+	}
+	defer unlock()
+
+	last, err := readLastLine(f)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrAudit)
+	}
+
+	record.Seq = 1
+	record.Prev = ""
+
+	if last != nil {
+		prev := &auditRecord{}
+
+		err = json.Unmarshal(last, prev)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't parse last record of %s: %w", err, path, ErrAuditTampered)
+		}
+
+		record.Seq = prev.Seq + 1
+		record.Prev = prev.Hash
+	}
+
+	line, err := record.seal()
+	if err != nil {
+		return err
+	}
+
+	// A single write, so that a crash can't leave half a record.
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("%s: couldn't write to %s: %w", err, path, ErrAudit)
+	}
+
+	return nil
+}
+
+// seal sets the record's Hash, and returns its JSON.
+func (r *auditRecord) seal() ([]byte, error) {
+	hash, err := r.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Hash = hash
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't marshal record: %w", err, ErrAudit)
+	}
+
+	return line, nil
+}
+
+func (r *auditRecord) hash() (string, error) {
+	unsealed := *r
+	unsealed.Hash = ""
+
+	data, err := json.Marshal(&unsealed)
+	if err != nil {
+		return "", fmt.Errorf("%s: couldn't marshal record: %w", err, ErrAudit)
+	}
+
+	digest := sha256.Sum256(data)
+
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// readLastLine returns the last line of f, without its newline, or nil if
+// f is empty.
+func readLastLine(f *os.File) ([]byte, error) {
+	const chunkSize = 4096
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	tail := []byte{}
+
+	for offset := end; offset > 0; {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+
+		offset -= size
+		chunk := make([]byte, size)
+
+		_, err = f.ReadAt(chunk, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		tail = append(chunk, tail...)
+
+		// The file ends with a newline, so look for the one before it.
+		if i := bytes.LastIndexByte(bytes.TrimSuffix(tail, []byte("\n")), '\n'); i != -1 {
+			return bytes.TrimSuffix(tail[i+1:], []byte("\n")), nil
+		}
+	}
+
+	tail = bytes.TrimSuffix(tail, []byte("\n"))
+	if len(tail) == 0 {
+		return nil, nil
+	}
+
+	return tail, nil
+}
+
+// VerifyAuditLog checks that every record in the configured audit log is
+// intact and chained to the one before it.  It returns an error wrapping
+// ErrAuditTampered at the first one that isn't.  Anyone who can write the
+// log can still rebuild the whole chain, or drop records from its end, so
+// it logs the last record's hash, to compare with a copy kept elsewhere.
+func VerifyAuditLog() error {
+	path := auditLogPath.Value()
+	if path == "" {
+		return fmt.Errorf("auditlog must be set: %w", ErrAudit)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't open %s: %w", err, path, ErrAudit)
+	}
+	defer f.Close()
+
+	count, last, err := verifyAuditRecords(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	log.Infof("Audit log %s: %d records verified, last hash %s", path, count, last)
+
+	return nil
+}
+
+// verifyAuditRecords checks the records read from r, and returns how many
+// there were and the last one's hash.
+func verifyAuditRecords(r io.Reader) (uint64, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	var (
+		count uint64
+		prev  string
+	)
+
+	for scanner.Scan() {
+		count++
+
+		record := &auditRecord{}
+
+		// Fields that the hash doesn't cover would otherwise pass.
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(record)
+		if err != nil {
+			return count, prev, fmt.Errorf("%s: record %d doesn't parse: %w", err, count, ErrAuditTampered)
+		}
+
+		if record.Seq != count {
+			return count, prev, fmt.Errorf("record %d has sequence number %d: %w", count, record.Seq,
+				ErrAuditTampered)
+		}
+
+		if record.Prev != prev {
+			return count, prev, fmt.Errorf("record %d isn't chained to the one before it: %w", count,
+				ErrAuditTampered)
+		}
+
+		hash, err := record.hash()
+		if err != nil {
+			return count, prev, err
+		}
+
+		if record.Hash != hash {
+			return count, prev, fmt.Errorf("record %d doesn't match its hash: %w", count, ErrAuditTampered)
+		}
+
+		prev = record.Hash
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return count, prev, fmt.Errorf("%s: %w", err, ErrAudit)
+	}
+
+	return count, prev, nil
+}
@@ -0,0 +1,142 @@
+package certinject
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	auditLogPath.SetValue(path)
+	defer auditLogPath.SetValue("")
+
+	certPath := filepath.Join(dir, "cert.p11-kit")
+	fingerprints := map[string]string{"sha256": "00"}
+
+	// A record longer than readLastLine's chunks still chains.
+	long := map[string]string{"sha256": strings.Repeat("0", 10000)}
+
+	for _, test := range []struct {
+		operation    string
+		requester    string
+		fingerprints map[string]string
+		data         []byte
+	}{
+		{auditInject, "", fingerprints, []byte("first")},
+		{auditInject, "", fingerprints, []byte("first")},
+		{auditRepair, "", long, []byte("second")},
+		{auditRemove, "resolver", fingerprints, nil},
+	} {
+		record := auditChange(test.operation, test.requester, manifestStoreP11Kit, test.fingerprints,
+			auditStateFile(certPath))
+
+		if test.data == nil {
+			err := os.Remove(certPath)
+			if err != nil {
+				t.Fatalf("couldn't remove file: %s", err)
+			}
+		} else {
+			err := os.WriteFile(certPath, test.data, 0o600)
+			if err != nil {
+				t.Fatalf("couldn't write file: %s", err)
+			}
+		}
+
+		record()
+	}
+
+	err := VerifyAuditLog()
+	if err != nil {
+		t.Fatalf("audit log didn't verify: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("couldn't read audit log: %s", err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines = lines[:len(lines)-1]
+
+	// Rewriting the same data isn't a change.
+	if len(lines) != 3 {
+		t.Fatalf("got %d records, expected 3", len(lines))
+	}
+
+	added := !bytes.Contains(lines[0], []byte(`"before"`)) && bytes.Contains(lines[0], []byte(`"after"`))
+	removed := bytes.Contains(lines[2], []byte(`"before"`)) && !bytes.Contains(lines[2], []byte(`"after"`))
+
+	if !added || !removed {
+		t.Errorf("records don't show the cert being added and then removed: %s", data)
+	}
+
+	if !bytes.Contains(lines[2], []byte(`"user":"resolver"`)) || bytes.Contains(lines[0], []byte(`"user":"resolver"`)) {
+		t.Errorf("records don't show who asked for each change: %s", data)
+	}
+
+	for _, test := range []struct {
+		name  string
+		lines [][]byte
+	}{
+		{"edited record", [][]byte{
+			lines[0], bytes.Replace(lines[1], []byte(auditRepair), []byte(auditInject), 1), lines[2],
+		}},
+		{"removed record", [][]byte{lines[0], lines[2]}},
+		{"reordered records", [][]byte{lines[1], lines[0], lines[2]}},
+		{"unhashed field", [][]byte{
+			lines[0], lines[1], bytes.Replace(lines[2], []byte("{"), []byte(`{"note":"x",`), 1),
+		}},
+	} {
+		_, _, err := verifyAuditRecords(bytes.NewReader(bytes.Join(test.lines, nil)))
+		if !errors.Is(err, ErrAuditTampered) {
+			t.Errorf("%s: verified with %v, expected ErrAuditTampered", test.name, err)
+		}
+	}
+}
+
+func TestAuditLogLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatalf("couldn't create audit log: %s", err)
+	}
+	defer f.Close()
+
+	// Another process's lock works the same, since each open file has its
+	// own.
+	unlock, err := lockAuditFile(f)
+	if err != nil {
+		t.Fatalf("couldn't lock audit log: %s", err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- appendAudit(path, &auditRecord{Operation: auditInject})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("appended to a locked audit log with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("couldn't append once unlocked: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("append didn't finish once unlocked")
+	}
+}
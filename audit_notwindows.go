@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockAuditFile takes an exclusive lock on an open audit log, waiting for
+// any other process that holds one, and returns a function that releases
+// it.
+func lockAuditFile(f *os.File) (func(), error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { _ = unix.Flock(int(f.Fd()), unix.LOCK_UN) }, nil
+}
@@ -0,0 +1,23 @@
+package certinject
+
+import (
+	"math"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockAuditFile takes an exclusive lock on an open audit log, waiting for
+// any other process that holds one, and returns a function that releases
+// it.
+func lockAuditFile(f *os.File) (func(), error) {
+	handle := windows.Handle(f.Fd())
+	overlapped := &windows.Overlapped{}
+
+	err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, math.MaxUint32, math.MaxUint32, overlapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { _ = windows.UnlockFileEx(handle, 0, math.MaxUint32, math.MaxUint32, overlapped) }, nil
+}
@@ -0,0 +1,375 @@
+package certinject
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// backupArchiveVersion is bumped whenever the archive format changes in a
+// way that older versions of certinject can't restore.
+const backupArchiveVersion = 1
+
+var (
+	ErrBackup          = errors.New("error backing up trust stores")
+	ErrRestore         = errors.New("error restoring trust stores")
+	ErrArchiveVersion  = fmt.Errorf("unsupported archive version: %w", ErrRestore)
+	ErrArchiveFileName = fmt.Errorf("invalid file name in archive: %w", ErrRestore)
+	ErrArchiveStore    = fmt.Errorf("archive is of a different store than the configured one: %w", ErrRestore)
+)
+
+// backupArchive is a gzipped JSON document holding everything certinject
+// can change in each configured trust store.  Stores that weren't
+// configured when the backup was made are nil, and aren't touched by a
+// restore.
+type backupArchive struct {
+	Version   int              `json:"version"`
+	Created   time.Time        `json:"created"`
+	CryptoAPI *cryptoAPIBackup `json:"cryptoapi,omitempty"`
+	NSS       *nssBackup       `json:"nss,omitempty"`
+	P11Kit    *dirBackup       `json:"p11kit,omitempty"`
+}
+
+// cryptoAPIBackup holds every cert subkey of one CryptoAPI store, with all of
+// its registry values (the Blob, and any magic tags or markers).
+type cryptoAPIBackup struct {
+	PhysicalStore string              `json:"physical-store"`
+	LogicalStore  string              `json:"logical-store"`
+	Certs         []registryKeyBackup `json:"certs"`
+}
+
+type registryKeyBackup struct {
+	Name   string                `json:"name"`
+	Values []registryValueBackup `json:"values"`
+}
+
+// registryValueBackup holds a registry value in its raw form, so that it can
+// be restored exactly regardless of its type.
+type registryValueBackup struct {
+	Name string `json:"name"`
+	Type uint32 `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// dirBackup holds the files in a directory that certinject writes to.
+// Modification times are kept because they're what cert expiry is based on.
+type dirBackup struct {
+	Dir   string       `json:"dir"`
+	Files []fileBackup `json:"files"`
+}
+
+type fileBackup struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod-time"`
+	Data    []byte      `json:"data"`
+}
+
+// Backup writes an archive of every entry that certinject can change in the
+// configured trust stores to w.
+func Backup(w io.Writer) error {
+	archive := &backupArchive{
+		Version: backupArchiveVersion,
+		Created: time.Now().UTC(),
+	}
+
+	err := backupStores(archive)
+	if err != nil {
+		return err
+	}
+
+	if archive.CryptoAPI == nil && archive.NSS == nil && archive.P11Kit == nil {
+		return fmt.Errorf("no trust stores configured: %w", ErrBackup)
+	}
+
+	return writeBackupArchive(w, archive)
+}
+
+// Restore puts the trust stores in an archive made by Backup back the way
+// they were.  Entries that were added since the backup are removed.  Each
+// store in the archive must be the one configured now, since the archive
+// isn't trusted to choose where to write.  In dry-run mode, it prints what
+// it would do instead.
+func Restore(r io.Reader) error {
+	archive, err := readBackupArchive(r)
+	if err != nil {
+		return err
+	}
+
+	return restoreStores(archive)
+}
+
+func writeBackupArchive(w io.Writer, archive *backupArchive) error {
+	compressor := gzip.NewWriter(w)
+
+	encoder := json.NewEncoder(compressor)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(archive)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't encode archive: %w", err, ErrBackup)
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return fmt.Errorf("%s: couldn't compress archive: %w", err, ErrBackup)
+	}
+
+	return nil
+}
+
+func readBackupArchive(r io.Reader) (*backupArchive, error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decompress archive: %w", err, ErrRestore)
+	}
+	defer decompressor.Close()
+
+	data, err := io.ReadAll(decompressor)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decompress archive: %w", err, ErrRestore)
+	}
+
+	// Check the version before decoding the rest, so that a newer archive
+	// gets a clear error rather than a confusing decoding error.
+	var header struct {
+		Version int `json:"version"`
+	}
+
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode archive: %w", err, ErrRestore)
+	}
+
+	if header.Version != backupArchiveVersion {
+		return nil, fmt.Errorf("got %d, expected %d: %w", header.Version, backupArchiveVersion, ErrArchiveVersion)
+	}
+
+	archive := &backupArchive{}
+
+	err = json.Unmarshal(data, archive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode archive: %w", err, ErrRestore)
+	}
+
+	return archive, nil
+}
+
+// backupDir saves the regular files in dir for which match returns true.
+func backupDir(dir string, match func(name string) bool) (*dirBackup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't list %s: %w", err, dir, ErrBackup)
+	}
+
+	result := &dirBackup{Dir: dir, Files: []fileBackup{}}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !match(entry.Name()) {
+			continue
+		}
+
+		file, err := backupFile(dir, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil {
+			result.Files = append(result.Files, *file)
+		}
+	}
+
+	return result, nil
+}
+
+// backupFile saves a single file in dir.  It returns nil if the file doesn't
+// exist.
+func backupFile(dir, name string) (*fileBackup, error) {
+	path := filepath.Join(dir, name)
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't stat %s: %w", err, name, ErrBackup)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read %s: %w", err, name, ErrBackup)
+	}
+
+	return &fileBackup{
+		Name:    name,
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+		Data:    data,
+	}, nil
+}
+
+// auditRestoreEach is auditChange for every entry in names that a restore
+// may change.  change returns the auditChange function for one entry.  The
+// entries are read before the restore starts, and the function it returns
+// records what changed once the restore is done, even if it failed partway.
+func auditRestoreEach(names map[string]bool, change func(name string) func()) func() {
+	if !auditEnabled() {
+		return func() {}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+
+	sort.Strings(sorted)
+
+	records := make([]func(), 0, len(sorted))
+	for _, name := range sorted {
+		records = append(records, change(name))
+	}
+
+	return func() {
+		for _, record := range records {
+			record()
+		}
+	}
+}
+
+// restoreDirNames returns the names of the files that restoreDir may change:
+// the matching files in dir, and those in the backup.
+func restoreDirNames(dir string, backup *dirBackup, match func(name string) bool) map[string]bool {
+	names := map[string]bool{}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && match(entry.Name()) {
+			names[entry.Name()] = true
+		}
+	}
+
+	// restoreDir rejects any other names before changing anything.
+	for _, file := range backup.Files {
+		if file.Name == filepath.Base(file.Name) && match(file.Name) {
+			names[file.Name] = true
+		}
+	}
+
+	return names
+}
+
+// restoreDir makes the files in dir for which match returns true identical
+// to the backup, deleting any that aren't in it.  dir is the configured
+// directory, which the one the backup was made of must be.
+func restoreDir(dir string, backup *dirBackup, match func(name string) bool) error {
+	err := checkArchiveStore(backup.Dir, dir)
+	if err != nil {
+		return err
+	}
+
+	archived := map[string]bool{}
+
+	for _, file := range backup.Files {
+		// Don't let a crafted archive write outside the directory.
+		if file.Name != filepath.Base(file.Name) || file.Name == "." || file.Name == ".." || !match(file.Name) {
+			return fmt.Errorf("%q: %w", file.Name, ErrArchiveFileName)
+		}
+
+		archived[file.Name] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: couldn't list %s: %w", err, dir, ErrRestore)
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !match(entry.Name()) || archived[entry.Name()] {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		if dryRun.Value() {
+			planf("delete %s", path)
+
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't delete %s: %w", err, path, ErrRestore)
+		}
+	}
+
+	for _, file := range backup.Files {
+		err = restoreFile(dir, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkArchiveStore returns an error if the store an archive was made of
+// isn't the configured one.
+func checkArchiveStore(archived, configured string) error {
+	if configured == "" {
+		return fmt.Errorf("archive has %s, but no store is configured: %w", archived, ErrArchiveStore)
+	}
+
+	if filepath.Clean(archived) != filepath.Clean(configured) {
+		return fmt.Errorf("archive has %s, but %s is configured: %w", archived, configured, ErrArchiveStore)
+	}
+
+	return nil
+}
+
+func restoreFile(dir string, file fileBackup) error {
+	path := filepath.Join(dir, file.Name)
+
+	// Certs are public, so the only mode worth keeping from the archive is
+	// whether others can read them.
+	mode := os.FileMode(0o600)
+	if file.Mode&0o044 != 0 {
+		mode = 0o644
+	}
+
+	if dryRun.Value() {
+		planf("write %s (%d bytes, mode %s, modified %s)", path, len(file.Data), mode,
+			file.ModTime.Format(time.RFC3339))
+
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't create %s: %w", err, dir, ErrRestore)
+	}
+
+	err = os.WriteFile(path, file.Data, mode)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't write %s: %w", err, path, ErrRestore)
+	}
+
+	// WriteFile only applies the mode to new files.
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't set mode of %s: %w", err, path, ErrRestore)
+	}
+
+	err = os.Chtimes(path, file.ModTime, file.ModTime)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't set modification time of %s: %w", err, path, ErrRestore)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package certinject
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupArchiveRoundTrip(t *testing.T) {
+	archive := &backupArchive{
+		Version: backupArchiveVersion,
+		Created: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		CryptoAPI: &cryptoAPIBackup{
+			PhysicalStore: "system",
+			LogicalStore:  "Root",
+			Certs: []registryKeyBackup{{
+				Name:   "0123456789ABCDEF0123456789ABCDEF01234567",
+				Values: []registryValueBackup{{Name: "Blob", Type: 3, Data: []byte{1, 2, 3}}},
+			}},
+		},
+		NSS: &nssBackup{
+			DBDir:   "/nssdb",
+			Certs:   []nssCertBackup{{Nickname: "Namecoin-00", Trust: "CP,,", DER: []byte{4, 5}}},
+			CertDir: &dirBackup{Dir: "/certs", Files: []fileBackup{}},
+		},
+	}
+
+	var buf bytes.Buffer
+
+	err := writeBackupArchive(&buf, archive)
+	if err != nil {
+		t.Fatalf("couldn't write archive: %s", err)
+	}
+
+	restored, err := readBackupArchive(&buf)
+	if err != nil {
+		t.Fatalf("couldn't read archive: %s", err)
+	}
+
+	if !reflect.DeepEqual(restored, archive) {
+		t.Errorf("archive didn't round-trip: got %+v", restored)
+	}
+}
+
+func TestBackupArchiveVersion(t *testing.T) {
+	var buf bytes.Buffer
+
+	compressor := gzip.NewWriter(&buf)
+	_, _ = compressor.Write([]byte(`{"version": 2, "future-field": true}`))
+	_ = compressor.Close()
+
+	_, err := readBackupArchive(&buf)
+	if !errors.Is(err, ErrArchiveVersion) {
+		t.Errorf("expected ErrArchiveVersion, got %v", err)
+	}
+}
+
+func TestBackupRestoreDir(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, strings.Repeat("01", 32)+".pem")
+	added := filepath.Join(dir, strings.Repeat("02", 32)+".pem")
+	unrelated := filepath.Join(dir, "unrelated.txt")
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	err := os.WriteFile(kept, []byte("original"), 0o644)
+	if err != nil {
+		t.Fatalf("couldn't write test file: %s", err)
+	}
+
+	err = os.Chtimes(kept, modTime, modTime)
+	if err != nil {
+		t.Fatalf("couldn't set test file time: %s", err)
+	}
+
+	backup, err := backupDir(dir, isNSSCertFile)
+	if err != nil {
+		t.Fatalf("couldn't back up: %s", err)
+	}
+
+	// Change the directory the way an injection would.
+	_ = os.WriteFile(kept, []byte("changed"), 0o644)
+	_ = os.WriteFile(added, []byte("new cert"), 0o644)
+	_ = os.WriteFile(unrelated, []byte("not a cert"), 0o644)
+
+	err = restoreDir(dir, backup, isNSSCertFile)
+	if err != nil {
+		t.Fatalf("couldn't restore: %s", err)
+	}
+
+	data, err := os.ReadFile(kept)
+	if err != nil || string(data) != "original" {
+		t.Errorf("kept file not restored: %q, %v", data, err)
+	}
+
+	info, err := os.Stat(kept)
+	if err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time not restored: %v", err)
+	}
+
+	if _, err := os.Stat(added); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file added since backup wasn't deleted: %v", err)
+	}
+
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("file that isn't a cert was deleted: %v", err)
+	}
+}
+
+func TestAuditRestore(t *testing.T) {
+	dir := t.TempDir()
+	kept := strings.Repeat("01", 32) + ".pem"
+	added := strings.Repeat("02", 32) + ".pem"
+	unchanged := strings.Repeat("03", 32) + ".pem"
+
+	for _, name := range []string{kept, unchanged} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("original"), 0o644)
+		if err != nil {
+			t.Fatalf("couldn't write test file: %s", err)
+		}
+	}
+
+	backup, err := backupDir(dir, isNSSCertFile)
+	if err != nil {
+		t.Fatalf("couldn't back up: %s", err)
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, kept), []byte("changed"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, added), []byte("new cert"), 0o644)
+
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	auditLogPath.SetValue(logPath)
+	defer auditLogPath.SetValue("")
+
+	recordRestore := auditRestoreEach(restoreDirNames(dir, backup, isNSSCertFile), func(name string) func() {
+		return auditChange(auditRestore, "", manifestStoreNSS, map[string]string{"sha256": name},
+			auditStateFile(filepath.Join(dir, name)))
+	})
+
+	err = restoreDir(dir, backup, isNSSCertFile)
+	if err != nil {
+		t.Fatalf("couldn't restore: %s", err)
+	}
+
+	recordRestore()
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("couldn't read audit log: %s", err)
+	}
+
+	// The unchanged file isn't recorded.
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], kept) || !strings.Contains(lines[1], added) ||
+		strings.Count(string(data), `"operation":"restore"`) != 2 {
+		t.Errorf("expected restore records for %s and %s, got:\n%s", kept, added, data)
+	}
+}
+
+func TestRestoreDirRejectsPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	backup := &dirBackup{
+		Dir:   dir,
+		Files: []fileBackup{{Name: "../" + strings.Repeat("01", 32) + ".pem", Mode: 0o644, Data: []byte("x")}},
+	}
+
+	err := restoreDir(dir, backup, isNSSCertFile)
+	if !errors.Is(err, ErrArchiveFileName) {
+		t.Errorf("expected ErrArchiveFileName, got %v", err)
+	}
+}
+
+func TestRestoreDirRejectsOtherStore(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	name := strings.Repeat("01", 32) + ".pem"
+
+	err := os.WriteFile(filepath.Join(other, name), []byte("not in the archive"), 0o644)
+	if err != nil {
+		t.Fatalf("couldn't write test file: %s", err)
+	}
+
+	backup := &dirBackup{Dir: other, Files: []fileBackup{}}
+
+	for _, configured := range []string{dir, ""} {
+		err = restoreDir(configured, backup, isNSSCertFile)
+		if !errors.Is(err, ErrArchiveStore) {
+			t.Errorf("restoring into %q: expected ErrArchiveStore, got %v", configured, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(other, name)); err != nil {
+		t.Errorf("file in the archive's directory was deleted: %v", err)
+	}
+}
+
+func TestRestoreFileClampsMode(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, test := range []struct {
+		archived os.FileMode
+		expected os.FileMode
+	}{
+		{0o777, 0o644},
+		{0o4755, 0o644},
+		{0o640, 0o644},
+		{0o700, 0o600},
+		{0o000, 0o600},
+	} {
+		name := fmt.Sprintf("%o.pem", test.archived)
+
+		err := restoreFile(dir, fileBackup{Name: name, Mode: test.archived, Data: []byte("x")})
+		if err != nil {
+			t.Fatalf("couldn't restore: %s", err)
+		}
+
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("couldn't stat: %s", err)
+		}
+
+		if info.Mode() != test.expected {
+			t.Errorf("archived mode %s: got %s, expected %s", test.archived, info.Mode(), test.expected)
+		}
+	}
+}
+
+func TestParseCertutilList(t *testing.T) {
+	output := []byte(`
+Certificate Nickname                                         Trust Attributes
+                                                             SSL,S/MIME,JAR/XPI
+
+Namecoin-1de4074b4e38377f                                    CP,,
+Some Other CA                                                CT,C,C
+Namecoin-with space                                          ,,
+`)
+
+	expected := []nssCertBackup{
+		{Nickname: "Namecoin-1de4074b4e38377f", Trust: "CP,,"},
+		{Nickname: "Namecoin-with space", Trust: ",,"},
+	}
+
+	if certs := parseCertutilList(output); !reflect.DeepEqual(certs, expected) {
+		t.Errorf("expected %v, got %v", expected, certs)
+	}
+}
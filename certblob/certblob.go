@@ -4,6 +4,7 @@ package certblob
 
 import (
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -35,6 +36,10 @@ var (
 	ErrPropertyMarshal      = fmt.Errorf("error marshaling: %w", ErrProperty)
 	ErrPropertyParse        = fmt.Errorf("error parsing: %w", ErrProperty)
 	ErrPropertyInvalidValue = fmt.Errorf("invalid Value: %w", ErrPropertyMarshal)
+	ErrPropertyTruncated    = fmt.Errorf("truncated: %w", ErrPropertyParse)
+	ErrPropertyDuplicate    = fmt.Errorf("duplicate property: %w", ErrPropertyParse)
+	ErrPropertyAfterContent = fmt.Errorf("property after content property is ignored by CryptoAPI: %w",
+		ErrPropertyParse)
 )
 
 func (prop *Property) Marshal() ([]byte, error) {
@@ -46,7 +51,7 @@ func (prop *Property) Marshal() ([]byte, error) {
 		return nil, fmt.Errorf("overflows uint32 size: %w", ErrPropertyInvalidValue)
 	}
 
-	result := make([]byte, 4+4+4)
+	result := make([]byte, propHeaderLen)
 
 	// Marshal header
 	binary.LittleEndian.PutUint32(result[0:], prop.ID)
@@ -102,6 +107,38 @@ func (b Blob) SetProperty(prop *Property) {
 	b[prop.ID] = prop.Value
 }
 
+// ExtKeyUsage decodes the CertEnhkeyUsagePropID property.  OID's without a
+// corresponding x509.ExtKeyUsage value are returned separately.
+func (b Blob) ExtKeyUsage() ([]x509.ExtKeyUsage, []asn1.ObjectIdentifier, error) {
+	value, err := b.variableProperty(CertEnhkeyUsagePropID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ekus, unknown, err := x509ext.ParseExtKeyUsage(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", err, ErrPropertyDecode)
+	}
+
+	return ekus, unknown, nil
+}
+
+// NameConstraints decodes the CertRootProgramNameConstraintsPropID property.
+// Only the name constraint fields of the result are populated.
+func (b Blob) NameConstraints() (*x509.Certificate, error) {
+	value, err := b.variableProperty(CertRootProgramNameConstraintsPropID)
+	if err != nil {
+		return nil, err
+	}
+
+	constraints, err := x509ext.ParseNameConstraints(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyDecode)
+	}
+
+	return constraints, nil
+}
+
 // We sort the ID's so that we get a deterministic Marshaling.
 func (b Blob) sortedIDs() []uint32 {
 	propIDs := make([]uint32, 0, len(b))
@@ -156,39 +193,119 @@ func (b Blob) Marshal() ([]byte, error) {
 	return result, nil
 }
 
+// ParseMode selects how ParseBlobMode treats blobs that are well-formed
+// enough to decode, but which contain properties that CryptoAPI would
+// handle in a surprising way.
+type ParseMode int
+
+const (
+	// ParseLenient decodes the blob the way CryptoAPI would, and reports any
+	// surprises as warnings.  Duplicate properties are resolved in favor of
+	// the last one, and properties after the content property are dropped.
+	ParseLenient ParseMode = iota
+
+	// ParseStrict rejects any blob that ParseLenient would warn about.
+	ParseStrict
+)
+
+// ParseError describes a problem with the property that begins at byte
+// Offset of a blob.
+type ParseError struct {
+	Offset int
+	ID     uint32
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("offset %d (ID %d): %s", e.Offset, e.ID, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+const propHeaderLen = 4 + 4 + 4
+
+// ParseBlob parses a blob in lenient mode, discarding any warnings.
 func ParseBlob(data []byte) (Blob, error) {
+	result, _, err := ParseBlobMode(data, ParseLenient)
+
+	return result, err
+}
+
+// ParseBlobMode parses a blob, which may come from an untrusted source such
+// as the registry.  Truncated or otherwise undecodable blobs are always
+// rejected.  In ParseLenient mode, the returned warnings list any
+// properties that were decoded but are suspicious; in ParseStrict mode,
+// those are returned as an error instead.
+func ParseBlobMode(data []byte, mode ParseMode) (Blob, []*ParseError, error) {
 	result := Blob{}
+	warnings := []*ParseError{}
+	seenContent := false
 
-	var (
-		prop    Property
-		propLen int
-	)
+	for offset := 0; offset < len(data); {
+		remaining := data[offset:]
 
-	for len(data) > 0 {
-		if len(data) < 12 {
-			return nil, fmt.Errorf("length inconsistent: %w", ErrPropertyParse)
+		if len(remaining) < propHeaderLen {
+			return nil, nil, &ParseError{Offset: offset, Err: fmt.Errorf(
+				"%d bytes left, need %d for header: %w", len(remaining), propHeaderLen, ErrPropertyTruncated)}
 		}
 
-		prop = Property{}
-
 		// PropID is the first 4 bytes
-		prop.ID = binary.LittleEndian.Uint32(data[0:])
+		propID := binary.LittleEndian.Uint32(remaining[0:])
 
 		// Reserved value is the next 4 bytes
-		if binary.LittleEndian.Uint32(data[4:]) != propReserved {
-			return nil, fmt.Errorf("unexpected reserved field: %w", ErrPropertyParse)
+		if binary.LittleEndian.Uint32(remaining[4:]) != propReserved {
+			return nil, nil, &ParseError{Offset: offset, ID: propID, Err: fmt.Errorf(
+				"unexpected reserved field: %w", ErrPropertyParse)}
 		}
 
-		// Then the value size
-		propLen = int(binary.LittleEndian.Uint32(data[8:]))
-		data = data[12:]
+		// Then the value size.  We compare as uint64 so that huge sizes
+		// can't overflow int on 32-bit platforms.
+		propLen := binary.LittleEndian.Uint32(remaining[8:])
+		if uint64(propLen) > uint64(len(remaining)-propHeaderLen) {
+			return nil, nil, &ParseError{Offset: offset, ID: propID, Err: fmt.Errorf(
+				"value size %d exceeds %d remaining bytes: %w", propLen, len(remaining)-propHeaderLen,
+				ErrPropertyTruncated)}
+		}
 
 		// And finally the value itself
-		prop.Value = data[:propLen]
-		data = data[propLen:]
+		value := remaining[propHeaderLen : propHeaderLen+int(propLen)]
+
+		var warning error
+
+		switch {
+		case seenContent:
+			warning = ErrPropertyAfterContent
+		case result.hasProperty(propID):
+			warning = ErrPropertyDuplicate
+		}
+
+		if warning != nil {
+			if mode == ParseStrict {
+				return nil, nil, &ParseError{Offset: offset, ID: propID, Err: warning}
+			}
+
+			warnings = append(warnings, &ParseError{Offset: offset, ID: propID, Err: warning})
+		}
+
+		// CryptoAPI silently ignores anything after the content property.
+		if !seenContent {
+			result.SetProperty(&Property{ID: propID, Value: value})
+		}
 
-		result.SetProperty(&prop)
+		if isContentPropID(propID) {
+			seenContent = true
+		}
+
+		offset += propHeaderLen + int(propLen)
 	}
 
-	return result, nil
+	return result, warnings, nil
+}
+
+func (b Blob) hasProperty(id uint32) bool {
+	_, ok := b[id]
+
+	return ok
 }
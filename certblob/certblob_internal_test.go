@@ -0,0 +1,300 @@
+package certblob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBlobFiles(t testing.TB) map[string][]byte {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.blob"))
+	if err != nil {
+		t.Fatalf("couldn't list test blobs: %s", err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatalf("no test blobs found")
+	}
+
+	result := map[string][]byte{}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("couldn't read %s: %s", path, err)
+		}
+
+		result[path] = data
+	}
+
+	return result
+}
+
+func rawProperty(id, reserved, size uint32, value []byte) []byte {
+	result := make([]byte, propHeaderLen)
+
+	binary.LittleEndian.PutUint32(result[0:], id)
+	binary.LittleEndian.PutUint32(result[4:], reserved)
+	binary.LittleEndian.PutUint32(result[8:], size)
+
+	return append(result, value...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseBlobTestdata(t *testing.T) {
+	for path, data := range testBlobFiles(t) {
+		blob, warnings, err := ParseBlobMode(data, ParseStrict)
+		if err != nil {
+			t.Errorf("%s: couldn't parse: %s", path, err)
+
+			continue
+		}
+
+		if len(warnings) != 0 {
+			t.Errorf("%s: unexpected warnings in strict mode: %v", path, warnings)
+		}
+
+		if _, ok := blob[CertContentCertPropID]; !ok {
+			t.Errorf("%s: no content property", path)
+		}
+
+		// The test blobs are stored in sorted order, so they should
+		// round-trip exactly.
+		marshaled, err := blob.Marshal()
+		if err != nil {
+			t.Errorf("%s: couldn't marshal: %s", path, err)
+
+			continue
+		}
+
+		if !bytes.Equal(marshaled, data) {
+			t.Errorf("%s: didn't round-trip", path)
+		}
+	}
+}
+
+func TestParseBlobErrors(t *testing.T) {
+	content := rawProperty(CertContentCertPropID, propReserved, 3, []byte{1, 2, 3})
+	friendly := rawProperty(CertFriendlyNamePropID, propReserved, 2, []byte{0, 0})
+
+	tests := []struct {
+		name           string
+		data           []byte
+		strictErr      error
+		lenientErr     error
+		offset         int
+		lenientWarning error
+	}{
+		{
+			name:       "short header",
+			data:       concat(content, []byte{1, 2, 3}),
+			strictErr:  ErrPropertyTruncated,
+			lenientErr: ErrPropertyTruncated,
+			offset:     len(content),
+		},
+		{
+			name:       "size past end",
+			data:       rawProperty(CertContentCertPropID, propReserved, 4, []byte{1, 2, 3}),
+			strictErr:  ErrPropertyTruncated,
+			lenientErr: ErrPropertyTruncated,
+			offset:     0,
+		},
+		{
+			name:       "huge size",
+			data:       rawProperty(CertContentCertPropID, propReserved, 0xFFFFFFFF, nil),
+			strictErr:  ErrPropertyTruncated,
+			lenientErr: ErrPropertyTruncated,
+			offset:     0,
+		},
+		{
+			name:       "bad reserved",
+			data:       concat(friendly, rawProperty(CertContentCertPropID, 2, 0, nil)),
+			strictErr:  ErrPropertyParse,
+			lenientErr: ErrPropertyParse,
+			offset:     len(friendly),
+		},
+		{
+			name:           "duplicate",
+			data:           concat(friendly, friendly, content),
+			strictErr:      ErrPropertyDuplicate,
+			offset:         len(friendly),
+			lenientWarning: ErrPropertyDuplicate,
+		},
+		{
+			name:           "after content",
+			data:           concat(content, friendly),
+			strictErr:      ErrPropertyAfterContent,
+			offset:         len(content),
+			lenientWarning: ErrPropertyAfterContent,
+		},
+	}
+
+	for _, test := range tests {
+		_, _, err := ParseBlobMode(test.data, ParseStrict)
+		checkParseError(t, test.name+" (strict)", err, test.strictErr, test.offset)
+
+		blob, warnings, err := ParseBlobMode(test.data, ParseLenient)
+		if test.lenientErr != nil {
+			checkParseError(t, test.name+" (lenient)", err, test.lenientErr, test.offset)
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s (lenient): unexpected error: %s", test.name, err)
+
+			continue
+		}
+
+		if len(warnings) != 1 {
+			t.Errorf("%s (lenient): expected 1 warning, got %v", test.name, warnings)
+
+			continue
+		}
+
+		checkParseError(t, test.name+" (lenient warning)", warnings[0], test.lenientWarning, test.offset)
+
+		if !bytes.Equal(blob[CertContentCertPropID], []byte{1, 2, 3}) {
+			t.Errorf("%s (lenient): wrong content %x", test.name, blob[CertContentCertPropID])
+		}
+	}
+}
+
+func TestParseBlobIgnoresAfterContent(t *testing.T) {
+	data := concat(
+		rawProperty(CertContentCertPropID, propReserved, 1, []byte{1}),
+		rawProperty(CertFriendlyNamePropID, propReserved, 2, []byte{0, 0}),
+	)
+
+	blob, err := ParseBlob(data)
+	if err != nil {
+		t.Fatalf("couldn't parse: %s", err)
+	}
+
+	if _, ok := blob[CertFriendlyNamePropID]; ok {
+		t.Errorf("property after content wasn't dropped")
+	}
+}
+
+// registryLayoutBlob has the shapes that a real registry blob may have but
+// the synthesized corpus doesn't: properties out of order, property ID's
+// that this package doesn't know, and an empty value.
+func registryLayoutBlob() []byte {
+	return concat(
+		rawProperty(CertSHA1HashPropID, propReserved, 2, []byte{1, 2}),
+		rawProperty(0x10000, propReserved, 3, []byte{3, 4, 5}),
+		rawProperty(CertFriendlyNamePropID, propReserved, 0, nil),
+		rawProperty(127, propReserved, 1, []byte{6}),
+		rawProperty(CertContentCertPropID, propReserved, 1, []byte{7}),
+	)
+}
+
+func TestParseBlobRegistryLayout(t *testing.T) {
+	blob, warnings, err := ParseBlobMode(registryLayoutBlob(), ParseStrict)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("couldn't parse: %v, %v", warnings, err)
+	}
+
+	if len(blob) != 5 || !bytes.Equal(blob[0x10000], []byte{3, 4, 5}) || len(blob[CertFriendlyNamePropID]) != 0 {
+		t.Errorf("properties weren't all kept: %v", blob)
+	}
+
+	marshaled, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal: %s", err)
+	}
+
+	// Marshaling sorts the properties, keeping the content last.
+	expected := concat(
+		rawProperty(CertSHA1HashPropID, propReserved, 2, []byte{1, 2}),
+		rawProperty(CertFriendlyNamePropID, propReserved, 0, nil),
+		rawProperty(127, propReserved, 1, []byte{6}),
+		rawProperty(0x10000, propReserved, 3, []byte{3, 4, 5}),
+		rawProperty(CertContentCertPropID, propReserved, 1, []byte{7}),
+	)
+	if !bytes.Equal(marshaled, expected) {
+		t.Errorf("marshaled %x, expected %x", marshaled, expected)
+	}
+}
+
+func checkParseError(t *testing.T, name string, err, expected error, offset int) {
+	t.Helper()
+
+	if !errors.Is(err, expected) {
+		t.Errorf("%s: expected %v, got %v", name, expected, err)
+
+		return
+	}
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("%s: expected a *ParseError, got %T", name, err)
+
+		return
+	}
+
+	if parseErr.Offset != offset {
+		t.Errorf("%s: expected offset %d, got %d", name, offset, parseErr.Offset)
+	}
+}
+
+func FuzzParseBlob(f *testing.F) {
+	for _, data := range testBlobFiles(f) {
+		f.Add(data)
+	}
+
+	f.Add([]byte{})
+	f.Add(registryLayoutBlob())
+	f.Add(rawProperty(CertContentCertPropID, propReserved, 0xFFFFFFFF, nil))
+	f.Add(concat(
+		rawProperty(CertContentCertPropID, propReserved, 1, []byte{1}),
+		rawProperty(CertContentCertPropID, propReserved, 1, []byte{2}),
+	))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lenient, _, lenientErr := ParseBlobMode(data, ParseLenient)
+		strict, _, strictErr := ParseBlobMode(data, ParseStrict)
+
+		if lenientErr != nil && strictErr == nil {
+			t.Fatalf("strict mode accepted what lenient mode rejected: %s", lenientErr)
+		}
+
+		if lenientErr != nil {
+			return
+		}
+
+		// Anything we can parse, we must be able to marshal and parse
+		// again to the same result.
+		marshaled, err := lenient.Marshal()
+		if err != nil {
+			t.Fatalf("couldn't marshal parsed blob: %s", err)
+		}
+
+		reparsed, _, err := ParseBlobMode(marshaled, ParseStrict)
+		if err != nil {
+			t.Fatalf("couldn't reparse marshaled blob: %s", err)
+		}
+
+		if len(reparsed) != len(lenient) {
+			t.Fatalf("reparsed blob has %d properties, expected %d", len(reparsed), len(lenient))
+		}
+
+		for id, value := range lenient {
+			if !bytes.Equal(reparsed[id], value) {
+				t.Fatalf("property %d changed after round-trip", id)
+			}
+		}
+
+		if strictErr == nil && len(strict) != len(lenient) {
+			t.Fatalf("strict and lenient results differ")
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AddExcludedDNSDomain merges domain into the excluded DNS domains of the
+// blob's CertRootProgramNameConstraintsPropID property, creating the
+// property if needed.  Any other existing constraints are preserved.  The
+// returned bool is false if the domain was already excluded, in which case
+// the blob is unchanged.
+func (b Blob) AddExcludedDNSDomain(domain string) (bool, error) {
+	constraints, err := b.nameConstraintsOrEmpty()
+	if err != nil {
+		return false, err
+	}
+
+	if containsDomain(constraints.ExcludedDNSDomains, domain) {
+		return false, nil
+	}
+
+	constraints.ExcludedDNSDomains = append(constraints.ExcludedDNSDomains, domain)
+
+	prop, err := BuildNameConstraints(constraints)
+	if err != nil {
+		return false, err
+	}
+
+	b.SetProperty(prop)
+
+	return true, nil
+}
+
+// RemoveExcludedDNSDomain removes domain from the excluded DNS domains of the
+// blob's CertRootProgramNameConstraintsPropID property, leaving any other
+// constraints in place.  If no constraints remain, the property is deleted.
+// The returned bool is false if the domain wasn't excluded, in which case
+// the blob is unchanged.
+func (b Blob) RemoveExcludedDNSDomain(domain string) (bool, error) {
+	constraints, err := b.nameConstraintsOrEmpty()
+	if err != nil {
+		return false, err
+	}
+
+	remaining := []string{}
+
+	for _, excluded := range constraints.ExcludedDNSDomains {
+		if !strings.EqualFold(excluded, domain) {
+			remaining = append(remaining, excluded)
+		}
+	}
+
+	if len(remaining) == len(constraints.ExcludedDNSDomains) {
+		return false, nil
+	}
+
+	constraints.ExcludedDNSDomains = remaining
+
+	if isEmptyNameConstraints(constraints) {
+		delete(b, CertRootProgramNameConstraintsPropID)
+
+		return true, nil
+	}
+
+	prop, err := BuildNameConstraints(constraints)
+	if err != nil {
+		return false, err
+	}
+
+	b.SetProperty(prop)
+
+	return true, nil
+}
+
+func (b Blob) nameConstraintsOrEmpty() (*x509.Certificate, error) {
+	constraints, err := b.NameConstraints()
+	if errors.Is(err, ErrPropertyNotFound) {
+		return &x509.Certificate{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode existing name constraints: %w", err, ErrPropertyBuild)
+	}
+
+	return constraints, nil
+}
+
+func isEmptyNameConstraints(c *x509.Certificate) bool {
+	return len(c.PermittedDNSDomains) == 0 && len(c.ExcludedDNSDomains) == 0 &&
+		len(c.PermittedIPRanges) == 0 && len(c.ExcludedIPRanges) == 0 &&
+		len(c.PermittedEmailAddresses) == 0 && len(c.ExcludedEmailAddresses) == 0 &&
+		len(c.PermittedURIDomains) == 0 && len(c.ExcludedURIDomains) == 0
+}
+
+// DNS names are case-insensitive.
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+)
+
+func TestAddRemoveExcludedDNSDomain(t *testing.T) {
+	existing, err := BuildNameConstraints(&x509.Certificate{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"bad.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't build existing constraints: %s", err)
+	}
+
+	blob := Blob{}
+	blob.SetProperty(existing)
+
+	added, err := blob.AddExcludedDNSDomain(".bit")
+	if err != nil || !added {
+		t.Fatalf("add: got %t, %v", added, err)
+	}
+
+	added, err = blob.AddExcludedDNSDomain(".BIT")
+	if err != nil || added {
+		t.Errorf("second add: got %t, %v", added, err)
+	}
+
+	constraints, err := blob.NameConstraints()
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err)
+	}
+
+	if !reflect.DeepEqual(constraints.PermittedDNSDomains, []string{"example.com"}) ||
+		!reflect.DeepEqual(constraints.ExcludedDNSDomains, []string{"bad.example.com", ".bit"}) {
+		t.Errorf("unexpected merged constraints %v / %v",
+			constraints.PermittedDNSDomains, constraints.ExcludedDNSDomains)
+	}
+
+	removed, err := blob.RemoveExcludedDNSDomain(".bit")
+	if err != nil || !removed {
+		t.Fatalf("remove: got %t, %v", removed, err)
+	}
+
+	if string(blob[CertRootProgramNameConstraintsPropID]) != string(existing.Value) {
+		t.Errorf("removing the exclusion didn't restore the original constraints")
+	}
+}
+
+func TestExcludedDNSDomainOnUnconstrainedBlob(t *testing.T) {
+	blob := Blob{CertContentCertPropID: []byte{0x30, 0x00}}
+
+	removed, err := blob.RemoveExcludedDNSDomain(".bit")
+	if err != nil || removed {
+		t.Errorf("remove from empty: got %t, %v", removed, err)
+	}
+
+	added, err := blob.AddExcludedDNSDomain(".bit")
+	if err != nil || !added {
+		t.Fatalf("add: got %t, %v", added, err)
+	}
+
+	removed, err = blob.RemoveExcludedDNSDomain(".bit")
+	if err != nil || !removed {
+		t.Fatalf("remove: got %t, %v", removed, err)
+	}
+
+	if _, ok := blob[CertRootProgramNameConstraintsPropID]; ok {
+		t.Errorf("empty name constraints property wasn't deleted")
+	}
+}
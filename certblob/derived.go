@@ -0,0 +1,91 @@
+package certblob
+
+import (
+	// #nosec G501
+	"crypto/md5"
+	// #nosec G505
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+var ErrDerivedProperties = fmt.Errorf("error deriving: %w", ErrProperty)
+
+// SetDerivedProperties adds the properties that CryptoAPI computes from the
+// certificate itself when it adds a certificate to a store (e.g. via
+// "certutil -addstore").  If they're missing, CryptoAPI computes them on
+// the fly and may rewrite the registry entry, so adding them up front keeps
+// our entries identical to native ones.  The blob must contain a
+// CertContentCertPropID property.
+func (b Blob) SetDerivedProperties() error {
+	derBytes, ok := b[CertContentCertPropID]
+	if !ok {
+		return fmt.Errorf("no certificate content: %w", ErrDerivedProperties)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't parse certificate: %w", err, ErrDerivedProperties)
+	}
+
+	publicKeyBits, err := subjectPublicKeyBits(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+
+	// Windows CryptoAPI identifies certificates with SHA-1.  As with the
+	// fingerprint, that's Microsoft's problem to fix, not ours.
+	sha1Hash := sha1.Sum(derBytes) // #nosec G401
+
+	// CryptoAPI uses the Subject Key Identifier extension if present, and
+	// otherwise a SHA-1 digest of the encoded SubjectPublicKeyInfo.
+	keyIdentifier := cert.SubjectKeyId
+	if len(keyIdentifier) == 0 {
+		spkiHash := sha1.Sum(cert.RawSubjectPublicKeyInfo) // #nosec G401
+		keyIdentifier = spkiHash[:]
+	}
+
+	publicKeyMD5 := md5.Sum(publicKeyBits) // #nosec G401
+
+	// CryptHashToBeSigned defaults to SHA-1 over the TBSCertificate.
+	signatureHash := sha1.Sum(cert.RawTBSCertificate) // #nosec G401
+
+	builders := []func() (*Property, error){
+		func() (*Property, error) { return BuildSHA1Hash(sha1Hash[:]) },
+		func() (*Property, error) { return BuildKeyIdentifier(keyIdentifier) },
+		func() (*Property, error) { return BuildSubjectPublicKeyMD5Hash(publicKeyMD5[:]) },
+		func() (*Property, error) { return BuildSignatureHash(signatureHash[:]) },
+	}
+
+	for _, build := range builders {
+		prop, err := build()
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrDerivedProperties)
+		}
+
+		b.SetProperty(prop)
+	}
+
+	return nil
+}
+
+// subjectPublicKeyBits returns the contents of the subjectPublicKey BIT
+// STRING, which is what CryptoAPI hashes for the public key MD5 property.
+func subjectPublicKeyBits(rawSPKI []byte) ([]byte, error) {
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+
+	rest, err := asn1.Unmarshal(rawSPKI, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse public key: %w", err, ErrDerivedProperties)
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after public key: %w", ErrDerivedProperties)
+	}
+
+	return spki.PublicKey.Bytes, nil
+}
@@ -0,0 +1,78 @@
+package certblob
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// The expected derived properties of the corpus certificates were computed
+// independently of this package, with OpenSSL, from the DER in each blob:
+//
+//	sha1:        openssl dgst -sha1 cert.der
+//	key-id:      openssl x509 -inform DER -in cert.der -noout -ext subjectKeyIdentifier
+//	pubkey-md5:  openssl x509 -inform DER -in cert.der -noout -pubkey |
+//	             openssl pkey -pubin -outform DER | tail -c <key length> | openssl dgst -md5
+//	sig-hash:    openssl asn1parse -inform DER -in cert.der -strparse 4 -noout -out tbs.der &&
+//	             openssl dgst -sha1 tbs.der
+//
+// where <key length> is the length of the subjectPublicKey BIT STRING's
+// contents, less its unused-bits byte, as shown by openssl asn1parse.
+func TestSetDerivedProperties(t *testing.T) {
+	for _, test := range []struct {
+		file      string
+		sha1      string
+		keyID     string
+		pubkeyMD5 string
+		sigHash   string
+	}{
+		{
+			"lets-encrypt-intermediate.blob",
+			"a053375bfe84e8b748782c7cee15827a6af5a405",
+			"142eb317b75856cbae500940e61faf9d8b14c2c6",
+			"f044424c506513d62804c04f719403f9",
+			"30aa608b41108f543c3e53508903c7d194d5043d",
+		},
+		{
+			"untrusted-root.badssl.com.blob",
+			"7890c8934d5869b25d2f8d0d646f9a5d7385ba85",
+			"6fc7837349b5a763ff75de6d6efeedfb97a32c00",
+			"2206dcdb7d28783d9a0dff308f46c0d6",
+			"3473c2f4e7c077eee9bc70e803e4e8f70e0e6438",
+		},
+	} {
+		parsed, err := ParseBlob(testBlobFiles(t)[filepath.Join("testdata", test.file)])
+		if err != nil {
+			t.Fatalf("%s: couldn't parse: %s", test.file, err)
+		}
+
+		blob := Blob{CertContentCertPropID: parsed[CertContentCertPropID]}
+
+		err = blob.SetDerivedProperties()
+		if err != nil {
+			t.Fatalf("%s: couldn't derive properties: %s", test.file, err)
+		}
+
+		for id, expectedHex := range map[uint32]string{
+			CertSHA1HashPropID:                test.sha1,
+			CertKeyIdentifierPropID:           test.keyID,
+			CertSubjectPublicKeyMD5HashPropID: test.pubkeyMD5,
+			CertSignatureHashPropID:           test.sigHash,
+		} {
+			expected, _ := hex.DecodeString(expectedHex)
+
+			if !bytes.Equal(blob[id], expected) {
+				t.Errorf("%s: property %d: expected %x, got %x", test.file, id, expected, blob[id])
+			}
+		}
+	}
+}
+
+func TestSetDerivedPropertiesNoContent(t *testing.T) {
+	err := Blob{}.SetDerivedProperties()
+	if !errors.Is(err, ErrDerivedProperties) {
+		t.Errorf("expected ErrDerivedProperties, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// propertyNames covers the properties that certinject reads or writes.
+// Others are described by number.
+var propertyNames = map[uint32]string{
+	CertContentCertPropID:                "certificate",
+	CertFriendlyNamePropID:               "friendly name",
+	CertDescriptionPropID:                "description",
+	CertSHA1HashPropID:                   "SHA-1 hash",
+	CertMD5HashPropID:                    "MD5 hash",
+	CertKeyIdentifierPropID:              "key identifier",
+	CertSubjectNameMD5HashPropID:         "subject name MD5 hash",
+	CertSubjectPublicKeyMD5HashPropID:    "subject public key MD5 hash",
+	CertSignatureHashPropID:              "signature hash",
+	CertEnhkeyUsagePropID:                "extended key usage",
+	CertRootProgramNameConstraintsPropID: "name constraints",
+	CertRootProgramCertPoliciesPropID:    "certificate policies",
+	CertDisallowedFiletimePropID:         "disallowed after",
+}
+
+// extKeyUsageNames match the certinject EKU flag names.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "any",
+	x509.ExtKeyUsageServerAuth:                     "server",
+	x509.ExtKeyUsageClientAuth:                     "client",
+	x509.ExtKeyUsageCodeSigning:                    "code",
+	x509.ExtKeyUsageEmailProtection:                "email",
+	x509.ExtKeyUsageIPSECEndSystem:                 "ipsec-end-system",
+	x509.ExtKeyUsageIPSECTunnel:                    "ipsec-tunnel",
+	x509.ExtKeyUsageIPSECUser:                      "ipsec-user",
+	x509.ExtKeyUsageTimeStamping:                   "time",
+	x509.ExtKeyUsageOCSPSigning:                    "ocsp",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "ms-sgc",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "ns-sgc",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "ms-code-com",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "ms-code-kernel",
+}
+
+// PropertyChange is a difference between two blobs.  Old is nil if the
+// property was added, and New is nil if it was removed.
+type PropertyChange struct {
+	ID  uint32
+	Old []byte
+	New []byte
+}
+
+// Clone returns a copy of b that can be edited without affecting b.
+func (b Blob) Clone() Blob {
+	result := Blob{}
+
+	for id, value := range b {
+		result[id] = append([]byte{}, value...)
+	}
+
+	return result
+}
+
+// Diff returns the properties that differ between old and updated, ordered
+// by ID.
+func Diff(old, updated Blob) []PropertyChange {
+	ids := map[uint32]bool{}
+
+	for id := range old {
+		ids[id] = true
+	}
+
+	for id := range updated {
+		ids[id] = true
+	}
+
+	result := []PropertyChange{}
+
+	for id := range ids {
+		oldValue, oldOK := old[id]
+		newValue, newOK := updated[id]
+
+		if oldOK && newOK && string(oldValue) == string(newValue) {
+			continue
+		}
+
+		change := PropertyChange{ID: id}
+
+		if oldOK {
+			change.Old = oldValue
+		}
+
+		if newOK {
+			change.New = newValue
+		}
+
+		result = append(result, change)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+func (c PropertyChange) String() string {
+	name := PropertyName(c.ID)
+
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("add %s: %s", name, DescribeProperty(c.ID, c.New))
+	case c.New == nil:
+		return fmt.Sprintf("remove %s: %s", name, DescribeProperty(c.ID, c.Old))
+	}
+
+	return fmt.Sprintf("change %s: %s -> %s", name, DescribeProperty(c.ID, c.Old),
+		DescribeProperty(c.ID, c.New))
+}
+
+// PropertyName returns a human-readable name for a property ID.
+func PropertyName(id uint32) string {
+	if name, ok := propertyNames[id]; ok {
+		return fmt.Sprintf("%s (%d)", name, id)
+	}
+
+	return fmt.Sprintf("property %d", id)
+}
+
+// DescribeProperty returns a human-readable rendering of a property value.
+// Properties that certblob knows how to decode are decoded; anything else,
+// including values that fail to decode, is shown as hex.
+func DescribeProperty(id uint32, value []byte) string {
+	blob := Blob{id: value}
+
+	var (
+		description string
+		err         error
+	)
+
+	switch id {
+	case CertContentCertPropID:
+		return fmt.Sprintf("%d bytes of DER", len(value))
+	case CertFriendlyNamePropID:
+		description, err = blob.FriendlyName()
+		description = fmt.Sprintf("%q", description)
+	case CertDescriptionPropID:
+		description, err = blob.Description()
+		description = fmt.Sprintf("%q", description)
+	case CertEnhkeyUsagePropID:
+		description, err = describeExtKeyUsage(blob)
+	case CertRootProgramNameConstraintsPropID:
+		description, err = describeNameConstraints(blob)
+	case CertRootProgramCertPoliciesPropID:
+		policies, policiesErr := blob.RootProgramCertPolicies()
+		description, err = fmt.Sprint(policies), policiesErr
+	case CertDisallowedFiletimePropID:
+		disallowed, disallowedErr := blob.DisallowedFiletime()
+		description, err = disallowed.UTC().Format(time.RFC3339), disallowedErr
+	default:
+		return hex.EncodeToString(value)
+	}
+
+	if err != nil {
+		return fmt.Sprintf("%s (undecodable: %s)", hex.EncodeToString(value), err)
+	}
+
+	return description
+}
+
+func describeExtKeyUsage(blob Blob) (string, error) {
+	ekus, unknown, err := blob.ExtKeyUsage()
+	if err != nil {
+		return "", err
+	}
+
+	names := []string{}
+
+	for _, eku := range ekus {
+		name, ok := extKeyUsageNames[eku]
+		if !ok {
+			name = fmt.Sprintf("eku(%d)", eku)
+		}
+
+		names = append(names, name)
+	}
+
+	for _, oid := range unknown {
+		names = append(names, oid.String())
+	}
+
+	return "[" + strings.Join(names, " ") + "]", nil
+}
+
+func describeNameConstraints(blob Blob) (string, error) {
+	constraints, err := blob.NameConstraints()
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{}
+	addPart := func(label string, names []string) {
+		if len(names) != 0 {
+			parts = append(parts, fmt.Sprintf("%s=%v", label, names))
+		}
+	}
+
+	addPart("permitted-dns", constraints.PermittedDNSDomains)
+	addPart("excluded-dns", constraints.ExcludedDNSDomains)
+	addPart("permitted-ip", ipNetStrings(constraints.PermittedIPRanges))
+	addPart("excluded-ip", ipNetStrings(constraints.ExcludedIPRanges))
+	addPart("permitted-email", constraints.PermittedEmailAddresses)
+	addPart("excluded-email", constraints.ExcludedEmailAddresses)
+	addPart("permitted-uri", constraints.PermittedURIDomains)
+	addPart("excluded-uri", constraints.ExcludedURIDomains)
+
+	return strings.Join(parts, " "), nil
+}
+
+func ipNetStrings(ranges []*net.IPNet) []string {
+	result := []string{}
+
+	for _, ipNet := range ranges {
+		result = append(result, ipNet.String())
+	}
+
+	return result
+}
@@ -0,0 +1,65 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ekuProperty, err := BuildExtKeyUsage(&x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatalf("couldn't build EKU: %s", err)
+	}
+
+	nameProperty, err := BuildFriendlyName("Namecoin")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %s", err)
+	}
+
+	oldBlob := Blob{
+		CertContentCertPropID:  []byte{1, 2, 3},
+		CertFriendlyNamePropID: []byte{'o', 0, 0, 0},
+		CertSHA1HashPropID:     make([]byte, sha1HashLen),
+	}
+
+	newBlob := oldBlob.Clone()
+	newBlob.SetProperty(ekuProperty)
+	newBlob.SetProperty(nameProperty)
+	delete(newBlob, CertSHA1HashPropID)
+
+	if _, ok := oldBlob[CertEnhkeyUsagePropID]; ok {
+		t.Fatalf("editing clone changed original")
+	}
+
+	changes := Diff(oldBlob, newBlob)
+
+	expected := []string{
+		`remove SHA-1 hash (3): 0000000000000000000000000000000000000000`,
+		`add extended key usage (9): [server]`,
+		`change friendly name (11): "o" -> "Namecoin"`,
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+
+	for i, change := range changes {
+		if change.String() != expected[i] {
+			t.Errorf("change %d: expected %q, got %q", i, expected[i], change.String())
+		}
+	}
+
+	if len(Diff(newBlob, newBlob.Clone())) != 0 {
+		t.Errorf("identical blobs have changes")
+	}
+}
+
+func TestDescribePropertyUndecodable(t *testing.T) {
+	description := DescribeProperty(CertEnhkeyUsagePropID, []byte{0xFF})
+	if !strings.HasPrefix(description, "ff (undecodable: ") {
+		t.Errorf("unexpected description %q", description)
+	}
+}
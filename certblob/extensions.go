@@ -0,0 +1,40 @@
+package certblob
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var ErrNoPropertyForExtension = fmt.Errorf("no CryptoAPI property for extension: %w", ErrPropertyBuild)
+
+// PropertyFromExtension converts an X.509 extension override to the
+// CryptoAPI property that has the same effect.  The extension is validated
+// first.  Extensions that CryptoAPI has no property for (e.g. Basic
+// Constraints) return ErrNoPropertyForExtension.  CryptoAPI properties
+// have no notion of criticality, so ext.Critical is ignored.
+func PropertyFromExtension(ext pkix.Extension) (*Property, error) {
+	err := x509ext.ValidateExtension(ext)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyBuild)
+	}
+
+	var id uint32
+
+	switch {
+	case ext.Id.Equal(x509ext.OIDExtensionExtKeyUsage):
+		id = CertEnhkeyUsagePropID
+	case ext.Id.Equal(x509ext.OIDExtensionNameConstraints):
+		id = CertRootProgramNameConstraintsPropID
+	case ext.Id.Equal(x509ext.OIDExtensionCertificatePolicies):
+		id = CertRootProgramCertPoliciesPropID
+	default:
+		return nil, fmt.Errorf("%s: %w", ext.Id, ErrNoPropertyForExtension)
+	}
+
+	return &Property{
+		ID:    id,
+		Value: append([]byte{}, ext.Value...),
+	}, nil
+}
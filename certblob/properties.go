@@ -0,0 +1,212 @@
+package certblob
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Sizes of the fixed-length hash properties.
+const (
+	sha1HashLen = 20
+	md5HashLen  = 16
+)
+
+var (
+	ErrPropertyNotFound = fmt.Errorf("not found: %w", ErrProperty)
+	ErrPropertyDecode   = fmt.Errorf("error decoding: %w", ErrProperty)
+)
+
+// BuildFriendlyName builds a CertFriendlyNamePropID property, which is the
+// name shown by certmgr.msc.
+func BuildFriendlyName(name string) (*Property, error) {
+	return buildStringProperty(CertFriendlyNamePropID, name)
+}
+
+// BuildDescription builds a CertDescriptionPropID property.
+func BuildDescription(description string) (*Property, error) {
+	return buildStringProperty(CertDescriptionPropID, description)
+}
+
+// BuildSHA1Hash builds a CertSHA1HashPropID property.  hash must be a SHA-1
+// digest of the DER-encoded certificate.
+func BuildSHA1Hash(hash []byte) (*Property, error) {
+	return buildFixedProperty(CertSHA1HashPropID, hash, sha1HashLen)
+}
+
+// BuildMD5Hash builds a CertMD5HashPropID property.  hash must be an MD5
+// digest of the DER-encoded certificate.
+func BuildMD5Hash(hash []byte) (*Property, error) {
+	return buildFixedProperty(CertMD5HashPropID, hash, md5HashLen)
+}
+
+// BuildKeyIdentifier builds a CertKeyIdentifierPropID property.
+func BuildKeyIdentifier(keyID []byte) (*Property, error) {
+	return buildVariableProperty(CertKeyIdentifierPropID, keyID)
+}
+
+// BuildSubjectNameMD5Hash builds a CertSubjectNameMD5HashPropID property.
+// hash must be an MD5 digest of the DER-encoded subject name.
+func BuildSubjectNameMD5Hash(hash []byte) (*Property, error) {
+	return buildFixedProperty(CertSubjectNameMD5HashPropID, hash, md5HashLen)
+}
+
+// BuildSubjectPublicKeyMD5Hash builds a CertSubjectPublicKeyMD5HashPropID
+// property.  hash must be an MD5 digest of the subject public key bits.
+func BuildSubjectPublicKeyMD5Hash(hash []byte) (*Property, error) {
+	return buildFixedProperty(CertSubjectPublicKeyMD5HashPropID, hash, md5HashLen)
+}
+
+// BuildSignatureHash builds a CertSignatureHashPropID property.
+func BuildSignatureHash(hash []byte) (*Property, error) {
+	return buildVariableProperty(CertSignatureHashPropID, hash)
+}
+
+func buildStringProperty(id uint32, value string) (*Property, error) {
+	encoded, err := encodeUTF16LE(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Property{
+		ID:    id,
+		Value: encoded,
+	}, nil
+}
+
+func buildFixedProperty(id uint32, value []byte, size int) (*Property, error) {
+	if len(value) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d: %w", size, len(value), ErrPropertyBuild)
+	}
+
+	return buildVariableProperty(id, value)
+}
+
+func buildVariableProperty(id uint32, value []byte) (*Property, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty value: %w", ErrPropertyBuild)
+	}
+
+	return &Property{
+		ID:    id,
+		Value: append([]byte{}, value...),
+	}, nil
+}
+
+// FriendlyName returns the decoded CertFriendlyNamePropID property.
+func (b Blob) FriendlyName() (string, error) {
+	return b.stringProperty(CertFriendlyNamePropID)
+}
+
+// Description returns the decoded CertDescriptionPropID property.
+func (b Blob) Description() (string, error) {
+	return b.stringProperty(CertDescriptionPropID)
+}
+
+// SHA1Hash returns the CertSHA1HashPropID property.
+func (b Blob) SHA1Hash() ([]byte, error) {
+	return b.fixedProperty(CertSHA1HashPropID, sha1HashLen)
+}
+
+// MD5Hash returns the CertMD5HashPropID property.
+func (b Blob) MD5Hash() ([]byte, error) {
+	return b.fixedProperty(CertMD5HashPropID, md5HashLen)
+}
+
+// KeyIdentifier returns the CertKeyIdentifierPropID property.
+func (b Blob) KeyIdentifier() ([]byte, error) {
+	return b.variableProperty(CertKeyIdentifierPropID)
+}
+
+// SubjectNameMD5Hash returns the CertSubjectNameMD5HashPropID property.
+func (b Blob) SubjectNameMD5Hash() ([]byte, error) {
+	return b.fixedProperty(CertSubjectNameMD5HashPropID, md5HashLen)
+}
+
+// SubjectPublicKeyMD5Hash returns the CertSubjectPublicKeyMD5HashPropID
+// property.
+func (b Blob) SubjectPublicKeyMD5Hash() ([]byte, error) {
+	return b.fixedProperty(CertSubjectPublicKeyMD5HashPropID, md5HashLen)
+}
+
+// SignatureHash returns the CertSignatureHashPropID property.
+func (b Blob) SignatureHash() ([]byte, error) {
+	return b.variableProperty(CertSignatureHashPropID)
+}
+
+func (b Blob) variableProperty(id uint32) ([]byte, error) {
+	value, ok := b[id]
+	if !ok {
+		return nil, fmt.Errorf("ID %d: %w", id, ErrPropertyNotFound)
+	}
+
+	return value, nil
+}
+
+func (b Blob) fixedProperty(id uint32, size int) ([]byte, error) {
+	value, err := b.variableProperty(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) != size {
+		return nil, fmt.Errorf("ID %d: expected %d bytes, got %d: %w", id, size, len(value), ErrPropertyDecode)
+	}
+
+	return value, nil
+}
+
+func (b Blob) stringProperty(id uint32) (string, error) {
+	value, err := b.variableProperty(id)
+	if err != nil {
+		return "", err
+	}
+
+	decoded, err := decodeUTF16LE(value)
+	if err != nil {
+		return "", fmt.Errorf("ID %d: %w", id, err)
+	}
+
+	return decoded, nil
+}
+
+// CryptoAPI stores string properties as NUL-terminated UTF-16LE.
+func encodeUTF16LE(value string) ([]byte, error) {
+	for _, r := range value {
+		if r == 0 {
+			return nil, fmt.Errorf("string contains NUL character: %w", ErrPropertyBuild)
+		}
+	}
+
+	units := utf16.Encode([]rune(value))
+	units = append(units, 0)
+
+	result := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(result[2*i:], unit)
+	}
+
+	return result, nil
+}
+
+func decodeUTF16LE(value []byte) (string, error) {
+	if len(value)%2 != 0 {
+		return "", fmt.Errorf("odd length for UTF-16 string: %w", ErrPropertyDecode)
+	}
+
+	units := make([]uint16, len(value)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(value[2*i:])
+	}
+
+	// The terminator is optional when parsing, since some writers omit it.
+	for i, unit := range units {
+		if unit == 0 {
+			units = units[:i]
+
+			break
+		}
+	}
+
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,112 @@
+package certblob
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFriendlyNameRoundTrip(t *testing.T) {
+	for _, name := range []string{"Namecoin Root CA", "", "Ünïcödé ☃ 𝄞"} {
+		prop, err := BuildFriendlyName(name)
+		if err != nil {
+			t.Errorf("%q: couldn't build: %s", name, err)
+
+			continue
+		}
+
+		blob := Blob{}
+		blob.SetProperty(prop)
+
+		decoded, err := blob.FriendlyName()
+		if err != nil {
+			t.Errorf("%q: couldn't decode: %s", name, err)
+
+			continue
+		}
+
+		if decoded != name {
+			t.Errorf("expected %q, got %q", name, decoded)
+		}
+	}
+}
+
+func TestFriendlyNameEncoding(t *testing.T) {
+	prop, err := BuildFriendlyName("Ab")
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	expected := []byte{'A', 0, 'b', 0, 0, 0}
+	if !bytes.Equal(prop.Value, expected) {
+		t.Errorf("expected %x, got %x", expected, prop.Value)
+	}
+}
+
+func TestFriendlyNameRejectsNUL(t *testing.T) {
+	_, err := BuildFriendlyName("a\x00b")
+	if !errors.Is(err, ErrPropertyBuild) {
+		t.Errorf("expected ErrPropertyBuild, got %v", err)
+	}
+}
+
+func TestHashProperties(t *testing.T) {
+	sha1Hash := bytes.Repeat([]byte{0x01}, 20)
+	md5Hash := bytes.Repeat([]byte{0x02}, 16)
+
+	blob := Blob{}
+
+	for _, build := range []func() (*Property, error){
+		func() (*Property, error) { return BuildSHA1Hash(sha1Hash) },
+		func() (*Property, error) { return BuildMD5Hash(md5Hash) },
+		func() (*Property, error) { return BuildSubjectNameMD5Hash(md5Hash) },
+		func() (*Property, error) { return BuildKeyIdentifier([]byte{0x03, 0x04}) },
+		func() (*Property, error) { return BuildSignatureHash(sha1Hash) },
+	} {
+		prop, err := build()
+		if err != nil {
+			t.Fatalf("couldn't build: %s", err)
+		}
+
+		blob.SetProperty(prop)
+	}
+
+	if got, err := blob.SHA1Hash(); err != nil || !bytes.Equal(got, sha1Hash) {
+		t.Errorf("SHA1Hash: got %x, %v", got, err)
+	}
+
+	if got, err := blob.MD5Hash(); err != nil || !bytes.Equal(got, md5Hash) {
+		t.Errorf("MD5Hash: got %x, %v", got, err)
+	}
+
+	if got, err := blob.SubjectNameMD5Hash(); err != nil || !bytes.Equal(got, md5Hash) {
+		t.Errorf("SubjectNameMD5Hash: got %x, %v", got, err)
+	}
+
+	if got, err := blob.KeyIdentifier(); err != nil || !bytes.Equal(got, []byte{0x03, 0x04}) {
+		t.Errorf("KeyIdentifier: got %x, %v", got, err)
+	}
+
+	if got, err := blob.SignatureHash(); err != nil || !bytes.Equal(got, sha1Hash) {
+		t.Errorf("SignatureHash: got %x, %v", got, err)
+	}
+}
+
+func TestHashPropertyLength(t *testing.T) {
+	_, err := BuildSHA1Hash([]byte{0x01})
+	if !errors.Is(err, ErrPropertyBuild) {
+		t.Errorf("expected ErrPropertyBuild for short SHA-1, got %v", err)
+	}
+
+	blob := Blob{CertMD5HashPropID: []byte{0x01}}
+
+	_, err = blob.MD5Hash()
+	if !errors.Is(err, ErrPropertyDecode) {
+		t.Errorf("expected ErrPropertyDecode for short MD5, got %v", err)
+	}
+
+	_, err = blob.Description()
+	if !errors.Is(err, ErrPropertyNotFound) {
+		t.Errorf("expected ErrPropertyNotFound, got %v", err)
+	}
+}
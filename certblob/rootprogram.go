@@ -0,0 +1,95 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+// FILETIME counts 100-nanosecond intervals since 1601-01-01 UTC.
+const (
+	filetimeLen            = 8
+	filetimeTicksPerSecond = 10000000
+	filetimeNanosPerTick   = 100
+	filetimeUnixEpochSecs  = 11644473600
+)
+
+// BuildRootProgramCertPolicies builds a CertRootProgramCertPoliciesPropID
+// property from the PolicyIdentifiers field of template.  CryptoAPI will
+// only trust chains through the cert for the listed policies.
+func BuildRootProgramCertPolicies(template *x509.Certificate) (*Property, error) {
+	value, err := x509ext.BuildCertificatePolicies(template)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyBuild)
+	}
+
+	return &Property{
+		ID:    CertRootProgramCertPoliciesPropID,
+		Value: value,
+	}, nil
+}
+
+// BuildDisallowedFiletime builds a CertDisallowedFiletimePropID property.
+// CryptoAPI will distrust certs that chain to the cert if they were issued
+// after t.  This is how Microsoft gracefully distrusts a root.
+func BuildDisallowedFiletime(t time.Time) (*Property, error) {
+	filetime, err := timeToFiletime(t)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, filetimeLen)
+	binary.LittleEndian.PutUint64(value, filetime)
+
+	return &Property{
+		ID:    CertDisallowedFiletimePropID,
+		Value: value,
+	}, nil
+}
+
+// RootProgramCertPolicies decodes the CertRootProgramCertPoliciesPropID
+// property.
+func (b Blob) RootProgramCertPolicies() ([]asn1.ObjectIdentifier, error) {
+	value, err := b.variableProperty(CertRootProgramCertPoliciesPropID)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := x509ext.ParseCertificatePolicies(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyDecode)
+	}
+
+	return policies, nil
+}
+
+// DisallowedFiletime decodes the CertDisallowedFiletimePropID property.
+func (b Blob) DisallowedFiletime() (time.Time, error) {
+	value, err := b.fixedProperty(CertDisallowedFiletimePropID, filetimeLen)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return filetimeToTime(binary.LittleEndian.Uint64(value)), nil
+}
+
+func timeToFiletime(t time.Time) (uint64, error) {
+	// UnixNano is only defined for years 1678 through 2262, which is also
+	// a sane range for a distrust date.
+	if t.Year() < 1678 || t.Year() > 2262 {
+		return 0, fmt.Errorf("time %s out of range: %w", t, ErrPropertyBuild)
+	}
+
+	return uint64(t.UnixNano()/filetimeNanosPerTick + filetimeUnixEpochSecs*filetimeTicksPerSecond), nil
+}
+
+func filetimeToTime(filetime uint64) time.Time {
+	secs := int64(filetime/filetimeTicksPerSecond) - filetimeUnixEpochSecs
+	nanos := int64(filetime%filetimeTicksPerSecond) * filetimeNanosPerTick
+
+	return time.Unix(secs, nanos).UTC()
+}
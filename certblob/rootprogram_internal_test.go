@@ -0,0 +1,62 @@
+package certblob
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+	"time"
+)
+
+func TestRootProgramCertPoliciesRoundTrip(t *testing.T) {
+	template := &x509.Certificate{
+		PolicyIdentifiers: []asn1.ObjectIdentifier{
+			{2, 23, 140, 1, 2, 1},
+			{2, 23, 140, 1, 2, 2},
+		},
+	}
+
+	prop, err := BuildRootProgramCertPolicies(template)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	blob := Blob{}
+	blob.SetProperty(prop)
+
+	policies, err := blob.RootProgramCertPolicies()
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err)
+	}
+
+	if len(policies) != 2 || !policies[0].Equal(template.PolicyIdentifiers[0]) ||
+		!policies[1].Equal(template.PolicyIdentifiers[1]) {
+		t.Errorf("expected %v, got %v", template.PolicyIdentifiers, policies)
+	}
+}
+
+func TestDisallowedFiletime(t *testing.T) {
+	distrust := time.Date(2020, time.September, 30, 0, 0, 0, 0, time.UTC)
+
+	prop, err := BuildDisallowedFiletime(distrust)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	// 2020-09-30T00:00:00Z as a little-endian FILETIME.
+	expected := []byte{0x00, 0xc0, 0xca, 0xa3, 0xbc, 0x96, 0xd6, 0x01}
+	if string(prop.Value) != string(expected) {
+		t.Errorf("expected %x, got %x", expected, prop.Value)
+	}
+
+	blob := Blob{}
+	blob.SetProperty(prop)
+
+	decoded, err := blob.DisallowedFiletime()
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err)
+	}
+
+	if !decoded.Equal(distrust) {
+		t.Errorf("expected %s, got %s", distrust, decoded)
+	}
+}
@@ -13,6 +13,8 @@ var (
 		"(in seconds) after which TLS certs will be removed from the "+
 		"trust store.  Making this smaller than the DNS TTL (default "+
 		"600) may cause TLS errors.")
+	dryRun = cflag.Bool(flagGroup, "dry-run", false, "Print the changes "+
+		"that would be made to each trust store without making them")
 )
 
 // SetLogLevel allows an application to set a log level.
@@ -3,15 +3,200 @@
 
 package certinject
 
+import (
+	"crypto/x509"
+	"fmt"
+)
+
 // This package is used to add and remove certificates to the system trust
 // store.
-// Currently only supports NSS sqlite3 stores.
+// Currently only supports NSS sqlite3 stores and p11-kit anchor directories.
 
 // InjectCert injects the given cert into all configured trust stores.
 func InjectCert(derBytes []byte) {
+	injectCert(derBytes, false)
+}
+
+// InjectExpirableCert is like InjectCert, but marks the cert as short-lived,
+// e.g. a Namecoin dehydrated cert, and then touches it, so that its age
+// counts from now.  NSS and p11-kit certs always expire once they're too
+// old, so on this platform there's no mark.
+func InjectExpirableCert(derBytes []byte) {
+	injectCert(derBytes, true)
+	TouchCert(derBytes)
+}
+
+// TouchCert resets the age of an already injected cert in all configured
+// trust stores, so that CleanCerts counts it from now.
+func TouchCert(derBytes []byte) {
+	_ = touchCert(derBytes)
+}
+
+// touchCert is TouchCert, but also returns the last error, having logged
+// each of them.
+func touchCert(derBytes []byte) error {
+	var lastErr error
+
+	if nssFlag.Value() {
+		err := touchCertNSS(derBytes)
+		if err != nil {
+			log.Errorf("Error touching cert in NSS: %s", err)
+
+			lastErr = err
+		}
+	}
+
+	if p11kitFlag.Value() {
+		err := touchCertP11Kit(derBytes)
+		if err != nil {
+			log.Errorf("Error touching cert in p11-kit: %s", err)
+
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// VerifyCert reads the given cert back from all configured trust stores, and
+// checks that each of them holds it as InjectCert would leave it.  It
+// returns an error wrapping ErrNotTrusted if any of them doesn't.
+func VerifyCert(derBytes []byte) error {
+	verifiers := []storeVerifier{}
+
+	if nssFlag.Value() {
+		verifiers = append(verifiers, storeVerifier{
+			store:  manifestStoreNSS,
+			verify: func() error { return verifyCertNSS(derBytes) },
+		})
+	}
+
+	if p11kitFlag.Value() {
+		verifiers = append(verifiers, storeVerifier{
+			store:  manifestStoreP11Kit,
+			verify: func() error { return verifyCertP11Kit(derBytes) },
+		})
+	}
+
+	return verifyStores(verifiers)
+}
+
+func injectCert(derBytes []byte, expirable bool) {
+	if transactional.Value() {
+		injectCertTransactional(derBytes, expirable)
+
+		return
+	}
+
+	err := checkInjection(derBytes)
+	if err != nil {
+		log.Errorf("Not injecting cert: %s", err)
+
+		return
+	}
+
+	if nssFlag.Value() {
+		err := observeInjection(manifestStoreNSS, func() error { return injectCertNSS(derBytes) })
+		if err != nil {
+			log.Errorf("Error injecting cert to NSS: %s", err)
+		}
+	}
+
+	if p11kitFlag.Value() {
+		err := observeInjection(manifestStoreP11Kit, func() error { return injectCertP11Kit(derBytes) })
+		if err != nil {
+			log.Errorf("Error injecting cert to p11-kit: %s", err)
+		}
+	}
+}
+
+// checkInjectPolicy checks InjectCert's configured stores, and the cert,
+// against policy.  NSS trusts the cert with its own restrictions, but
+// p11-kit trusts it with the extension overrides stapled to it, which may
+// e.g. make it a CA.
+func checkInjectPolicy(policy *injectPolicy, derBytes []byte) error {
+	stores := []string{}
+
+	if nssFlag.Value() {
+		stores = append(stores, manifestStoreNSS)
+	}
+
+	if p11kitFlag.Value() {
+		stores = append(stores, manifestStoreP11Kit)
+	}
+
+	err := policy.checkStores(stores, "")
+	if err != nil {
+		return err
+	}
+
 	if nssFlag.Value() {
-		injectCertNSS(derBytes)
+		err = policy.checkPolicyCert(derBytes, nil)
+		if err != nil {
+			return err
+		}
 	}
+
+	if p11kitFlag.Value() {
+		exts, err := buildExtensionOverrides(derBytes)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't build extension overrides: %w", err, ErrPolicy)
+		}
+
+		return policy.checkPolicyCert(derBytes, exts)
+	}
+
+	return nil
+}
+
+// injectionLintTarget returns where InjectCert puts certs.  NSS and p11-kit
+// both trust them as anchors.
+func injectionLintTarget() lintTarget {
+	existing := func() []*x509.Certificate {
+		certs := [][]byte{}
+
+		if nssFlag.Value() {
+			certs = append(certs, existingCertsNSS()...)
+		}
+
+		if p11kitFlag.Value() && p11kitDir.Value() != "" {
+			certs = append(certs, readCertFiles(p11kitDir.Value(), isP11KitFile, func(data []byte) ([]byte, error) {
+				derBytes, _, err := parseP11KitObjects(data)
+
+				return derBytes, err
+			})...)
+		}
+
+		return parseCerts(certs)
+	}
+
+	return lintTarget{root: true, existing: existing}
+}
+
+// transactionSteps returns a transaction step for each configured trust
+// store, in the order InjectCert uses.
+//
+// expirable only affects CryptoAPI, so it's unused here.
+func transactionSteps(derBytes []byte, _ bool) ([]transactionStep, error) {
+	steps := []transactionStep{}
+
+	if nssFlag.Value() {
+		steps = append(steps, transactionStep{
+			store:   manifestStoreNSS,
+			prepare: func() (func() error, error) { return prepareNSSUndo(derBytes) },
+			inject:  func() error { return injectCertNSS(derBytes) },
+		})
+	}
+
+	if p11kitFlag.Value() {
+		steps = append(steps, transactionStep{
+			store:   manifestStoreP11Kit,
+			prepare: func() (func() error, error) { return prepareP11KitUndo(derBytes) },
+			inject:  func() error { return injectCertP11Kit(derBytes) },
+		})
+	}
+
+	return steps, nil
 }
 
 // CleanCerts cleans expired certs from all configured trust stores.
@@ -19,4 +204,141 @@ func CleanCerts() {
 	if nssFlag.Value() {
 		cleanCertsNSS()
 	}
+
+	if p11kitFlag.Value() {
+		cleanCertsP11Kit()
+	}
+}
+
+// sweepStores removes the expired certs that the serve daemon owns in the
+// stores in m, other than the held certs.
+func sweepStores(m *manifest, held []*manifestCert) {
+	if m.NSS != nil {
+		err := cleanNSSDir(m.NSS.DBDir, m.NSS.CertDir, held)
+		if err != nil {
+			log.Warnf("%s", err)
+		}
+	}
+
+	if m.P11Kit != nil {
+		cleanP11KitDir(m.P11Kit.Dir, held)
+	}
+}
+
+// backupStores adds each configured trust store to archive.
+func backupStores(archive *backupArchive) error {
+	var err error
+
+	if nssFlag.Value() {
+		archive.NSS, err = backupNSS()
+		if err != nil {
+			return err
+		}
+	}
+
+	if p11kitFlag.Value() {
+		if p11kitDir.Value() == "" {
+			return fmt.Errorf("p11kitdir must be set: %w", ErrBackup)
+		}
+
+		archive.P11Kit, err = backupDir(p11kitDir.Value(), isP11KitFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreStores restores each trust store in archive.
+func restoreStores(archive *backupArchive) error {
+	if archive.CryptoAPI != nil {
+		return fmt.Errorf("archive contains a CryptoAPI store, which can only be restored on Windows: %w",
+			ErrRestore)
+	}
+
+	if archive.NSS != nil {
+		err := restoreNSS(archive.NSS)
+		if err != nil {
+			return err
+		}
+	}
+
+	if archive.P11Kit != nil {
+		dir := p11kitDir.Value()
+
+		recordRestore := auditRestoreEach(restoreDirNames(dir, archive.P11Kit, isP11KitFile),
+			func(name string) func() { return auditChangeP11Kit(auditRestore, "", dir, name) })
+
+		err := restoreDir(dir, archive.P11Kit, isP11KitFile)
+
+		recordRestore()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyManifest reconciles each trust store in m.
+func applyManifest(m *manifest) error {
+	if m.CryptoAPI != nil {
+		return fmt.Errorf("manifest has a [cryptoapi] section, which can only be applied on Windows: %w", ErrApply)
+	}
+
+	if m.NSS != nil {
+		err := reconcileNSS(m.NSS, m.certsForStore(manifestStoreNSS))
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.P11Kit != nil {
+		err := reconcileP11Kit(m.P11Kit, m.certsForStore(manifestStoreP11Kit))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureCert injects a single manifest cert into one store configured in m.
+func ensureCert(m *manifest, cert *manifestCert, store string) error {
+	switch store {
+	case manifestStoreNSS:
+		listed, err := listCertsNSS(m.NSS.DBDir)
+		if err != nil {
+			return err
+		}
+
+		currentTrust := map[string]string{}
+		for _, listedCert := range listed {
+			currentTrust[listedCert.Nickname] = listedCert.Trust
+		}
+
+		return ensureCertNSS(m.NSS, cert, currentTrust)
+	case manifestStoreP11Kit:
+		_, err := ensureCertP11Kit(m.P11Kit, cert)
+
+		return err
+	default:
+		return fmt.Errorf("%s isn't supported on this platform: %w", store, ErrApply)
+	}
+}
+
+// removeCert removes a single manifest cert from one store configured in m.
+func removeCert(m *manifest, cert *manifestCert, store string) error {
+	switch store {
+	case manifestStoreNSS:
+		defer auditChangeNSS(auditRemove, cert.requester, m.NSS.DBDir, m.NSS.CertDir, cert.fingerprintHex())()
+
+		return removeCertNSS(m.NSS.DBDir, m.NSS.CertDir, cert.fingerprintHex()+".pem")
+	case manifestStoreP11Kit:
+		return removeP11KitFile(m.P11Kit.Dir, cert.fingerprintHex()+p11kitExtension, cert.requester)
+	default:
+		return fmt.Errorf("%s isn't supported on this platform: %w", store, ErrApply)
+	}
 }
@@ -1,6 +1,9 @@
 package certinject
 
 import (
+	"crypto/x509"
+	"fmt"
+
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 )
 
@@ -13,13 +16,180 @@ var cryptoAPIFlag = cflag.Bool(flagGroup, "cryptoapi", false,
 
 // InjectCert injects the given cert into all configured trust stores.
 func InjectCert(derBytes []byte) {
+	injectCert(derBytes, false)
+}
+
+// InjectExpirableCert is like InjectCert, but tags the cert in CryptoAPI with
+// the expirable magic tag instead of the set magic tag, so that CleanCerts
+// removes it once it's too old, and then touches it, so that its age counts
+// from now.  Use it for short-lived certs such as Namecoin dehydrated certs.
+func InjectExpirableCert(derBytes []byte) {
+	injectCert(derBytes, true)
+	TouchCert(derBytes)
+}
+
+// TouchCert resets the age of an already injected cert in all configured
+// trust stores, so that CleanCerts counts it from now.  Injecting a cert
+// again leaves it alone if it's already right, so this is how a caller
+// keeps a cert it's still using from expiring.
+func TouchCert(derBytes []byte) {
+	_ = touchCert(derBytes)
+}
+
+// touchCert is TouchCert, but also returns the last error, having logged
+// each of them.
+func touchCert(derBytes []byte) error {
+	var lastErr error
+
+	if cryptoAPIFlag.Value() {
+		err := touchCertCryptoAPI(derBytes)
+		if err != nil {
+			log.Errorf("Error touching cert in CryptoAPI: %s", err)
+
+			lastErr = err
+		}
+	}
+
+	if nssFlag.Value() {
+		err := touchCertNSS(derBytes)
+		if err != nil {
+			log.Errorf("Error touching cert in NSS: %s", err)
+
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// VerifyCert reads the given cert back from all configured trust stores, and
+// checks that each of them holds it as InjectCert would leave it.  It
+// returns an error wrapping ErrNotTrusted if any of them doesn't.
+func VerifyCert(derBytes []byte) error {
+	verifiers := []storeVerifier{}
+
+	if cryptoAPIFlag.Value() {
+		verifiers = append(verifiers, storeVerifier{
+			store:  manifestStoreCryptoAPI,
+			verify: func() error { return verifyCertCryptoAPI(derBytes) },
+		})
+	}
+
+	if nssFlag.Value() {
+		verifiers = append(verifiers, storeVerifier{
+			store:  manifestStoreNSS,
+			verify: func() error { return verifyCertNSS(derBytes) },
+		})
+	}
+
+	return verifyStores(verifiers)
+}
+
+func injectCert(derBytes []byte, expirable bool) {
+	if transactional.Value() {
+		injectCertTransactional(derBytes, expirable)
+
+		return
+	}
+
+	err := checkInjection(derBytes)
+	if err != nil {
+		log.Errorf("Not injecting cert: %s", err)
+
+		return
+	}
+
+	if cryptoAPIFlag.Value() {
+		injectCertCryptoAPI(derBytes, expirable)
+	}
+
+	if nssFlag.Value() {
+		err := observeInjection(manifestStoreNSS, func() error { return injectCertNSS(derBytes) })
+		if err != nil {
+			log.Errorf("Error injecting cert to NSS: %s", err)
+		}
+	}
+}
+
+// checkInjectPolicy checks InjectCert's configured stores and operations,
+// and the cert, against policy.  CryptoAPI certs are checked by
+// reconcileCertCryptoAPI instead, with the properties they're about to be
+// written with, however they were selected.
+func checkInjectPolicy(policy *injectPolicy, derBytes []byte) error {
+	stores := []string{}
+
+	if cryptoAPIFlag.Value() {
+		stores = append(stores, manifestStoreCryptoAPI)
+	}
+
+	if nssFlag.Value() {
+		stores = append(stores, manifestStoreNSS)
+	}
+
+	err := policy.checkStores(stores, cryptoAPIFlagLogicalStoreName.Value())
+	if err != nil {
+		return err
+	}
+
+	if cryptoAPIFlag.Value() {
+		err = checkPolicyFlagsCryptoAPI(policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	if nssFlag.Value() && derBytes != nil {
+		return policy.checkPolicyCert(derBytes, nil)
+	}
+
+	return nil
+}
+
+// injectionLintTarget returns where InjectCert puts certs.  NSS trusts them
+// as anchors; CryptoAPI does if they go into a root logical store.
+func injectionLintTarget() lintTarget {
+	root := nssFlag.Value() || (cryptoAPIFlag.Value() && isRootLogicalStore(cryptoAPIFlagLogicalStoreName.Value()))
+
+	existing := func() []*x509.Certificate {
+		certs := [][]byte{}
+
+		if cryptoAPIFlag.Value() {
+			certs = append(certs, existingCertsCryptoAPI()...)
+		}
+
+		if nssFlag.Value() {
+			certs = append(certs, existingCertsNSS()...)
+		}
+
+		return parseCerts(certs)
+	}
+
+	return lintTarget{root: root, existing: existing}
+}
+
+// transactionSteps returns a transaction step for each configured trust
+// store, in the order InjectCert uses.
+func transactionSteps(derBytes []byte, expirable bool) ([]transactionStep, error) {
+	steps := []transactionStep{}
+
 	if cryptoAPIFlag.Value() {
-		injectCertCryptoAPI(derBytes)
+		step, err := cryptoAPITransactionStep(derBytes, expirable)
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, step)
 	}
 
 	if nssFlag.Value() {
-		injectCertNSS(derBytes)
+		steps = append(steps, transactionStep{
+			store:   manifestStoreNSS,
+			prepare: func() (func() error, error) { return prepareNSSUndo(derBytes) },
+			inject:  func() error { return injectCertNSS(derBytes) },
+		})
 	}
+
+	return steps, nil
 }
 
 // CleanCerts cleans expired certs from all configured trust stores.
@@ -32,3 +202,125 @@ func CleanCerts() {
 		cleanCertsNSS()
 	}
 }
+
+// sweepStores removes the expired certs that the serve daemon owns in the
+// stores in m, other than the held certs.
+func sweepStores(m *manifest, held []*manifestCert) {
+	if m.CryptoAPI != nil {
+		err := cleanOwnedCryptoAPI(m.CryptoAPI, m.owner, held)
+		if err != nil {
+			log.Warnf("%s", err)
+		}
+	}
+
+	if m.NSS != nil {
+		err := cleanNSSDir(m.NSS.DBDir, m.NSS.CertDir, held)
+		if err != nil {
+			log.Warnf("%s", err)
+		}
+	}
+}
+
+// backupStores adds each configured trust store to archive.
+func backupStores(archive *backupArchive) error {
+	var err error
+
+	if cryptoAPIFlag.Value() {
+		archive.CryptoAPI, err = backupCryptoAPI()
+		if err != nil {
+			return err
+		}
+	}
+
+	if nssFlag.Value() {
+		archive.NSS, err = backupNSS()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreStores restores each trust store in archive.
+func restoreStores(archive *backupArchive) error {
+	if archive.P11Kit != nil {
+		return fmt.Errorf("archive contains a p11-kit directory, which can't be restored on Windows: %w",
+			ErrRestore)
+	}
+
+	if archive.CryptoAPI != nil {
+		err := restoreCryptoAPI(archive.CryptoAPI)
+		if err != nil {
+			return err
+		}
+	}
+
+	if archive.NSS != nil {
+		err := restoreNSS(archive.NSS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyManifest reconciles each trust store in m.
+func applyManifest(m *manifest) error {
+	if m.P11Kit != nil {
+		return fmt.Errorf("manifest has a [p11kit] section, which can't be applied on Windows: %w", ErrApply)
+	}
+
+	if m.CryptoAPI != nil {
+		err := reconcileCryptoAPI(m.CryptoAPI, m.owner, m.certsForStore(manifestStoreCryptoAPI))
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.NSS != nil {
+		err := reconcileNSS(m.NSS, m.certsForStore(manifestStoreNSS))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureCert injects a single manifest cert into one store configured in m.
+func ensureCert(m *manifest, cert *manifestCert, store string) error {
+	switch store {
+	case manifestStoreCryptoAPI:
+		return ensureCertCryptoAPI(m.CryptoAPI, m.owner, cert)
+	case manifestStoreNSS:
+		listed, err := listCertsNSS(m.NSS.DBDir)
+		if err != nil {
+			return err
+		}
+
+		currentTrust := map[string]string{}
+		for _, listedCert := range listed {
+			currentTrust[listedCert.Nickname] = listedCert.Trust
+		}
+
+		return ensureCertNSS(m.NSS, cert, currentTrust)
+	default:
+		return fmt.Errorf("%s isn't supported on this platform: %w", store, ErrApply)
+	}
+}
+
+// removeCert removes a single manifest cert from one store configured in m.
+func removeCert(m *manifest, cert *manifestCert, store string) error {
+	switch store {
+	case manifestStoreCryptoAPI:
+		return removeCertCryptoAPI(m.CryptoAPI, m.owner, cert)
+	case manifestStoreNSS:
+		defer auditChangeNSS(auditRemove, cert.requester, m.NSS.DBDir, m.NSS.CertDir, cert.fingerprintHex())()
+
+		return removeCertNSS(m.NSS.DBDir, m.NSS.CertDir, cert.fingerprintHex()+".pem")
+	default:
+		return fmt.Errorf("%s isn't supported on this platform: %w", store, ErrApply)
+	}
+}
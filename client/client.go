@@ -0,0 +1,176 @@
+// Package client talks to a certinject daemon started with "certinject
+// serve", so that a process without the rights to change trust stores can
+// ask a privileged helper to inject certs on its behalf.
+//
+// The protocol is one JSON Request per connection to the daemon's Unix
+// socket, answered by one JSON Response.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Operations a Request can ask for.
+const (
+	OpInject = "inject"
+	OpRemove = "remove"
+	OpList   = "list"
+	OpClean  = "clean"
+)
+
+var (
+	ErrClient = errors.New("certinject client error")
+	ErrServer = errors.New("certinject daemon refused request")
+)
+
+// Request is sent by a client.  Token identifies the client to the daemon,
+// which applies that client's policy.
+type Request struct {
+	Token string `json:"token"`
+	Op    string `json:"op"`
+
+	// Cert is the DER cert to inject.
+	Cert []byte `json:"cert,omitempty"`
+
+	// Fingerprint is the SHA-256 fingerprint (lowercase hex) of the cert
+	// to remove.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	InjectOptions
+}
+
+// InjectOptions restrict an injected cert.  The daemon's policy for the
+// client may require some of them.
+type InjectOptions struct {
+	// Stores lists the trust stores to inject into, e.g. "nss".  If empty,
+	// every store the client is allowed to use.
+	Stores []string `json:"stores,omitempty"`
+
+	// EKU lists the extended key usages to trust the cert for, as names
+	// (e.g. "server") or OID's.
+	EKU []string `json:"eku,omitempty"`
+
+	NameConstraints *NameConstraints `json:"name-constraints,omitempty"`
+
+	// TTL is how long the cert is kept before the daemon removes it.  If
+	// zero, the longest the client is allowed.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// NameConstraints lists the permitted and excluded names of each type.
+type NameConstraints struct {
+	PermittedDNS   []string `json:"permitted-dns,omitempty"`
+	ExcludedDNS    []string `json:"excluded-dns,omitempty"`
+	PermittedIP    []string `json:"permitted-ip,omitempty"`
+	ExcludedIP     []string `json:"excluded-ip,omitempty"`
+	PermittedEmail []string `json:"permitted-email,omitempty"`
+	ExcludedEmail  []string `json:"excluded-email,omitempty"`
+	PermittedURI   []string `json:"permitted-uri,omitempty"`
+	ExcludedURI    []string `json:"excluded-uri,omitempty"`
+}
+
+// Response is sent by the daemon.  Error is empty on success.
+type Response struct {
+	Error string     `json:"error,omitempty"`
+	Certs []CertInfo `json:"certs,omitempty"`
+}
+
+// CertInfo describes a cert that the daemon injected for a client.
+type CertInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Stores      []string  `json:"stores"`
+	Expires     time.Time `json:"expires,omitempty"`
+}
+
+// Client sends requests to a daemon.
+type Client struct {
+	Socket  string
+	Token   string
+	Timeout time.Duration
+}
+
+// New returns a Client for the daemon listening on socket.
+func New(socket, token string) *Client {
+	return &Client{Socket: socket, Token: token, Timeout: 30 * time.Second}
+}
+
+// Inject asks the daemon to inject a DER cert.  It returns the cert as
+// injected.
+func (c *Client) Inject(derBytes []byte, opts InjectOptions) (*CertInfo, error) {
+	resp, err := c.Do(&Request{Op: OpInject, Cert: derBytes, InjectOptions: opts})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Certs) != 1 {
+		return nil, fmt.Errorf("expected 1 cert in response, got %d: %w", len(resp.Certs), ErrClient)
+	}
+
+	return &resp.Certs[0], nil
+}
+
+// Remove asks the daemon to remove a cert that it injected for this client.
+func (c *Client) Remove(fingerprint string) error {
+	_, err := c.Do(&Request{Op: OpRemove, Fingerprint: fingerprint})
+
+	return err
+}
+
+// List returns the certs that the daemon injected for this client.
+func (c *Client) List() ([]CertInfo, error) {
+	resp, err := c.Do(&Request{Op: OpList})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Certs, nil
+}
+
+// Clean asks the daemon to remove this client's expired certs, and returns
+// the ones it removed.
+func (c *Client) Clean() ([]CertInfo, error) {
+	resp, err := c.Do(&Request{Op: OpClean})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Certs, nil
+}
+
+// Do sends a request, filling in the token, and returns the response.  An
+// error from the daemon is returned wrapping ErrServer.
+func (c *Client) Do(req *Request) (*Response, error) {
+	req.Token = c.Token
+
+	conn, err := net.DialTimeout("unix", c.Socket, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't connect to %s: %w", err, c.Socket, ErrClient)
+	}
+	defer conn.Close()
+
+	if c.Timeout != 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't send request: %w", err, ErrClient)
+	}
+
+	resp := &Response{}
+
+	err = json.NewDecoder(conn).Decode(resp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read response: %w", err, ErrClient)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s: %w", resp.Error, ErrServer)
+	}
+
+	return resp, nil
+}
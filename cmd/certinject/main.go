@@ -1,11 +1,19 @@
 // Copyright 2020 Namecoin Developers GPLv3+
 
-// Command certinject injects certificates into all configured trust stores
+// Command certinject injects certificates into all configured trust stores,
+// keeps them there while watching for changes, resets their age so that they
+// don't expire, checks that they're trusted, reconciles them with a manifest,
+// serves injection requests from other processes, backs up and restores
+// them, and verifies the audit log of its changes
 package main
 
 import (
+	"context"
 	"encoding/pem"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/hlandau/dexlogconfig"
 	"github.com/hlandau/xlog"
@@ -19,10 +27,34 @@ var log, _ = xlog.New("certinject")
 
 func main() {
 	var (
-		flagGroup = cflag.NewGroup(nil, "certinject")
-		certflag  = cflag.String(flagGroup, "cert", "", "path to certificate to inject into trust store")
+		flagGroup   = cflag.NewGroup(nil, "certinject")
+		certflag    = cflag.String(flagGroup, "cert", "", "path to certificate to inject into trust store")
+		archiveflag = cflag.String(flagGroup, "archive", "",
+			"path to archive written by the backup command and read by the restore command")
+		manifestflag = cflag.String(flagGroup, "manifest", "",
+			"path to TOML manifest of the desired trust store state, read by the apply command")
+		serveconfigflag = cflag.String(flagGroup, "serve-config", "",
+			"path to TOML config of the socket, trust stores and client policies, read by the serve command")
+		leafflag = cflag.String(flagGroup, "leaf", "",
+			"path to leaf certificate that the verify command builds a chain for from the trust stores (Linux only)")
+		hostnameflag = cflag.String(flagGroup, "hostname", "",
+			"hostname that the verify command checks the leaf certificate for")
 	)
 
+	// The first argument may name a command; injecting is the default.
+	command := "inject"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	// The audit command takes a subcommand.
+	subcommand := ""
+	if command == "audit" && len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		subcommand = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// read config
 	config := easyconfig.Configurator{
 		ProgramName: "certinject",
@@ -30,12 +62,140 @@ func main() {
 	config.ParseFatal(nil)
 	dexlogconfig.Init()
 
+	switch command {
+	case "inject":
+		inject(certflag.Value())
+	case "backup":
+		backup(archiveflag.Value())
+	case "restore":
+		restore(archiveflag.Value())
+	case "apply":
+		apply(manifestflag.Value())
+	case "serve":
+		serve(serveconfigflag.Value())
+	case "watch":
+		watch(certflag.Value())
+	case "touch":
+		touch(certflag.Value())
+	case "verify":
+		verify(certflag.Value(), leafflag.Value(), hostnameflag.Value())
+	case "audit":
+		audit(subcommand)
+	default:
+		log.Fatalf("unknown command %q (consider inject, watch, touch, verify, apply, serve, backup, restore, audit)",
+			command)
+	}
+}
+
+func inject(cert string) {
+	certbytes := readCert(cert)
+
+	checkPolicy(certbytes)
+
+	log.Debugf("injecting certificate...")
+
+	certinject.InjectCert(certbytes)
+	log.Debugf("injected certificate: %q", cert)
+}
+
+// watch injects the cert, and injects it again whenever the trust stores
+// change, until interrupted.
+func watch(cert string) {
+	certbytes := readCert(cert)
+
+	checkPolicy(certbytes)
+
+	defer startMetrics()()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := certinject.WatchCert(ctx, certbytes)
+	if err != nil {
+		log.Fatale(err, "error watching trust stores")
+	}
+
+	log.Debugf("stopped watching trust stores")
+}
+
+// startMetrics exports metrics, if configured, until the function it
+// returns is called.
+func startMetrics() func() {
+	stop, err := certinject.StartMetrics()
+	if err != nil {
+		log.Fatale(err, "error starting metrics")
+	}
+
+	return stop
+}
+
+// checkPolicy exits if the policy file doesn't allow injecting the cert.
+// InjectCert would refuse it anyway, but only log why.
+func checkPolicy(certbytes []byte) {
+	err := certinject.CheckPolicy(certbytes)
+	if err != nil {
+		log.Fatale(err, "policy violation")
+	}
+}
+
+// audit runs an audit log subcommand.
+func audit(subcommand string) {
+	switch subcommand {
+	case "verify":
+		err := certinject.VerifyAuditLog()
+		if err != nil {
+			log.Fatale(err, "error verifying audit log")
+		}
+	default:
+		log.Fatalf("unknown audit subcommand %q (consider verify)", subcommand)
+	}
+}
+
+// touch resets the age of an already injected cert, so that it isn't
+// cleaned up as expired yet.
+func touch(cert string) {
+	if cert == "" {
+		log.Fatal("touch requires -certinject.cert")
+	}
+
+	certbytes := readCert(cert)
+
+	certinject.TouchCert(certbytes)
+	log.Debugf("touched certificate: %q", cert)
+}
+
+// verify checks that the trust stores hold the injected cert as inject left
+// it, and that a chain can be built from the leaf cert for the hostname.
+func verify(cert, leaf, hostname string) {
+	if cert == "" && leaf == "" {
+		log.Fatal("verify requires -certinject.cert, -certinject.leaf or both")
+	}
+
+	if cert != "" {
+		err := certinject.VerifyCert(readCert(cert))
+		if err != nil {
+			log.Fatale(err, "error verifying injected certificate")
+		}
+
+		log.Debugf("verified certificate: %q", cert)
+	}
+
+	if leaf != "" {
+		err := certinject.VerifyChain(readCert(leaf), hostname)
+		if err != nil {
+			log.Fatale(err, "error verifying chain")
+		}
+
+		log.Debugf("verified chain for %q: %q", hostname, leaf)
+	}
+}
+
+func readCert(cert string) []byte {
 	var (
 		certbytes []byte
 		err       error
 	)
 
-	cert := certflag.Value()
 	if cert != "" {
 		log.Debugf("reading certificate: %q", cert)
 
@@ -58,8 +218,82 @@ func main() {
 		}
 	}
 
-	log.Debugf("injecting certificate...")
+	return certbytes
+}
 
-	certinject.InjectCert(certbytes)
-	log.Debugf("injected certificate: %q", cert)
+func backup(archive string) {
+	if archive == "" {
+		log.Fatal("backup requires -certinject.archive")
+	}
+
+	// Never overwrite an existing archive; it may be the only copy of the
+	// state we're about to change.
+	archiveFile, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatale(err, "error creating archive")
+	}
+
+	err = certinject.Backup(archiveFile)
+	if err != nil {
+		archiveFile.Close()
+		os.Remove(archive)
+		log.Fatale(err, "error backing up trust stores")
+	}
+
+	err = archiveFile.Close()
+	if err != nil {
+		log.Fatale(err, "error writing archive")
+	}
+
+	log.Debugf("backed up trust stores: %q", archive)
+}
+
+func restore(archive string) {
+	if archive == "" {
+		log.Fatal("restore requires -certinject.archive")
+	}
+
+	archiveFile, err := os.Open(archive)
+	if err != nil {
+		log.Fatale(err, "error opening archive")
+	}
+	defer archiveFile.Close()
+
+	err = certinject.Restore(archiveFile)
+	if err != nil {
+		log.Fatale(err, "error restoring trust stores")
+	}
+
+	log.Debugf("restored trust stores: %q", archive)
+}
+
+func apply(manifest string) {
+	if manifest == "" {
+		log.Fatal("apply requires -certinject.manifest")
+	}
+
+	err := certinject.Apply(manifest)
+	if err != nil {
+		log.Fatale(err, "error applying manifest")
+	}
+
+	log.Debugf("applied manifest: %q", manifest)
+}
+
+func serve(config string) {
+	if config == "" {
+		log.Fatal("serve requires -certinject.serve-config")
+	}
+
+	server, err := certinject.NewServer(config)
+	if err != nil {
+		log.Fatale(err, "error reading serve config")
+	}
+
+	defer startMetrics()()
+
+	err = server.ListenAndServe()
+	if err != nil {
+		log.Fatale(err, "error serving")
+	}
 }
@@ -0,0 +1,290 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+var (
+	constrainAllRoots = cflag.String(cryptoAPIFlagGroup, "constrain-all-roots", "",
+		"Merge an exclusion of this DNS domain (e.g. .bit) into the name "+
+			"constraints of every CA cert in the store")
+	unconstrainAllRoots = cflag.String(cryptoAPIFlagGroup, "unconstrain-all-roots", "",
+		"Remove an exclusion of this DNS domain from every cert in the store, "+
+			"but only where constrain-all-roots added it")
+	constrainExempt = cflag.String(cryptoAPIFlagGroup, "constrain-exempt", "",
+		"Don't constrain certs with these SHA1 hashes (comma-separated "+
+			"uppercase hex); certs with the skip-magic-name tag are also exempt.  "+
+			"unconstrain-all-roots still removes the exclusions it added to them")
+)
+
+// constrainMarkerValueName is a registry value that lists the excluded DNS
+// domains which constrain-all-roots added to a cert, so that
+// unconstrain-all-roots never removes an exclusion that was already there.
+// Like the magic tags, CryptoAPI ignores it.
+const constrainMarkerValueName = "CertinjectExcludedDNS"
+
+var ErrConstrainCert = fmt.Errorf("error constraining cert: %w", ErrInjectCerts)
+
+// This is the operation described in the applyMagic comment: exclude a
+// domain (e.g. .bit) from every root CA, except for the ones that are
+// exempt (e.g. Namecoin's own roots).  Certs that aren't CAs are left
+// alone, since name constraints don't limit them.  The exemptions don't
+// apply to unconstraining, which only removes the exclusions that the
+// marker lists, so that a cert exempted after it was constrained can still
+// be restored.  Changes are recorded in undo, if it isn't nil.
+func constrainAllRootsOnceCryptoAPI(registryBase registry.Key, storeKey, operation string,
+	undo *cryptoAPIUndo,
+) (bool, error) {
+	fingerprintHexUpperList, err := allFingerprintsInStore(registryBase, storeKey)
+	if err != nil {
+		return false, err
+	}
+
+	exempt := map[string]bool{}
+
+	if constrainAllRoots.Value() != "" {
+		for _, fingerprint := range splitFlagList(constrainExempt.Value()) {
+			exempt[strings.ToUpper(fingerprint)] = true
+		}
+	}
+
+	failed := 0
+	changed := false
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		if exempt[fingerprintHexUpper] {
+			continue
+		}
+
+		var wrote bool
+
+		recordUndo, err := undo.track(registryBase, storeKey, fingerprintHexUpper)
+		if err != nil {
+			return changed, err
+		}
+
+		recordChange := auditChangeCryptoAPI(operation, "", nil, registryBase, storeKey, fingerprintHexUpper)
+
+		if constrainAllRoots.Value() != "" {
+			wrote, err = constrainSingleCertCryptoAPI(fingerprintHexUpper, registryBase, storeKey,
+				constrainAllRoots.Value())
+		} else {
+			wrote, err = unconstrainSingleCertCryptoAPI(fingerprintHexUpper, registryBase, storeKey,
+				unconstrainAllRoots.Value())
+		}
+
+		recordChange()
+		recordUndo(wrote, err)
+
+		if err != nil {
+			log.Errorf("Cert %s: %s", fingerprintHexUpper, err)
+
+			failed++
+		}
+
+		changed = changed || wrote
+	}
+
+	if failed != 0 {
+		return changed, fmt.Errorf("%d of %d certs failed: %w", failed, len(fingerprintHexUpperList), ErrConstrainCert)
+	}
+
+	return changed, nil
+}
+
+func constrainSingleCertCryptoAPI(fingerprintHexUpper string, registryBase registry.Key, storeKey,
+	domain string,
+) (bool, error) {
+	certKey, blob, err := openBlobForConstrain(fingerprintHexUpper, registryBase, storeKey)
+	if err != nil {
+		return false, err
+	}
+	defer certKey.Close()
+
+	if skippedForConstrain(certKey) {
+		return false, nil
+	}
+
+	isCA, err := blobIsCA(blob)
+	if err != nil || !isCA {
+		return false, err
+	}
+
+	oldBlob := blob.Clone()
+
+	added, err := blob.AddExcludedDNSDomain(domain)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", err, ErrConstrainCert)
+	}
+
+	if !added {
+		// Already excluded, either by us or by someone else.  Either way,
+		// there's nothing for us to own.
+		return false, nil
+	}
+
+	markers := readConstrainMarkers(certKey)
+
+	if dryRun.Value() {
+		planBlobCryptoAPI(fingerprintHexUpper, oldBlob, blob)
+		planf("%s: set %s to %v", fingerprintHexUpper, constrainMarkerValueName, append(markers, domain))
+
+		return false, nil
+	}
+
+	// Write the blob before the marker.  If we're interrupted in between,
+	// the exclusion stays in place rather than a marker claiming an
+	// exclusion that doesn't exist.
+	err = writeBlobForConstrain(certKey, blob)
+	if err != nil {
+		return false, err
+	}
+
+	err = certKey.SetStringsValue(constrainMarkerValueName, append(markers, domain))
+	if err != nil {
+		return true, fmt.Errorf("%s: couldn't set marker: %w", err, ErrConstrainCert)
+	}
+
+	return true, nil
+}
+
+func unconstrainSingleCertCryptoAPI(fingerprintHexUpper string, registryBase registry.Key, storeKey,
+	domain string,
+) (bool, error) {
+	certKey, blob, err := openBlobForConstrain(fingerprintHexUpper, registryBase, storeKey)
+	if err != nil {
+		return false, err
+	}
+	defer certKey.Close()
+
+	markers := readConstrainMarkers(certKey)
+	remainingMarkers := []string{}
+
+	for _, marker := range markers {
+		if !strings.EqualFold(marker, domain) {
+			remainingMarkers = append(remainingMarkers, marker)
+		}
+	}
+
+	if len(remainingMarkers) == len(markers) {
+		// We didn't add this exclusion, so it's not ours to remove.
+		return false, nil
+	}
+
+	oldBlob := blob.Clone()
+
+	_, err = blob.RemoveExcludedDNSDomain(domain)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", err, ErrConstrainCert)
+	}
+
+	if dryRun.Value() {
+		planBlobCryptoAPI(fingerprintHexUpper, oldBlob, blob)
+		planf("%s: set %s to %v", fingerprintHexUpper, constrainMarkerValueName, remainingMarkers)
+
+		return false, nil
+	}
+
+	err = writeBlobForConstrain(certKey, blob)
+	if err != nil {
+		return false, err
+	}
+
+	if len(remainingMarkers) == 0 {
+		err = certKey.DeleteValue(constrainMarkerValueName)
+	} else {
+		err = certKey.SetStringsValue(constrainMarkerValueName, remainingMarkers)
+	}
+
+	if err != nil {
+		return true, fmt.Errorf("%s: couldn't update marker: %w", err, ErrConstrainCert)
+	}
+
+	return true, nil
+}
+
+// openBlobForConstrain opens and parses a cert's blob.
+func openBlobForConstrain(fingerprintHexUpper string, registryBase registry.Key,
+	storeKey string,
+) (registry.Key, certblob.Blob, error) {
+	certKey, err := registry.OpenKey(registryBase, storeKey+`\`+fingerprintHexUpper, registry.ALL_ACCESS)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: couldn't open cert: %w", err, ErrConstrainCert)
+	}
+
+	blobBytes, _, err := certKey.GetBinaryValue("Blob")
+	if err != nil {
+		certKey.Close()
+
+		return 0, nil, fmt.Errorf("%s: couldn't read blob: %w", err, ErrConstrainCert)
+	}
+
+	blob, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		certKey.Close()
+
+		return 0, nil, fmt.Errorf("%s: couldn't parse blob: %w", err, ErrConstrainCert)
+	}
+
+	return certKey, blob, nil
+}
+
+// skippedForConstrain reports whether a cert is exempt from constraining via
+// the skip magic tag.
+func skippedForConstrain(certKey registry.Key) bool {
+	if skipMagicName.Value() == "" {
+		return false
+	}
+
+	shouldSkip, _, err := certKey.GetIntegerValue(skipMagicName.Value())
+
+	return err == nil && shouldSkip == uint64(skipMagicData.Value())
+}
+
+// blobIsCA reports whether a blob's cert is a CA.  A cert without Basic
+// Constraints, such as an old v1 root, counts as one.
+func blobIsCA(blob certblob.Blob) (bool, error) {
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't parse cert: %w", err, ErrConstrainCert)
+	}
+
+	return cert.IsCA || !cert.BasicConstraintsValid, nil
+}
+
+func writeBlobForConstrain(certKey registry.Key, blob certblob.Blob) error {
+	blobBytes, err := blob.Marshal()
+	if err != nil {
+		return fmt.Errorf("%s: couldn't marshal blob: %w", err, ErrConstrainCert)
+	}
+
+	err = certKey.SetBinaryValue("Blob", blobBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't write blob: %w", err, ErrConstrainCert)
+	}
+
+	return nil
+}
+
+func readConstrainMarkers(certKey registry.Key) []string {
+	markers, _, err := certKey.GetStringsValue(constrainMarkerValueName)
+	if errors.Is(err, registry.ErrNotExist) {
+		return []string{}
+	}
+
+	if err != nil {
+		log.Warnf("Couldn't read %s marker: %s", constrainMarkerValueName, err)
+
+		return []string{}
+	}
+
+	return markers
+}
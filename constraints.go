@@ -0,0 +1,137 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var ErrNameConstraintsPolicy = errors.New("error in name constraints policy")
+
+// nameConstraintsPolicy lists the permitted and excluded names of each type.
+// It's the format of the file named by the -certstore.capi.nc.policy-file
+// flag, e.g.:
+//
+//	permitted-dns = [".bit"]
+//	permitted-ip = ["10.0.0.0/8", "192.168.0.0/16"]
+type nameConstraintsPolicy struct {
+	PermittedDNS   []string `toml:"permitted-dns"`
+	ExcludedDNS    []string `toml:"excluded-dns"`
+	PermittedIP    []string `toml:"permitted-ip"`
+	ExcludedIP     []string `toml:"excluded-ip"`
+	PermittedEmail []string `toml:"permitted-email"`
+	ExcludedEmail  []string `toml:"excluded-email"`
+	PermittedURI   []string `toml:"permitted-uri"`
+	ExcludedURI    []string `toml:"excluded-uri"`
+}
+
+func loadNameConstraintsPolicy(path string) (*nameConstraintsPolicy, error) {
+	policy := &nameConstraintsPolicy{}
+
+	meta, err := toml.DecodeFile(path, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrNameConstraintsPolicy)
+	}
+
+	// A typo in a constraint policy would silently widen it, so reject
+	// anything we don't recognize.
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("unknown keys %v in %s: %w", undecoded, path, ErrNameConstraintsPolicy)
+	}
+
+	// Likewise, a malformed name would be encoded into a constraint that
+	// trust stores may read differently, so check every entry now.
+	_, _, err = policy.template()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return policy, nil
+}
+
+// merge appends the names in other to p.
+func (p *nameConstraintsPolicy) merge(other *nameConstraintsPolicy) {
+	p.PermittedDNS = append(p.PermittedDNS, other.PermittedDNS...)
+	p.ExcludedDNS = append(p.ExcludedDNS, other.ExcludedDNS...)
+	p.PermittedIP = append(p.PermittedIP, other.PermittedIP...)
+	p.ExcludedIP = append(p.ExcludedIP, other.ExcludedIP...)
+	p.PermittedEmail = append(p.PermittedEmail, other.PermittedEmail...)
+	p.ExcludedEmail = append(p.ExcludedEmail, other.ExcludedEmail...)
+	p.PermittedURI = append(p.PermittedURI, other.PermittedURI...)
+	p.ExcludedURI = append(p.ExcludedURI, other.ExcludedURI...)
+}
+
+// template converts the policy to a certificate template suitable for
+// certblob.BuildNameConstraints, and checks that every name is well formed.
+// The returned bool is false if the policy is empty.
+func (p *nameConstraintsPolicy) template() (*x509.Certificate, bool, error) {
+	valid := false
+	template := x509.Certificate{}
+
+	setNameConstraintsStrings(&template.PermittedDNSDomains, p.PermittedDNS, &valid)
+	setNameConstraintsStrings(&template.ExcludedDNSDomains, p.ExcludedDNS, &valid)
+
+	err := setNameConstraintsIPRanges(&template.PermittedIPRanges, p.PermittedIP, &valid)
+	if err != nil {
+		return nil, false, fmt.Errorf("permitted: %w", err)
+	}
+
+	err = setNameConstraintsIPRanges(&template.ExcludedIPRanges, p.ExcludedIP, &valid)
+	if err != nil {
+		return nil, false, fmt.Errorf("excluded: %w", err)
+	}
+
+	setNameConstraintsStrings(&template.PermittedEmailAddresses, p.PermittedEmail, &valid)
+	setNameConstraintsStrings(&template.ExcludedEmailAddresses, p.ExcludedEmail, &valid)
+	setNameConstraintsStrings(&template.PermittedURIDomains, p.PermittedURI, &valid)
+	setNameConstraintsStrings(&template.ExcludedURIDomains, p.ExcludedURI, &valid)
+
+	err = x509ext.CheckNameConstraints(&template)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", err, ErrNameConstraintsPolicy)
+	}
+
+	return &template, valid, nil
+}
+
+func setNameConstraintsStrings(ncs *[]string, vals []string, valid *bool) {
+	if len(vals) != 0 {
+		*ncs = append(*ncs, vals...)
+		*valid = true
+	}
+}
+
+func setNameConstraintsIPRanges(ncs *[]*net.IPNet, vals []string, valid *bool) error {
+	for _, val := range vals {
+		_, IPNet, err := net.ParseCIDR(val)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't parse IP CIDR: %w", err, ErrNameConstraintsPolicy)
+		}
+
+		*ncs = append(*ncs, IPNet)
+		*valid = true
+	}
+
+	return nil
+}
+
+// splitFlagList splits a comma-separated flag value, ignoring whitespace
+// and empty entries.
+func splitFlagList(val string) []string {
+	result := []string{}
+
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,115 @@
+package certinject
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitFlagList(t *testing.T) {
+	tests := map[string][]string{
+		"":                    {},
+		".bit":                {".bit"},
+		".bit, example.com ,": {".bit", "example.com"},
+	}
+
+	for input, expected := range tests {
+		if got := splitFlagList(input); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected %v, got %v", input, expected, got)
+		}
+	}
+}
+
+func TestNameConstraintsPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.toml")
+
+	err := os.WriteFile(path, []byte(`
+permitted-dns = [".bit"]
+permitted-ip = ["10.0.0.0/8", "192.168.0.0/16"]
+excluded-email = ["example.com"]
+`), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write policy: %s", err)
+	}
+
+	policy := nameConstraintsPolicy{PermittedDNS: splitFlagList(".example.org")}
+
+	filePolicy, err := loadNameConstraintsPolicy(path)
+	if err != nil {
+		t.Fatalf("couldn't load policy: %s", err)
+	}
+
+	policy.merge(filePolicy)
+
+	template, valid, err := policy.template()
+	if err != nil {
+		t.Fatalf("couldn't build template: %s", err)
+	}
+
+	if !valid {
+		t.Fatalf("template unexpectedly empty")
+	}
+
+	if !reflect.DeepEqual(template.PermittedDNSDomains, []string{".example.org", ".bit"}) {
+		t.Errorf("unexpected permitted DNS domains %v", template.PermittedDNSDomains)
+	}
+
+	if len(template.PermittedIPRanges) != 2 || template.PermittedIPRanges[1].String() != "192.168.0.0/16" {
+		t.Errorf("unexpected permitted IP ranges %v", template.PermittedIPRanges)
+	}
+
+	if !reflect.DeepEqual(template.ExcludedEmailAddresses, []string{"example.com"}) {
+		t.Errorf("unexpected excluded email addresses %v", template.ExcludedEmailAddresses)
+	}
+}
+
+func TestNameConstraintsPolicyErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.toml")
+
+	err := os.WriteFile(path, []byte(`permitted-dsn = [".bit"]`), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write policy: %s", err)
+	}
+
+	_, err = loadNameConstraintsPolicy(path)
+	if !errors.Is(err, ErrNameConstraintsPolicy) {
+		t.Errorf("misspelled key: expected ErrNameConstraintsPolicy, got %v", err)
+	}
+
+	for name, text := range map[string]string{
+		"empty DNS label":  `permitted-dns = ["a..bit"]`,
+		"bare dot email":   `excluded-email = ["."]`,
+		"URI of an IP":     `permitted-uri = ["10.0.0.1"]`,
+		"DNS with a space": `excluded-dns = [".b it"]`,
+	} {
+		err = os.WriteFile(path, []byte(text), 0o600)
+		if err != nil {
+			t.Fatalf("couldn't write policy: %s", err)
+		}
+
+		_, err = loadNameConstraintsPolicy(path)
+		if !errors.Is(err, ErrNameConstraintsPolicy) {
+			t.Errorf("%s: expected ErrNameConstraintsPolicy, got %v", name, err)
+		}
+	}
+
+	// Flags are checked when they're converted.
+	_, _, err = (&nameConstraintsPolicy{ExcludedDNS: splitFlagList(".bit,a..b")}).template()
+	if !errors.Is(err, ErrNameConstraintsPolicy) {
+		t.Errorf("malformed flag entry: expected ErrNameConstraintsPolicy, got %v", err)
+	}
+
+	policy := nameConstraintsPolicy{ExcludedIP: []string{"10.0.0.0"}}
+
+	_, _, err = policy.template()
+	if !errors.Is(err, ErrNameConstraintsPolicy) {
+		t.Errorf("bad CIDR: expected ErrNameConstraintsPolicy, got %v", err)
+	}
+
+	_, valid, err := (&nameConstraintsPolicy{}).template()
+	if err != nil || valid {
+		t.Errorf("empty policy: expected invalid template without error, got %t, %v", valid, err)
+	}
+}
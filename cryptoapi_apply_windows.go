@@ -0,0 +1,411 @@
+package certinject
+
+import (
+	"crypto/sha1" // #nosec G505
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// Registry values that apply writes next to the Blob.  Like magic tags,
+// they're ignored by CryptoAPI.
+const (
+	// ownerValueName names what added a cert: the manifest (see
+	// manifestOwner) or the serve daemon.  Each only removes the certs that
+	// it owns, and certs without it are never removed.
+	ownerValueName = "CertinjectOwner"
+
+	// expiresValueName holds the Unix time after which CleanCerts removes an
+	// owned cert whose manifest entry has a ttl.
+	expiresValueName = "CertinjectExpires"
+)
+
+// reconcileCryptoAPI makes the certs in a CryptoAPI store that owner owns
+// match certs.
+func reconcileCryptoAPI(cfg *manifestCryptoAPI, owner string, certs []*manifestCert) error {
+	certStoreKey, err := openManifestStoreCryptoAPI(cfg)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	fingerprintHexUpperList, err := certStoreKey.ReadSubKeyNames(0)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't list certs in cert store: %w", err, ErrApply)
+	}
+
+	desired := map[string]bool{}
+
+	for _, cert := range certs {
+		fingerprintHexUpper := fingerprintHexUpperCryptoAPI(cert.der)
+		desired[fingerprintHexUpper] = true
+
+		recordChange := auditChangeCryptoAPI(auditInject, cert.requester, cert.der, certStoreKey, "", fingerprintHexUpper)
+
+		_, err = reconcileCertCryptoAPI(certStoreKey, fingerprintHexUpper, owner, cert)
+
+		recordChange()
+
+		if err != nil {
+			return fmt.Errorf("%s: cert %s: %w", err, cert.Path, ErrApply)
+		}
+	}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		if desired[fingerprintHexUpper] {
+			continue
+		}
+
+		err = removeOwnedCertCryptoAPI(certStoreKey, fingerprintHexUpper, owner, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureCertCryptoAPI adds a single manifest cert to a CryptoAPI store, or
+// fixes it.
+func ensureCertCryptoAPI(cfg *manifestCryptoAPI, owner string, cert *manifestCert) error {
+	certStoreKey, err := openManifestStoreCryptoAPI(cfg)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(cert.der)
+
+	defer auditChangeCryptoAPI(auditInject, cert.requester, cert.der, certStoreKey, "", fingerprintHexUpper)()
+
+	_, err = reconcileCertCryptoAPI(certStoreKey, fingerprintHexUpper, owner, cert)
+
+	return err
+}
+
+// removeCertCryptoAPI deletes a single manifest cert from a CryptoAPI store,
+// if owner owns it.
+func removeCertCryptoAPI(cfg *manifestCryptoAPI, owner string, cert *manifestCert) error {
+	certStoreKey, err := openManifestStoreCryptoAPI(cfg)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	return removeOwnedCertCryptoAPI(certStoreKey, fingerprintHexUpperCryptoAPI(cert.der), owner, cert.requester)
+}
+
+// cleanOwnedCryptoAPI removes the certs in a CryptoAPI store that owner owns
+// and whose ttl has passed, other than the held certs.
+func cleanOwnedCryptoAPI(cfg *manifestCryptoAPI, owner string, held []*manifestCert) error {
+	certStoreKey, err := openManifestStoreCryptoAPI(cfg)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	keep := map[string]bool{}
+	for _, cert := range held {
+		keep[fingerprintHexUpperCryptoAPI(cert.der)] = true
+	}
+
+	fingerprintHexUpperList, err := certStoreKey.ReadSubKeyNames(0)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't list certs in cert store: %w", err, ErrApply)
+	}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		if keep[fingerprintHexUpper] || !ownedCryptoAPI(certStoreKey, fingerprintHexUpper, owner) ||
+			!checkOwnedCertExpiredCryptoAPI(certStoreKey, fingerprintHexUpper) {
+			continue
+		}
+
+		if dryRun.Value() {
+			planf("%s: delete expired cert", fingerprintHexUpper)
+
+			continue
+		}
+
+		recordClean := auditChangeCryptoAPI(auditClean, "", nil, certStoreKey, "", fingerprintHexUpper)
+
+		err = registry.DeleteKey(certStoreKey, fingerprintHexUpper)
+
+		recordClean()
+
+		if err != nil {
+			return fmt.Errorf("%s: couldn't delete %s: %w", err, fingerprintHexUpper, ErrApply)
+		}
+
+		metricCleaned.inc(manifestStoreCryptoAPI)
+	}
+
+	return nil
+}
+
+func openManifestStoreCryptoAPI(cfg *manifestCryptoAPI) (registry.Key, error) {
+	store, err := cryptoAPINameToStore(cfg.PhysicalStore)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrApply)
+	}
+
+	access := uint32(registry.ALL_ACCESS)
+	if dryRun.Value() {
+		access = registry.READ
+	}
+
+	certStoreKey, err := registry.OpenKey(store.Base, store.keyForLogical(cfg.LogicalStore), access)
+	if err != nil {
+		return 0, fmt.Errorf("%s: couldn't open cert store: %w", err, ErrApply)
+	}
+
+	return certStoreKey, nil
+}
+
+func removeOwnedCertCryptoAPI(certStoreKey registry.Key, fingerprintHexUpper, owner, requester string) error {
+	if !ownedCryptoAPI(certStoreKey, fingerprintHexUpper, owner) {
+		return nil
+	}
+
+	defer auditChangeCryptoAPI(auditRemove, requester, nil, certStoreKey, "", fingerprintHexUpper)()
+
+	if dryRun.Value() {
+		planf("%s: delete owned cert", fingerprintHexUpper)
+
+		return nil
+	}
+
+	err := registry.DeleteKey(certStoreKey, fingerprintHexUpper)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't delete %s: %w", err, fingerprintHexUpper, ErrApply)
+	}
+
+	return nil
+}
+
+// fingerprintHexUpperCryptoAPI returns the uppercase SHA-1 fingerprint that
+// Windows CryptoAPI identifies certs by.
+func fingerprintHexUpperCryptoAPI(derBytes []byte) string {
+	fingerprint := sha1.Sum(derBytes) // #nosec G401
+
+	return strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+}
+
+// reconcileCertCryptoAPI writes a cert's blob, if it differs from the one in
+// the registry, and its magic tag, and returns whether it changed anything.
+// A manifest cert that this creates is marked as owned by owner, and gets an
+// expiry if it has a ttl; a cert that was already there keeps whatever owner
+// it had, since it may be one that Windows, someone else or another owner
+// added.  cert.der is nil if the cert is selected by fingerprint, in which
+// case it must already be there.  Certs carrying the skip magic tag are left
+// alone.
+func reconcileCertCryptoAPI(certStoreKey registry.Key, fingerprintHexUpper, owner string,
+	cert *manifestCert,
+) (bool, error) {
+	oldBlob := certblob.Blob{}
+
+	certKey, err := registry.OpenKey(certStoreKey, fingerprintHexUpper, registry.QUERY_VALUE)
+	existed := err == nil
+
+	if existed {
+		defer certKey.Close()
+
+		shouldSkip, _, err := certKey.GetIntegerValue(skipMagicName.Value())
+		if err == nil && shouldSkip == uint64(skipMagicData.Value()) {
+			if dryRun.Value() {
+				planf("%s: skip (has magic tag %s)", fingerprintHexUpper, skipMagicName.Value())
+			}
+
+			return false, nil
+		}
+
+		oldBlob, err = readBlobCryptoAPI(certKey, fingerprintHexUpper)
+		if err != nil && cert.der == nil {
+			return false, err
+		}
+
+		if err != nil {
+			log.Warnf("Replacing blob for %s: %s", fingerprintHexUpper, err)
+
+			oldBlob = certblob.Blob{}
+		}
+	}
+
+	if !existed && cert.der == nil {
+		return false, fmt.Errorf("%s isn't in the store: %w", fingerprintHexUpper, ErrGetInitialBlob)
+	}
+
+	newBlob, err := cert.cryptoAPIBlob(oldBlob)
+	if err != nil {
+		return false, err
+	}
+
+	err = checkPolicyBlobCryptoAPI(newBlob)
+	if err != nil {
+		return false, err
+	}
+
+	blobBytes, err := newBlob.Marshal()
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't marshal cert blob: %w", err, ErrInjectCerts)
+	}
+
+	magic := magicTag{}
+	if cert.MagicName != "" {
+		magic = magicTag{cert.MagicName, cert.magicData()}
+	}
+
+	var expires time.Time
+	if cert.ttl != 0 {
+		expires = time.Now().Add(cert.ttl)
+	}
+
+	owned := !cert.fromFlags && (!existed || ownedCryptoAPI(certStoreKey, fingerprintHexUpper, owner))
+
+	if dryRun.Value() {
+		planCertCryptoAPI(fingerprintHexUpper, certKey, existed, oldBlob, newBlob, magic)
+
+		if owned && !existed {
+			planf("%s: set %s=%s", fingerprintHexUpper, ownerValueName, owner)
+		}
+
+		if !cert.fromFlags && !owned {
+			planf("%s: already in the store, so leave its owner alone", fingerprintHexUpper)
+		}
+
+		if owned {
+			planExpiryCryptoAPI(fingerprintHexUpper, certKey, existed, expires)
+		}
+
+		return false, nil
+	}
+
+	// If the cert already existed, the "last modified" metadata won't
+	// update, which is what touchCertCryptoAPI is for.
+	certKey, openedExisting, err := registry.CreateKey(certStoreKey, fingerprintHexUpper, registry.ALL_ACCESS)
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't create registry key for certificate: %w", err, ErrInjectCerts)
+	}
+	defer certKey.Close()
+
+	changed, err := applyRegistryValues(certKey, blobBytes, magic)
+	if err != nil {
+		return changed, err
+	}
+
+	// Only a key that this call created is certinject's to remove later.
+	if owned && !openedExisting {
+		err = certKey.SetStringValue(ownerValueName, owner)
+		if err != nil {
+			return true, fmt.Errorf("%s: couldn't set owner: %w", err, ErrInjectCerts)
+		}
+
+		changed = true
+	}
+
+	if !owned {
+		return changed, nil
+	}
+
+	expiryChanged, err := applyExpiryCryptoAPI(certKey, expires)
+
+	return changed || expiryChanged, err
+}
+
+// applyExpiryCryptoAPI sets an owned cert's expiry, and returns whether it
+// changed anything.  An expiry that's already set is kept, so that applying
+// the manifest again doesn't push it back and the cert still expires a ttl
+// after it was added.  A zero expires removes it.
+func applyExpiryCryptoAPI(certKey registry.Key, expires time.Time) (bool, error) {
+	if expires.IsZero() {
+		err := certKey.DeleteValue(expiresValueName)
+		if errors.Is(err, registry.ErrNotExist) {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("%s: couldn't remove expiry: %w", err, ErrInjectCerts)
+		}
+
+		return true, nil
+	}
+
+	_, _, err := certKey.GetIntegerValue(expiresValueName)
+	if err == nil {
+		return false, nil
+	}
+
+	err = certKey.SetQWordValue(expiresValueName, uint64(expires.Unix()))
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't set expiry: %w", err, ErrInjectCerts)
+	}
+
+	return true, nil
+}
+
+// planExpiryCryptoAPI prints what applyExpiryCryptoAPI would do.  certKey is
+// only open if existed.
+func planExpiryCryptoAPI(fingerprintHexUpper string, certKey registry.Key, existed bool, expires time.Time) {
+	current := false
+
+	if existed {
+		_, _, err := certKey.GetIntegerValue(expiresValueName)
+		current = err == nil
+	}
+
+	switch {
+	case expires.IsZero() && current:
+		planf("%s: remove %s", fingerprintHexUpper, expiresValueName)
+	case !expires.IsZero() && current:
+		planf("%s: %s already set, so keep it", fingerprintHexUpper, expiresValueName)
+	case !expires.IsZero():
+		planf("%s: set %s to %s", fingerprintHexUpper, expiresValueName, expires.Format(time.RFC3339))
+	}
+}
+
+// ownedCryptoAPI returns whether owner owns a cert.
+func ownedCryptoAPI(certStoreKey registry.Key, fingerprintHexUpper, owner string) bool {
+	return owner != "" && ownerCryptoAPI(certStoreKey, fingerprintHexUpper) == owner
+}
+
+// ownerCryptoAPI returns the owner of a cert, or "" if it has none.
+func ownerCryptoAPI(certStoreKey registry.Key, fingerprintHexUpper string) string {
+	certKey, err := registry.OpenKey(certStoreKey, fingerprintHexUpper, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer certKey.Close()
+
+	owner, _, err := certKey.GetStringValue(ownerValueName)
+	if err != nil {
+		return ""
+	}
+
+	return owner
+}
+
+// checkOwnedCertExpiredCryptoAPI returns whether the ttl of a cert that any
+// owner owns has passed.  Certs without an expiry never expire this way.
+func checkOwnedCertExpiredCryptoAPI(certStoreKey registry.Key, fingerprintHexUpper string) bool {
+	if ownerCryptoAPI(certStoreKey, fingerprintHexUpper) == "" {
+		return false
+	}
+
+	certKey, err := registry.OpenKey(certStoreKey, fingerprintHexUpper, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer certKey.Close()
+
+	expires, _, err := certKey.GetIntegerValue(expiresValueName)
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > int64(expires)
+}
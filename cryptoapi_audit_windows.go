@@ -0,0 +1,58 @@
+package certinject
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// auditChangeCryptoAPI is auditChange for a cert's registry key, whose
+// state is all of its values.  storeKey is the store's path under
+// registryBase, or empty if registryBase is the store itself.  derBytes may
+// be nil if the cert was selected by fingerprint.
+func auditChangeCryptoAPI(operation, requester string, derBytes []byte, registryBase registry.Key, storeKey,
+	fingerprintHexUpper string,
+) func() {
+	path := fingerprintHexUpper
+	if storeKey != "" {
+		path = storeKey + `\` + fingerprintHexUpper
+	}
+
+	fingerprints := auditFingerprintsCryptoAPI(derBytes, fingerprintHexUpper)
+
+	return auditChange(operation, requester, manifestStoreCryptoAPI, fingerprints,
+		func() []byte {
+			values, err := backupRegistryKey(registryBase, path)
+			if err != nil {
+				return nil
+			}
+
+			return registryValuesState(values)
+		})
+}
+
+// auditFingerprintsCryptoAPI returns the fingerprints of a cert, or only
+// the SHA-1 one that CryptoAPI names it by if derBytes is nil.
+func auditFingerprintsCryptoAPI(derBytes []byte, fingerprintHexUpper string) map[string]string {
+	if derBytes == nil {
+		return map[string]string{"sha1": strings.ToLower(fingerprintHexUpper)}
+	}
+
+	return auditFingerprints(derBytes)
+}
+
+// registryValuesState returns a registry key's values in a stable form, for
+// the audit log.
+func registryValuesState(values []registryValueBackup) []byte {
+	sorted := append([]registryValueBackup{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	data, err := json.Marshal(sorted)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
@@ -0,0 +1,266 @@
+package certinject
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+var ErrRegistryValueType = fmt.Errorf("unsupported registry value type: %w", ErrRestore)
+
+func backupCryptoAPI() (*cryptoAPIBackup, error) {
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrBackup)
+	}
+
+	return backupCryptoAPIStore(store, cryptoAPIFlagPhysicalStoreName.Value(),
+		cryptoAPIFlagLogicalStoreName.Value())
+}
+
+func restoreCryptoAPI(backup *cryptoAPIBackup) error {
+	// Registry key names aren't case-sensitive.
+	if !strings.EqualFold(backup.PhysicalStore, cryptoAPIFlagPhysicalStoreName.Value()) ||
+		!strings.EqualFold(backup.LogicalStore, cryptoAPIFlagLogicalStoreName.Value()) {
+		return fmt.Errorf("archive has %s\\%s, but %s\\%s is configured: %w", backup.PhysicalStore,
+			backup.LogicalStore, cryptoAPIFlagPhysicalStoreName.Value(), cryptoAPIFlagLogicalStoreName.Value(),
+			ErrArchiveStore)
+	}
+
+	store, err := cryptoAPINameToStore(backup.PhysicalStore)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrRestore)
+	}
+
+	return restoreCryptoAPIStore(store, backup)
+}
+
+// backupCryptoAPIStore saves every cert subkey in a store.  It takes the
+// Store directly so that tests can point it at a scratch registry key.
+func backupCryptoAPIStore(store Store, physical, logical string) (*cryptoAPIBackup, error) {
+	storeKey := store.keyForLogical(logical)
+
+	fingerprintHexUpperList, err := allFingerprintsInStore(store.Base, storeKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrBackup)
+	}
+
+	result := &cryptoAPIBackup{
+		PhysicalStore: physical,
+		LogicalStore:  logical,
+		Certs:         []registryKeyBackup{},
+	}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		values, err := backupRegistryKey(store.Base, storeKey+`\`+fingerprintHexUpper)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Certs = append(result.Certs, registryKeyBackup{Name: fingerprintHexUpper, Values: values})
+	}
+
+	return result, nil
+}
+
+func backupRegistryKey(registryBase registry.Key, path string) ([]registryValueBackup, error) {
+	certKey, err := registry.OpenKey(registryBase, path, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't open %s: %w", err, path, ErrBackup)
+	}
+	defer certKey.Close()
+
+	names, err := certKey.ReadValueNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't list values of %s: %w", err, path, ErrBackup)
+	}
+
+	result := []registryValueBackup{}
+
+	for _, name := range names {
+		size, valueType, err := certKey.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't read %s of %s: %w", err, name, path, ErrBackup)
+		}
+
+		data := make([]byte, size)
+
+		if size != 0 {
+			_, _, err = certKey.GetValue(name, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: couldn't read %s of %s: %w", err, name, path, ErrBackup)
+			}
+		}
+
+		result = append(result, registryValueBackup{Name: name, Type: valueType, Data: data})
+	}
+
+	return result, nil
+}
+
+// restoreCryptoAPIStore makes the cert subkeys in a store identical to the
+// backup.  The subkeys' last-modified times can't be restored, so expirable
+// certs restart their expiry period.
+func restoreCryptoAPIStore(store Store, backup *cryptoAPIBackup) error {
+	storeKey := store.keyForLogical(backup.LogicalStore)
+
+	fingerprintHexUpperList, err := allFingerprintsInStore(store.Base, storeKey)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrRestore)
+	}
+
+	archived := map[string]bool{}
+
+	for _, cert := range backup.Certs {
+		if cert.Name == "" || strings.Contains(cert.Name, `\`) {
+			return fmt.Errorf("invalid cert key name %q: %w", cert.Name, ErrRestore)
+		}
+
+		archived[cert.Name] = true
+	}
+
+	certStoreKey, err := registry.OpenKey(store.Base, storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't open cert store: %w", err, ErrRestore)
+	}
+	defer certStoreKey.Close()
+
+	names := map[string]bool{}
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		names[fingerprintHexUpper] = true
+	}
+
+	for name := range archived {
+		names[name] = true
+	}
+
+	defer auditRestoreEach(names, func(name string) func() {
+		return auditChangeCryptoAPI(auditRestore, "", nil, certStoreKey, "", name)
+	})()
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		if archived[fingerprintHexUpper] {
+			continue
+		}
+
+		if dryRun.Value() {
+			planf("%s: delete cert added since backup", fingerprintHexUpper)
+
+			continue
+		}
+
+		err = registry.DeleteKey(certStoreKey, fingerprintHexUpper)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't delete %s: %w", err, fingerprintHexUpper, ErrRestore)
+		}
+	}
+
+	for _, cert := range backup.Certs {
+		err = restoreRegistryKey(certStoreKey, cert)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func restoreRegistryKey(certStoreKey registry.Key, cert registryKeyBackup) error {
+	if dryRun.Value() {
+		planf("%s: restore %d registry values", cert.Name, len(cert.Values))
+
+		return nil
+	}
+
+	certKey, _, err := registry.CreateKey(certStoreKey, cert.Name, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't create %s: %w", err, cert.Name, ErrRestore)
+	}
+	defer certKey.Close()
+
+	names, err := certKey.ReadValueNames(0)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't list values of %s: %w", err, cert.Name, ErrRestore)
+	}
+
+	archived := map[string]bool{}
+	for _, value := range cert.Values {
+		archived[value.Name] = true
+	}
+
+	for _, name := range names {
+		if archived[name] {
+			continue
+		}
+
+		err = certKey.DeleteValue(name)
+		if err != nil && !errors.Is(err, registry.ErrNotExist) {
+			return fmt.Errorf("%s: couldn't delete %s of %s: %w", err, name, cert.Name, ErrRestore)
+		}
+	}
+
+	for _, value := range cert.Values {
+		err = setRawRegistryValue(certKey, value)
+		if err != nil {
+			return fmt.Errorf("%s of %s: %w", value.Name, cert.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// setRawRegistryValue writes a value saved by backupRegistryKey.  The
+// registry package doesn't expose a raw setter, so each type that CryptoAPI
+// stores use is decoded and written with its typed setter.
+func setRawRegistryValue(key registry.Key, value registryValueBackup) error {
+	var err error
+
+	switch value.Type {
+	case registry.BINARY:
+		err = key.SetBinaryValue(value.Name, value.Data)
+	case registry.DWORD:
+		if len(value.Data) != 4 {
+			return fmt.Errorf("DWORD of %d bytes: %w", len(value.Data), ErrRestore)
+		}
+
+		err = key.SetDWordValue(value.Name, binary.LittleEndian.Uint32(value.Data))
+	case registry.QWORD:
+		if len(value.Data) != 8 {
+			return fmt.Errorf("QWORD of %d bytes: %w", len(value.Data), ErrRestore)
+		}
+
+		err = key.SetQWordValue(value.Name, binary.LittleEndian.Uint64(value.Data))
+	case registry.SZ:
+		err = key.SetStringValue(value.Name, strings.TrimRight(decodeRegistryString(value.Data), "\x00"))
+	case registry.EXPAND_SZ:
+		err = key.SetExpandStringValue(value.Name, strings.TrimRight(decodeRegistryString(value.Data), "\x00"))
+	case registry.MULTI_SZ:
+		strs := strings.Split(strings.TrimRight(decodeRegistryString(value.Data), "\x00"), "\x00")
+		if len(strs) == 1 && strs[0] == "" {
+			strs = []string{}
+		}
+
+		err = key.SetStringsValue(value.Name, strs)
+	default:
+		return fmt.Errorf("%d: %w", value.Type, ErrRegistryValueType)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: couldn't write value: %w", err, ErrRestore)
+	}
+
+	return nil
+}
+
+func decodeRegistryString(data []byte) string {
+	codeUnits := make([]uint16, len(data)/2)
+	for i := range codeUnits {
+		codeUnits[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+
+	return string(utf16.Decode(codeUnits))
+}
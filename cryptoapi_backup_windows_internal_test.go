@@ -0,0 +1,80 @@
+//go:build windows
+// +build windows
+
+package certinject
+
+import (
+	"testing"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// testBackupStore is a scratch store in HKCU, so that the test doesn't need
+// admin rights or touch a real trust store.
+var testBackupStore = Store{registry.CURRENT_USER, `SOFTWARE\Namecoin\CertinjectTest`, `%s\Certificates`}
+
+func TestBackupRestoreCryptoAPI(t *testing.T) {
+	storeKey := testBackupStore.keyForLogical("Root")
+
+	certKey, _, err := registry.CreateKey(registry.CURRENT_USER, storeKey+`\KEPT`, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create test cert: %s", err)
+	}
+
+	defer func() {
+		_ = registry.DeleteKey(registry.CURRENT_USER, storeKey+`\KEPT`)
+		_ = registry.DeleteKey(registry.CURRENT_USER, storeKey+`\ADDED`)
+		_ = registry.DeleteKey(registry.CURRENT_USER, storeKey)
+		_ = registry.DeleteKey(registry.CURRENT_USER, `SOFTWARE\Namecoin\CertinjectTest\Root`)
+		_ = registry.DeleteKey(registry.CURRENT_USER, `SOFTWARE\Namecoin\CertinjectTest`)
+	}()
+
+	_ = certKey.SetBinaryValue("Blob", []byte{1, 2, 3})
+	_ = certKey.SetDWordValue("Magic", 1)
+	_ = certKey.SetStringsValue(constrainMarkerValueName, []string{".bit"})
+	certKey.Close()
+
+	backup, err := backupCryptoAPIStore(testBackupStore, "test", "Root")
+	if err != nil {
+		t.Fatalf("couldn't back up: %s", err)
+	}
+
+	// Change the store the way an injection would.
+	certKey, _ = registry.OpenKey(registry.CURRENT_USER, storeKey+`\KEPT`, registry.ALL_ACCESS)
+	_ = certKey.SetBinaryValue("Blob", []byte{4, 5, 6})
+	_ = certKey.DeleteValue("Magic")
+	_ = certKey.SetDWordValue("OtherMagic", 2)
+	certKey.Close()
+
+	addedKey, _, _ := registry.CreateKey(registry.CURRENT_USER, storeKey+`\ADDED`, registry.ALL_ACCESS)
+	addedKey.Close()
+
+	err = restoreCryptoAPIStore(testBackupStore, backup)
+	if err != nil {
+		t.Fatalf("couldn't restore: %s", err)
+	}
+
+	restored, err := backupCryptoAPIStore(testBackupStore, "test", "Root")
+	if err != nil {
+		t.Fatalf("couldn't back up restored store: %s", err)
+	}
+
+	if len(restored.Certs) != 1 || restored.Certs[0].Name != "KEPT" {
+		t.Fatalf("expected only KEPT after restore, got %+v", restored.Certs)
+	}
+
+	expected := map[string]registryValueBackup{}
+	for _, value := range backup.Certs[0].Values {
+		expected[value.Name] = value
+	}
+
+	if len(restored.Certs[0].Values) != len(expected) {
+		t.Errorf("expected %d values, got %+v", len(expected), restored.Certs[0].Values)
+	}
+
+	for _, value := range restored.Certs[0].Values {
+		if want, ok := expected[value.Name]; !ok || want.Type != value.Type || string(want.Data) != string(value.Data) {
+			t.Errorf("value %s not restored exactly: %+v", value.Name, value)
+		}
+	}
+}
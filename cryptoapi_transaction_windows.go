@@ -0,0 +1,125 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// cryptoAPITransactionStep injects into the configured CryptoAPI store once.
+// Since the operations can select any number of certs (e.g. all-certs or
+// constrain-all-roots), the injection snapshots each cert just before
+// writing it, and the undo step puts back only the certs that it wrote.
+// Certs that something else changes in the meantime are left alone.
+func cryptoAPITransactionStep(derBytes []byte, expirable bool) (transactionStep, error) {
+	if watch.Value() {
+		return transactionStep{}, fmt.Errorf("can't watch the CryptoAPI store in a transaction: %w", ErrTransaction)
+	}
+
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return transactionStep{}, fmt.Errorf("%s: %w", err, ErrTransaction)
+	}
+
+	storeKey := store.keyForLogical(cryptoAPIFlagLogicalStoreName.Value())
+	undo := &cryptoAPIUndo{}
+
+	return transactionStep{
+		store: manifestStoreCryptoAPI,
+		prepare: func() (func() error, error) {
+			return func() error { return undo.rollback(store.Base, storeKey) }, nil
+		},
+		inject: func() error {
+			_, err := injectCertOnceCryptoAPI(derBytes, store.Base, storeKey, injectMagicTag(expirable),
+				auditInject, undo)
+
+			return err
+		},
+	}, nil
+}
+
+// cryptoAPIUndo records how each cert that a transaction step wrote was
+// before it did.  A nil *cryptoAPIUndo records nothing.
+type cryptoAPIUndo struct {
+	certs []cryptoAPIUndoCert
+}
+
+type cryptoAPIUndoCert struct {
+	registryKeyBackup
+
+	existed bool
+}
+
+// track snapshots a cert that's about to be written.  The returned func
+// records the snapshot, if the write changed anything or failed partway.
+func (u *cryptoAPIUndo) track(registryBase registry.Key, storeKey,
+	fingerprintHexUpper string,
+) (func(wrote bool, err error), error) {
+	if u == nil {
+		return func(bool, error) {}, nil
+	}
+
+	cert := cryptoAPIUndoCert{registryKeyBackup: registryKeyBackup{Name: fingerprintHexUpper}}
+
+	certKey, err := registry.OpenKey(registryBase, storeKey+`\`+fingerprintHexUpper, registry.QUERY_VALUE)
+	if err == nil {
+		certKey.Close()
+
+		cert.existed = true
+
+		cert.Values, err = backupRegistryKey(registryBase, storeKey+`\`+fingerprintHexUpper)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrInjectCerts)
+		}
+	} else if !errors.Is(err, registry.ErrNotExist) {
+		return nil, fmt.Errorf("%s: couldn't open %s: %w", err, fingerprintHexUpper, ErrInjectCerts)
+	}
+
+	return func(wrote bool, err error) {
+		if wrote || err != nil {
+			u.certs = append(u.certs, cert)
+		}
+	}, nil
+}
+
+// rollback puts each cert that was written back the way it was, in reverse
+// order, deleting the ones that the step added.
+func (u *cryptoAPIUndo) rollback(registryBase registry.Key, storeKey string) error {
+	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't open cert store: %w", err, ErrRollback)
+	}
+	defer certStoreKey.Close()
+
+	for i := len(u.certs) - 1; i >= 0; i-- {
+		cert := u.certs[i]
+
+		if dryRun.Value() && !cert.existed {
+			planf("%s: delete cert added by the injection", cert.Name)
+
+			continue
+		}
+
+		recordRollback := auditChangeCryptoAPI(auditRollback, "", nil, certStoreKey, "", cert.Name)
+
+		if cert.existed {
+			err = restoreRegistryKey(certStoreKey, cert.registryKeyBackup)
+		} else {
+			err = registry.DeleteKey(certStoreKey, cert.Name)
+			if errors.Is(err, registry.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		recordRollback()
+
+		if err != nil {
+			return fmt.Errorf("%s: couldn't roll back %s: %w", err, cert.Name, ErrRollback)
+		}
+	}
+
+	u.certs = nil
+
+	return nil
+}
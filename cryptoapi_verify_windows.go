@@ -0,0 +1,98 @@
+package certinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// verifyCertCryptoAPI reads an injected cert's blob back from the registry,
+// and checks that it holds the cert, with the properties that
+// reconcileCertCryptoAPI would give it, and the magic tag.
+func verifyCertCryptoAPI(derBytes []byte) error {
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrVerify)
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	certKey, err := registry.OpenKey(store.Base, store.Key()+`\`+fingerprintHexUpper, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return fmt.Errorf("%s isn't in the %s store: %w", fingerprintHexUpper, store, ErrNotTrusted)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: couldn't open cert: %w", err, ErrVerify)
+	}
+	defer certKey.Close()
+
+	// Injection leaves these alone, so whatever they hold is intended.
+	shouldSkip, _, err := certKey.GetIntegerValue(skipMagicName.Value())
+	if err == nil && shouldSkip == uint64(skipMagicData.Value()) {
+		log.Infof("%s has magic tag %s, so inject leaves it alone", fingerprintHexUpper, skipMagicName.Value())
+
+		return nil
+	}
+
+	blobBytes, _, err := certKey.GetBinaryValue("Blob")
+	if err != nil {
+		return fmt.Errorf("%s: couldn't read blob: %w", err, ErrNotTrusted)
+	}
+
+	blob, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't parse blob: %w", err, ErrNotTrusted)
+	}
+
+	if !bytes.Equal(blob[certblob.CertContentCertPropID], derBytes) {
+		return fmt.Errorf("%s: blob holds a different cert: %w", fingerprintHexUpper, ErrNotTrusted)
+	}
+
+	// Editing the stored blob again changes nothing if the edits took.
+	expected, err := injectionCertCryptoAPI(derBytes, magicTag{}).cryptoAPIBlob(blob)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrVerify)
+	}
+
+	changes := certblob.Diff(blob, expected)
+	if len(changes) != 0 {
+		described := make([]string, 0, len(changes))
+		for _, change := range changes {
+			described = append(described, change.String())
+		}
+
+		return fmt.Errorf("%s: blob still needs: %s: %w", fingerprintHexUpper, strings.Join(described, "; "),
+			ErrNotTrusted)
+	}
+
+	return verifyMagicCryptoAPI(certKey, fingerprintHexUpper)
+}
+
+// verifyMagicCryptoAPI checks that a cert has the magic tag that injection
+// sets, or the expirable one, which InjectExpirableCert sets instead.
+func verifyMagicCryptoAPI(certKey registry.Key, fingerprintHexUpper string) error {
+	magic := injectMagicTag(false)
+	if magic.name == "" {
+		return nil
+	}
+
+	for _, tag := range []magicTag{magic, injectMagicTag(true)} {
+		if tag.name == "" {
+			continue
+		}
+
+		data, _, err := certKey.GetIntegerValue(tag.name)
+		if err == nil && data == uint64(tag.data) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s doesn't have magic tag %s=%d: %w", fingerprintHexUpper, magic.name, magic.data,
+		ErrNotTrusted)
+}
@@ -0,0 +1,174 @@
+package certinject
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/regwait"
+)
+
+// registryNotifier reports changes to a registry key and its subkeys, using
+// an event that RegNotifyChangeKeyValue signals.
+type registryNotifier struct {
+	name  string
+	key   registry.Key
+	event windows.Handle
+}
+
+// newRegistryNotifier starts watching a registry key.  Changes made from
+// now on are reported, even ones made before the first Wait.
+func newRegistryNotifier(base registry.Key, path string) (*registryNotifier, error) {
+	key, err := registry.OpenKey(base, path, registry.NOTIFY)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't open cert store: %w", err, ErrWatch)
+	}
+
+	// Auto-reset, so that each signal is consumed by one Wait.
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		key.Close()
+
+		return nil, fmt.Errorf("%s: couldn't create event: %w", err, ErrWatch)
+	}
+
+	n := &registryNotifier{name: path, key: key, event: event}
+
+	err = n.arm()
+	if err != nil {
+		n.Close()
+
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *registryNotifier) arm() error {
+	err := regwait.NotifyChange(n.key, true, regwait.Subkey|regwait.Value, n.event)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't watch cert store: %w", err, ErrWatch)
+	}
+
+	return nil
+}
+
+func (n *registryNotifier) Wait(ctx context.Context) (string, error) {
+	// A second event lets ctx interrupt WaitForMultipleObjects.
+	cancelEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s: couldn't create event: %w", err, ErrWatch)
+	}
+	defer windows.CloseHandle(cancelEvent)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = windows.SetEvent(cancelEvent)
+		case <-done:
+		}
+	}()
+
+	signaled, err := windows.WaitForMultipleObjects([]windows.Handle{n.event, cancelEvent}, false, windows.INFINITE)
+	if err != nil {
+		return "", fmt.Errorf("%s: couldn't wait for cert store change: %w", err, ErrWatch)
+	}
+
+	if signaled != windows.WAIT_OBJECT_0 {
+		return "", ctx.Err()
+	}
+
+	// The notification is used up, so ask for the next one before
+	// returning.  Changes made in between are seen by whatever the caller
+	// does next, since it runs after this.
+	err = n.arm()
+	if err != nil {
+		return "", err
+	}
+
+	return n.name, nil
+}
+
+func (n *registryNotifier) Close() error {
+	err := windows.CloseHandle(n.event)
+	n.key.Close()
+
+	return err
+}
+
+// watchCertCryptoAPI injects a cert into a CryptoAPI store, and again
+// whenever the store changes, until ctx is done.  Values that are already
+// right are left alone, so its own writes only cause one extra check.
+func watchCertCryptoAPI(ctx context.Context, derBytes []byte, registryBase registry.Key, storeKey string,
+	magic magicTag,
+) error {
+	// The first injection isn't a repair.
+	operation := auditInject
+
+	apply := func() (bool, error) {
+		defer func() { operation = auditRepair }()
+
+		return injectCertOnceCryptoAPI(derBytes, registryBase, storeKey, magic, operation, nil)
+	}
+
+	// A dry run only prints the plan once, since it doesn't change
+	// anything that a later check would need to fix up.
+	if dryRun.Value() {
+		_, err := apply()
+
+		return err
+	}
+
+	// Start watching before the first injection, so that a change made
+	// while it runs isn't missed.
+	n, err := newRegistryNotifier(registryBase, storeKey)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+
+	_, err = apply()
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+
+	log.Info("Waiting for registry change...")
+
+	return watchLoop(ctx, n, time.Duration(watchDebounce.Value())*time.Millisecond, apply)
+}
+
+// WatchCert injects the given cert into the configured CryptoAPI store, and
+// injects it again whenever the store changes, e.g. because something
+// removed or edited it, until ctx is done.  This is the same as the watch
+// flag, except that it can be stopped.  The NSS store, if configured, is
+// only injected into once.
+func WatchCert(ctx context.Context, derBytes []byte) error {
+	err := checkInjection(derBytes)
+	if err != nil {
+		return err
+	}
+
+	if nssFlag.Value() {
+		err = injectCertNSS(derBytes)
+		if err != nil {
+			log.Errorf("Error injecting cert to NSS: %s", err)
+		}
+	}
+
+	if !cryptoAPIFlag.Value() {
+		return fmt.Errorf("no trust store to watch (consider cryptoapi): %w", ErrWatch)
+	}
+
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrWatch)
+	}
+
+	return watchCertCryptoAPI(ctx, derBytes, store.Base, store.Key(), injectMagicTag(false))
+}
@@ -1,14 +1,16 @@
 package certinject
 
 import (
+	"bytes"
+	"context"
 	// #nosec G505
 	"crypto/sha1"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
-	"net"
 	"strings"
 	"time"
 
@@ -16,7 +18,7 @@ import (
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 
 	"github.com/namecoin/certinject/certblob"
-	"github.com/namecoin/certinject/regwait"
+	"github.com/namecoin/certinject/x509ext"
 )
 
 var (
@@ -58,23 +60,45 @@ var (
 		"Microsoft commercial code signing")
 	ekuMSCodeKernel = cflag.Bool(ekuFlagGroup, "ms-code-kernel", false,
 		"Microsoft kernel-mode code signing")
+	ekuCustom = cflag.String(ekuFlagGroup, "custom", "",
+		"Custom purpose OID's (comma-separated, e.g. 1.3.6.1.4.1.311.10.3.12 "+
+			"for document signing)")
+	mergeMode = cflag.String(cryptoAPIFlagGroup, "merge", "replace",
+		"How to combine requested EKU and name constraints with ones the "+
+			"certificate already has. Valid choices: replace, intersect, union")
 	nameConstraintsFlagGroup    = cflag.NewGroup(cryptoAPIFlagGroup, "nc")
 	nameConstraintsPermittedDNS = cflag.String(nameConstraintsFlagGroup,
-		"permitted-dns", "", "Permitted DNS domain")
+		"permitted-dns", "", "Permitted DNS domains (comma-separated)")
 	nameConstraintsExcludedDNS = cflag.String(nameConstraintsFlagGroup,
-		"excluded-dns", "", "Excluded DNS domain")
+		"excluded-dns", "", "Excluded DNS domains (comma-separated)")
 	nameConstraintsPermittedIP = cflag.String(nameConstraintsFlagGroup,
-		"permitted-ip", "", "Permitted IP range")
+		"permitted-ip", "", "Permitted IP ranges (comma-separated CIDR)")
 	nameConstraintsExcludedIP = cflag.String(nameConstraintsFlagGroup,
-		"excluded-ip", "", "Excluded IP range")
+		"excluded-ip", "", "Excluded IP ranges (comma-separated CIDR)")
 	nameConstraintsPermittedEmail = cflag.String(nameConstraintsFlagGroup,
-		"permitted-email", "", "Permitted email address")
+		"permitted-email", "", "Permitted email addresses (comma-separated)")
 	nameConstraintsExcludedEmail = cflag.String(nameConstraintsFlagGroup,
-		"excluded-email", "", "Excluded email address")
+		"excluded-email", "", "Excluded email addresses (comma-separated)")
 	nameConstraintsPermittedURI = cflag.String(nameConstraintsFlagGroup,
-		"permitted-uri", "", "Permitted URI domain")
+		"permitted-uri", "", "Permitted URI domains (comma-separated)")
 	nameConstraintsExcludedURI = cflag.String(nameConstraintsFlagGroup,
-		"excluded-uri", "", "Excluded URI domain")
+		"excluded-uri", "", "Excluded URI domains (comma-separated)")
+	nameConstraintsPolicyFile = cflag.String(nameConstraintsFlagGroup,
+		"policy-file", "", "TOML file listing permitted-dns, excluded-ip, etc. "+
+			"as arrays; combined with the other nc flags")
+	rootProgramCertPolicies = cflag.String(cryptoAPIFlagGroup, "cert-policies", "",
+		"Only trust this certificate for these certificate policy OID's "+
+			"(comma-separated, e.g. 2.23.140.1.2.1)")
+	disallowedAfter = cflag.String(cryptoAPIFlagGroup, "disallowed-after", "",
+		"Distrust certificates issued by this certificate after this date "+
+			"(RFC 3339 timestamp or YYYY-MM-DD)")
+	friendlyName = cflag.String(cryptoAPIFlagGroup, "friendly-name", "",
+		"Set the friendly name shown by certmgr.msc")
+	certDescription = cflag.String(cryptoAPIFlagGroup, "description", "",
+		"Set the description shown by certmgr.msc")
+	derivedProperties = cflag.Bool(cryptoAPIFlagGroup, "derived-properties", false,
+		"Add the hash and key identifier properties that CryptoAPI derives "+
+			"from the certificate, so that the entry matches one added by certutil")
 	setMagicName = cflag.String(cryptoAPIFlagGroup, "set-magic-name", "",
 		"Set a magic tag with this name")
 	setMagicData = cflag.Int(cryptoAPIFlagGroup, "set-magic-data", 1,
@@ -128,7 +152,13 @@ func (s Store) String() string {
 
 // Key generates the registry key for use in opening the store.
 func (s Store) Key() string {
-	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, cryptoAPIFlagLogicalStoreName.Value())
+	return s.keyForLogical(cryptoAPIFlagLogicalStoreName.Value())
+}
+
+// keyForLogical is like Key, but for a logical store other than the one in
+// the -logical-store flag.
+func (s Store) keyForLogical(logical string) string {
+	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, logical)
 }
 
 // cryptoAPINameToStore returns a Store for the specified name.  Returns an
@@ -158,39 +188,72 @@ func allFingerprintsInStore(registryBase registry.Key, storeKey string) ([]strin
 	return fingerprintHexUpperList, nil
 }
 
-func readInputBlob(derBytes []byte, registryBase registry.Key, path string) (certblob.Blob, error) {
-	if cryptoAPIFlagReset.Value() && derBytes != nil {
-		// We already know the cert preimage, and we're excluding any
-		// properties, so no need to check the registry.
-		return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+// existingCertsCryptoAPI returns the certs in the configured CryptoAPI
+// store, skipping any whose blob can't be read.
+func existingCertsCryptoAPI() [][]byte {
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return nil
 	}
 
-	// We need to look up either the cert preimage or the properties via
-	// the registry.
+	fingerprintHexUpperList, err := allFingerprintsInStore(store.Base, store.Key())
+	if err != nil {
+		log.Warnf("Couldn't list CryptoAPI certs for lint: %s", err)
 
-	// Open up the cert key.
-	certKey, err := registry.OpenKey(registryBase, path, registry.QUERY_VALUE)
-	if err != nil && derBytes != nil {
-		// We can't read the blob, but we do already know the cert
-		// preimage, so create a default blob based on that preimage.
-		return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+		return nil
 	}
-	defer certKey.Close()
 
-	inputBlobBytes, _, err := certKey.GetBinaryValue("Blob")
+	result := [][]byte{}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		certKey, err := registry.OpenKey(store.Base, store.Key()+`\`+fingerprintHexUpper, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+
+		blobBytes, _, err := certKey.GetBinaryValue("Blob")
+		certKey.Close()
+
+		if err != nil {
+			continue
+		}
+
+		blob, err := certblob.ParseBlob(blobBytes)
+		if err != nil || blob[certblob.CertContentCertPropID] == nil {
+			continue
+		}
+
+		result = append(result, blob[certblob.CertContentCertPropID])
+	}
+
+	return result
+}
+
+// readBlobCryptoAPI reads and parses a cert's blob.  Properties that don't
+// parse are kept as they are, with a warning.
+func readBlobCryptoAPI(certKey registry.Key, fingerprintHexUpper string) (certblob.Blob, error) {
+	blobBytes, _, err := certKey.GetBinaryValue("Blob")
 	if err != nil {
 		return nil, fmt.Errorf("%s: couldn't read blob value: %w", err, ErrGetInitialBlob)
 	}
 
-	blob, err := certblob.ParseBlob(inputBlobBytes)
+	blob, warnings, err := certblob.ParseBlobMode(blobBytes, certblob.ParseLenient)
 	if err != nil {
 		return nil, fmt.Errorf("%s: couldn't parse blob: %w", err, ErrGetInitialBlob)
 	}
 
+	for _, warning := range warnings {
+		log.Warnf("Blob for %s: %s", fingerprintHexUpper, warning)
+	}
+
 	return blob, nil
 }
 
-func injectCertCryptoAPI(derBytes []byte) {
+// injectCertCryptoAPI injects a cert into the CryptoAPI store.  If expirable
+// is set, it's tagged with the expirable magic tag instead of the set magic
+// tag, so that CleanCerts removes it once it's too old.  In watch mode, it
+// keeps injecting it whenever the store changes, and never returns.
+func injectCertCryptoAPI(derBytes []byte, expirable bool) {
 	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
 	if err != nil {
 		log.Errorf("error: %s", err.Error())
@@ -198,68 +261,37 @@ func injectCertCryptoAPI(derBytes []byte) {
 		return
 	}
 
-	registryBase := store.Base
-	storeKey := store.Key()
-
-	var storeNotifyKey registry.Key
-
 	if watch.Value() {
-		// Open up the cert store.
-		storeNotifyKey, err = registry.OpenKey(registryBase, storeKey, registry.NOTIFY)
+		err = watchCertCryptoAPI(context.Background(), derBytes, store.Base, store.Key(), injectMagicTag(expirable))
 		if err != nil {
-			log.Errorf("%s: couldn't open cert store: %w", err, ErrEnumerateCerts)
-
-			return
-		}
-		defer storeNotifyKey.Close()
-	}
-
-	injectCertLoopCryptoAPI(derBytes, registryBase, storeKey, storeNotifyKey)
-}
-
-func injectCertLoopCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string, storeNotifyKey registry.Key) {
-	ready := false
-
-	for {
-		injectCertOnceCryptoAPI(derBytes, registryBase, storeKey)
-
-		if !watch.Value() {
-			break
+			log.Errorf("%s", err)
 		}
 
-		// As per Windows API docs, the first call to RegNotifyChangeKeyValue
-		// behaves differently from subsequent calls.  The first call waits for
-		// an event that occurred after the call was made; all subsequent calls
-		// wait for an event that occurred after the previous reported event.
-		// The first call does NOT report events that occurred between the
-		// opening of the key and the first call, which is what would be sane.
-		// Thus, we have a race condition, where if an event happens between
-		// opening the key and the first call, that event will be dropped.
-		// Thus, as a stupid workaround, we set up a goroutine to reapply any
-		// requested cert store operations ~3 seconds after the first call, so
-		// that if the race condition was hit, it will be automatically fixed
-		// after ~3 seconds.  I know this is stupid.  Blame Microsoft, not me.
-		if !ready {
-			go func() {
-				time.Sleep(3 * time.Second)
-				injectCertOnceCryptoAPI(derBytes, registryBase, storeKey)
-
-				log.Info("Registry is ready")
-
-				ready = true
-			}()
-		}
+		return
+	}
 
-		log.Info("Waiting for registry change...")
+	err = observeInjection(manifestStoreCryptoAPI, func() error {
+		_, err := injectCertOnceCryptoAPI(derBytes, store.Base, store.Key(), injectMagicTag(expirable), auditInject,
+			nil)
 
-		err := regwait.WaitChange(storeNotifyKey, true, regwait.Subkey|regwait.Value)
-		if err != nil {
-			log.Errorf("%s: couldn't watch cert store", err)
-		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("%s", err)
 	}
 }
 
-func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string) {
+// injectCertOnceCryptoAPI applies the requested operations to each selected
+// cert, and returns whether it changed anything.  When there are several,
+// a failure doesn't stop the others from being attempted.  Changes are
+// recorded in the audit log as operation, and in undo, if it isn't nil.
+func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string,
+	magic magicTag, operation string, undo *cryptoAPIUndo,
+) (bool, error) {
+	if constrainAllRoots.Value() != "" || unconstrainAllRoots.Value() != "" {
+		return constrainAllRootsOnceCryptoAPI(registryBase, storeKey, operation, undo)
+	}
+
 	fingerprintHexUpperList := []string{}
 
 	var err error
@@ -269,9 +301,7 @@ func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKe
 
 		fingerprintHexUpperList, err = allFingerprintsInStore(registryBase, storeKey)
 		if err != nil {
-			log.Errorf("Couldn't enumerate certificates in store: %s", err)
-
-			return
+			return false, err
 		}
 	}
 
@@ -281,9 +311,7 @@ func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKe
 
 	if len(fingerprintHexUpperList) == 0 {
 		if derBytes == nil {
-			log.Errorf("No cert specified")
-
-			return
+			return false, fmt.Errorf("no cert specified: %w", ErrInjectCerts)
 		}
 
 		// Windows CryptoAPI uses the SHA-1 fingerprint to identify a cert.
@@ -298,87 +326,244 @@ func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKe
 		fingerprintHexUpperList = append(fingerprintHexUpperList, strings.ToUpper(fingerprintHex))
 	}
 
+	failed := 0
+	changed := false
+
 	for _, fingerprintHexUpper := range fingerprintHexUpperList {
-		injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registryBase, storeKey)
+		recordUndo, err := undo.track(registryBase, storeKey, fingerprintHexUpper)
+		if err != nil {
+			return changed, err
+		}
+
+		recordChange := auditChangeCryptoAPI(operation, "", derBytes, registryBase, storeKey, fingerprintHexUpper)
+
+		wrote, err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registryBase, storeKey, magic)
+
+		recordChange()
+		recordUndo(wrote, err)
+
+		if err != nil {
+			log.Errorf("Cert %s: %s", fingerprintHexUpper, err)
+
+			failed++
+		}
+
+		changed = changed || wrote
 	}
+
+	if failed != 0 {
+		return changed, fmt.Errorf("%d of %d certs failed: %w", failed, len(fingerprintHexUpperList), ErrInjectCerts)
+	}
+
+	return changed, nil
 }
 
+// injectSingleCertCryptoAPI injects one cert, as a case of reconciling the
+// store with a manifest that lists it.  derBytes is nil if the cert is
+// selected by fingerprint.
 func injectSingleCertCryptoAPI(derBytes []byte, fingerprintHexUpper string,
-	registryBase registry.Key, storeKey string,
-) {
-	// Construct the input Blob
-	blob, err := readInputBlob(derBytes, registryBase, storeKey+`\`+fingerprintHexUpper)
+	registryBase registry.Key, storeKey string, magic magicTag,
+) (bool, error) {
+	access := uint32(registry.ALL_ACCESS)
+	if dryRun.Value() {
+		access = registry.READ
+	}
+
+	certStoreKey, err := registry.OpenKey(registryBase, storeKey, access)
 	if err != nil {
-		log.Errorf("Couldn't read input blob: %s", err)
+		return false, fmt.Errorf("%s: couldn't open cert store: %w", err, ErrInjectCerts)
+	}
+	defer certStoreKey.Close()
 
-		return
+	return reconcileCertCryptoAPI(certStoreKey, fingerprintHexUpper, "", injectionCertCryptoAPI(derBytes, magic))
+}
+
+// injectionCertCryptoAPI returns InjectCert's cert as a manifest cert, whose
+// blob is edited as the flags say.
+func injectionCertCryptoAPI(derBytes []byte, magic magicTag) *manifestCert {
+	cert := injectionCert(derBytes)
+	cert.MagicName = magic.name
+
+	magicData := int(magic.data)
+	cert.MagicData = &magicData
+
+	cert.editBlob = func(blob certblob.Blob) error {
+		// With the cert preimage known, reset excludes every other
+		// property that's already there.
+		if cryptoAPIFlagReset.Value() && derBytes != nil {
+			for propID := range blob {
+				if propID != certblob.CertContentCertPropID {
+					delete(blob, propID)
+				}
+			}
+		}
+
+		return editBlob(blob)
 	}
 
-	err = editBlob(blob)
-	if err != nil {
-		log.Errorf("Couldn't edit blob: %s", err)
+	return cert
+}
 
-		return
+// checkPolicyFlagsCryptoAPI checks the CryptoAPI operations requested by
+// flags against policy.
+func checkPolicyFlagsCryptoAPI(policy *injectPolicy) error {
+	for _, storeWide := range []struct {
+		name      string
+		requested bool
+	}{
+		{"all-certs", allCerts.Value()},
+		{"constrain-all-roots", constrainAllRoots.Value() != ""},
+		{"unconstrain-all-roots", unconstrainAllRoots.Value() != ""},
+	} {
+		if storeWide.requested {
+			err := policy.checkStoreWide(storeWide.name)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Marshal the Blob
-	blobBytes, err := blob.Marshal()
+	customEKUs, err := buildCustomEKUList()
 	if err != nil {
-		log.Errorf("Couldn't marshal cert blob: %s", err)
+		return err
+	}
 
-		return
+	return policy.checkEKU(&x509.Certificate{ExtKeyUsage: buildEKUList(), UnknownExtKeyUsage: customEKUs})
+}
+
+// checkPolicyBlobCryptoAPI checks a cert against the policy file, with the
+// EKU and name constraints properties that it's about to be written with.
+// Where a property is absent, the cert's own extension applies.
+func checkPolicyBlobCryptoAPI(blob certblob.Blob) error {
+	policy, err := loadInjectPolicy()
+	if policy == nil {
+		return err
 	}
 
-	// Open up the cert store.
-	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
 	if err != nil {
-		log.Errorf("Couldn't open cert store: %s", err)
+		return fmt.Errorf("%s: couldn't parse cert: %w", err, ErrPolicy)
+	}
 
-		return
+	eku, nameConstraints := certRestrictions(cert)
+
+	blobEKU, err := existingEKU(blob, x509ext.MergeIntersect)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrPolicy)
+	}
+
+	if blobEKU != nil {
+		eku = blobEKU
 	}
-	defer certStoreKey.Close()
 
-	// Create the registry key in which we will store the cert.
-	// The 2nd result of CreateKey is openedExisting, which tells us if the cert already existed.
-	// This doesn't matter to us.  If true, the "last modified" metadata won't update,
-	// but we delete and recreate the magic value inside it as a workaround.
-	certKey, _, err := registry.CreateKey(certStoreKey, fingerprintHexUpper, registry.ALL_ACCESS)
+	blobNameConstraints, err := existingNameConstraints(blob, x509ext.MergeIntersect)
 	if err != nil {
-		log.Errorf("Couldn't create registry key for certificate: %s", err)
+		return fmt.Errorf("%s: %w", err, ErrPolicy)
+	}
 
-		return
+	if blobNameConstraints != nil {
+		nameConstraints = blobNameConstraints
 	}
-	defer certKey.Close()
 
-	// Check for magic value indicating we should skip this cert
-	shouldSkip, _, err := certKey.GetIntegerValue(skipMagicName.Value())
-	if err == nil && shouldSkip == uint64(skipMagicData.Value()) {
-		// Magic value detected.  Skip.
+	return policy.checkCert(cert, eku, nameConstraints)
+}
+
+// planCertCryptoAPI prints what reconcileCertCryptoAPI would write.
+// certKey is only open if existed.
+func planCertCryptoAPI(fingerprintHexUpper string, certKey registry.Key, existed bool,
+	oldBlob, newBlob certblob.Blob, magic magicTag,
+) {
+	if !existed {
+		planf("%s: create registry key", fingerprintHexUpper)
+
+		certKey = 0
+	}
+
+	planBlobCryptoAPI(fingerprintHexUpper, oldBlob, newBlob)
+	planMagicCryptoAPI(fingerprintHexUpper, certKey, magic)
+}
+
+func planBlobCryptoAPI(fingerprintHexUpper string, oldBlob, newBlob certblob.Blob) {
+	changes := certblob.Diff(oldBlob, newBlob)
+	if len(changes) == 0 {
+		planf("%s: blob unchanged", fingerprintHexUpper)
+
 		return
 	}
 
-	applyRegistryValues(certKey, blobBytes)
+	for _, change := range changes {
+		planf("%s: %s", fingerprintHexUpper, change)
+	}
 }
 
-func applyRegistryValues(certKey registry.Key, blobBytes []byte) {
-	var err error
+// planMagicCryptoAPI prints the magic tag that applyMagic would set.  certKey
+// is zero if the cert doesn't exist yet.
+func planMagicCryptoAPI(fingerprintHexUpper string, certKey registry.Key, magic magicTag) {
+	if magic.name == "" {
+		return
+	}
 
-	if setMagicName.Value() != "" {
-		err = applyMagic(certKey)
-		if err != nil {
-			log.Errorf("Couldn't set magic registry value for certificate: %s", err)
+	current := "absent"
+
+	if certKey != 0 {
+		data, _, err := certKey.GetIntegerValue(magic.name)
+		if err == nil && data == uint64(magic.data) {
+			planf("%s: magic tag %s=%d unchanged", fingerprintHexUpper, magic.name, magic.data)
 
 			return
 		}
+
+		if err == nil {
+			current = fmt.Sprint(data)
+		}
+	}
+
+	planf("%s: set magic tag %s=%d (currently %s)", fingerprintHexUpper, magic.name, magic.data, current)
+}
+
+// applyRegistryValues writes the magic tag and blob, and returns whether it
+// changed anything.  Values that already hold the right data are left alone,
+// so that injecting a cert again doesn't churn the registry, bump its
+// last-write time, or, in watch mode, trigger another change notification.
+func applyRegistryValues(certKey registry.Key, blobBytes []byte, magic magicTag) (bool, error) {
+	changed := false
+
+	if magic.name != "" {
+		var err error
+
+		changed, err = applyMagic(certKey, magic)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	oldBlobBytes, _, err := certKey.GetBinaryValue("Blob")
+	if err == nil && bytes.Equal(oldBlobBytes, blobBytes) {
+		return changed, nil
 	}
 
 	// Create the registry value which holds the certificate.
 	err = certKey.SetBinaryValue("Blob", blobBytes)
 	if err != nil {
-		log.Errorf("Couldn't set blob registry value for certificate: %s", err)
+		return changed, fmt.Errorf("%s: couldn't set blob registry value for certificate: %w", err, ErrInjectCerts)
+	}
 
-		return
+	return true, nil
+}
+
+// magicTag is a registry value that applyMagic sets next to a cert's blob.
+type magicTag struct {
+	name string
+	data uint32
+}
+
+// injectMagicTag returns the magic tag to set on injected certs.
+func injectMagicTag(expirable bool) magicTag {
+	if expirable {
+		return magicTag{expirableMagicName.Value(), uint32(expirableMagicData.Value())}
 	}
+
+	return magicTag{setMagicName.Value(), uint32(setMagicData.Value())}
 }
 
 // Add an extra registry value that serves as a "magic tag".  This will be
@@ -387,30 +572,85 @@ func applyRegistryValues(certKey registry.Key, blobBytes []byte) {
 //
 //   - Indicating that a certificate is a Namecoin dehydrated certificate, and
 //     should be deleted once it reaches a certain age to avoid leaving browsing
-//     history in the registry.
+//     history in the registry.  touchCertCryptoAPI resets its age.
 //   - Indicating that a certificate is a Namecoin root certificate, and should
 //     be exempt from a Namecoin name constraint exclusion that is applied to all
 //     other root CA's.
-func applyMagic(certKey registry.Key) error {
-	// To satisfy the first example use case, we have to delete it before we
-	// create it, so that we make sure that the "last modified" metadata gets
-	// updated.  If an error occurs during deletion, we ignore it, since it
-	// probably just means it wasn't there already.  In watch mode, we don't do
-	// this, since it would cause an infinite loop.
-	if !watch.Value() {
-		_ = certKey.DeleteValue(setMagicName.Value())
+//
+// It returns whether it changed anything; a tag that's already right is left
+// alone.
+func applyMagic(certKey registry.Key, magic magicTag) (bool, error) {
+	data, _, err := certKey.GetIntegerValue(magic.name)
+	if err == nil && data == uint64(magic.data) {
+		return false, nil
+	}
+
+	err = certKey.SetDWordValue(magic.name, magic.data)
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't apply magic '%s'='%d': %w", err,
+			magic.name, magic.data, ErrSetMagic)
+	}
+
+	return true, nil
+}
+
+// touchCertCryptoAPI resets the age of an injected cert that carries the
+// expirable magic tag, so that CleanCerts counts it from now.  Nothing else
+// about the cert changes, and certs without the tag are left alone, since
+// they never expire.
+func touchCertCryptoAPI(derBytes []byte) error {
+	if expirableMagicName.Value() == "" {
+		return nil
+	}
+
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return err
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	certKey, err := registry.OpenKey(store.Base, store.Key()+`\`+fingerprintHexUpper, registry.ALL_ACCESS)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
 	}
 
-	err := certKey.SetDWordValue(setMagicName.Value(), uint32(setMagicData.Value()))
 	if err != nil {
-		return fmt.Errorf("%s: couldn't apply magic '%s'='%d': %w", err,
-			setMagicName.Value(), uint32(setMagicData.Value()), ErrSetMagic)
+		return fmt.Errorf("%s: couldn't open cert: %w", err, ErrInjectCerts)
+	}
+	defer certKey.Close()
+
+	data, _, err := certKey.GetIntegerValue(expirableMagicName.Value())
+	if err != nil || data != uint64(expirableMagicData.Value()) {
+		return nil
+	}
+
+	if dryRun.Value() {
+		planf("%s: touch %s to reset the cert's age", fingerprintHexUpper, expirableMagicName.Value())
+
+		return nil
+	}
+
+	// Deleting and recreating the value, rather than setting it to the
+	// same data, makes sure that the key's last-write time is updated.
+	_ = certKey.DeleteValue(expirableMagicName.Value())
+
+	err = certKey.SetDWordValue(expirableMagicName.Value(), uint32(data))
+	if err != nil {
+		return fmt.Errorf("%s: couldn't touch magic '%s': %w", err, expirableMagicName.Value(), ErrSetMagic)
 	}
 
 	return nil
 }
 
 func editBlob(blob certblob.Blob) error {
+	if derivedProperties.Value() {
+		err := blob.SetDerivedProperties()
+		if err != nil {
+			return fmt.Errorf("%s: couldn't add derived properties: %w", err, ErrEditBlob)
+		}
+	}
+
 	err := editBlobEKU(blob)
 	if err != nil {
 		return err
@@ -421,21 +661,172 @@ func editBlob(blob certblob.Blob) error {
 		return err
 	}
 
+	err = editBlobRootProgram(blob)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobExtensionOverrides(blob)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobDisplay(blob)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func editBlobRootProgram(blob certblob.Blob) error {
+	// Both set the root program policies property, so one would silently
+	// override the other.
+	if rootProgramCertPolicies.Value() != "" && extPolicies.Value() != "" {
+		return fmt.Errorf("capi.cert-policies and ext.policies can't both be set (consider ext.policies, "+
+			"which p11-kit also supports): %w", ErrEditBlob)
+	}
+
+	if rootProgramCertPolicies.Value() != "" {
+		policiesTemplate := x509.Certificate{}
+
+		for _, oidString := range splitFlagList(rootProgramCertPolicies.Value()) {
+			oid, err := x509ext.ParseOID(oidString)
+			if err != nil {
+				return fmt.Errorf("%s: couldn't parse certificate policy: %w", err, ErrEditBlob)
+			}
+
+			policiesTemplate.PolicyIdentifiers = append(policiesTemplate.PolicyIdentifiers, oid)
+		}
+
+		policiesProperty, err := certblob.BuildRootProgramCertPolicies(&policiesTemplate)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't marshal certificate policies property: %w", err, ErrEditBlob)
+		}
+
+		blob.SetProperty(policiesProperty)
+	}
+
+	if disallowedAfter.Value() != "" {
+		distrustTime, err := parseDisallowedAfter(disallowedAfter.Value())
+		if err != nil {
+			return err
+		}
+
+		disallowedProperty, err := certblob.BuildDisallowedFiletime(distrustTime)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't marshal disallowed filetime property: %w", err, ErrEditBlob)
+		}
+
+		blob.SetProperty(disallowedProperty)
+	}
+
+	return nil
+}
+
+func editBlobExtensionOverrides(blob certblob.Blob) error {
+	exts, err := buildExtensionOverrides(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		return fmt.Errorf("%s: couldn't build extension overrides: %w", err, ErrEditBlob)
+	}
+
+	for _, ext := range exts {
+		extProperty, err := certblob.PropertyFromExtension(ext)
+		if errors.Is(err, certblob.ErrNoPropertyForExtension) {
+			log.Warnf("Extension %s can't be overridden via CryptoAPI; ignoring", ext.Id)
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: couldn't convert extension override: %w", err, ErrEditBlob)
+		}
+
+		blob.SetProperty(extProperty)
+	}
+
+	return nil
+}
+
+func parseDisallowedAfter(val string) (time.Time, error) {
+	distrustTime, err := time.Parse(time.RFC3339, val)
+	if err == nil {
+		return distrustTime, nil
+	}
+
+	distrustTime, err = time.Parse("2006-01-02", val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: couldn't parse disallowed date: %w", err, ErrEditBlob)
+	}
+
+	return distrustTime, nil
+}
+
+func editBlobDisplay(blob certblob.Blob) error {
+	if friendlyName.Value() != "" {
+		friendlyNameProperty, err := certblob.BuildFriendlyName(friendlyName.Value())
+		if err != nil {
+			return fmt.Errorf("%s: couldn't marshal friendly name property: %w", err, ErrEditBlob)
+		}
+
+		blob.SetProperty(friendlyNameProperty)
+	}
+
+	if certDescription.Value() != "" {
+		descriptionProperty, err := certblob.BuildDescription(certDescription.Value())
+		if err != nil {
+			return fmt.Errorf("%s: couldn't marshal description property: %w", err, ErrEditBlob)
+		}
+
+		blob.SetProperty(descriptionProperty)
+	}
+
 	return nil
 }
 
 func editBlobEKU(blob certblob.Blob) error {
 	ekus := buildEKUList()
 
-	if len(ekus) == 0 {
+	customEKUs, err := buildCustomEKUList()
+	if err != nil {
+		return err
+	}
+
+	if len(ekus) == 0 && len(customEKUs) == 0 {
 		return nil
 	}
 
 	ekuTemplate := x509.Certificate{
-		ExtKeyUsage: ekus,
+		ExtKeyUsage:        ekus,
+		UnknownExtKeyUsage: customEKUs,
+	}
+
+	mode, err := x509ext.ParseMergeMode(mergeMode.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrEditBlob)
+	}
+
+	existing, err := existingEKU(blob, mode)
+	if err != nil {
+		return err
+	}
+
+	merged, err := x509ext.MergeExtKeyUsage(existing, &ekuTemplate, mode)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't merge extended key usage: %w", err, ErrEditBlob)
+	}
+
+	if x509ext.ExtKeyUsageBroader(existing, merged) {
+		log.Warnf("Extended key usage of %X is broader than before", sha1Property(blob))
+	}
+
+	if merged == nil {
+		delete(blob, certblob.CertEnhkeyUsagePropID)
+
+		return nil
 	}
 
-	ekuProperty, err := certblob.BuildExtKeyUsage(&ekuTemplate)
+	ekuProperty, err := certblob.BuildExtKeyUsage(merged)
 	if err != nil {
 		return fmt.Errorf("%s: couldn't marshal extended key usage property: %w", err, ErrEditBlob)
 	}
@@ -445,6 +836,56 @@ func editBlobEKU(blob certblob.Blob) error {
 	return nil
 }
 
+// existingEKU returns the EKU restriction that blob already has, or nil if
+// it has none.  An undecodable property is only fatal if we need to merge
+// with it.
+func existingEKU(blob certblob.Blob, mode x509ext.MergeMode) (*x509.Certificate, error) {
+	ekus, unknown, err := blob.ExtKeyUsage()
+	if errors.Is(err, certblob.ErrPropertyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		if mode == x509ext.MergeReplace {
+			log.Warnf("Replacing undecodable extended key usage property: %s", err)
+
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%s: couldn't decode existing extended key usage: %w", err, ErrEditBlob)
+	}
+
+	return &x509.Certificate{ExtKeyUsage: ekus, UnknownExtKeyUsage: unknown}, nil
+}
+
+// existingNameConstraints is like existingEKU, but for name constraints.
+func existingNameConstraints(blob certblob.Blob, mode x509ext.MergeMode) (*x509.Certificate, error) {
+	constraints, err := blob.NameConstraints()
+	if errors.Is(err, certblob.ErrPropertyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		if mode == x509ext.MergeReplace {
+			log.Warnf("Replacing undecodable name constraints property: %s", err)
+
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%s: couldn't decode existing name constraints: %w", err, ErrEditBlob)
+	}
+
+	return constraints, nil
+}
+
+// sha1Property identifies a blob in log messages.
+func sha1Property(blob certblob.Blob) []byte {
+	// #nosec G401
+	fingerprint := sha1.Sum(blob[certblob.CertContentCertPropID])
+
+	return fingerprint[:]
+}
+
 func buildEKUList() []x509.ExtKeyUsage {
 	ekus := []x509.ExtKeyUsage{}
 
@@ -464,6 +905,21 @@ func buildEKUList() []x509.ExtKeyUsage {
 	return ekus
 }
 
+func buildCustomEKUList() ([]asn1.ObjectIdentifier, error) {
+	oids := []asn1.ObjectIdentifier{}
+
+	for _, oidString := range splitFlagList(ekuCustom.Value()) {
+		oid, err := x509ext.ParseOID(oidString)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't parse custom extended key usage: %w", err, ErrEditBlob)
+		}
+
+		oids = append(oids, oid)
+	}
+
+	return oids, nil
+}
+
 func appendToEKUList(ekus *[]x509.ExtKeyUsage, enable bool, usage x509.ExtKeyUsage) {
 	if enable {
 		*ekus = append(*ekus, usage)
@@ -476,82 +932,72 @@ func editBlobNameConstraints(blob certblob.Blob) error {
 		return err
 	}
 
-	if nameConstraintsValid {
-		nameConstraintsProperty, err := certblob.BuildNameConstraints(nameConstraintsTemplate)
-		if err != nil {
-			return fmt.Errorf("%s: couldn't marshal name constraints property: %w", err, ErrEditBlob)
-		}
-
-		blob.SetProperty(nameConstraintsProperty)
+	if !nameConstraintsValid {
+		return nil
 	}
 
-	return nil
-}
-
-func buildNameConstraintsTemplate() (*x509.Certificate, bool, error) {
-	nameConstraintsValid := false
-	nameConstraintsTemplate := x509.Certificate{}
-
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedDNSDomains,
-		nameConstraintsPermittedDNS.Value(), &nameConstraintsValid)
-
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedDNSDomains,
-		nameConstraintsExcludedDNS.Value(), &nameConstraintsValid)
+	mode, err := x509ext.ParseMergeMode(mergeMode.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrEditBlob)
+	}
 
-	err := setNameConstraintsIPRanges(
-		&nameConstraintsTemplate.PermittedIPRanges,
-		nameConstraintsPermittedIP.Value(), &nameConstraintsValid)
+	existing, err := existingNameConstraints(blob, mode)
 	if err != nil {
-		return nil, false, fmt.Errorf("permitted: %w", err)
+		return err
 	}
 
-	err = setNameConstraintsIPRanges(
-		&nameConstraintsTemplate.ExcludedIPRanges,
-		nameConstraintsExcludedIP.Value(), &nameConstraintsValid)
+	merged, err := x509ext.MergeNameConstraints(existing, nameConstraintsTemplate, mode)
 	if err != nil {
-		return nil, false, fmt.Errorf("excluded: %w", err)
+		return fmt.Errorf("%s: couldn't merge name constraints: %w", err, ErrEditBlob)
+	}
+
+	if x509ext.NameConstraintsBroader(existing, merged) {
+		log.Warnf("Name constraints of %X are broader than before", sha1Property(blob))
 	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedEmailAddresses,
-		nameConstraintsPermittedEmail.Value(), &nameConstraintsValid)
+	if merged == nil {
+		delete(blob, certblob.CertRootProgramNameConstraintsPropID)
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedEmailAddresses,
-		nameConstraintsExcludedEmail.Value(), &nameConstraintsValid)
+		return nil
+	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedURIDomains,
-		nameConstraintsPermittedURI.Value(), &nameConstraintsValid)
+	nameConstraintsProperty, err := certblob.BuildNameConstraints(merged)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't marshal name constraints property: %w", err, ErrEditBlob)
+	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedURIDomains,
-		nameConstraintsExcludedURI.Value(), &nameConstraintsValid)
+	blob.SetProperty(nameConstraintsProperty)
 
-	return &nameConstraintsTemplate, nameConstraintsValid, nil
+	return nil
 }
 
-func setNameConstraintsStrings(ncs *[]string, val string, valid *bool) {
-	if val != "" {
-		*ncs = []string{val}
-		*valid = true
+func buildNameConstraintsTemplate() (*x509.Certificate, bool, error) {
+	policy := nameConstraintsPolicy{
+		PermittedDNS:   splitFlagList(nameConstraintsPermittedDNS.Value()),
+		ExcludedDNS:    splitFlagList(nameConstraintsExcludedDNS.Value()),
+		PermittedIP:    splitFlagList(nameConstraintsPermittedIP.Value()),
+		ExcludedIP:     splitFlagList(nameConstraintsExcludedIP.Value()),
+		PermittedEmail: splitFlagList(nameConstraintsPermittedEmail.Value()),
+		ExcludedEmail:  splitFlagList(nameConstraintsExcludedEmail.Value()),
+		PermittedURI:   splitFlagList(nameConstraintsPermittedURI.Value()),
+		ExcludedURI:    splitFlagList(nameConstraintsExcludedURI.Value()),
 	}
-}
 
-func setNameConstraintsIPRanges(ncs *[]*net.IPNet, val string, valid *bool) error {
-	if val != "" {
-		_, IPNet, err := net.ParseCIDR(val)
+	if nameConstraintsPolicyFile.Value() != "" {
+		filePolicy, err := loadNameConstraintsPolicy(nameConstraintsPolicyFile.Value())
 		if err != nil {
-			return fmt.Errorf("%s: couldn't parse IP CIDR: %w", err, ErrEditBlob)
+			return nil, false, fmt.Errorf("%s: %w", err, ErrEditBlob)
 		}
 
-		*ncs = []*net.IPNet{IPNet}
-		*valid = true
+		policy.merge(filePolicy)
 	}
 
-	return nil
+	nameConstraintsTemplate, nameConstraintsValid, err := policy.template()
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", err, ErrEditBlob)
+	}
+
+	return nameConstraintsTemplate, nameConstraintsValid, nil
 }
 
 func cleanCertsCryptoAPI() {
@@ -592,11 +1038,27 @@ func cleanCertsCryptoAPI() {
 			return
 		}
 
+		// Certs added by a manifest with a ttl expire on their own
+		// schedule.
+		expired = expired || checkOwnedCertExpiredCryptoAPI(certStoreKey, subKeyName)
+
 		// delete the cert if it's expired
+		if expired && dryRun.Value() {
+			planf("%s: delete expired cert", subKeyName)
+
+			continue
+		}
+
 		if expired {
+			recordClean := auditChangeCryptoAPI(auditClean, "", nil, certStoreKey, "", subKeyName)
+
 			if err := registry.DeleteKey(certStoreKey, subKeyName); err != nil {
 				log.Errorf("Coudn't delete expired cert: %s", err)
+			} else {
+				metricCleaned.inc(manifestStoreCryptoAPI)
 			}
+
+			recordClean()
 		}
 	}
 }
@@ -4,9 +4,15 @@
 package certinject
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
 	"testing"
 
 	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
 )
 
 type registryKeyNamesTestCase struct {
@@ -92,3 +98,43 @@ func TestRegistryKeyNames(t *testing.T) {
 		t.Logf("[PASS] test %q: %s\\%s", testCase.Name, base2str(t, base), key)
 	}
 }
+
+func TestEditBlobRootProgramBothPolicies(t *testing.T) {
+	rootProgramCertPolicies.SetValue("2.23.140.1.2.1")
+	defer rootProgramCertPolicies.SetValue("")
+
+	extPolicies.SetValue("2.23.140.1.2.2")
+	defer extPolicies.SetValue("")
+
+	err := editBlobRootProgram(certblob.Blob{})
+	if !errors.Is(err, ErrEditBlob) {
+		t.Errorf("both policy flags: got %v, expected ErrEditBlob", err)
+	}
+}
+
+func TestBlobIsCA(t *testing.T) {
+	blobBytes, err := os.ReadFile("certblob/testdata/lets-encrypt-intermediate.blob")
+	if err != nil {
+		t.Fatalf("couldn't read blob: %s", err)
+	}
+
+	blob, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse blob: %s", err)
+	}
+
+	isCA, err := blobIsCA(blob)
+	if err != nil || !isCA {
+		t.Errorf("intermediate: got %t, %v; expected a CA", isCA, err)
+	}
+
+	leaf := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "www.example.bit"},
+		BasicConstraintsValid: true,
+	})
+
+	isCA, err = blobIsCA(certblob.Blob{certblob.CertContentCertPropID: leaf})
+	if err != nil || isCA {
+		t.Errorf("leaf: got %t, %v; expected not a CA", isCA, err)
+	}
+}
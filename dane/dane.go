@@ -0,0 +1,186 @@
+// Package dane works out what to inject into the trust stores for a domain's
+// TLSA records (RFC 6698), and asks a certinject daemon to inject it.
+//
+// Only records that carry a full cert can be injected:
+//
+//   - DANE-TA (usage 2) certs are injected as trust anchors, name-constrained
+//     to the domain, so that they can't issue certs for any other name.
+//   - DANE-EE (usage 3) certs are injected as end-entity certs, limited to
+//     server authentication.  They're name-constrained to the domain too,
+//     since many self-signed certs are marked as CAs and could otherwise
+//     issue for any name.
+//
+// The name constraints cover every name type: DNS names, and the hosts of
+// email addresses and URIs, must be within the domain, and IP addresses are
+// excluded.
+//
+// Records that only carry a hash of the cert or public key, or only the
+// public key, can't be turned into a trust store entry, and are rejected.
+// So are the PKIX usages, which are checked against the existing roots.
+package dane
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/namecoin/certinject/client"
+	"github.com/namecoin/certinject/x509ext"
+)
+
+// TLSA certificate usages.
+const (
+	UsagePKIXTA = 0
+	UsagePKIXEE = 1
+	UsageDANETA = 2
+	UsageDANEEE = 3
+)
+
+// TLSA selectors.
+const (
+	SelectorCert = 0
+	SelectorSPKI = 1
+)
+
+// TLSA matching types.
+const (
+	MatchingFull   = 0
+	MatchingSHA256 = 1
+	MatchingSHA512 = 2
+)
+
+var (
+	ErrDANE     = errors.New("error in TLSA records")
+	ErrNoRecord = fmt.Errorf("no TLSA records: %w", ErrDANE)
+	ErrHashOnly = fmt.Errorf("record only has a hash, not the cert it matches, so there's nothing "+
+		"to inject (consider publishing matching type 0): %w", ErrDANE)
+	ErrSPKIOnly = fmt.Errorf("record only has a public key, not a cert, so there's nothing to inject "+
+		"(consider publishing selector 0): %w", ErrDANE)
+	ErrPKIXUsage = fmt.Errorf("PKIX usages are checked against the existing roots, so there's nothing "+
+		"to inject (consider usage 2 or 3): %w", ErrDANE)
+	ErrUsage = fmt.Errorf("unknown certificate usage: %w", ErrDANE)
+)
+
+// Record is a TLSA record.
+type Record struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("TLSA %d %d %d", r.Usage, r.Selector, r.MatchingType)
+}
+
+// Injection is a cert to inject for a TLSA record, and the restrictions to
+// inject it with.
+type Injection struct {
+	Record  Record
+	Cert    []byte
+	Options client.InjectOptions
+}
+
+// Plan works out what to inject for a domain's TLSA records.  If any record
+// can't be injected, it fails, rather than inject only part of the set.
+func Plan(domain string, records []Record) ([]Injection, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return nil, fmt.Errorf("empty domain: %w", ErrDANE)
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: %w", domain, ErrNoRecord)
+	}
+
+	result := make([]Injection, 0, len(records))
+
+	for i, record := range records {
+		injection, err := planRecord(domain, record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: record %d (%s): %w", domain, i, record, err)
+		}
+
+		result = append(result, injection)
+	}
+
+	return result, nil
+}
+
+func planRecord(domain string, record Record) (Injection, error) {
+	switch record.Usage {
+	case UsageDANETA, UsageDANEEE:
+	case UsagePKIXTA, UsagePKIXEE:
+		return Injection{}, ErrPKIXUsage
+	default:
+		return Injection{}, ErrUsage
+	}
+
+	if record.MatchingType != MatchingFull {
+		return Injection{}, fmt.Errorf("matching type %d: %w", record.MatchingType, ErrHashOnly)
+	}
+
+	if record.Selector != SelectorCert {
+		return Injection{}, fmt.Errorf("selector %d: %w", record.Selector, ErrSPKIOnly)
+	}
+
+	_, err := x509.ParseCertificate(record.Data)
+	if err != nil {
+		return Injection{}, fmt.Errorf("%s: couldn't parse cert: %w", err, ErrDANE)
+	}
+
+	injection := Injection{Record: record, Cert: record.Data}
+	injection.Options.NameConstraints = domainNameConstraints(domain)
+
+	if record.Usage == UsageDANEEE {
+		injection.Options.EKU = []string{"server"}
+	}
+
+	return injection, nil
+}
+
+// domainNameConstraints returns name constraints that confine a cert to
+// domain for every name type.
+func domainNameConstraints(domain string) *client.NameConstraints {
+	confined := x509ext.DomainNameConstraints([]string{domain})
+	constraints := &client.NameConstraints{
+		PermittedDNS:   confined.PermittedDNSDomains,
+		PermittedEmail: confined.PermittedEmailAddresses,
+		PermittedURI:   confined.PermittedURIDomains,
+	}
+
+	for _, ipNet := range confined.ExcludedIPRanges {
+		constraints.ExcludedIP = append(constraints.ExcludedIP, ipNet.String())
+	}
+
+	return constraints
+}
+
+// Inject asks the daemon that c talks to to inject what Plan works out for
+// a domain's TLSA records.  Any stores and TTL in opts apply to every
+// record.  Nothing is injected unless every record can be planned.  If the
+// daemon refuses a record, the certs injected before it are returned with
+// the error.
+func Inject(c *client.Client, domain string, records []Record, opts client.InjectOptions) ([]client.CertInfo, error) {
+	injections, err := Plan(domain, records)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]client.CertInfo, 0, len(injections))
+
+	for _, injection := range injections {
+		injection.Options.Stores = opts.Stores
+		injection.Options.TTL = opts.TTL
+
+		info, err := c.Inject(injection.Cert, injection.Options)
+		if err != nil {
+			return result, fmt.Errorf("%s: %s: %w", domain, injection.Record, err)
+		}
+
+		result = append(result, *info)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,129 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject/client"
+)
+
+func testCert(t *testing.T, isCA bool) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.bit"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"example.bit"},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create cert: %s", err)
+	}
+
+	return derBytes
+}
+
+func TestPlan(t *testing.T) {
+	ca := testCert(t, true)
+	leaf := testCert(t, false)
+
+	injections, err := Plan("Example.BIT.", []Record{
+		{UsageDANETA, SelectorCert, MatchingFull, ca},
+		{UsageDANEEE, SelectorCert, MatchingFull, leaf},
+		{UsageDANEEE, SelectorCert, MatchingFull, ca},
+	})
+	if err != nil {
+		t.Fatalf("couldn't plan: %s", err)
+	}
+
+	if len(injections) != 3 {
+		t.Fatalf("got %d injections, expected 3", len(injections))
+	}
+
+	expected := &client.NameConstraints{
+		PermittedDNS:   []string{"example.bit"},
+		ExcludedIP:     []string{"0.0.0.0/0", "::/0"},
+		PermittedEmail: []string{"example.bit", ".example.bit"},
+		PermittedURI:   []string{"example.bit", ".example.bit"},
+	}
+
+	ta := injections[0].Options
+	if !reflect.DeepEqual(ta.NameConstraints, expected) {
+		t.Errorf("DANE-TA name constraints: got %+v, expected %+v", ta.NameConstraints, expected)
+	}
+
+	if len(ta.EKU) != 0 {
+		t.Errorf("DANE-TA EKU: got %v, expected none", ta.EKU)
+	}
+
+	// A self-signed DANE-EE cert is often marked as a CA, so it's
+	// constrained just like a DANE-TA one.
+	for _, injection := range injections[1:] {
+		ee := injection.Options
+		if !reflect.DeepEqual(ee.EKU, []string{"server"}) {
+			t.Errorf("DANE-EE EKU: got %v, expected [server]", ee.EKU)
+		}
+
+		if !reflect.DeepEqual(ee.NameConstraints, expected) {
+			t.Errorf("DANE-EE name constraints: got %+v, expected %+v", ee.NameConstraints, expected)
+		}
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	der := testCert(t, true)
+	hash := make([]byte, 32)
+
+	tests := []struct {
+		name     string
+		domain   string
+		records  []Record
+		expected error
+	}{
+		{"no records", "example.bit", nil, ErrNoRecord},
+		{"empty domain", ".", []Record{{UsageDANEEE, SelectorCert, MatchingFull, der}}, ErrDANE},
+		{"SHA-256", "example.bit", []Record{{UsageDANEEE, SelectorCert, MatchingSHA256, hash}}, ErrHashOnly},
+		{"SHA-512 SPKI", "example.bit", []Record{{UsageDANETA, SelectorSPKI, MatchingSHA512, hash}}, ErrHashOnly},
+		{"full SPKI", "example.bit", []Record{{UsageDANEEE, SelectorSPKI, MatchingFull, der}}, ErrSPKIOnly},
+		{"PKIX-TA", "example.bit", []Record{{UsagePKIXTA, SelectorCert, MatchingFull, der}}, ErrPKIXUsage},
+		{"unknown usage", "example.bit", []Record{{4, SelectorCert, MatchingFull, der}}, ErrUsage},
+		{"bad cert", "example.bit", []Record{{UsageDANEEE, SelectorCert, MatchingFull, hash}}, ErrDANE},
+		{
+			"one hash among full certs", "example.bit",
+			[]Record{
+				{UsageDANETA, SelectorCert, MatchingFull, der},
+				{UsageDANEEE, SelectorCert, MatchingSHA256, hash},
+			},
+			ErrHashOnly,
+		},
+	}
+
+	for _, test := range tests {
+		injections, err := Plan(test.domain, test.records)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.expected)
+		}
+
+		if injections != nil {
+			t.Errorf("%s: got injections despite the error", test.name)
+		}
+	}
+}
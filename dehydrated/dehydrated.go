@@ -0,0 +1,415 @@
+// Package dehydrated rebuilds Namecoin dehydrated certs from the "tls" field
+// of a domain's name value, and injects them into the configured trust
+// stores.
+//
+// A dehydrated cert is a self-signed cert with everything that can be
+// derived from the domain name left out.  In the tls field, it's an array:
+//
+//	[0, "<base64 SubjectPublicKeyInfo>", <notBefore>, <notAfter>, <signature algorithm>, "<base64 signature>"]
+//
+// where 0 is the format version, the validity period is in units of 5
+// minutes since the Unix epoch, and the signature algorithm is Go's
+// x509.SignatureAlgorithm.  Rehydrating it rebuilds the exact DER that was
+// signed, so the signature can be checked and reused.  The serial number is
+// derived as ncdns's certdehydrate does; see SerialNumber.
+package dehydrated
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/namecoin/certinject"
+)
+
+// TimestampPrecision is the unit of the scaled validity period.
+const TimestampPrecision = 5 * time.Minute
+
+// Version is the only dehydrated cert format version this package knows.
+const Version = 0
+
+// certFields is the number of elements in a dehydrated cert array.
+const certFields = 6
+
+// subjectSerialNumber marks the subject of a rehydrated cert.
+const subjectSerialNumber = "Namecoin TLS Certificate"
+
+// serialNumberSize keeps serial numbers positive and within the 20 bytes
+// that RFC 5280 allows.
+const serialNumberSize = 19
+
+var (
+	ErrDehydrated  = errors.New("error rehydrating cert")
+	ErrParse       = fmt.Errorf("couldn't parse dehydrated cert: %w", ErrDehydrated)
+	ErrVersion     = fmt.Errorf("unsupported dehydrated cert version: %w", ErrParse)
+	ErrSignature   = fmt.Errorf("rehydrated cert signature is invalid: %w", ErrDehydrated)
+	ErrTimestamp   = fmt.Errorf("timestamp isn't a multiple of the timestamp precision: %w", ErrDehydrated)
+	ErrNoDehydrate = fmt.Errorf("tls record has no dehydrated certs: %w", ErrDehydrated)
+	ErrInject      = fmt.Errorf("couldn't inject rehydrated cert: %w", ErrDehydrated)
+)
+
+// Cert is a dehydrated cert.
+type Cert struct {
+	PubkeyB64          string
+	NotBeforeScaled    int64
+	NotAfterScaled     int64
+	SignatureAlgorithm x509.SignatureAlgorithm
+	SignatureB64       string
+}
+
+// Parse parses a dehydrated cert array, as found in a tls record.
+func Parse(data []byte) (*Cert, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var fields []interface{}
+
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrParse)
+	}
+
+	return parseFields(fields)
+}
+
+func parseFields(fields []interface{}) (*Cert, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty array: %w", ErrParse)
+	}
+
+	version, err := parseInt(fields[0], "version")
+	if err != nil {
+		return nil, err
+	}
+
+	if version != Version {
+		return nil, fmt.Errorf("version %d: %w", version, ErrVersion)
+	}
+
+	if len(fields) != certFields {
+		return nil, fmt.Errorf("%d elements, expected %d: %w", len(fields), certFields, ErrParse)
+	}
+
+	pubkeyB64, ok := fields[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("public key isn't a string: %w", ErrParse)
+	}
+
+	notBefore, err := parseInt(fields[2], "notBefore")
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter, err := parseInt(fields[3], "notAfter")
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := parseInt(fields[4], "signature algorithm")
+	if err != nil {
+		return nil, err
+	}
+
+	signatureB64, ok := fields[5].(string)
+	if !ok {
+		return nil, fmt.Errorf("signature isn't a string: %w", ErrParse)
+	}
+
+	return &Cert{
+		PubkeyB64:          pubkeyB64,
+		NotBeforeScaled:    notBefore,
+		NotAfterScaled:     notAfter,
+		SignatureAlgorithm: x509.SignatureAlgorithm(algorithm),
+		SignatureB64:       signatureB64,
+	}, nil
+}
+
+func parseInt(field interface{}, name string) (int64, error) {
+	number, ok := field.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s isn't a number: %w", name, ErrParse)
+	}
+
+	result, err := number.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s isn't an integer: %w", err, name, ErrParse)
+	}
+
+	return result, nil
+}
+
+// MarshalJSON encodes c as a dehydrated cert array.
+func (c *Cert) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{
+		Version,
+		c.PubkeyB64,
+		c.NotBeforeScaled,
+		c.NotAfterScaled,
+		int(c.SignatureAlgorithm),
+		c.SignatureB64,
+	})
+}
+
+// NotBefore returns the start of the validity period.
+func (c *Cert) NotBefore() time.Time {
+	return time.Unix(c.NotBeforeScaled*int64(TimestampPrecision/time.Second), 0)
+}
+
+// NotAfter returns the end of the validity period.
+func (c *Cert) NotAfter() time.Time {
+	return time.Unix(c.NotAfterScaled*int64(TimestampPrecision/time.Second), 0)
+}
+
+// SerialNumber returns the serial number of the cert that c rehydrates to
+// for the given domain: the first 19 bytes of the SHA-256 hash of the
+// domain's SHA-256 hash, the public key's SHA-256 hash, and the scaled
+// validity period as big-endian 64-bit integers.
+func (c *Cert) SerialNumber(domain string) (*big.Int, error) {
+	pubkeyBytes, err := base64.StdEncoding.DecodeString(c.PubkeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode public key: %w", err, ErrParse)
+	}
+
+	domainHash := sha256.Sum256([]byte(domain))
+	pubkeyHash := sha256.Sum256(pubkeyBytes)
+
+	hash := sha256.New()
+	hash.Write(domainHash[:])
+	hash.Write(pubkeyHash[:])
+
+	// Writing fixed-size integers to a hash can't fail.
+	_ = binary.Write(hash, binary.BigEndian, c.NotBeforeScaled)
+	_ = binary.Write(hash, binary.BigEndian, c.NotAfterScaled)
+
+	return new(big.Int).SetBytes(hash.Sum(nil)[:serialNumberSize]), nil
+}
+
+// Template returns the cert template that a dehydrated cert with the given
+// serial number, validity period and signature algorithm was signed with,
+// for the given domain.  Its public key and signature aren't set.
+func Template(domain string, serialNumber *big.Int, notBefore, notAfter time.Time,
+	algorithm x509.SignatureAlgorithm,
+) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   domain,
+			SerialNumber: subjectSerialNumber,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{domain},
+		SignatureAlgorithm:    algorithm,
+	}
+}
+
+// Rehydrate rebuilds the DER cert that c was dehydrated from, for the given
+// domain, and checks its signature.
+func (c *Cert) Rehydrate(domain string) ([]byte, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return nil, fmt.Errorf("empty domain: %w", ErrDehydrated)
+	}
+
+	pubkeyBytes, err := base64.StdEncoding.DecodeString(c.PubkeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode public key: %w", err, ErrParse)
+	}
+
+	pubkey, err := x509.ParsePKIXPublicKey(pubkeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse public key: %w", err, ErrParse)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(c.SignatureB64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't decode signature: %w", err, ErrParse)
+	}
+
+	serialNumber, err := c.SerialNumber(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	template := Template(domain, serialNumber, c.NotBefore(), c.NotAfter(), c.SignatureAlgorithm)
+
+	// The signature is already known, so splice it in rather than signing.
+	// CreateCertificate checks it against the public key.
+	derBytes, err := x509.CreateCertificate(nil, template, template, pubkey,
+		splicedSigner{public: pubkey, signature: signature})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrSignature)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse rehydrated cert: %w", err, ErrDehydrated)
+	}
+
+	// Not CheckSignatureFrom, since the cert isn't a CA.
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrSignature)
+	}
+
+	return derBytes, nil
+}
+
+// splicedSigner "signs" with a signature that was made beforehand.
+type splicedSigner struct {
+	public    crypto.PublicKey
+	signature []byte
+}
+
+func (s splicedSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s splicedSigner) Sign(_ io.Reader, _ []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return s.signature, nil
+}
+
+// Dehydrate dehydrates a cert.  It fails unless the cert is exactly what
+// Rehydrate would rebuild for its domain.
+func Dehydrate(derBytes []byte) (*Cert, error) {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse cert: %w", err, ErrDehydrated)
+	}
+
+	precision := int64(TimestampPrecision / time.Second)
+
+	if cert.NotBefore.Unix()%precision != 0 || cert.NotAfter.Unix()%precision != 0 {
+		return nil, ErrTimestamp
+	}
+
+	dehydrated := &Cert{
+		PubkeyB64:          base64.StdEncoding.EncodeToString(cert.RawSubjectPublicKeyInfo),
+		NotBeforeScaled:    cert.NotBefore.Unix() / precision,
+		NotAfterScaled:     cert.NotAfter.Unix() / precision,
+		SignatureAlgorithm: cert.SignatureAlgorithm,
+		SignatureB64:       base64.StdEncoding.EncodeToString(cert.Signature),
+	}
+
+	rehydrated, err := dehydrated.Rehydrate(cert.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(rehydrated, derBytes) {
+		return nil, fmt.Errorf("cert has fields that can't be dehydrated: %w", ErrDehydrated)
+	}
+
+	return dehydrated, nil
+}
+
+// ParseTLSRecord returns the dehydrated certs in a domain's tls record,
+// which is a JSON array of arrays.  Items that aren't dehydrated certs, such
+// as TLSA records, and dehydrated certs of an unknown version are skipped.
+func ParseTLSRecord(tls []byte) ([]*Cert, error) {
+	decoder := json.NewDecoder(bytes.NewReader(tls))
+	decoder.UseNumber()
+
+	var items [][]interface{}
+
+	err := decoder.Decode(&items)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse tls record: %w", err, ErrParse)
+	}
+
+	certs := []*Cert{}
+
+	for _, item := range items {
+		if !isDehydratedCert(item) {
+			continue
+		}
+
+		cert, err := parseFields(item)
+		if errors.Is(err, ErrVersion) {
+			// Leave newer formats to software that knows them.
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// isDehydratedCert tells a dehydrated cert apart from the other items of a
+// tls record, i.e. TLSA records, whose second element is a number.
+func isDehydratedCert(item []interface{}) bool {
+	if len(item) < 2 {
+		return false
+	}
+
+	_, ok := item[1].(string)
+
+	return ok
+}
+
+// RehydrateTLSRecord rehydrates every dehydrated cert in a domain's tls
+// record.  It fails if any of them is invalid, or if there are none.
+func RehydrateTLSRecord(domain string, tls []byte) ([][]byte, error) {
+	certs, err := ParseTLSRecord(tls)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: %w", domain, ErrNoDehydrate)
+	}
+
+	result := make([][]byte, 0, len(certs))
+
+	for i, cert := range certs {
+		derBytes, err := cert.Rehydrate(domain)
+		if err != nil {
+			return nil, fmt.Errorf("%s: dehydrated cert %d: %w", domain, i, err)
+		}
+
+		result = append(result, derBytes)
+	}
+
+	return result, nil
+}
+
+// Inject rehydrates every dehydrated cert in a domain's tls record, and
+// injects them into all configured trust stores as expirable certs, each in
+// a transaction.  Nothing is injected unless all of them rehydrate.  If one
+// can't be injected, it's rolled back and an error wrapping ErrInject is
+// returned, but the ones before it stay injected.  Watching the stores
+// isn't supported, since it would never return.
+func Inject(domain string, tls []byte) error {
+	certs, err := RehydrateTLSRecord(domain, tls)
+	if err != nil {
+		return err
+	}
+
+	for i, derBytes := range certs {
+		result, err := certinject.InjectExpirableCertTransaction(derBytes)
+		if err != nil {
+			return fmt.Errorf("%s: dehydrated cert %d (%s): %s: %w", domain, i, result, err, ErrInject)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package dehydrated
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testVector struct {
+	Domain string          `json:"domain"`
+	TLS    json.RawMessage `json:"tls"`
+}
+
+func readTestVector(t *testing.T, path string) (testVector, []byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("couldn't read %s: %s", path, err)
+	}
+
+	var vector testVector
+
+	err = json.Unmarshal(data, &vector)
+	if err != nil {
+		t.Fatalf("couldn't parse %s: %s", path, err)
+	}
+
+	pemBytes, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".pem")
+	if err != nil {
+		t.Fatalf("couldn't read expected cert for %s: %s", path, err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		t.Fatalf("expected cert for %s isn't PEM", path)
+	}
+
+	return vector, block.Bytes
+}
+
+func TestRehydrateTLSRecord(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatalf("couldn't list test vectors: %s", err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatalf("no test vectors found")
+	}
+
+	for _, path := range paths {
+		vector, expected := readTestVector(t, path)
+
+		certs, err := RehydrateTLSRecord(vector.Domain, vector.TLS)
+		if err != nil {
+			t.Errorf("%s: couldn't rehydrate: %s", path, err)
+
+			continue
+		}
+
+		if len(certs) != 1 {
+			t.Errorf("%s: got %d certs, expected 1", path, len(certs))
+
+			continue
+		}
+
+		if !bytes.Equal(certs[0], expected) {
+			t.Errorf("%s: rehydrated cert differs from the expected cert", path)
+		}
+
+		// Dehydrating the expected cert must give back the tls item.
+		dehydrated, err := Dehydrate(expected)
+		if err != nil {
+			t.Errorf("%s: couldn't dehydrate: %s", path, err)
+
+			continue
+		}
+
+		parsed, err := ParseTLSRecord(vector.TLS)
+		if err != nil {
+			t.Errorf("%s: couldn't parse tls record: %s", path, err)
+
+			continue
+		}
+
+		if *parsed[0] != *dehydrated {
+			t.Errorf("%s: dehydrated %+v, expected %+v", path, dehydrated, parsed[0])
+		}
+	}
+}
+
+func TestRehydrateWrongDomain(t *testing.T) {
+	vector, _ := readTestVector(t, filepath.Join("testdata", "example.bit.json"))
+
+	_, err := RehydrateTLSRecord("other.bit", vector.TLS)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("rehydrating for another domain: got %v, expected ErrSignature", err)
+	}
+
+	// Case and a trailing dot don't matter.
+	_, err = RehydrateTLSRecord("Example.BIT.", vector.TLS)
+	if err != nil {
+		t.Errorf("rehydrating for a non-canonical domain: %s", err)
+	}
+}
+
+func TestSerialNumber(t *testing.T) {
+	vector, expected := readTestVector(t, filepath.Join("testdata", "example.bit.json"))
+
+	certs, err := ParseTLSRecord(vector.TLS)
+	if err != nil {
+		t.Fatalf("couldn't parse tls record: %s", err)
+	}
+
+	serialNumber, err := certs[0].SerialNumber(vector.Domain)
+	if err != nil {
+		t.Fatalf("couldn't derive serial number: %s", err)
+	}
+
+	// Computed separately, with Python's hashlib.
+	if serialNumber.Text(16) != "7cb3eb2d848ce61bde2fab2262a524f21c1e" {
+		t.Errorf("unexpected serial number %x", serialNumber)
+	}
+
+	cert, err := x509.ParseCertificate(expected)
+	if err != nil {
+		t.Fatalf("couldn't parse expected cert: %s", err)
+	}
+
+	if cert.SerialNumber.Cmp(serialNumber) != 0 {
+		t.Errorf("expected cert has serial number %x, derived %x", cert.SerialNumber, serialNumber)
+	}
+
+	other, err := certs[0].SerialNumber("other.bit")
+	if err != nil || other.Cmp(serialNumber) == 0 {
+		t.Errorf("serial number for another domain: got %x, %v", other, err)
+	}
+}
+
+func TestRehydrateTamperedSignature(t *testing.T) {
+	vector, _ := readTestVector(t, filepath.Join("testdata", "ed25519.bit.json"))
+
+	certs, err := ParseTLSRecord(vector.TLS)
+	if err != nil {
+		t.Fatalf("couldn't parse tls record: %s", err)
+	}
+
+	cert := *certs[0]
+	cert.NotAfterScaled++
+
+	_, err = cert.Rehydrate(vector.Domain)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("rehydrating with a changed validity period: got %v, expected ErrSignature", err)
+	}
+}
+
+func TestParseTLSRecordErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      string
+		expected error
+	}{
+		{"not JSON", `{`, ErrParse},
+		{"not an array of arrays", `{"a": 1}`, ErrParse},
+		{"too few elements", `[[0, "AAAA", 1, 2, 10]]`, ErrParse},
+		{"fractional timestamp", `[[0, "AAAA", 1.5, 2, 10, "AAAA"]]`, ErrParse},
+		{"string timestamp", `[[0, "AAAA", "1", 2, 10, "AAAA"]]`, ErrParse},
+		{"bad public key", `[[0, "!", 1, 2, 10, "AAAA"]]`, ErrParse},
+	}
+
+	for _, test := range tests {
+		_, err := RehydrateTLSRecord("example.bit", []byte(test.tls))
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	// Only TLSA items and certs of a newer version.
+	_, err := RehydrateTLSRecord("example.bit", []byte(`[[2, 1, 0, "AAAA"], [1, "AAAA"]]`))
+	if !errors.Is(err, ErrNoDehydrate) {
+		t.Errorf("tls record without dehydrated certs: got %v, expected ErrNoDehydrate", err)
+	}
+}
@@ -0,0 +1,35 @@
+package certinject
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// dryRunOutput receives the plan printed in dry-run mode.  It's stdout rather
+// than the log so that the plan is shown regardless of log level and can be
+// redirected on its own.
+var dryRunOutput io.Writer = os.Stdout
+
+// planf prints one line of the dry-run plan.
+func planf(format string, args ...interface{}) {
+	fmt.Fprintf(dryRunOutput, "dry-run: "+format+"\n", args...)
+}
+
+// planCommand prints a command that would be run, quoting arguments that
+// contain spaces.
+func planCommand(cmd *exec.Cmd) {
+	args := make([]string, 0, len(cmd.Args))
+
+	for _, arg := range cmd.Args {
+		if strings.ContainsAny(arg, " \t\"'") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+
+		args = append(args, arg)
+	}
+
+	planf("run %s", strings.Join(args, " "))
+}
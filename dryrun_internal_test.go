@@ -0,0 +1,50 @@
+package certinject
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDryRunNSS(t *testing.T) {
+	var output bytes.Buffer
+
+	dryRunOutput = &output
+	defer func() { dryRunOutput = os.Stdout }()
+
+	dir := t.TempDir()
+
+	dryRun.SetValue(true)
+	defer dryRun.SetValue(false)
+
+	certDir.SetValue(dir)
+	defer certDir.SetValue("")
+
+	nssDir.SetValue(dir)
+	defer nssDir.SetValue("")
+
+	injectCertNSS([]byte("TEST DATA"))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("couldn't list cert directory: %s", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("dry run wrote %d files", len(entries))
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 plan lines, got %q", output.String())
+	}
+
+	if !strings.HasPrefix(lines[0], "dry-run: write "+dir+"/") {
+		t.Errorf("unexpected file write plan %q", lines[0])
+	}
+
+	if !strings.HasPrefix(lines[1], "dry-run: run "+nssCertutilName+" -d sql:"+dir+" -A ") {
+		t.Errorf("unexpected command plan %q", lines[1])
+	}
+}
@@ -0,0 +1,123 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var (
+	extFlagGroup = cflag.NewGroup(flagGroup, "ext")
+	extPathLen   = cflag.Int(extFlagGroup, "path-len", -1,
+		"Override the Basic Constraints path length of the cert, which must "+
+			"already be a CA (-1 leaves it alone)")
+	extPolicies = cflag.String(extFlagGroup, "policies", "",
+		"Override the Certificate Policies of the cert with these OID's "+
+			"(comma-separated).  In CryptoAPI, this is the same as "+
+			"capi.cert-policies, which can't also be set")
+	extRequireExplicitPolicy = cflag.Int(extFlagGroup, "require-explicit-policy", -1,
+		"Override the Policy Constraints requireExplicitPolicy skip count "+
+			"(-1 leaves it absent)")
+	extInhibitPolicyMapping = cflag.Int(extFlagGroup, "inhibit-policy-mapping", -1,
+		"Override the Policy Constraints inhibitPolicyMapping skip count "+
+			"(-1 leaves it absent)")
+	extInhibitAnyPolicy = cflag.Int(extFlagGroup, "inhibit-any-policy", -1,
+		"Override the Inhibit anyPolicy skip count (-1 leaves it alone)")
+)
+
+var ErrPathLenNotCA = errors.New("path length can only be overridden for a CA cert")
+
+// buildExtensionOverrides returns the extensions requested via the ext flag
+// group for the cert derBytes.  Criticality follows RFC 5280: everything
+// except Certificate Policies is marked critical.  Each extension is
+// validated by parsing it back before it's returned.  A path length is only
+// accepted for a cert that's already a CA, since stapling it would otherwise
+// turn a leaf into a CA.
+func buildExtensionOverrides(derBytes []byte) ([]pkix.Extension, error) {
+	exts := []pkix.Extension{}
+
+	add := func(oid []int, critical bool, value []byte, err error) error {
+		if err != nil {
+			return err
+		}
+
+		ext := pkix.Extension{Id: oid, Critical: critical, Value: value}
+
+		err = x509ext.ValidateExtension(ext)
+		if err != nil {
+			return err
+		}
+
+		exts = append(exts, ext)
+
+		return nil
+	}
+
+	if extPathLen.Value() != -1 {
+		cert, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't parse cert: %w", err, ErrPathLenNotCA)
+		}
+
+		if !cert.BasicConstraintsValid || !cert.IsCA {
+			return nil, ErrPathLenNotCA
+		}
+
+		value, err := x509ext.BuildBasicConstraints(&x509.Certificate{
+			IsCA:           true,
+			MaxPathLen:     extPathLen.Value(),
+			MaxPathLenZero: extPathLen.Value() == 0,
+		})
+
+		err = add(x509ext.OIDExtensionBasicConstraints, true, value, err)
+		if err != nil {
+			return nil, fmt.Errorf("basic constraints: %w", err)
+		}
+	}
+
+	if extPolicies.Value() != "" {
+		template := x509.Certificate{}
+
+		for _, oidString := range splitFlagList(extPolicies.Value()) {
+			oid, err := x509ext.ParseOID(oidString)
+			if err != nil {
+				return nil, fmt.Errorf("certificate policies: %w", err)
+			}
+
+			template.PolicyIdentifiers = append(template.PolicyIdentifiers, oid)
+		}
+
+		value, err := x509ext.BuildCertificatePolicies(&template)
+
+		err = add(x509ext.OIDExtensionCertificatePolicies, false, value, err)
+		if err != nil {
+			return nil, fmt.Errorf("certificate policies: %w", err)
+		}
+	}
+
+	if extRequireExplicitPolicy.Value() != -1 || extInhibitPolicyMapping.Value() != -1 {
+		value, err := x509ext.BuildPolicyConstraints(extRequireExplicitPolicy.Value(),
+			extInhibitPolicyMapping.Value())
+
+		err = add(x509ext.OIDExtensionPolicyConstraints, true, value, err)
+		if err != nil {
+			return nil, fmt.Errorf("policy constraints: %w", err)
+		}
+	}
+
+	if extInhibitAnyPolicy.Value() != -1 {
+		value, err := x509ext.BuildInhibitAnyPolicy(extInhibitAnyPolicy.Value())
+
+		err = add(x509ext.OIDExtensionInhibitAnyPolicy, true, value, err)
+		if err != nil {
+			return nil, fmt.Errorf("inhibit anyPolicy: %w", err)
+		}
+	}
+
+	return exts, nil
+}
@@ -2,16 +2,51 @@ package certinject
 
 import (
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"time"
 )
 
 // Injects a certificate by writing to a file.  Might be relevant for non-CryptoAPI trust stores.
-func injectCertFile(derBytes []byte, fileName string) {
+func injectCertFile(derBytes []byte, fileName string) error {
 	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 
+	if dryRun.Value() {
+		planf("write %s (%d bytes)", fileName, len(pemBytes))
+
+		return nil
+	}
+
 	err := ioutil.WriteFile(fileName, pemBytes, 0644)
 	if err != nil {
-		log.Errore(err, "Error writing cert!")
-		return
+		return fmt.Errorf("error writing cert: %w", err)
+	}
+
+	return nil
+}
+
+// touchFile sets a file's modification time to now, which is what expiry of
+// file-based certs counts from.  A missing file is left missing.
+func touchFile(fileName string) error {
+	_, err := os.Stat(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
 	}
+
+	if dryRun.Value() {
+		planf("touch %s", fileName)
+
+		return nil
+	}
+
+	now := time.Now()
+
+	err = os.Chtimes(fileName, now, now)
+	if err != nil {
+		return fmt.Errorf("error touching cert: %w", err)
+	}
+
+	return nil
 }
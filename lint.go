@@ -0,0 +1,315 @@
+package certinject
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var (
+	lintFlagGroup = cflag.NewGroup(flagGroup, "lint")
+	lintMode      = cflag.String(lintFlagGroup, "mode", "warn",
+		"What to do about problems found in a cert before injecting it: "+
+			"off, warn (log them) or enforce (also refuse to inject a "+
+			"cert with errors)")
+	lintAllow = cflag.String(lintFlagGroup, "allow", "",
+		"Lint checks to skip (comma-separated), e.g. "+
+			"leaf-in-root,duplicate-subject")
+	lintMinRSABits = cflag.Int(lintFlagGroup, "min-rsa-bits", 2048,
+		"Smallest RSA key that the weak-key lint check accepts")
+)
+
+var ErrLint = errors.New("cert failed lint")
+
+// Names of the lint checks, as used by the allow flag.
+const (
+	lintParse            = "parse"
+	lintLeafInRoot       = "leaf-in-root"
+	lintExpired          = "expired"
+	lintNotYetValid      = "not-yet-valid"
+	lintWeakKey          = "weak-key"
+	lintWeakSignature    = "weak-signature"
+	lintKeyUsage         = "key-usage"
+	lintDuplicateSubject = "duplicate-subject"
+)
+
+// lintFinding is a problem that a lint check found.  Errors block injection
+// in enforce mode; warnings are only logged.
+type lintFinding struct {
+	check   string
+	isError bool
+	message string
+}
+
+func (f lintFinding) String() string {
+	severity := "warning"
+	if f.isError {
+		severity = "error"
+	}
+
+	return fmt.Sprintf("%s: %s (%s)", severity, f.message, f.check)
+}
+
+// lintTarget describes where a cert is about to be injected.
+type lintTarget struct {
+	// root is whether any of the stores trusts the cert as an anchor.
+	root bool
+
+	// existing returns the certs already in the stores.  It's only called
+	// if the duplicate-subject check is enabled, since reading them can
+	// be slow.
+	existing func() []*x509.Certificate
+}
+
+// lintGate lints a cert that's about to be injected, and logs what it finds.
+// In enforce mode, it returns an error wrapping ErrLint if any check that
+// isn't allowed found an error.
+func lintGate(derBytes []byte, target lintTarget) error {
+	// Operations such as all-certs edit certs that are already there.
+	if derBytes == nil {
+		return nil
+	}
+
+	switch lintMode.Value() {
+	case "off":
+		return nil
+	case "warn", "enforce":
+	default:
+		return fmt.Errorf("unknown lint mode %q (consider off, warn or enforce): %w", lintMode.Value(), ErrLint)
+	}
+
+	allowed := map[string]bool{}
+	for _, check := range splitFlagList(lintAllow.Value()) {
+		allowed[check] = true
+	}
+
+	if allowed[lintDuplicateSubject] {
+		target.existing = nil
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+	failed := 0
+
+	for _, finding := range lintCert(derBytes, target, time.Now()) {
+		if allowed[finding.check] {
+			continue
+		}
+
+		log.Warnf("Lint %s: %s", fingerprintHex, finding)
+
+		if finding.isError {
+			failed++
+		}
+	}
+
+	if failed != 0 && lintMode.Value() == "enforce" {
+		return fmt.Errorf("%d lint errors (consider fixing the cert, or skipping checks with lint.allow): %w",
+			failed, ErrLint)
+	}
+
+	return nil
+}
+
+// lintCert checks a cert that's about to be injected into target, as of now.
+func lintCert(derBytes []byte, target lintTarget, now time.Time) []lintFinding {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return []lintFinding{{lintParse, true, fmt.Sprintf("couldn't parse cert: %s", err)}}
+	}
+
+	return lintParsedCert(cert, target, now)
+}
+
+func lintParsedCert(cert *x509.Certificate, target lintTarget, now time.Time) []lintFinding {
+	findings := []lintFinding{}
+
+	add := func(check string, isError bool, format string, args ...interface{}) {
+		findings = append(findings, lintFinding{check, isError, fmt.Sprintf(format, args...)})
+	}
+
+	selfIssued := bytes.Equal(cert.RawIssuer, cert.RawSubject)
+
+	// A self-issued leaf, such as a Namecoin dehydrated cert, is meant to
+	// be trusted as itself.  A leaf that a CA issued is normally trusted
+	// via that CA, so trusting it as a root is almost always a mistake.
+	if target.root && !cert.IsCA && !selfIssued {
+		add(lintLeafInRoot, true, "cert isn't a CA, and was issued by %s, but is going into a root store",
+			cert.Issuer)
+	}
+
+	if now.After(cert.NotAfter) {
+		add(lintExpired, true, "cert expired at %s", cert.NotAfter)
+	}
+
+	if now.Before(cert.NotBefore) {
+		add(lintNotYetValid, true, "cert isn't valid until %s", cert.NotBefore)
+	}
+
+	lintKey(cert, add)
+
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		// Nobody checks the signature of a self-signed anchor, so a weak
+		// one only matters for certs that a CA issued.
+		add(lintWeakSignature, !selfIssued, "cert is signed with %s", cert.SignatureAlgorithm)
+	}
+
+	switch {
+	case cert.KeyUsage == 0:
+		add(lintKeyUsage, false, "cert has no key usage")
+	case cert.IsCA && cert.KeyUsage&x509.KeyUsageCertSign == 0:
+		add(lintKeyUsage, true, "cert is a CA, but its key usage doesn't allow signing certs")
+	}
+
+	if target.existing != nil {
+		for _, other := range target.existing() {
+			if bytes.Equal(other.RawSubject, cert.RawSubject) && !bytes.Equal(other.Raw, cert.Raw) {
+				add(lintDuplicateSubject, false, "a different cert with subject %s is already in the store",
+					cert.Subject)
+
+				break
+			}
+		}
+	}
+
+	return findings
+}
+
+func lintKey(cert *x509.Certificate, add func(check string, isError bool, format string, args ...interface{})) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < lintMinRSABits.Value() {
+			add(lintWeakKey, true, "cert has a %d-bit RSA key, expected at least %d", key.N.BitLen(),
+				lintMinRSABits.Value())
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < 256 {
+			add(lintWeakKey, true, "cert has a %d-bit ECDSA key, expected at least 256",
+				key.Curve.Params().BitSize)
+		}
+	}
+
+	if cert.PublicKeyAlgorithm == x509.DSA {
+		add(lintWeakKey, true, "cert has a DSA key")
+	}
+}
+
+// lintTarget returns where a manifest cert is going; others are
+// the other certs that go into the same stores.
+func (m *manifest) lintTarget(cert *manifestCert, others [][]byte) lintTarget {
+	root := false
+
+	for _, store := range cert.Stores {
+		switch store {
+		case manifestStoreCryptoAPI:
+			root = root || (m.CryptoAPI != nil && isRootLogicalStore(m.CryptoAPI.LogicalStore))
+		case manifestStoreNSS:
+			trust := cert.NSSTrust
+			if trust == "" {
+				trust = nssDefaultTrust
+			}
+
+			root = root || strings.Contains(strings.SplitN(trust, ",", 2)[0], "C")
+		case manifestStoreP11Kit:
+			root = true
+		}
+	}
+
+	return lintTarget{root: root, existing: func() []*x509.Certificate { return parseCerts(others) }}
+}
+
+// lint lints each cert in m, as if the others were already in the stores.
+func (m *manifest) lint() error {
+	for i, cert := range m.Certs {
+		others := [][]byte{}
+
+		for j, other := range m.Certs {
+			if j != i {
+				others = append(others, other.der)
+			}
+		}
+
+		err := lintGate(cert.der, m.lintTarget(cert, others))
+		if err != nil {
+			return fmt.Errorf("cert %s: %w", cert.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// isRootLogicalStore reports whether a CryptoAPI logical store holds trust
+// anchors.
+func isRootLogicalStore(name string) bool {
+	return strings.EqualFold(name, "Root") || strings.EqualFold(name, "AuthRoot")
+}
+
+// parseCerts parses each cert, skipping any that don't parse.
+func parseCerts(certs [][]byte) []*x509.Certificate {
+	result := []*x509.Certificate{}
+
+	for _, derBytes := range certs {
+		cert, err := x509.ParseCertificate(derBytes)
+		if err == nil {
+			result = append(result, cert)
+		}
+	}
+
+	return result
+}
+
+// existingCertsNSS returns the certs in the NSS cert directory, which holds
+// a PEM file for each cert injected into NSS.
+func existingCertsNSS() [][]byte {
+	if certDir.Value() == "" {
+		return nil
+	}
+
+	return readCertFiles(certDir.Value(), func(name string) bool { return strings.HasSuffix(name, ".pem") },
+		decodeCertFile)
+}
+
+// readCertFiles decodes each matching file in dir, skipping any that can't
+// be read or decoded.
+func readCertFiles(dir string, match func(name string) bool, decode func([]byte) ([]byte, error)) [][]byte {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Warnf("Couldn't list %s for lint: %s", dir, err)
+
+		return nil
+	}
+
+	result := [][]byte{}
+
+	for _, entry := range entries {
+		if !match(entry.Name()) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		derBytes, err := decode(data)
+		if err != nil {
+			continue
+		}
+
+		result = append(result, derBytes)
+	}
+
+	return result
+}
@@ -0,0 +1,185 @@
+package certinject
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLintCert(t *testing.T) {
+	data, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	der, err := decodeCertFile(data)
+	if err != nil {
+		t.Fatalf("couldn't decode test cert: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %s", err)
+	}
+
+	valid := cert.NotBefore.Add(time.Hour)
+	root := lintTarget{root: true}
+
+	for _, test := range []struct {
+		name    string
+		der     []byte
+		target  lintTarget
+		now     time.Time
+		checks  []string
+		isError bool
+	}{
+		{"clean root CA", der, root, valid, nil, false},
+		{"expired", der, root, cert.NotAfter.Add(time.Hour), []string{lintExpired}, true},
+		{"not yet valid", der, root, cert.NotBefore.Add(-time.Hour), []string{lintNotYetValid}, true},
+		{"garbage", []byte("not a cert"), root, valid, []string{lintParse}, true},
+		{
+			"duplicate subject", der,
+			lintTarget{root: true, existing: func() []*x509.Certificate {
+				return []*x509.Certificate{{Raw: []byte("another cert"), RawSubject: cert.RawSubject}}
+			}},
+			valid, []string{lintDuplicateSubject}, false,
+		},
+		{
+			"same cert again", der,
+			lintTarget{root: true, existing: func() []*x509.Certificate { return []*x509.Certificate{cert} }},
+			valid, nil, false,
+		},
+	} {
+		findings := lintCert(test.der, test.target, test.now)
+		checkFindings(t, test.name, findings, test.checks, test.isError)
+	}
+}
+
+// TestLintParsed checks the lint checks that depend on fields that are
+// easier to edit after parsing than to build a cert for.
+func TestLintParsed(t *testing.T) {
+	data, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	der, err := decodeCertFile(data)
+	if err != nil {
+		t.Fatalf("couldn't decode test cert: %s", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		edit    func(cert *x509.Certificate)
+		checks  []string
+		isError bool
+	}{
+		{
+			"weak RSA key",
+			func(cert *x509.Certificate) {
+				cert.PublicKey = &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+			},
+			[]string{lintWeakKey}, true,
+		},
+		{
+			"SHA-1 self-signed",
+			func(cert *x509.Certificate) { cert.SignatureAlgorithm = x509.SHA1WithRSA },
+			[]string{lintWeakSignature}, false,
+		},
+		{
+			"SHA-1 issued by a CA",
+			func(cert *x509.Certificate) {
+				cert.SignatureAlgorithm = x509.SHA1WithRSA
+				cert.RawIssuer = []byte("another CA")
+				cert.IsCA = true
+			},
+			[]string{lintWeakSignature}, true,
+		},
+		{
+			"issued leaf",
+			func(cert *x509.Certificate) {
+				cert.RawIssuer = []byte("another CA")
+				cert.IsCA = false
+			},
+			[]string{lintLeafInRoot}, true,
+		},
+		{
+			"self-signed leaf",
+			func(cert *x509.Certificate) { cert.IsCA = false },
+			nil, false,
+		},
+		{
+			"CA that can't sign certs",
+			func(cert *x509.Certificate) { cert.KeyUsage = x509.KeyUsageDigitalSignature },
+			[]string{lintKeyUsage}, true,
+		},
+		{
+			"no key usage",
+			func(cert *x509.Certificate) { cert.KeyUsage = 0 },
+			[]string{lintKeyUsage}, false,
+		},
+	} {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("couldn't parse test cert: %s", err)
+		}
+
+		test.edit(cert)
+
+		findings := lintParsedCert(cert, lintTarget{root: true}, cert.NotBefore.Add(time.Hour))
+		checkFindings(t, test.name, findings, test.checks, test.isError)
+	}
+}
+
+func checkFindings(t *testing.T, name string, findings []lintFinding, checks []string, isError bool) {
+	t.Helper()
+
+	if len(findings) != len(checks) {
+		t.Errorf("%s: found %v, expected %v", name, findings, checks)
+
+		return
+	}
+
+	for i, finding := range findings {
+		if finding.check != checks[i] || finding.isError != isError {
+			t.Errorf("%s: found %s, expected %s (error %t)", name, finding, checks[i], isError)
+		}
+	}
+}
+
+func TestLintGate(t *testing.T) {
+	defer lintMode.SetValue("warn")
+	defer lintAllow.SetValue("")
+
+	garbage := []byte("not a cert")
+
+	err := lintGate(garbage, lintTarget{})
+	if err != nil {
+		t.Errorf("warn mode blocked injection: %s", err)
+	}
+
+	lintMode.SetValue("enforce")
+
+	err = lintGate(garbage, lintTarget{})
+	if !errors.Is(err, ErrLint) {
+		t.Errorf("enforce mode returned %v, expected ErrLint", err)
+	}
+
+	lintAllow.SetValue("expired, parse")
+
+	err = lintGate(garbage, lintTarget{})
+	if err != nil {
+		t.Errorf("allowed check blocked injection: %s", err)
+	}
+
+	lintMode.SetValue("strict")
+
+	err = lintGate(garbage, lintTarget{})
+	if !errors.Is(err, ErrLint) {
+		t.Errorf("unknown mode returned %v, expected ErrLint", err)
+	}
+}
@@ -0,0 +1,489 @@
+package certinject
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/namecoin/certinject/certblob"
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var (
+	ErrManifest = errors.New("error in manifest")
+	ErrApply    = errors.New("error applying manifest")
+)
+
+// Names of the stores a manifest cert can list.
+const (
+	manifestStoreCryptoAPI = "cryptoapi"
+	manifestStoreNSS       = "nss"
+	manifestStoreP11Kit    = "p11kit"
+)
+
+// nssDefaultTrust is the trust that InjectCert gives certs in NSS.
+// TODO: check whether we can replace CP with just P.
+const nssDefaultTrust = "CP,,"
+
+// extKeyUsageNames match the EKU flag names.
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server":           x509.ExtKeyUsageServerAuth,
+	"client":           x509.ExtKeyUsageClientAuth,
+	"code":             x509.ExtKeyUsageCodeSigning,
+	"email":            x509.ExtKeyUsageEmailProtection,
+	"ipsec-end-system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec-tunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsec-user":       x509.ExtKeyUsageIPSECUser,
+	"time":             x509.ExtKeyUsageTimeStamping,
+	"ocsp":             x509.ExtKeyUsageOCSPSigning,
+	"ms-code-com":      x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	"ms-code-kernel":   x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+// manifest is the desired state of each trust store, as read by the apply
+// command, e.g.:
+//
+//	[cryptoapi]
+//	physical-store = "system"
+//	logical-store = "Root"
+//
+//	[[cert]]
+//	path = "namecoin-root.pem"
+//	stores = ["cryptoapi"]
+//	eku = ["server"]
+//	ttl = "1h"
+//
+//	[cert.name-constraints]
+//	permitted-dns = [".bit"]
+//
+// Only entries that certinject owns are ever removed: CryptoAPI certs whose
+// owner is this manifest, which apply only sets on certs that it adds, NSS
+// certs with certinject's nickname prefix, and files in the p11-kit
+// directory.  NSS and p11-kit can't tell owners apart, so don't share their
+// directories between manifests or with the serve daemon.  InjectCert
+// injects its cert the same way, as a one-cert manifest that doesn't remove
+// anything.
+type manifest struct {
+	CryptoAPI *manifestCryptoAPI `toml:"cryptoapi"`
+	NSS       *manifestNSS       `toml:"nss"`
+	P11Kit    *manifestP11Kit    `toml:"p11kit"`
+	Certs     []*manifestCert    `toml:"cert"`
+
+	// owner marks the CryptoAPI certs that this manifest adds, so that it
+	// only removes its own.
+	owner string
+}
+
+type manifestCryptoAPI struct {
+	PhysicalStore string `toml:"physical-store"`
+	LogicalStore  string `toml:"logical-store"`
+}
+
+type manifestNSS struct {
+	DBDir   string `toml:"db-dir"`
+	CertDir string `toml:"cert-dir"`
+}
+
+type manifestP11Kit struct {
+	Dir string `toml:"dir"`
+}
+
+type manifestCert struct {
+	Path            string                 `toml:"path"`
+	Stores          []string               `toml:"stores"`
+	EKU             []string               `toml:"eku"`
+	NameConstraints *nameConstraintsPolicy `toml:"name-constraints"`
+	MagicName       string                 `toml:"magic-name"`
+	MagicData       *int                   `toml:"magic-data"`
+	NSSTrust        string                 `toml:"nss-trust"`
+	TTL             string                 `toml:"ttl"`
+
+	// Filled in by loadManifest.
+	der             []byte
+	ttl             time.Duration
+	extKeyUsage     *x509.Certificate
+	nameConstraints *x509.Certificate
+
+	// Set instead of the restrictions above for InjectCert's cert, whose
+	// restrictions come from flags rather than a manifest.  Since no
+	// manifest lists it, it's never marked as owned.
+	fromFlags bool
+	editBlob  func(certblob.Blob) error
+	overrides []pkix.Extension
+
+	// Set by the serve command to the client the cert is injected for, so
+	// that the audit log records who asked for each change.
+	requester string
+}
+
+// Apply reconciles the trust stores in the manifest at path with it: certs
+// that are missing are injected, certs whose properties differ are fixed,
+// and owned certs that are no longer listed are removed.  In dry-run mode,
+// it prints what it would do instead.
+func Apply(path string) error {
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	err = m.checkPolicy()
+	if err != nil {
+		return err
+	}
+
+	err = m.lint()
+	if err != nil {
+		return err
+	}
+
+	return applyManifest(m)
+}
+
+func loadManifest(path string) (*manifest, error) {
+	owner, err := manifestOwner(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{owner: owner}
+
+	meta, err := toml.DecodeFile(path, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrManifest)
+	}
+
+	// As with name constraints policies, a typo could silently widen
+	// trust, so reject anything we don't recognize.
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("unknown keys %v in %s: %w", undecoded, path, ErrManifest)
+	}
+
+	err = m.setDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+
+	for _, cert := range m.Certs {
+		// Relative cert paths are relative to the manifest.
+		certPath := cert.Path
+		if !filepath.IsAbs(certPath) {
+			certPath = filepath.Join(filepath.Dir(path), certPath)
+		}
+
+		err = cert.resolve(m, certPath)
+		if err != nil {
+			return nil, fmt.Errorf("cert %s: %w", cert.Path, err)
+		}
+
+		for _, store := range cert.Stores {
+			key := store + " " + cert.fingerprintHex()
+			if seen[key] {
+				return nil, fmt.Errorf("cert %s is listed twice for %s: %w", cert.Path, store, ErrManifest)
+			}
+
+			seen[key] = true
+		}
+	}
+
+	return m, nil
+}
+
+// manifestOwner returns the owner of the certs that the manifest at path
+// adds, which is derived from its absolute path so that other manifests and
+// the serve daemon don't remove them.
+func manifestOwner(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err, ErrManifest)
+	}
+
+	hash := sha256.Sum256([]byte(absPath))
+
+	return "manifest:" + hex.EncodeToString(hash[:8]), nil
+}
+
+// setDefaults fills in and checks the store sections.
+func (m *manifest) setDefaults() error {
+	// Same defaults as the capi flags.
+	if m.CryptoAPI != nil && m.CryptoAPI.PhysicalStore == "" {
+		m.CryptoAPI.PhysicalStore = "system"
+	}
+
+	if m.CryptoAPI != nil && m.CryptoAPI.LogicalStore == "" {
+		m.CryptoAPI.LogicalStore = "Root"
+	}
+
+	if m.NSS != nil && (m.NSS.DBDir == "" || m.NSS.CertDir == "") {
+		return fmt.Errorf("nss needs db-dir and cert-dir: %w", ErrManifest)
+	}
+
+	if m.P11Kit != nil && m.P11Kit.Dir == "" {
+		return fmt.Errorf("p11kit needs dir: %w", ErrManifest)
+	}
+
+	return nil
+}
+
+// resolve loads and validates everything that cert refers to.
+func (cert *manifestCert) resolve(m *manifest, certPath string) error {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrManifest)
+	}
+
+	cert.der, err = decodeCertFile(data)
+	if err != nil {
+		return err
+	}
+
+	return cert.validate(m)
+}
+
+// validate parses and checks everything in cert other than the cert itself.
+func (cert *manifestCert) validate(m *manifest) error {
+	var err error
+
+	cert.extKeyUsage, err = parseExtKeyUsageNames(cert.EKU)
+	if err != nil {
+		return err
+	}
+
+	if cert.NameConstraints != nil {
+		template, valid, err := cert.NameConstraints.template()
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrManifest)
+		}
+
+		if valid {
+			cert.nameConstraints = template
+		}
+	}
+
+	if cert.TTL != "" {
+		cert.ttl, err = time.ParseDuration(cert.TTL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrManifest)
+		}
+
+		if cert.ttl <= 0 {
+			return fmt.Errorf("ttl must be positive: %w", ErrManifest)
+		}
+	}
+
+	if cert.NSSTrust == "" {
+		cert.NSSTrust = nssDefaultTrust
+	}
+
+	if strings.Count(cert.NSSTrust, ",") != 2 {
+		return fmt.Errorf("nss-trust %q should look like %q: %w", cert.NSSTrust, nssDefaultTrust, ErrManifest)
+	}
+
+	if len(cert.Stores) == 0 {
+		return fmt.Errorf("no stores listed: %w", ErrManifest)
+	}
+
+	for _, store := range cert.Stores {
+		err = cert.checkStore(m, store)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkStore makes sure that store is configured and can represent
+// everything the cert asks for, since silently dropping a restriction would
+// trust the cert more than the manifest says.
+func (cert *manifestCert) checkStore(m *manifest, store string) error {
+	switch store {
+	case manifestStoreCryptoAPI:
+		if m.CryptoAPI == nil {
+			return fmt.Errorf("no [cryptoapi] section: %w", ErrManifest)
+		}
+	case manifestStoreNSS:
+		if m.NSS == nil {
+			return fmt.Errorf("no [nss] section: %w", ErrManifest)
+		}
+
+		if cert.extKeyUsage != nil || cert.nameConstraints != nil {
+			return fmt.Errorf("nss can't apply eku or name-constraints; use nss-trust: %w", ErrManifest)
+		}
+	case manifestStoreP11Kit:
+		if m.P11Kit == nil {
+			return fmt.Errorf("no [p11kit] section: %w", ErrManifest)
+		}
+	default:
+		return fmt.Errorf("unknown store %q (consider %s, %s, %s): %w", store,
+			manifestStoreCryptoAPI, manifestStoreNSS, manifestStoreP11Kit, ErrManifest)
+	}
+
+	if store != manifestStoreCryptoAPI && (cert.MagicName != "" || cert.ttl != 0) {
+		return fmt.Errorf("magic-name and ttl are only supported by %s: %w", manifestStoreCryptoAPI, ErrManifest)
+	}
+
+	return nil
+}
+
+// injectionCert returns InjectCert's cert as a manifest cert, so that it's
+// injected the same way as a manifest's.  Its restrictions are filled in
+// from flags by each store.
+func injectionCert(derBytes []byte) *manifestCert {
+	return &manifestCert{der: derBytes, NSSTrust: nssDefaultTrust, fromFlags: true}
+}
+
+// certsForStore returns the manifest certs that list store.
+func (m *manifest) certsForStore(store string) []*manifestCert {
+	result := []*manifestCert{}
+
+	for _, cert := range m.Certs {
+		for _, certStore := range cert.Stores {
+			if certStore == store {
+				result = append(result, cert)
+			}
+		}
+	}
+
+	return result
+}
+
+func (cert *manifestCert) fingerprintHex() string {
+	fingerprint := sha256.Sum256(cert.der)
+
+	return hex.EncodeToString(fingerprint[:])
+}
+
+func (cert *manifestCert) magicData() uint32 {
+	if cert.MagicData == nil {
+		return 1
+	}
+
+	return uint32(*cert.MagicData)
+}
+
+// extensions returns the EKU and name constraints of the cert as
+// extensions, for stores that staple them.
+func (cert *manifestCert) extensions() ([]pkix.Extension, error) {
+	if cert.fromFlags {
+		return cert.overrides, nil
+	}
+
+	exts := []pkix.Extension{}
+
+	if cert.extKeyUsage != nil {
+		value, err := x509ext.BuildExtKeyUsage(cert.extKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+
+		exts = append(exts, pkix.Extension{Id: x509ext.OIDExtensionExtKeyUsage, Value: value})
+	}
+
+	if cert.nameConstraints != nil {
+		value, err := x509ext.BuildNameConstraints(cert.nameConstraints)
+		if err != nil {
+			return nil, err
+		}
+
+		// RFC 5280 requires Name Constraints to be critical.
+		exts = append(exts, pkix.Extension{Id: x509ext.OIDExtensionNameConstraints, Critical: true, Value: value})
+	}
+
+	return exts, nil
+}
+
+// cryptoAPIBlob returns existing with the properties that the manifest
+// controls set as it says.  Other properties, such as the ones CryptoAPI
+// derives itself, are kept.
+func (cert *manifestCert) cryptoAPIBlob(existing certblob.Blob) (certblob.Blob, error) {
+	blob := existing.Clone()
+
+	if cert.der != nil {
+		blob[certblob.CertContentCertPropID] = cert.der
+	}
+
+	if cert.fromFlags {
+		return blob, cert.editBlob(blob)
+	}
+
+	delete(blob, certblob.CertEnhkeyUsagePropID)
+	delete(blob, certblob.CertRootProgramNameConstraintsPropID)
+
+	if cert.extKeyUsage != nil {
+		prop, err := certblob.BuildExtKeyUsage(cert.extKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+
+		blob.SetProperty(prop)
+	}
+
+	if cert.nameConstraints != nil {
+		prop, err := certblob.BuildNameConstraints(cert.nameConstraints)
+		if err != nil {
+			return nil, err
+		}
+
+		blob.SetProperty(prop)
+	}
+
+	return blob, nil
+}
+
+// parseExtKeyUsageNames parses EKU flag names and OID's.  It returns nil if
+// names is empty.
+func parseExtKeyUsageNames(names []string) (*x509.Certificate, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	template := &x509.Certificate{}
+
+	for _, name := range names {
+		if usage, ok := extKeyUsageNames[name]; ok {
+			template.ExtKeyUsage = append(template.ExtKeyUsage, usage)
+
+			continue
+		}
+
+		oid, err := x509ext.ParseOID(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: eku %q is neither a known name nor an OID: %w", err, name, ErrManifest)
+		}
+
+		template.UnknownExtKeyUsage = append(template.UnknownExtKeyUsage, oid)
+	}
+
+	return template, nil
+}
+
+// decodeCertFile accepts a PEM or DER certificate.
+func decodeCertFile(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("PEM type was %s, expecting CERTIFICATE: %w", block.Type, ErrManifest)
+		}
+
+		data = block.Bytes
+	}
+
+	_, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrManifest)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,204 @@
+package certinject
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// writeTestManifest writes a manifest, and a copy of a test cert next to it
+// as root.pem.
+func writeTestManifest(t *testing.T, text string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	cert, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "root.pem"), cert, 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write cert: %s", err)
+	}
+
+	path := filepath.Join(dir, "manifest.toml")
+
+	err = os.WriteFile(path, []byte(text), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write manifest: %s", err)
+	}
+
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	path := writeTestManifest(t, `
+[cryptoapi]
+
+[p11kit]
+dir = "/anchors"
+
+[[cert]]
+path = "root.pem"
+stores = ["cryptoapi", "p11kit"]
+eku = ["server", "1.2.3.4"]
+
+[cert.name-constraints]
+permitted-dns = [".bit"]
+`)
+
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("couldn't load manifest: %s", err)
+	}
+
+	if m.CryptoAPI.PhysicalStore != "system" || m.CryptoAPI.LogicalStore != "Root" {
+		t.Errorf("unexpected cryptoapi defaults %+v", m.CryptoAPI)
+	}
+
+	cert := m.Certs[0]
+
+	if len(cert.der) == 0 || cert.NSSTrust != nssDefaultTrust {
+		t.Errorf("cert not resolved: %+v", cert)
+	}
+
+	if len(cert.extKeyUsage.ExtKeyUsage) != 1 || len(cert.extKeyUsage.UnknownExtKeyUsage) != 1 {
+		t.Errorf("unexpected eku %+v", cert.extKeyUsage)
+	}
+
+	if cert.nameConstraints == nil || cert.nameConstraints.PermittedDNSDomains[0] != ".bit" {
+		t.Errorf("unexpected name constraints %+v", cert.nameConstraints)
+	}
+
+	exts, err := cert.extensions()
+	if err != nil || len(exts) != 2 || !exts[1].Critical {
+		t.Errorf("unexpected extensions %+v, %v", exts, err)
+	}
+
+	if len(m.certsForStore(manifestStoreP11Kit)) != 1 || len(m.certsForStore(manifestStoreNSS)) != 0 {
+		t.Errorf("certs not sorted by store")
+	}
+}
+
+func TestManifestOwner(t *testing.T) {
+	first, err := manifestOwner("/etc/certinject/first.toml")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	second, err := manifestOwner("/etc/certinject/second.toml")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	again, err := manifestOwner("/etc/certinject/../certinject/first.toml")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if first == second || first == serveOwner || !strings.HasPrefix(first, "manifest:") {
+		t.Errorf("owners %q and %q don't tell manifests and the daemon apart", first, second)
+	}
+
+	if again != first {
+		t.Errorf("the same manifest got owners %q and %q", first, again)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"unknown key": `
+[p11kit]
+dir = "/anchors"
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+ekus = ["server"]
+`,
+		"unknown store": `
+[[cert]]
+path = "root.pem"
+stores = ["keychain"]
+`,
+		"unconfigured store": `
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+`,
+		"eku in nss": `
+[nss]
+db-dir = "/nssdb"
+cert-dir = "/certs"
+[[cert]]
+path = "root.pem"
+stores = ["nss"]
+eku = ["server"]
+`,
+		"ttl outside cryptoapi": `
+[p11kit]
+dir = "/anchors"
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+ttl = "1h"
+`,
+		"duplicate": `
+[p11kit]
+dir = "/anchors"
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+`,
+	} {
+		_, err := loadManifest(writeTestManifest(t, text))
+		if !errors.Is(err, ErrManifest) {
+			t.Errorf("%s: expected ErrManifest, got %v", name, err)
+		}
+	}
+}
+
+func TestManifestCryptoAPIBlob(t *testing.T) {
+	m, err := loadManifest(writeTestManifest(t, `
+[cryptoapi]
+[[cert]]
+path = "root.pem"
+stores = ["cryptoapi"]
+eku = ["server"]
+`))
+	if err != nil {
+		t.Fatalf("couldn't load manifest: %s", err)
+	}
+
+	friendlyName, err := certblob.BuildFriendlyName("kept")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %s", err)
+	}
+
+	existing := certblob.Blob{certblob.CertRootProgramNameConstraintsPropID: []byte{0x30, 0x00}}
+	existing.SetProperty(friendlyName)
+
+	blob, err := m.Certs[0].cryptoAPIBlob(existing)
+	if err != nil {
+		t.Fatalf("couldn't build blob: %s", err)
+	}
+
+	changes := []string{}
+	for _, change := range certblob.Diff(existing, blob) {
+		changes = append(changes, change.String())
+	}
+
+	// The name constraints aren't in the manifest, so they're removed, but
+	// the friendly name isn't managed by it, so it's kept.
+	if len(changes) != 3 || !strings.HasPrefix(changes[0], "add") || !strings.HasPrefix(changes[2], "remove") {
+		t.Errorf("unexpected changes %q", changes)
+	}
+}
@@ -0,0 +1,448 @@
+package certinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var (
+	metricsFlagGroup = cflag.NewGroup(flagGroup, "metrics")
+	metricsListen    = cflag.String(metricsFlagGroup, "listen", "",
+		"Address to serve Prometheus/OpenMetrics metrics on at /metrics, in "+
+			"watch and serve mode, e.g. 127.0.0.1:9773.  Anyone who can "+
+			"reach it can see what certinject is doing, so keep it local")
+	metricsTextfile = cflag.String(metricsFlagGroup, "textfile", "",
+		"Path to write metrics to in watch and serve mode, for "+
+			"node_exporter's textfile collector, e.g. "+
+			"/var/lib/node_exporter/textfile_collector/certinject.prom")
+	metricsInterval = cflag.Int(metricsFlagGroup, "interval", 15,
+		"Seconds between writes of the metrics textfile")
+)
+
+var ErrMetrics = errors.New("error exporting metrics")
+
+var (
+	metricInjections = newCounterVec("certinject_injections_total",
+		"Certs injected, per trust store.", "store")
+	metricInjectionFailures = newCounterVec("certinject_injection_failures_total",
+		"Injections that failed or were refused, per error type.", "error")
+	metricInjectionDuration = newHistogramVec("certinject_injection_duration_seconds",
+		"How long injections took, per trust store.", "store",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	metricCleaned = newCounterVec("certinject_certs_cleaned_total",
+		"Expired certs removed by CleanCerts, per trust store.", "store")
+	metricCertutilRetries = newCounterVec("certinject_certutil_retries_total",
+		"Times certutil was run again after a temporary error.", "")
+)
+
+// metricsErrorType is a failure metric's error label for errors that wrap
+// err.
+type metricsErrorType struct {
+	label string
+	err   error
+}
+
+// metricsStores is the manifest whose stores the owned certs gauge counts,
+// or nil for the stores configured by flags.  The serve command sets it.
+var (
+	metricsStoresMutex sync.Mutex
+	metricsStores      *manifest
+)
+
+// observeInjection runs inject, which injects into store, and counts it.
+func observeInjection(store string, inject func() error) error {
+	start := time.Now()
+	err := inject()
+
+	metricInjectionDuration.observe(store, time.Since(start).Seconds())
+
+	if err != nil {
+		metricInjectionFailures.inc(metricsErrorLabel(err))
+	} else {
+		metricInjections.inc(store)
+	}
+
+	return err
+}
+
+// metricsErrorLabel returns the failure metric's error label for err.
+// More specific errors are checked first.
+func metricsErrorLabel(err error) string {
+	errorTypes := append([]metricsErrorType{
+		{"policy", ErrPolicy},
+		{"lint", ErrLint},
+		{"certutil", ErrCertutil},
+		{"nss", ErrNSS},
+	}, storeErrorTypes...)
+
+	errorTypes = append(errorTypes,
+		metricsErrorType{"rollback", ErrRollback},
+		metricsErrorType{"transaction", ErrTransaction},
+		metricsErrorType{"apply", ErrApply},
+	)
+
+	for _, errorType := range errorTypes {
+		if errors.Is(err, errorType.err) {
+			return errorType.label
+		}
+	}
+
+	return "other"
+}
+
+func setMetricsStores(m *manifest) {
+	metricsStoresMutex.Lock()
+	defer metricsStoresMutex.Unlock()
+
+	metricsStores = m
+}
+
+// StartMetrics starts serving metrics on the listen address, and writing
+// them to the textfile, if either is configured.  The function it returns
+// stops both, after writing the textfile one last time.
+func StartMetrics() (func(), error) {
+	stops := []func(){}
+
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+
+	if addr := metricsListen.Value(); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't listen on %s: %w", err, addr, ErrMetrics)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+		go func() {
+			err := server.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("Error serving metrics: %s", err)
+			}
+		}()
+
+		stops = append(stops, func() { _ = server.Close() })
+	}
+
+	if path := metricsTextfile.Value(); path != "" {
+		if metricsInterval.Value() <= 0 {
+			stopAll()
+
+			return nil, fmt.Errorf("metrics interval must be positive: %w", ErrMetrics)
+		}
+
+		done := make(chan struct{})
+		finished := make(chan struct{})
+
+		go writeMetricsTextfileEvery(path, time.Duration(metricsInterval.Value())*time.Second, done, finished)
+
+		stops = append(stops, func() {
+			close(done)
+			<-finished
+		})
+	}
+
+	return stopAll, nil
+}
+
+// writeMetricsTextfileEvery writes the textfile every interval, and once
+// more when done is closed, then closes finished.
+func writeMetricsTextfileEvery(path string, interval time.Duration, done, finished chan struct{}) {
+	defer close(finished)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := writeMetricsTextfile(path)
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			err = writeMetricsTextfile(path)
+			if err != nil {
+				log.Errorf("%s", err)
+			}
+
+			return
+		}
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+
+	err := writeMetrics(w, openMetrics)
+	if err != nil {
+		log.Debugf("Error writing metrics: %s", err)
+	}
+}
+
+// writeMetricsTextfile writes the metrics to path.  The textfile collector
+// could read it at any time, so it's written next to it and renamed.
+func writeMetricsTextfile(path string) error {
+	var buf bytes.Buffer
+
+	err := writeMetrics(&buf, false)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+
+	err = os.WriteFile(tmpPath, buf.Bytes(), 0o644)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't write %s: %w", err, tmpPath, ErrMetrics)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't rename %s: %w", err, tmpPath, ErrMetrics)
+	}
+
+	return nil
+}
+
+// writeMetrics writes every metric, in the Prometheus text format, or in
+// OpenMetrics if openMetrics is set.
+func writeMetrics(w io.Writer, openMetrics bool) error {
+	var buf bytes.Buffer
+
+	for _, counter := range []*counterVec{
+		metricInjections, metricInjectionFailures, metricCleaned, metricCertutilRetries,
+	} {
+		counter.write(&buf, openMetrics)
+	}
+
+	metricInjectionDuration.write(&buf)
+
+	stats := WatchStatistics()
+
+	for _, watchCounter := range []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"certinject_watch_notifications_total", "Trust store changes reported in watch mode.", stats.Notifications},
+		{"certinject_watch_checks_total", "Times watch mode checked the trust stores.", stats.Checks},
+		{"certinject_watch_repairs_total", "Watch mode checks that had to repair a trust store.", stats.Repairs},
+		{"certinject_watch_errors_total", "Watch mode checks that failed.", stats.Errors},
+	} {
+		writeMetricHeader(&buf, watchCounter.name, watchCounter.help, "counter", openMetrics)
+		fmt.Fprintf(&buf, "%s %d\n", watchCounter.name, watchCounter.value)
+	}
+
+	metricsStoresMutex.Lock()
+	stores := metricsStores
+	metricsStoresMutex.Unlock()
+
+	if stores == nil {
+		stores = flagStores()
+	}
+
+	owned := ownedCertCounts(stores)
+
+	writeMetricHeader(&buf, "certinject_owned_certs", "Certs that certinject owns, per trust store.", "gauge",
+		openMetrics)
+
+	for _, store := range sortedKeys(owned) {
+		fmt.Fprintf(&buf, "certinject_owned_certs{store=%q} %d\n", store, owned[store])
+	}
+
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrMetrics)
+	}
+
+	return nil
+}
+
+// writeMetricHeader writes a metric's HELP and TYPE lines.  OpenMetrics
+// names a counter without its _total suffix there.
+func writeMetricHeader(w io.Writer, name, help, metricType string, openMetrics bool) {
+	if openMetrics && metricType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// countFiles returns how many files in dir match.  A missing directory has
+// none.
+func countFiles(dir string, match func(name string) bool) (uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%s: couldn't list %s: %w", err, dir, ErrMetrics)
+	}
+
+	count := uint64(0)
+
+	for _, entry := range entries {
+		if match(entry.Name()) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// counterVec is a counter with at most one label.  Without a label, its
+// only series has the empty label value.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: map[string]uint64{}}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[labelValue]++
+}
+
+func (c *counterVec) write(w io.Writer, openMetrics bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter", openMetrics)
+
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+
+		return
+	}
+
+	for _, labelValue := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+// histogramVec is a histogram with one label.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+// histogram holds the number of observations in each bucket, not
+// cumulatively.  Observations above the last bucket are only in count.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series := h.series[labelValue]
+	if series == nil {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			series.counts[i]++
+
+			break
+		}
+	}
+
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram", false)
+
+	labelValues := make([]string, 0, len(h.series))
+	for labelValue := range h.series {
+		labelValues = append(labelValues, labelValue)
+	}
+
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		series := h.series[labelValue]
+		cumulative := uint64(0)
+
+		for i, bucket := range h.buckets {
+			cumulative += series.counts[i]
+
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.label, labelValue,
+				strconv.FormatFloat(bucket, 'g', -1, 64), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, labelValue, series.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", h.name, h.label, labelValue,
+			strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, labelValue, series.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
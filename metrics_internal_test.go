@@ -0,0 +1,112 @@
+package certinject
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	_ = observeInjection("test-store", func() error { return nil })
+	_ = observeInjection("test-store", func() error { return fmt.Errorf("denied: %w", ErrPolicy) })
+	_ = observeInjection("test-store", func() error { return fmt.Errorf("exit status 1: %w", ErrCertutil) })
+
+	metricInjectionDuration.observe("test-histogram", 0.02)
+	metricInjectionDuration.observe("test-histogram", 0.2)
+	metricInjectionDuration.observe("test-histogram", 20)
+
+	dir := t.TempDir()
+
+	for _, name := range []string{strings.Repeat("01", 32) + ".pem", strings.Repeat("02", 32) + ".pem", "c.pem"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0o600)
+		if err != nil {
+			t.Fatalf("couldn't write file: %s", err)
+		}
+	}
+
+	setMetricsStores(&manifest{NSS: &manifestNSS{CertDir: dir}})
+	defer setMetricsStores(nil)
+
+	var buf bytes.Buffer
+
+	err := writeMetrics(&buf, false)
+	if err != nil {
+		t.Fatalf("couldn't write metrics: %s", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE certinject_injections_total counter",
+		`certinject_injections_total{store="test-store"} 1`,
+		`certinject_injection_failures_total{error="policy"} `,
+		`certinject_injection_failures_total{error="certutil"} `,
+		`certinject_injection_duration_seconds_bucket{store="test-histogram",le="0.01"} 0`,
+		`certinject_injection_duration_seconds_bucket{store="test-histogram",le="0.025"} 1`,
+		`certinject_injection_duration_seconds_bucket{store="test-histogram",le="10"} 2`,
+		`certinject_injection_duration_seconds_bucket{store="test-histogram",le="+Inf"} 3`,
+		`certinject_injection_duration_seconds_count{store="test-histogram"} 3`,
+		"certinject_certutil_retries_total ",
+		"certinject_watch_repairs_total ",
+		`certinject_owned_certs{store="nss"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics don't contain %q:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+
+	err = writeMetrics(&buf, true)
+	if err != nil {
+		t.Fatalf("couldn't write OpenMetrics: %s", err)
+	}
+
+	if !strings.Contains(buf.String(), "# TYPE certinject_injections counter\n") ||
+		!strings.HasSuffix(buf.String(), "# EOF\n") {
+		t.Errorf("OpenMetrics counters should be named without _total, and end with EOF:\n%s", buf.String())
+	}
+}
+
+func TestMetricsTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certinject.prom")
+
+	metricsTextfile.SetValue(path)
+	defer metricsTextfile.SetValue("")
+
+	stop, err := StartMetrics()
+	if err != nil {
+		t.Fatalf("couldn't start metrics: %s", err)
+	}
+
+	metricCleaned.inc("test-textfile")
+
+	// Stopping writes the textfile one last time.
+	stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("couldn't read textfile: %s", err)
+	}
+
+	if !strings.Contains(string(data), `certinject_certs_cleaned_total{store="test-textfile"} 1`) {
+		t.Errorf("textfile doesn't count the cleaned cert:\n%s", data)
+	}
+
+	_, err = os.Stat(path + ".tmp")
+	if !os.IsNotExist(err) {
+		t.Errorf("temporary textfile was left behind: %v", err)
+	}
+
+	metricsInterval.SetValue(0)
+	defer metricsInterval.SetValue(15)
+
+	start := time.Now()
+
+	_, err = StartMetrics()
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("started with a zero interval")
+	}
+}
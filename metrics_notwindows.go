@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+var storeErrorTypes = []metricsErrorType{{"p11kit", ErrP11Kit}}
+
+// flagStores returns the trust stores configured by flags, in the form of a
+// manifest.
+func flagStores() *manifest {
+	m := &manifest{}
+
+	if nssFlag.Value() {
+		m.NSS = &manifestNSS{DBDir: nssDir.Value(), CertDir: certDir.Value()}
+	}
+
+	if p11kitFlag.Value() {
+		m.P11Kit = &manifestP11Kit{Dir: p11kitDir.Value()}
+	}
+
+	return m
+}
+
+// ownedCertCounts returns how many certs certinject owns in each of the
+// stores in m: the files in the NSS cert directory and the p11-kit
+// directory.  Stores that can't be read are left out.
+func ownedCertCounts(m *manifest) map[string]uint64 {
+	counts := map[string]uint64{}
+
+	if m.NSS != nil && m.NSS.CertDir != "" {
+		count, err := countFiles(m.NSS.CertDir, isNSSCertFile)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else {
+			counts[manifestStoreNSS] = count
+		}
+	}
+
+	if m.P11Kit != nil && m.P11Kit.Dir != "" {
+		count, err := countFiles(m.P11Kit.Dir, isP11KitFile)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else {
+			counts[manifestStoreP11Kit] = count
+		}
+	}
+
+	return counts
+}
@@ -0,0 +1,103 @@
+package certinject
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+var storeErrorTypes = []metricsErrorType{{"cryptoapi", ErrInjectCerts}}
+
+// flagStores returns the trust stores configured by flags, in the form of a
+// manifest.
+func flagStores() *manifest {
+	m := &manifest{}
+
+	if cryptoAPIFlag.Value() {
+		m.CryptoAPI = &manifestCryptoAPI{
+			PhysicalStore: cryptoAPIFlagPhysicalStoreName.Value(),
+			LogicalStore:  cryptoAPIFlagLogicalStoreName.Value(),
+		}
+	}
+
+	if nssFlag.Value() {
+		m.NSS = &manifestNSS{DBDir: nssDir.Value(), CertDir: certDir.Value()}
+	}
+
+	return m
+}
+
+// ownedCertCounts returns how many certs certinject owns in each of the
+// stores in m: the CryptoAPI certs with a magic tag or owner, and
+// the files in the NSS cert directory.  Stores that can't be read are left
+// out.
+func ownedCertCounts(m *manifest) map[string]uint64 {
+	counts := map[string]uint64{}
+
+	if m.CryptoAPI != nil {
+		count, err := ownedCertCountCryptoAPI(m.CryptoAPI)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else {
+			counts[manifestStoreCryptoAPI] = count
+		}
+	}
+
+	if m.NSS != nil && m.NSS.CertDir != "" {
+		count, err := countFiles(m.NSS.CertDir, isNSSCertFile)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else {
+			counts[manifestStoreNSS] = count
+		}
+	}
+
+	return counts
+}
+
+func ownedCertCountCryptoAPI(cfg *manifestCryptoAPI) (uint64, error) {
+	store, err := cryptoAPINameToStore(cfg.PhysicalStore)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrMetrics)
+	}
+
+	storeKey := store.keyForLogical(cfg.LogicalStore)
+
+	fingerprintHexUpperList, err := allFingerprintsInStore(store.Base, storeKey)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrMetrics)
+	}
+
+	tags := []string{}
+
+	for _, name := range []string{setMagicName.Value(), expirableMagicName.Value()} {
+		if name != "" {
+			tags = append(tags, name)
+		}
+	}
+
+	count := uint64(0)
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		certKey, err := registry.OpenKey(store.Base, storeKey+`\`+fingerprintHexUpper, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+
+		_, _, err = certKey.GetStringValue(ownerValueName)
+		owned := err == nil
+
+		for _, tag := range tags {
+			_, _, err = certKey.GetIntegerValue(tag)
+			owned = owned || err == nil
+		}
+
+		if owned {
+			count++
+		}
+
+		certKey.Close()
+	}
+
+	return count, nil
+}
@@ -1,8 +1,12 @@
 package certinject
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
@@ -13,13 +17,18 @@ import (
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 )
 
+var (
+	ErrNSS      = errors.New("NSS trust store error")
+	ErrCertutil = fmt.Errorf("certutil failed: %w", ErrNSS)
+)
+
 var certDir = cflag.String(flagGroup, "nsscertdir", "", "Directory to store "+
 	"certificate files.  Only use a directory that only ncdns can write "+
 	"to.  (Required if nss is set.)")
 var nssDir = cflag.String(flagGroup, "nssdbdir", "", "Directory that "+
 	"contains NSS's cert9.db.  (Required if nss is set.)")
 
-func injectCertNSS(derBytes []byte) {
+func injectCertNSS(derBytes []byte) error {
 	if certDir.Value() == "" {
 		log.Fatal("Empty nsscertdir configuration.")
 	}
@@ -28,30 +37,79 @@ func injectCertNSS(derBytes []byte) {
 		log.Fatal("Empty nssdbdir configuration.")
 	}
 
+	cfg := &manifestNSS{DBDir: nssDir.Value(), CertDir: certDir.Value()}
+
+	err := ensureCertNSS(cfg, injectionCert(derBytes), nil)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't inject cert to NSS database: %w", err, ErrNSS)
+	}
+
+	return nil
+}
+
+// touchCertNSS resets the age of an injected cert's file, so that
+// cleanCertsNSS counts it from now.
+func touchCertNSS(derBytes []byte) error {
+	if certDir.Value() == "" {
+		return fmt.Errorf("nsscertdir must be set: %w", ErrNSS)
+	}
+
 	fingerprint := sha256.Sum256(derBytes)
 
+	err := touchFile(certDir.Value() + "/" + hex.EncodeToString(fingerprint[:]) + ".pem")
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrNSS)
+	}
+
+	return nil
+}
+
+// verifyCertNSS checks that an injected cert's file and NSS database entry
+// are what injectCertNSS writes, reading the cert back from the database.
+func verifyCertNSS(derBytes []byte) error {
+	if certDir.Value() == "" || nssDir.Value() == "" {
+		return fmt.Errorf("nsscertdir and nssdbdir must both be set: %w", ErrVerify)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
 	fingerprintHex := hex.EncodeToString(fingerprint[:])
 
-	path := certDir.Value() + "/" + fingerprintHex + ".pem"
+	err := verifyFile(certDir.Value()+"/"+fingerprintHex+".pem",
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}))
+	if err != nil {
+		return err
+	}
 
-	injectCertFile(derBytes, path)
+	listed, err := listCertsNSS(nssDir.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrVerify)
+	}
 
 	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
 
-	// TODO: check whether we can replace CP with just P.
-	cmd := exec.Command(nssCertutilName, "-d", "sql:"+nssDir.Value(), "-A",
-		"-t", "CP,,", "-n", nickname, "-a", "-i", path)
+	for _, cert := range listed {
+		if cert.Nickname != nickname {
+			continue
+		}
 
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		if strings.Contains(string(stdoutStderr), "SEC_ERROR_PKCS11_GENERAL_ERROR") {
-			log.Warn("Temporary SEC_ERROR_PKCS11_GENERAL_ERROR injecting certificate to NSS database; retrying in 1ms...")
-			time.Sleep(1 * time.Millisecond)
-			injectCertNSS(derBytes)
-		} else {
-			log.Errorf("Error injecting cert to NSS database: %s\n%s", err, stdoutStderr)
+		if cert.Trust != nssDefaultTrust {
+			return fmt.Errorf("%s has trust flags %s, expected %s: %w", nickname, cert.Trust, nssDefaultTrust,
+				ErrNotTrusted)
+		}
+
+		stored, err := exportCertNSS(nssDir.Value(), nickname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrVerify)
 		}
+
+		if !bytes.Equal(stored, derBytes) {
+			return fmt.Errorf("%s holds a different cert: %w", nickname, ErrNotTrusted)
+		}
+
+		return nil
 	}
+
+	return fmt.Errorf("%s isn't in the NSS database: %w", nickname, ErrNotTrusted)
 }
 
 func cleanCertsNSS() {
@@ -63,55 +121,141 @@ func cleanCertsNSS() {
 		log.Fatal("Empty nssdbdir configuration.")
 	}
 
-	certFiles, err := ioutil.ReadDir(certDir.Value() + "/")
+	err := cleanNSSDir(nssDir.Value(), certDir.Value(), nil)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// cleanNSSDir removes the expired certs in an NSS cert directory, and from
+// its database, other than the held certs.
+func cleanNSSDir(dbDir, dir string, held []*manifestCert) error {
+	keep := map[string]bool{}
+	for _, cert := range held {
+		keep[cert.fingerprintHex()+".pem"] = true
+	}
+
+	certFiles, err := ioutil.ReadDir(dir + "/")
 	if err != nil {
-		log.Fatalf("Error enumerating files in cert directory: %s", err)
+		return fmt.Errorf("%s: error enumerating files in cert directory: %w", err, ErrNSS)
 	}
 
 	// for all Namecoin certs in the folder
 	for _, f := range certFiles {
+		if keep[f.Name()] {
+			continue
+		}
+
 		// Check if the cert is expired
 		expired, err := checkCertExpiredNSS(f)
 		if err != nil {
-			log.Fatalf("Error checking if NSS cert is expired: %s", err)
+			return fmt.Errorf("%s: error checking if NSS cert is expired: %w", err, ErrNSS)
 		}
 
 		// delete the cert if it's expired
 		if expired {
-			filename := f.Name()
-
-			fingerprintHex := strings.Replace(filename, ".pem", "",
-				-1)
-
-			nickname := nicknameFromFingerprintHexNSS(
-				fingerprintHex)
-
-			// Delete the cert from NSS
-			cmd := exec.Command(nssCertutilName, "-d", "sql:"+
-				nssDir.Value(), "-D", "-n", nickname)
-
-			stdoutStderr, err := cmd.CombinedOutput()
-
-			switch {
-			case err == nil: // skip
-			case strings.Contains(string(stdoutStderr), "SEC_ERROR_UNRECOGNIZED_OID"):
-				log.Warn("Tried to delete certificate from NSS database, " +
-					"but the certificate was already not present in NSS database")
-			case strings.Contains(string(stdoutStderr), "SEC_ERROR_PKCS11_GENERAL_ERROR"):
-				log.Warn("Temporary SEC_ERROR_PKCS11_GENERAL_ERROR deleting certificate from NSS database; retrying in 1ms...")
-				time.Sleep(1 * time.Millisecond)
-				cleanCertsNSS()
-			default:
-				log.Fatalf("Error deleting cert from NSS database: %s\n%s", err, stdoutStderr)
-			}
+			recordClean := auditChangeNSS(auditClean, "", dbDir, dir, strings.TrimSuffix(f.Name(), ".pem"))
+
+			err = removeCertNSS(dbDir, dir, f.Name())
+
+			recordClean()
 
-			// Also delete the cert from the filesystem
-			err = os.Remove(certDir.Value() + "/" + filename)
 			if err != nil {
-				log.Fatalf("Error deleting NSS cert from filesystem: %s", err)
+				return fmt.Errorf("%s: error deleting expired NSS cert: %w", err, ErrNSS)
 			}
+
+			metricCleaned.inc(manifestStoreNSS)
 		}
 	}
+
+	return nil
+}
+
+// isNSSCertFile reports whether name is that of a cert file written by
+// injectCertNSS, i.e. a SHA-256 fingerprint in hex followed by .pem.
+func isNSSCertFile(name string) bool {
+	fingerprintHex := strings.TrimSuffix(name, ".pem")
+
+	fingerprint, err := hex.DecodeString(fingerprintHex)
+
+	return fingerprintHex != name && err == nil && len(fingerprint) == sha256.Size
+}
+
+// addCertNSS adds the cert in the PEM file at path to an NSS database.
+func addCertNSS(dbDir, nickname, trust, path string) error {
+	stdoutStderr, err := runCertutil(nil, "-d", "sql:"+dbDir, "-A",
+		"-t", trust, "-n", nickname, "-a", "-i", path)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", err, stdoutStderr, ErrCertutil)
+	}
+
+	return nil
+}
+
+// removeCertNSS deletes a cert file named filename from the cert directory,
+// and the corresponding cert from the NSS database.
+func removeCertNSS(dbDir, dir, filename string) error {
+	fingerprintHex := strings.Replace(filename, ".pem", "",
+		-1)
+
+	nickname := nicknameFromFingerprintHexNSS(
+		fingerprintHex)
+
+	// Delete the cert from NSS
+	stdoutStderr, err := runCertutil(nil, "-d", "sql:"+dbDir, "-D", "-n", nickname)
+
+	switch {
+	case err == nil: // skip
+	case strings.Contains(string(stdoutStderr), "SEC_ERROR_UNRECOGNIZED_OID"):
+		log.Warn("Tried to delete certificate from NSS database, " +
+			"but the certificate was already not present in NSS database")
+	default:
+		return fmt.Errorf("%s: couldn't delete cert from NSS database: %s: %w", err, stdoutStderr, ErrCertutil)
+	}
+
+	if dryRun.Value() {
+		planf("delete %s", dir+"/"+filename)
+
+		return nil
+	}
+
+	// Also delete the cert from the filesystem
+	err = os.Remove(dir + "/" + filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%s: couldn't delete NSS cert from filesystem: %w", err, ErrNSS)
+	}
+
+	return nil
+}
+
+// runCertutil runs NSS's certutil with stdin as its input, retrying while
+// NSS reports a temporary error.  In dry-run mode, it prints the command
+// instead.
+func runCertutil(stdin []byte, args ...string) ([]byte, error) {
+	for {
+		cmd := exec.Command(nssCertutilName, args...)
+
+		if dryRun.Value() {
+			planCommand(cmd)
+
+			return nil, nil
+		}
+
+		if stdin != nil {
+			cmd.Stdin = bytes.NewReader(stdin)
+		}
+
+		stdoutStderr, err := cmd.CombinedOutput()
+		if err != nil && strings.Contains(string(stdoutStderr), "SEC_ERROR_PKCS11_GENERAL_ERROR") {
+			log.Warn("Temporary SEC_ERROR_PKCS11_GENERAL_ERROR running certutil; retrying in 1ms...")
+			metricCertutilRetries.inc("")
+			time.Sleep(1 * time.Millisecond)
+
+			continue
+		}
+
+		return stdoutStderr, err
+	}
 }
 
 func checkCertExpiredNSS(certFile os.FileInfo) (bool, error) {
@@ -130,6 +274,33 @@ func checkCertExpiredNSS(certFile os.FileInfo) (bool, error) {
 	return expired, nil
 }
 
+// auditChangeNSS is auditChange for a cert's NSS database entry and cert
+// file.  Their state is the entry's trust flags, followed by the file.
+func auditChangeNSS(operation, requester, dbDir, dir, fingerprintHex string) func() {
+	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+	readFile := auditStateFile(dir + "/" + fingerprintHex + ".pem")
+
+	return auditChange(operation, requester, manifestStoreNSS, map[string]string{"sha256": fingerprintHex}, func() []byte {
+		trust := ""
+
+		listed, err := listCertsNSS(dbDir)
+		if err == nil {
+			for _, cert := range listed {
+				if cert.Nickname == nickname {
+					trust = cert.Trust
+				}
+			}
+		}
+
+		file := readFile()
+		if trust == "" && file == nil {
+			return nil
+		}
+
+		return append([]byte(trust+"\n"), file...)
+	})
+}
+
 func nicknameFromFingerprintHexNSS(fingerprintHex string) string {
 	return "Namecoin-" + fingerprintHex
 }
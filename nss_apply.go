@@ -0,0 +1,101 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// reconcileNSS makes the certinject certs in an NSS database, and the files
+// in its cert directory, match certs.
+func reconcileNSS(cfg *manifestNSS, certs []*manifestCert) error {
+	listed, err := listCertsNSS(cfg.DBDir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrApply)
+	}
+
+	currentTrust := map[string]string{}
+	for _, cert := range listed {
+		currentTrust[cert.Nickname] = cert.Trust
+	}
+
+	desired := map[string]bool{}
+
+	for _, cert := range certs {
+		desired[cert.fingerprintHex()] = true
+
+		err = ensureCertNSS(cfg, cert, currentTrust)
+		if err != nil {
+			return fmt.Errorf("%s: cert %s: %w", err, cert.Path, ErrApply)
+		}
+	}
+
+	// Anything certinject added that isn't listed any more, whether it's in
+	// the database, the cert directory, or both.
+	unlisted := map[string]bool{}
+
+	for _, cert := range listed {
+		unlisted[strings.TrimPrefix(cert.Nickname, nssNicknamePrefix)] = true
+	}
+
+	certFiles, err := os.ReadDir(cfg.CertDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: couldn't list cert directory: %w", err, ErrApply)
+	}
+
+	for _, certFile := range certFiles {
+		unlisted[strings.TrimSuffix(certFile.Name(), ".pem")] = true
+	}
+
+	for fingerprintHex := range unlisted {
+		if desired[fingerprintHex] {
+			continue
+		}
+
+		recordRemove := auditChangeNSS(auditRemove, "", cfg.DBDir, cfg.CertDir, fingerprintHex)
+
+		err = removeCertNSS(cfg.DBDir, cfg.CertDir, fingerprintHex+".pem")
+
+		recordRemove()
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrApply)
+		}
+	}
+
+	return nil
+}
+
+// ensureCertNSS adds a manifest cert to an NSS database, or fixes its trust
+// flags.  currentTrust maps the nickname of each certinject cert in the
+// database to its trust flags.  If it's nil, the cert is added whether or
+// not it's there, which also resets its trust flags.
+func ensureCertNSS(cfg *manifestNSS, cert *manifestCert, currentTrust map[string]string) error {
+	fingerprintHex := cert.fingerprintHex()
+	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+	path := cfg.CertDir + "/" + fingerprintHex + ".pem"
+
+	defer auditChangeNSS(auditInject, cert.requester, cfg.DBDir, cfg.CertDir, fingerprintHex)()
+
+	// Like InjectCert, always rewrite the file so that its expiry is
+	// refreshed.
+	err := injectCertFile(cert.der, path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrNSS)
+	}
+
+	trust, present := currentTrust[nickname]
+
+	switch {
+	case currentTrust == nil, !present:
+		return addCertNSS(cfg.DBDir, nickname, cert.NSSTrust, path)
+	case trust != cert.NSSTrust:
+		stdoutStderr, err := runCertutil(nil, "-d", "sql:"+cfg.DBDir, "-M", "-t", cert.NSSTrust, "-n", nickname)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", err, stdoutStderr, ErrCertutil)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package certinject
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// nssBackup holds the Namecoin certs in an NSS database, with their trust
+// flags, and the contents of the nsscertdir.  Certs that certinject didn't
+// add are left alone by both backup and restore.
+type nssBackup struct {
+	DBDir   string          `json:"db-dir"`
+	Certs   []nssCertBackup `json:"certs"`
+	CertDir *dirBackup      `json:"cert-dir"`
+}
+
+type nssCertBackup struct {
+	Nickname string `json:"nickname"`
+	Trust    string `json:"trust"`
+	DER      []byte `json:"der"`
+}
+
+// nssNicknamePrefix is the prefix of nicknameFromFingerprintHexNSS.
+const nssNicknamePrefix = "Namecoin-"
+
+func backupNSS() (*nssBackup, error) {
+	if certDir.Value() == "" || nssDir.Value() == "" {
+		return nil, fmt.Errorf("nsscertdir and nssdbdir must both be set: %w", ErrBackup)
+	}
+
+	listed, err := listCertsNSS(nssDir.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrBackup)
+	}
+
+	result := &nssBackup{DBDir: nssDir.Value(), Certs: []nssCertBackup{}}
+
+	for _, cert := range listed {
+		der, err := exportCertNSS(nssDir.Value(), cert.Nickname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrBackup)
+		}
+
+		cert.DER = der
+		result.Certs = append(result.Certs, cert)
+	}
+
+	result.CertDir, err = backupDir(certDir.Value(), isNSSCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func restoreNSS(backup *nssBackup) error {
+	err := checkArchiveStore(backup.DBDir, nssDir.Value())
+	if err != nil {
+		return err
+	}
+
+	if backup.CertDir == nil {
+		return fmt.Errorf("archive has no nsscertdir: %w", ErrRestore)
+	}
+
+	// Check this before changing the database, rather than halfway through.
+	err = checkArchiveStore(backup.CertDir.Dir, certDir.Value())
+	if err != nil {
+		return err
+	}
+
+	listed, err := listCertsNSS(nssDir.Value())
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrRestore)
+	}
+
+	// Each cert's audit state covers both its database entry and its file.
+	fingerprints := map[string]bool{}
+
+	for _, cert := range append(append([]nssCertBackup{}, listed...), backup.Certs...) {
+		if strings.HasPrefix(cert.Nickname, nssNicknamePrefix) {
+			fingerprints[strings.TrimPrefix(cert.Nickname, nssNicknamePrefix)] = true
+		}
+	}
+
+	for name := range restoreDirNames(certDir.Value(), backup.CertDir, isNSSCertFile) {
+		fingerprints[strings.TrimSuffix(name, ".pem")] = true
+	}
+
+	defer auditRestoreEach(fingerprints, func(fingerprintHex string) func() {
+		return auditChangeNSS(auditRestore, "", nssDir.Value(), certDir.Value(), fingerprintHex)
+	})()
+
+	currentTrust := map[string]string{}
+	for _, cert := range listed {
+		currentTrust[cert.Nickname] = cert.Trust
+	}
+
+	archived := map[string]bool{}
+	for _, cert := range backup.Certs {
+		archived[cert.Nickname] = true
+	}
+
+	for _, cert := range listed {
+		if archived[cert.Nickname] {
+			continue
+		}
+
+		err = runCertutilRestore(nil, "-d", "sql:"+nssDir.Value(), "-D", "-n", cert.Nickname)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, cert := range backup.Certs {
+		if !strings.HasPrefix(cert.Nickname, nssNicknamePrefix) {
+			return fmt.Errorf("%q isn't a certinject nickname: %w", cert.Nickname, ErrRestore)
+		}
+
+		trust, present := currentTrust[cert.Nickname]
+
+		switch {
+		case !present:
+			// Without -i, certutil reads the cert from stdin.
+			err = runCertutilRestore(cert.DER, "-d", "sql:"+nssDir.Value(), "-A",
+				"-t", cert.Trust, "-n", cert.Nickname)
+		case trust != cert.Trust:
+			// The nickname is derived from the cert's fingerprint, so only
+			// the trust flags can differ.
+			err = runCertutilRestore(nil, "-d", "sql:"+nssDir.Value(), "-M",
+				"-t", cert.Trust, "-n", cert.Nickname)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return restoreDir(certDir.Value(), backup.CertDir, isNSSCertFile)
+}
+
+func runCertutilRestore(stdin []byte, args ...string) error {
+	stdoutStderr, err := runCertutil(stdin, args...)
+	if err != nil {
+		return fmt.Errorf("%s: certutil failed: %s: %w", err, stdoutStderr, ErrRestore)
+	}
+
+	return nil
+}
+
+// listCertsNSS returns the nickname and trust flags of each certinject cert
+// in an NSS database.
+func listCertsNSS(dbDir string) ([]nssCertBackup, error) {
+	cmd := exec.Command(nssCertutilName, "-d", "sql:"+dbDir, "-L")
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't list NSS certs: %w", err, ErrCertutil)
+	}
+
+	return parseCertutilList(output), nil
+}
+
+// exportCertNSS returns the DER bytes of the cert with the given nickname
+// in an NSS database.
+func exportCertNSS(dbDir, nickname string) ([]byte, error) {
+	cmd := exec.Command(nssCertutilName, "-d", "sql:"+dbDir, "-L", "-n", nickname, "-r")
+
+	der, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't export %s: %w", err, nickname, ErrCertutil)
+	}
+
+	return der, nil
+}
+
+// parseCertutilList parses the table printed by "certutil -L", e.g.:
+//
+//	Certificate Nickname                                         Trust Attributes
+//	                                                             SSL,S/MIME,JAR/XPI
+//
+//	Namecoin-1de4074b...                                         CP,,
+//
+// Nicknames may contain spaces, so the trust flags are taken from the end of
+// the line.
+func parseCertutilList(output []byte) []nssCertBackup {
+	result := []nssCertBackup{}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		separator := strings.LastIndexAny(line, " \t")
+		if separator == -1 {
+			continue
+		}
+
+		nickname := strings.TrimSpace(line[:separator])
+		trust := line[separator+1:]
+
+		if !strings.HasPrefix(nickname, nssNicknamePrefix) || strings.Count(trust, ",") != 2 {
+			continue
+		}
+
+		result = append(result, nssCertBackup{Nickname: nickname, Trust: trust})
+	}
+
+	return result
+}
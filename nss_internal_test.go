@@ -1,7 +1,10 @@
 package certinject
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -46,3 +49,59 @@ func TestCheckCertExpired(t *testing.T) {
 		t.Errorf("Cert never expired")
 	}
 }
+
+func TestTouchCertNSS(t *testing.T) {
+	dir := t.TempDir()
+
+	certDir.SetValue(dir)
+	defer certDir.SetValue("")
+
+	certExpirePeriod.SetValue(60)
+	defer certExpirePeriod.SetValue(60 * 30)
+
+	bytesDummy := []byte(`TEST DATA`)
+	fingerprint := sha256.Sum256(bytesDummy)
+	path := filepath.Join(dir, hex.EncodeToString(fingerprint[:])+".pem")
+
+	err := injectCertFile(bytesDummy, path)
+	if err != nil {
+		t.Fatalf("Error writing cert: %s", err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatalf("Error aging cert: %s", err)
+	}
+
+	err = touchCertNSS(bytesDummy)
+	if err != nil {
+		t.Fatalf("Error touching cert: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error getting file info: %s", err)
+	}
+
+	expired, err := checkCertExpiredNSS(info)
+	if err != nil {
+		t.Errorf("Error checking if touched cert expired: %s", err)
+	}
+
+	if expired {
+		t.Errorf("Touched cert is still expired")
+	}
+
+	// Touching a cert that was never injected doesn't create it.
+	err = touchCertNSS([]byte(`OTHER DATA`))
+	if err != nil {
+		t.Errorf("Error touching missing cert: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Touching a missing cert changed the directory: %v, %v", entries, err)
+	}
+}
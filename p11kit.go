@@ -0,0 +1,410 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var (
+	p11kitFlag = cflag.Bool(flagGroup, "p11kit", false,
+		"Write TLS certs, with any extension overrides stapled to them, to a "+
+			"p11-kit anchor directory")
+	p11kitDir = cflag.String(flagGroup, "p11kitdir", "",
+		"p11-kit anchor directory to write .p11-kit files to, e.g. "+
+			"/etc/pki/ca-trust/source.  Only use a directory that only "+
+			"certinject writes to.  (Required if p11kit is set.)")
+)
+
+var ErrP11Kit = errors.New("p11-kit trust store error")
+
+const p11kitExtension = ".p11-kit"
+
+func injectCertP11Kit(derBytes []byte) error {
+	if p11kitDir.Value() == "" {
+		log.Fatal("Empty p11kitdir configuration.")
+	}
+
+	cert := injectionCert(derBytes)
+
+	var err error
+
+	cert.overrides, err = buildExtensionOverrides(derBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't build extension overrides: %w", err, ErrP11Kit)
+	}
+
+	_, err = ensureCertP11Kit(&manifestP11Kit{Dir: p11kitDir.Value()}, cert)
+
+	return err
+}
+
+// writeP11KitFile writes the objects for a cert to dir, named after the
+// cert's fingerprint, and returns the file name.
+func writeP11KitFile(dir string, derBytes, objects []byte, extCount int, requester string) (string, error) {
+	fingerprint := sha256.Sum256(derBytes)
+	name := hex.EncodeToString(fingerprint[:]) + p11kitExtension
+	path := filepath.Join(dir, name)
+
+	defer auditChangeP11Kit(auditInject, requester, dir, name)()
+
+	if dryRun.Value() {
+		planf("write %s (%d bytes, %d stapled extensions)", path, len(objects), extCount)
+
+		return name, nil
+	}
+
+	return name, os.WriteFile(path, objects, 0o644)
+}
+
+// prepareP11KitUndo returns a function that puts the cert's p11-kit file back
+// the way it is now.
+func prepareP11KitUndo(derBytes []byte) (func() error, error) {
+	if p11kitDir.Value() == "" {
+		return nil, fmt.Errorf("p11kitdir must be set: %w", ErrP11Kit)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	name := hex.EncodeToString(fingerprint[:]) + p11kitExtension
+
+	undo, err := prepareFileUndo(p11kitDir.Value(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		defer auditChangeP11Kit(auditRollback, "", p11kitDir.Value(), name)()
+
+		return undo()
+	}, nil
+}
+
+// reconcileP11Kit makes the .p11-kit files in a directory match certs.
+func reconcileP11Kit(cfg *manifestP11Kit, certs []*manifestCert) error {
+	desired := map[string]bool{}
+
+	for _, cert := range certs {
+		name, err := ensureCertP11Kit(cfg, cert)
+		if err != nil {
+			return fmt.Errorf("%s: cert %s: %w", err, cert.Path, ErrApply)
+		}
+
+		desired[name] = true
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't list %s: %w", err, cfg.Dir, ErrApply)
+	}
+
+	for _, entry := range entries {
+		if !isP11KitFile(entry.Name()) || desired[entry.Name()] {
+			continue
+		}
+
+		err = removeP11KitFile(cfg.Dir, entry.Name(), "")
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrApply)
+		}
+	}
+
+	return nil
+}
+
+// ensureCertP11Kit writes a manifest cert, with its extensions stapled, to
+// a p11-kit directory, and returns the file name.  Rewriting an unchanged
+// file is harmless, and refreshes its expiry.
+func ensureCertP11Kit(cfg *manifestP11Kit, cert *manifestCert) (string, error) {
+	exts, err := cert.extensions()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err, ErrP11Kit)
+	}
+
+	objects, err := marshalP11KitObjects(cert.der, exts)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err, ErrP11Kit)
+	}
+
+	name, err := writeP11KitFile(cfg.Dir, cert.der, objects, len(exts), cert.requester)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err, ErrP11Kit)
+	}
+
+	return name, nil
+}
+
+func removeP11KitFile(dir, name, requester string) error {
+	path := filepath.Join(dir, name)
+
+	defer auditChangeP11Kit(auditRemove, requester, dir, name)()
+
+	if dryRun.Value() {
+		planf("delete %s", path)
+
+		return nil
+	}
+
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: couldn't delete %s: %w", err, path, ErrP11Kit)
+	}
+
+	return nil
+}
+
+// touchCertP11Kit resets the age of an injected cert's file, so that
+// cleanCertsP11Kit counts it from now.
+func touchCertP11Kit(derBytes []byte) error {
+	if p11kitDir.Value() == "" {
+		return fmt.Errorf("p11kitdir must be set: %w", ErrP11Kit)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+
+	err := touchFile(filepath.Join(p11kitDir.Value(), hex.EncodeToString(fingerprint[:])+p11kitExtension))
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrP11Kit)
+	}
+
+	return nil
+}
+
+// verifyCertP11Kit checks that an injected cert's p11-kit file is what
+// injectCertP11Kit writes, with the currently requested extensions stapled.
+func verifyCertP11Kit(derBytes []byte) error {
+	if p11kitDir.Value() == "" {
+		return fmt.Errorf("p11kitdir must be set: %w", ErrVerify)
+	}
+
+	exts, err := buildExtensionOverrides(derBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't build extension overrides: %w", err, ErrVerify)
+	}
+
+	objects, err := marshalP11KitObjects(derBytes, exts)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't marshal p11-kit objects: %w", err, ErrVerify)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+
+	return verifyFile(filepath.Join(p11kitDir.Value(), hex.EncodeToString(fingerprint[:])+p11kitExtension), objects)
+}
+
+func cleanCertsP11Kit() {
+	if p11kitDir.Value() == "" {
+		log.Fatal("Empty p11kitdir configuration.")
+	}
+
+	cleanP11KitDir(p11kitDir.Value(), nil)
+}
+
+// cleanP11KitDir removes the expired files in a p11-kit directory, other
+// than those of the held certs.
+func cleanP11KitDir(dir string, held []*manifestCert) {
+	keep := map[string]bool{}
+	for _, cert := range held {
+		keep[cert.fingerprintHex()+p11kitExtension] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Errorf("Error enumerating files in p11-kit directory: %s", err)
+
+		return
+	}
+
+	for _, entry := range entries {
+		if !isP11KitFile(entry.Name()) || keep[entry.Name()] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			log.Errorf("Error reading p11-kit file metadata: %s", err)
+
+			continue
+		}
+
+		// Same expiry rule as the NSS cert directory.
+		expired, err := checkCertExpiredNSS(info)
+		if err != nil || !expired {
+			continue
+		}
+
+		if dryRun.Value() {
+			planf("delete %s", filepath.Join(dir, entry.Name()))
+
+			continue
+		}
+
+		recordClean := auditChangeP11Kit(auditClean, "", dir, entry.Name())
+
+		err = os.Remove(filepath.Join(dir, entry.Name()))
+
+		recordClean()
+
+		if err != nil {
+			log.Errorf("Error deleting expired p11-kit file: %s", err)
+
+			continue
+		}
+
+		metricCleaned.inc(manifestStoreP11Kit)
+	}
+}
+
+// auditChangeP11Kit is auditChange for a p11-kit file, named after the
+// cert's fingerprint.
+func auditChangeP11Kit(operation, requester, dir, name string) func() {
+	fingerprints := map[string]string{"sha256": strings.TrimSuffix(name, p11kitExtension)}
+
+	return auditChange(operation, requester, manifestStoreP11Kit, fingerprints, auditStateFile(filepath.Join(dir, name)))
+}
+
+func isP11KitFile(name string) bool {
+	return strings.HasSuffix(name, p11kitExtension)
+}
+
+// marshalP11KitObjects returns a p11-kit persistence file containing the
+// certificate as a trust anchor, followed by each extension stapled to the
+// certificate's public key.  p11-kit-based stores apply stapled extensions
+// in place of the certificate's own extensions with the same OID.
+func marshalP11KitObjects(derBytes []byte, exts []pkix.Extension) ([]byte, error) {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse certificate: %w", err)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	label := nicknameFromFingerprintHexNSS(hex.EncodeToString(fingerprint[:]))
+
+	var result strings.Builder
+
+	result.WriteString("[p11-kit-object-v1]\n")
+	result.WriteString("class: certificate\n")
+	result.WriteString("certificate-type: x-509\n")
+	result.WriteString("trusted: true\n")
+	fmt.Fprintf(&result, "label: %q\n", label)
+	result.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}))
+
+	for _, ext := range exts {
+		err = x509ext.ValidateExtension(ext)
+		if err != nil {
+			return nil, err
+		}
+
+		result.WriteString("\n[p11-kit-object-v1]\n")
+		result.WriteString("class: x-certificate-extension\n")
+		fmt.Fprintf(&result, "label: %q\n", label)
+		fmt.Fprintf(&result, "object-id: %s\n", ext.Id)
+
+		if ext.Critical {
+			result.WriteString("x-critical: true\n")
+		}
+
+		fmt.Fprintf(&result, "value: \"%s\"\n", percentEncode(ext.Value))
+		result.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: cert.RawSubjectPublicKeyInfo}))
+	}
+
+	return []byte(result.String()), nil
+}
+
+// parseP11KitObjects parses a p11-kit persistence file written by
+// marshalP11KitObjects, and returns the cert and its stapled extensions.
+func parseP11KitObjects(data []byte) ([]byte, []pkix.Extension, error) {
+	var derBytes []byte
+
+	exts := []pkix.Extension{}
+
+	for _, object := range strings.Split(string(data), "[p11-kit-object-v1]")[1:] {
+		attributes := map[string]string{}
+
+		for _, line := range strings.Split(object, "\n") {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) == 2 {
+				attributes[parts[0]] = parts[1]
+			}
+		}
+
+		switch attributes["class"] {
+		case "certificate":
+			block, _ := pem.Decode([]byte(object))
+			if block == nil || block.Type != "CERTIFICATE" {
+				return nil, nil, fmt.Errorf("certificate object has no certificate: %w", ErrP11Kit)
+			}
+
+			derBytes = block.Bytes
+		case "x-certificate-extension":
+			oid, err := x509ext.ParseOID(attributes["object-id"])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", err, ErrP11Kit)
+			}
+
+			value, err := percentDecode(strings.Trim(attributes["value"], `"`))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: extension %s: %w", err, oid, ErrP11Kit)
+			}
+
+			exts = append(exts, pkix.Extension{Id: oid, Critical: attributes["x-critical"] == "true", Value: value})
+		default:
+			return nil, nil, fmt.Errorf("unknown object class %q: %w", attributes["class"], ErrP11Kit)
+		}
+	}
+
+	if derBytes == nil {
+		return nil, nil, fmt.Errorf("no certificate object: %w", ErrP11Kit)
+	}
+
+	return derBytes, exts, nil
+}
+
+func percentEncode(data []byte) string {
+	var result strings.Builder
+
+	for _, b := range data {
+		fmt.Fprintf(&result, "%%%02x", b)
+	}
+
+	return result.String()
+}
+
+func percentDecode(data string) ([]byte, error) {
+	result := make([]byte, 0, len(data)/3)
+
+	for i := 0; i < len(data); i++ {
+		if data[i] != '%' {
+			result = append(result, data[i])
+
+			continue
+		}
+
+		if i+2 >= len(data) {
+			return nil, fmt.Errorf("truncated percent escape: %w", ErrP11Kit)
+		}
+
+		b, err := hex.DecodeString(data[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid percent escape: %w", err, ErrP11Kit)
+		}
+
+		result = append(result, b[0])
+		i += 2
+	}
+
+	return result, nil
+}
@@ -0,0 +1,239 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+func TestMarshalP11KitObjects(t *testing.T) {
+	pemBytes, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	exts := []pkix.Extension{
+		{Id: x509ext.OIDExtensionInhibitAnyPolicy, Critical: true, Value: []byte{0x02, 0x01, 0x00}},
+	}
+
+	objects, err := marshalP11KitObjects(block.Bytes, exts)
+	if err != nil {
+		t.Fatalf("couldn't marshal: %s", err)
+	}
+
+	text := string(objects)
+
+	for _, expected := range []string{
+		"class: certificate\n",
+		"trusted: true\n",
+		"-----BEGIN CERTIFICATE-----\n",
+		"class: x-certificate-extension\n",
+		"object-id: 2.5.29.54\n",
+		"x-critical: true\n",
+		"value: \"%02%01%00\"\n",
+		"-----BEGIN PUBLIC KEY-----\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("output doesn't contain %q:\n%s", expected, text)
+		}
+	}
+
+	exts[0].Value = []byte{0x02, 0x01, 0xff}
+
+	_, err = marshalP11KitObjects(block.Bytes, exts)
+	if err == nil {
+		t.Errorf("invalid extension was stapled")
+	}
+}
+
+func TestBuildExtensionOverridesPathLen(t *testing.T) {
+	pemBytes, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	extPathLen.SetValue(0)
+	defer extPathLen.SetValue(-1)
+
+	exts, err := buildExtensionOverrides(block.Bytes)
+	if err != nil || len(exts) != 1 || !exts[0].Id.Equal(x509ext.OIDExtensionBasicConstraints) {
+		t.Errorf("CA: got %v, %v; expected a basic constraints override", exts, err)
+	}
+
+	leaf := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "www.example.bit"},
+		DNSNames:              []string{"www.example.bit"},
+		BasicConstraintsValid: true,
+	})
+
+	_, err = buildExtensionOverrides(leaf)
+	if !errors.Is(err, ErrPathLenNotCA) {
+		t.Errorf("leaf: got %v, expected ErrPathLenNotCA", err)
+	}
+}
+
+func TestReconcileP11Kit(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := loadManifest(writeTestManifest(t, `
+[p11kit]
+dir = "`+dir+`"
+[[cert]]
+path = "root.pem"
+stores = ["p11kit"]
+eku = ["server"]
+`))
+	if err != nil {
+		t.Fatalf("couldn't load manifest: %s", err)
+	}
+
+	for _, name := range []string{"stale.p11-kit", "notes.txt"} {
+		err = os.WriteFile(filepath.Join(dir, name), []byte{}, 0o600)
+		if err != nil {
+			t.Fatalf("couldn't write %s: %s", name, err)
+		}
+	}
+
+	err = reconcileP11Kit(m.P11Kit, m.certsForStore(manifestStoreP11Kit))
+	if err != nil {
+		t.Fatalf("couldn't reconcile: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("couldn't list directory: %s", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	// The listed cert is written and the stale anchor removed, but files
+	// that aren't anchors are left alone.
+	expected := m.Certs[0].fingerprintHex() + p11kitExtension
+	if len(names) != 2 || names[0] != expected || names[1] != "notes.txt" {
+		t.Errorf("unexpected directory contents %v", names)
+	}
+}
+
+func TestVerifyCertP11Kit(t *testing.T) {
+	dir := t.TempDir()
+
+	p11kitDir.SetValue(dir)
+	defer p11kitDir.SetValue("")
+
+	extInhibitAnyPolicy.SetValue(0)
+	defer extInhibitAnyPolicy.SetValue(-1)
+
+	pemBytes, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	err = verifyCertP11Kit(block.Bytes)
+	if !errors.Is(err, ErrNotTrusted) {
+		t.Errorf("missing cert verified with %v, expected ErrNotTrusted", err)
+	}
+
+	err = injectCertP11Kit(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't inject: %s", err)
+	}
+
+	err = verifyCertP11Kit(block.Bytes)
+	if err != nil {
+		t.Errorf("injected cert didn't verify: %s", err)
+	}
+
+	// The cert is read back with its stapled extension.
+	objects, err := os.ReadFile(filepath.Join(dir, (&manifestCert{der: block.Bytes}).fingerprintHex()+p11kitExtension))
+	if err != nil {
+		t.Fatalf("couldn't read p11-kit file: %s", err)
+	}
+
+	der, exts, err := parseP11KitObjects(objects)
+	if err != nil {
+		t.Fatalf("couldn't parse p11-kit file: %s", err)
+	}
+
+	if !bytes.Equal(der, block.Bytes) || len(exts) != 1 ||
+		!exts[0].Id.Equal(x509ext.OIDExtensionInhibitAnyPolicy) || !exts[0].Critical ||
+		!bytes.Equal(exts[0].Value, []byte{0x02, 0x01, 0x00}) {
+		t.Errorf("parsed %v, expected the cert with inhibit anyPolicy stapled", exts)
+	}
+
+	// A stapled extension that no longer matches the flags fails.
+	extInhibitAnyPolicy.SetValue(1)
+
+	err = verifyCertP11Kit(block.Bytes)
+	if !errors.Is(err, ErrNotTrusted) {
+		t.Errorf("stale extension verified with %v, expected ErrNotTrusted", err)
+	}
+}
+
+func TestInjectExpirableCertTransactionP11Kit(t *testing.T) {
+	dir := t.TempDir()
+
+	p11kitFlag.SetValue(true)
+	defer p11kitFlag.SetValue(false)
+
+	p11kitDir.SetValue(dir)
+	defer p11kitDir.SetValue("")
+
+	pemBytes, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	path := filepath.Join(dir, (&manifestCert{der: block.Bytes}).fingerprintHex()+p11kitExtension)
+
+	_, err = InjectExpirableCertTransaction(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't inject: %s", err)
+	}
+
+	// Injecting it again leaves the file alone, but it's still touched.
+	old := time.Now().Add(-time.Hour)
+
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatalf("couldn't set file time: %s", err)
+	}
+
+	_, err = InjectExpirableCertTransaction(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't inject again: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("cert wasn't touched: %v", err)
+	}
+
+	p11kitDir.SetValue(filepath.Join(path, "not-a-dir"))
+
+	result, err := InjectExpirableCertTransaction(block.Bytes)
+	if !errors.Is(err, ErrTransaction) || result.Failed != manifestStoreP11Kit {
+		t.Errorf("unwritable store: got %s, %v; expected ErrTransaction", result, err)
+	}
+}
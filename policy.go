@@ -0,0 +1,517 @@
+package certinject
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+// injectPolicyPath is the policy file.  It's a fixed path rather than a
+// flag, since whoever runs a privileged helper could otherwise point it at
+// a policy of their own.
+var injectPolicyPath = defaultInjectPolicyPath()
+
+// privileged is set if certinject runs as root or elevated, and so could
+// write to stores that its caller couldn't.
+var privileged = isPrivileged()
+
+var ErrPolicyFile = errors.New("error in policy file")
+
+// spkiPinPrefix is the prefix of an SPKI pin, as in HPKP.
+const spkiPinPrefix = "sha256/"
+
+// injectPolicy is an allowlist for injection, read from the policy file,
+// e.g.:
+//
+//	stores = ["cryptoapi"]
+//	logical-stores = ["Root"]
+//	spki-pins = ["sha256/..."]
+//	names = [".bit"]
+//	forbidden-eku = ["any", "ms-code-kernel"]
+//
+// The keys are:
+//
+//   - stores lists the trust stores that may be written to.
+//   - logical-stores, if set, lists the CryptoAPI logical stores that may be
+//     written to.
+//   - issuers and spki-pins, if either is set, limit which certs may be
+//     injected: a cert must have one of the issuer names (as printed by
+//     Go, e.g. "CN=Example Root,O=Example"), or one of the SPKI pins
+//     (base64 SHA-256 of the SubjectPublicKeyInfo).  Anyone can copy an
+//     issuer name, so prefer spki-pins.
+//   - names, if set, limits the DNS names certs may be valid for, as in the
+//     serve command's client policies.  That includes the hosts of email
+//     and URI names, and the CN of certs without SANs; IP addresses aren't
+//     allowed.  CA certs must then be restricted by name constraints within
+//     names for DNS, email and URI names, excluding every IP address.
+//   - forbidden-eku lists extended key usages that certs may not be
+//     trusted for, whether via their own EKU or one set on injection.  If
+//     it's set, certs must be limited to an EKU other than any.
+//   - store-wide allows operations on every cert in a store, such as
+//     all-certs and constrain-all-roots.  Each cert they edit must still
+//     pass the other checks.
+type injectPolicy struct {
+	Stores        []string `toml:"stores"`
+	LogicalStores []string `toml:"logical-stores"`
+	Issuers       []string `toml:"issuers"`
+	SPKIPins      []string `toml:"spki-pins"`
+	Names         []string `toml:"names"`
+	ForbiddenEKU  []string `toml:"forbidden-eku"`
+	StoreWide     bool     `toml:"store-wide"`
+
+	forbiddenEKU *x509.Certificate
+}
+
+// loadInjectPolicy reads the policy file.  When certinject runs privileged,
+// the policy file is required, and must be owned by an administrator.
+// Otherwise it returns nil if there's no policy file, since certinject can
+// then only write to stores that its caller could write to anyway.
+func loadInjectPolicy() (*injectPolicy, error) {
+	path := injectPolicyPath
+
+	_, err := os.Stat(path)
+	if path == "" || errors.Is(err, os.ErrNotExist) {
+		if privileged {
+			return nil, fmt.Errorf("no policy file at %q, which is required when running privileged: %w", path,
+				ErrPolicyFile)
+		}
+
+		return nil, nil
+	}
+
+	if privileged {
+		err = checkPolicyFileOwner(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrPolicyFile)
+		}
+	}
+
+	policy := &injectPolicy{}
+
+	meta, err := toml.DecodeFile(path, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrPolicyFile)
+	}
+
+	// A typo could silently loosen the policy.
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("unknown keys %v in %s: %w", undecoded, path, ErrPolicyFile)
+	}
+
+	err = policy.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return policy, nil
+}
+
+func (p *injectPolicy) validate() error {
+	if len(p.Stores) == 0 {
+		return fmt.Errorf("no stores listed: %w", ErrPolicyFile)
+	}
+
+	for _, store := range p.Stores {
+		switch store {
+		case manifestStoreCryptoAPI, manifestStoreNSS, manifestStoreP11Kit:
+		default:
+			return fmt.Errorf("unknown store %q (consider %s, %s, %s): %w", store,
+				manifestStoreCryptoAPI, manifestStoreNSS, manifestStoreP11Kit, ErrPolicyFile)
+		}
+	}
+
+	for _, pin := range p.SPKIPins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+		if !strings.HasPrefix(pin, spkiPinPrefix) || err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("spki pin %q isn't %s followed by a base64 SHA-256 hash: %w", pin, spkiPinPrefix,
+				ErrPolicyFile)
+		}
+	}
+
+	var err error
+
+	p.forbiddenEKU, err = parseExtKeyUsageNames(p.ForbiddenEKU)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrPolicyFile)
+	}
+
+	return nil
+}
+
+// checkStores checks that the stores may be written to.  logicalStore is the
+// CryptoAPI logical store, if cryptoapi is one of them.
+func (p *injectPolicy) checkStores(stores []string, logicalStore string) error {
+	for _, store := range stores {
+		if !containsString(p.Stores, store) {
+			return fmt.Errorf("store %s isn't allowed (consider %v): %w", store, p.Stores, ErrPolicy)
+		}
+
+		if store != manifestStoreCryptoAPI || len(p.LogicalStores) == 0 {
+			continue
+		}
+
+		allowed := false
+		for _, name := range p.LogicalStores {
+			allowed = allowed || strings.EqualFold(name, logicalStore)
+		}
+
+		if !allowed {
+			return fmt.Errorf("CryptoAPI logical store %s isn't allowed (consider %v): %w", logicalStore,
+				p.LogicalStores, ErrPolicy)
+		}
+	}
+
+	return nil
+}
+
+// checkStoreWide checks whether operations on every cert in a store are
+// allowed.
+func (p *injectPolicy) checkStoreWide(operation string) error {
+	if !p.StoreWide {
+		return fmt.Errorf("%s affects every cert in the store, which isn't allowed (consider store-wide): %w",
+			operation, ErrPolicy)
+	}
+
+	return nil
+}
+
+// checkCert checks a cert, and the restrictions it will be trusted with.
+// eku and nameConstraints follow the x509ext merge functions: nil means
+// unrestricted.
+func (p *injectPolicy) checkCert(cert *x509.Certificate, eku, nameConstraints *x509.Certificate) error {
+	err := p.checkIssuer(cert)
+	if err != nil {
+		return err
+	}
+
+	err = p.checkEKU(eku)
+	if err != nil {
+		return err
+	}
+
+	if len(p.Names) == 0 {
+		return nil
+	}
+
+	err = checkCertNames(cert, p.Names)
+	if err != nil {
+		return err
+	}
+
+	isCA := cert.IsCA || !cert.BasicConstraintsValid
+	allowed := x509ext.DomainNameConstraints(p.Names)
+
+	if isCA && x509ext.NameConstraintsBroader(allowed, nameConstraints) {
+		return fmt.Errorf("name constraints must limit the cert to within %v, for every name type: %w", p.Names,
+			ErrPolicy)
+	}
+
+	return nil
+}
+
+// checkCertNames checks that every name a cert is valid for is within names.
+// That covers the hosts of email and URI SANs, and the Subject CN of a cert
+// without SANs, which legacy clients match against hostnames.  IP addresses
+// can't be within a domain, so they're never allowed.
+func checkCertNames(cert *x509.Certificate, names []string) error {
+	hosts := append([]string{}, cert.DNSNames...)
+
+	for _, email := range cert.EmailAddresses {
+		hosts = append(hosts, email[strings.LastIndex(email, "@")+1:])
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.Hostname() == "" {
+			return fmt.Errorf("cert is valid for %s, which has no host: %w", uri, ErrPolicy)
+		}
+
+		hosts = append(hosts, uri.Hostname())
+	}
+
+	if len(cert.IPAddresses) != 0 {
+		return fmt.Errorf("cert is valid for %v, outside %v: %w", cert.IPAddresses, names, ErrPolicy)
+	}
+
+	if len(hosts) == 0 && isHostnameLike(cert.Subject.CommonName) {
+		hosts = append(hosts, cert.Subject.CommonName)
+	}
+
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil || !x509ext.DomainWithinAny(host, names) {
+			return fmt.Errorf("cert is valid for %s, outside %v: %w", host, names, ErrPolicy)
+		}
+	}
+
+	return nil
+}
+
+// isHostnameLike reports whether a Subject CN might be matched as a hostname
+// or IP address, i.e. whether it consists only of characters that can
+// appear in one.
+func isHostnameLike(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		isAlphanumeric := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+		if !isAlphanumeric && !strings.ContainsRune("-._*:", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *injectPolicy) checkIssuer(cert *x509.Certificate) error {
+	if len(p.Issuers) == 0 && len(p.SPKIPins) == 0 {
+		return nil
+	}
+
+	if containsString(p.Issuers, cert.Issuer.String()) {
+		return nil
+	}
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := spkiPinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+
+	if containsString(p.SPKIPins, pin) {
+		return nil
+	}
+
+	return fmt.Errorf("cert issued by %s with SPKI pin %s isn't in issuers or spki-pins: %w", cert.Issuer, pin,
+		ErrPolicy)
+}
+
+// checkEKU checks that an EKU restriction doesn't allow a forbidden usage.
+// A cert without one is trusted for every usage, as with the any usage, so
+// neither is allowed if anything is forbidden.
+func (p *injectPolicy) checkEKU(eku *x509.Certificate) error {
+	if p.forbiddenEKU == nil {
+		return nil
+	}
+
+	if eku == nil {
+		return fmt.Errorf("cert isn't limited to any eku, so it's trusted for forbidden ones %v: %w",
+			p.ForbiddenEKU, ErrPolicy)
+	}
+
+	for _, usage := range eku.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageAny {
+			return fmt.Errorf("eku any includes forbidden ones %v: %w", p.ForbiddenEKU, ErrPolicy)
+		}
+	}
+
+	for _, usage := range eku.ExtKeyUsage {
+		for _, forbidden := range p.forbiddenEKU.ExtKeyUsage {
+			if usage == forbidden {
+				return fmt.Errorf("eku %s isn't allowed: %w", extKeyUsageName(usage), ErrPolicy)
+			}
+		}
+	}
+
+	for _, oid := range eku.UnknownExtKeyUsage {
+		for _, forbidden := range p.forbiddenEKU.UnknownExtKeyUsage {
+			if oid.Equal(forbidden) {
+				return fmt.Errorf("eku %s isn't allowed: %w", oid, ErrPolicy)
+			}
+		}
+	}
+
+	return nil
+}
+
+// extKeyUsageName returns the name that the EKU flags and manifests use for
+// usage.
+func extKeyUsageName(usage x509.ExtKeyUsage) string {
+	for name, known := range extKeyUsageNames {
+		if known == usage {
+			return name
+		}
+	}
+
+	return fmt.Sprint(usage)
+}
+
+// certRestrictions returns the EKU and name constraints in a cert itself,
+// in the form that checkCert takes.
+func certRestrictions(cert *x509.Certificate) (*x509.Certificate, *x509.Certificate) {
+	var eku, nameConstraints *x509.Certificate
+
+	if len(cert.ExtKeyUsage) != 0 || len(cert.UnknownExtKeyUsage) != 0 {
+		eku = &x509.Certificate{ExtKeyUsage: cert.ExtKeyUsage, UnknownExtKeyUsage: cert.UnknownExtKeyUsage}
+	}
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(x509ext.OIDExtensionNameConstraints) {
+			nameConstraints = cert
+		}
+	}
+
+	return eku, nameConstraints
+}
+
+// checkPolicyCert checks a cert that will be trusted with its own
+// restrictions, apart from any extensions stapled in place of them, as in
+// p11-kit.  NSS staples nothing.
+func (p *injectPolicy) checkPolicyCert(derBytes []byte, stapled []pkix.Extension) error {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't parse cert: %w", err, ErrPolicy)
+	}
+
+	cert, err = stapledCert(cert, stapled)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrPolicy)
+	}
+
+	eku, nameConstraints := certRestrictions(cert)
+
+	return p.checkCert(cert, eku, nameConstraints)
+}
+
+// stapledCert returns a copy of cert as a store that staples exts to it
+// sees it: each of them replaces the cert's own extension with the same
+// OID.  Only the extensions that the policy checks are parsed.
+func stapledCert(cert *x509.Certificate, exts []pkix.Extension) (*x509.Certificate, error) {
+	result := *cert
+	result.Extensions = []pkix.Extension{}
+
+	for _, ext := range cert.Extensions {
+		replaced := false
+		for _, stapled := range exts {
+			replaced = replaced || stapled.Id.Equal(ext.Id)
+		}
+
+		if !replaced {
+			result.Extensions = append(result.Extensions, ext)
+		}
+	}
+
+	for _, ext := range exts {
+		result.Extensions = append(result.Extensions, ext)
+
+		var err error
+
+		switch {
+		case ext.Id.Equal(x509ext.OIDExtensionBasicConstraints):
+			result.BasicConstraintsValid = true
+			result.IsCA, result.MaxPathLen, err = x509ext.ParseBasicConstraints(ext.Value)
+		case ext.Id.Equal(x509ext.OIDExtensionExtKeyUsage):
+			result.ExtKeyUsage, result.UnknownExtKeyUsage, err = x509ext.ParseExtKeyUsage(ext.Value)
+		case ext.Id.Equal(x509ext.OIDExtensionNameConstraints):
+			var nameConstraints *x509.Certificate
+
+			nameConstraints, err = x509ext.ParseNameConstraints(ext.Value)
+			if err == nil {
+				setNameConstraints(&result, nameConstraints)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("stapled extension %s: %w", ext.Id, err)
+		}
+	}
+
+	return &result, nil
+}
+
+// setNameConstraints copies the name constraints in from to cert.
+func setNameConstraints(cert, from *x509.Certificate) {
+	cert.PermittedDNSDomains = from.PermittedDNSDomains
+	cert.ExcludedDNSDomains = from.ExcludedDNSDomains
+	cert.PermittedIPRanges = from.PermittedIPRanges
+	cert.ExcludedIPRanges = from.ExcludedIPRanges
+	cert.PermittedEmailAddresses = from.PermittedEmailAddresses
+	cert.ExcludedEmailAddresses = from.ExcludedEmailAddresses
+	cert.PermittedURIDomains = from.PermittedURIDomains
+	cert.ExcludedURIDomains = from.ExcludedURIDomains
+}
+
+// checkManifestCert checks a manifest cert, with the restrictions it will
+// be injected with, before apply or the serve command injects it.
+func (p *injectPolicy) checkManifestCert(m *manifest, cert *manifestCert) error {
+	logicalStore := ""
+	if m.CryptoAPI != nil {
+		logicalStore = m.CryptoAPI.LogicalStore
+	}
+
+	err := p.checkStores(cert.Stores, logicalStore)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := x509.ParseCertificate(cert.der)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't parse cert: %w", err, ErrPolicy)
+	}
+
+	eku, nameConstraints := certRestrictions(parsed)
+
+	if cert.extKeyUsage != nil {
+		eku = cert.extKeyUsage
+	}
+
+	if cert.nameConstraints != nil {
+		nameConstraints = cert.nameConstraints
+	}
+
+	return p.checkCert(parsed, eku, nameConstraints)
+}
+
+// checkPolicy checks each cert in m against the policy file.
+func (m *manifest) checkPolicy() error {
+	policy, err := loadInjectPolicy()
+	if policy == nil {
+		return err
+	}
+
+	for _, cert := range m.Certs {
+		err := policy.checkManifestCert(m, cert)
+		if err != nil {
+			return fmt.Errorf("cert %s: %w", cert.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// CheckPolicy checks that InjectCert may inject the given cert into the
+// configured trust stores, with the configured restrictions, under the
+// policy file.  It returns an error wrapping ErrPolicy if it may not, an
+// error wrapping ErrPolicyFile if the policy file is required but missing,
+// or nil if there's no policy file.  InjectCert checks this itself; it's
+// exported so that a caller can report a violation.
+func CheckPolicy(derBytes []byte) error {
+	policy, err := loadInjectPolicy()
+	if policy == nil {
+		return err
+	}
+
+	return checkInjectPolicy(policy, derBytes)
+}
+
+// checkInjection checks a cert against the policy file, and then lints it,
+// before InjectCert injects it.
+func checkInjection(derBytes []byte) error {
+	err := CheckPolicy(derBytes)
+	if err == nil {
+		err = lintGate(derBytes, injectionLintTarget())
+	}
+
+	if err != nil {
+		metricInjectionFailures.inc(metricsErrorLabel(err))
+	}
+
+	return err
+}
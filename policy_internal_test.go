@@ -0,0 +1,253 @@
+package certinject
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+// TestMain keeps the tests from reading the machine's policy file, and runs
+// them as an unprivileged caller even if they run as root, e.g. in a
+// container.  Tests that need otherwise change them.
+func TestMain(m *testing.M) {
+	injectPolicyPath = ""
+	privileged = false
+
+	os.Exit(m.Run())
+}
+
+// usePolicy writes a policy file and points certinject at it until the test
+// finishes.
+func usePolicy(t *testing.T, policy string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.toml")
+
+	err := os.WriteFile(path, []byte(policy), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write policy: %s", err)
+	}
+
+	injectPolicyPath = path
+	t.Cleanup(func() { injectPolicyPath = "" })
+}
+
+// testCert returns a self-signed cert made from template, which is filled in
+// with a serial number and validity period.
+func testCert(t *testing.T, template *x509.Certificate) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create cert: %s", err)
+	}
+
+	return derBytes
+}
+
+func TestLoadInjectPolicy(t *testing.T) {
+	policy, err := loadInjectPolicy()
+	if policy != nil || err != nil {
+		t.Errorf("loaded %v, %v with no policy file, expected nothing", policy, err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		policy string
+	}{
+		{"no stores", `names = [".bit"]`},
+		{"unknown store", `stores = ["keychain"]`},
+		{"unknown key", "stores = [\"nss\"]\nspki-pin = [\"sha256/AAAA\"]"},
+		{"bad pin", "stores = [\"nss\"]\nspki-pins = [\"sha1/AAAA\"]"},
+		{"short pin", "stores = [\"nss\"]\nspki-pins = [\"sha256/AAAA\"]"},
+		{"unknown eku", "stores = [\"nss\"]\nforbidden-eku = [\"everything\"]"},
+	} {
+		usePolicy(t, test.policy)
+
+		_, err := loadInjectPolicy()
+		if !errors.Is(err, ErrPolicyFile) {
+			t.Errorf("%s: loaded with %v, expected ErrPolicyFile", test.name, err)
+		}
+	}
+}
+
+func TestInjectPolicy(t *testing.T) {
+	data, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	der, err := decodeCertFile(data)
+	if err != nil {
+		t.Fatalf("couldn't decode test cert: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %s", err)
+	}
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := spkiPinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := spkiPinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	usePolicy(t, `
+stores = ["cryptoapi", "p11kit"]
+logical-stores = ["Root"]
+spki-pins = ["`+otherPin+`", "`+pin+`"]
+names = ["bit"]
+forbidden-eku = ["any", "ms-code-kernel"]
+`)
+
+	policy, err := loadInjectPolicy()
+	if err != nil {
+		t.Fatalf("couldn't load policy: %s", err)
+	}
+
+	withinBit := x509ext.DomainNameConstraints([]string{"bit"})
+	serverAuth := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	anyEKU := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageAny}}
+
+	for _, test := range []struct {
+		name string
+		err  error
+	}{
+		{"p11kit", policy.checkStores([]string{manifestStoreP11Kit}, "")},
+		{"cryptoapi root", policy.checkStores([]string{manifestStoreCryptoAPI}, "root")},
+		{"pinned CA within names", policy.checkCert(cert, serverAuth, withinBit)},
+	} {
+		if test.err != nil {
+			t.Errorf("%s: denied with %s", test.name, test.err)
+		}
+	}
+
+	otherCert := *cert
+	otherCert.RawSubjectPublicKeyInfo = []byte("another key")
+
+	kernelForbidden := &injectPolicy{ForbiddenEKU: []string{"ms-code-kernel"}}
+	kernelForbidden.forbiddenEKU, _ = parseExtKeyUsageNames(kernelForbidden.ForbiddenEKU)
+
+	// The test CA has no EKU of its own, so it's trusted for every usage.
+	ekuOnly := &injectPolicy{ForbiddenEKU: []string{"any", "ms-code-kernel"}}
+	ekuOnly.forbiddenEKU, _ = parseExtKeyUsageNames(ekuOnly.ForbiddenEKU)
+
+	for _, test := range []struct {
+		name string
+		err  error
+	}{
+		{"nss", policy.checkStores([]string{manifestStoreP11Kit, manifestStoreNSS}, "")},
+		{"cryptoapi disallowed", policy.checkStores([]string{manifestStoreCryptoAPI}, "Disallowed")},
+		{"store-wide", policy.checkStoreWide("all-certs")},
+		{"unpinned", policy.checkCert(&otherCert, serverAuth, withinBit)},
+		{"forbidden eku", policy.checkCert(cert, anyEKU, withinBit)},
+		{"no eku restriction", policy.checkCert(cert, nil, withinBit)},
+		{"any eku when another is forbidden", kernelForbidden.checkEKU(anyEKU)},
+		{"CA without an eku", ekuOnly.checkPolicyCert(der, nil)},
+		{"unconstrained CA", policy.checkCert(cert, serverAuth, nil)},
+		{"CA constrained too broadly", policy.checkCert(cert, serverAuth,
+			&x509.Certificate{PermittedDNSDomains: []string{"bit", "com"}})},
+		{"CA constrained only for DNS names", policy.checkCert(cert, serverAuth,
+			&x509.Certificate{PermittedDNSDomains: []string{"bit"}})},
+		{"own restrictions", policy.checkPolicyCert(der, nil)},
+	} {
+		if !errors.Is(test.err, ErrPolicy) {
+			t.Errorf("%s: allowed with %v, expected ErrPolicy", test.name, test.err)
+		}
+	}
+}
+
+func TestCheckCertNames(t *testing.T) {
+	names := []string{".bit"}
+	site := &url.URL{Scheme: "https", Host: "www.example.bit"}
+
+	for _, test := range []struct {
+		name    string
+		cert    *x509.Certificate
+		allowed bool
+	}{
+		{"dns within", &x509.Certificate{DNSNames: []string{"www.example.bit"}}, true},
+		{"dns outside", &x509.Certificate{DNSNames: []string{"www.example.com"}}, false},
+		{"email within", &x509.Certificate{EmailAddresses: []string{"user@example.bit"}}, true},
+		{"email outside", &x509.Certificate{EmailAddresses: []string{"user@example.com"}}, false},
+		{"uri within", &x509.Certificate{URIs: []*url.URL{site}}, true},
+		{"uri without host", &x509.Certificate{URIs: []*url.URL{{Scheme: "urn", Opaque: "example"}}}, false},
+		{"ip", &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}, false},
+		{"cn within", &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.bit"}}, true},
+		{"cn outside", &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}}, false},
+		{"cn ip", &x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}}, false},
+		{"cn not a hostname", &x509.Certificate{Subject: pkix.Name{CommonName: "Example Root CA"}}, true},
+		{"cn beside sans", &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "Example"},
+			DNSNames: []string{"www.example.bit"},
+		}, true},
+	} {
+		err := checkCertNames(test.cert, names)
+		if test.allowed && err != nil {
+			t.Errorf("%s: denied with %s", test.name, err)
+		}
+
+		if !test.allowed && !errors.Is(err, ErrPolicy) {
+			t.Errorf("%s: allowed with %v, expected ErrPolicy", test.name, err)
+		}
+	}
+}
+
+func TestInjectPolicyStapled(t *testing.T) {
+	usePolicy(t, `
+stores = ["p11kit"]
+names = [".bit"]
+`)
+
+	policy, err := loadInjectPolicy()
+	if err != nil {
+		t.Fatalf("couldn't load policy: %s", err)
+	}
+
+	leaf := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "www.example.bit"},
+		DNSNames:              []string{"www.example.bit"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	})
+
+	err = policy.checkPolicyCert(leaf, nil)
+	if err != nil {
+		t.Errorf("leaf within names: denied with %s", err)
+	}
+
+	basicConstraints, err := x509ext.BuildBasicConstraints(&x509.Certificate{IsCA: true, MaxPathLenZero: true})
+	if err != nil {
+		t.Fatalf("couldn't build basic constraints: %s", err)
+	}
+
+	// Stapled as a CA, it could issue for any name.
+	err = policy.checkPolicyCert(leaf, []pkix.Extension{
+		{Id: x509ext.OIDExtensionBasicConstraints, Critical: true, Value: basicConstraints},
+	})
+	if !errors.Is(err, ErrPolicy) {
+		t.Errorf("leaf stapled as a CA: allowed with %v, expected ErrPolicy", err)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultInjectPolicyPath returns where the administrator keeps the policy
+// file.
+func defaultInjectPolicyPath() string {
+	return "/etc/certinject/policy.toml"
+}
+
+// isPrivileged reports whether certinject is running as root.
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
+// checkPolicyFileOwner checks that only root can change the policy file,
+// i.e. that root owns it and its directory, and neither is writable by
+// anyone else.
+func checkPolicyFileOwner(path string) error {
+	for _, name := range []string{path, filepath.Dir(path)} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != 0 {
+			return fmt.Errorf("%s isn't owned by root", name)
+		}
+
+		if info.Mode().Perm()&0o022 != 0 {
+			return fmt.Errorf("%s is writable by users other than root", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadInjectPolicyPrivileged(t *testing.T) {
+	privileged = true
+	t.Cleanup(func() { privileged = false })
+
+	for _, path := range []string{"", filepath.Join(t.TempDir(), "missing.toml")} {
+		injectPolicyPath = path
+
+		policy, err := loadInjectPolicy()
+		if !errors.Is(err, ErrPolicyFile) {
+			t.Errorf("no policy file at %q: loaded %v, %v, expected ErrPolicyFile", path, policy, err)
+		}
+	}
+
+	usePolicy(t, `stores = ["nss"]`)
+
+	if os.Geteuid() == 0 {
+		_, err := loadInjectPolicy()
+		if err != nil {
+			t.Errorf("couldn't load policy owned by root: %s", err)
+		}
+	}
+
+	err := os.Chmod(injectPolicyPath, 0o666)
+	if err != nil {
+		t.Fatalf("couldn't change policy mode: %s", err)
+	}
+
+	_, err = loadInjectPolicy()
+	if !errors.Is(err, ErrPolicyFile) {
+		t.Errorf("loaded a policy that anyone can write with %v, expected ErrPolicyFile", err)
+	}
+}
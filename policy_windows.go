@@ -0,0 +1,46 @@
+package certinject
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultInjectPolicyPath returns where the administrator keeps the policy
+// file, or "" if the ProgramData folder can't be found.  The environment
+// isn't consulted, since the caller controls it.
+func defaultInjectPolicyPath() string {
+	programData, err := windows.KnownFolderPath(windows.FOLDERID_ProgramData, 0)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(programData, "certinject", "policy.toml")
+}
+
+// isPrivileged reports whether certinject is running elevated.
+func isPrivileged() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// checkPolicyFileOwner checks that the policy file is owned by the
+// Administrators group or LocalSystem, so that a user can't have created
+// it.  Its ACL must also keep other users from writing to it.
+func checkPolicyFileOwner(path string) error {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return err
+	}
+
+	if !owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) && !owner.IsWellKnown(windows.WinLocalSystemSid) {
+		return fmt.Errorf("%s is owned by %s, not Administrators or LocalSystem", path, owner)
+	}
+
+	return nil
+}
@@ -26,6 +26,11 @@ const (
 	Attribute = 0x2
 	Value     = 0x4
 	Security  = 0x8
+
+	// threadAgnostic is REG_NOTIFY_THREAD_AGNOSTIC.  Without it, an
+	// asynchronous request is cancelled when the thread that made it
+	// exits, and goroutines can move between threads at any time.
+	threadAgnostic = 0x10000000
 )
 
 func regNotifyChangeKeyValue(key syscall.Handle, watchSubtree bool,
@@ -61,3 +66,11 @@ func regNotifyChangeKeyValue(key syscall.Handle, watchSubtree bool,
 func WaitChange(k registry.Key, subtree bool, filter uint32) error {
 	return regNotifyChangeKeyValue(syscall.Handle(k), subtree, filter, 0, false)
 }
+
+// NotifyChange asks for event to be signaled the next time k changes, and
+// returns immediately.  The request is used up by the first change, so it
+// has to be made again after each signal.  It doesn't depend on the calling
+// thread, so it needs Windows 8 or later.
+func NotifyChange(k registry.Key, subtree bool, filter uint32, event windows.Handle) error {
+	return regNotifyChangeKeyValue(syscall.Handle(k), subtree, filter|threadAgnostic, syscall.Handle(event), true)
+}
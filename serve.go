@@ -0,0 +1,628 @@
+package certinject
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/namecoin/certinject/client"
+	"github.com/namecoin/certinject/x509ext"
+)
+
+var (
+	ErrServe  = errors.New("error serving")
+	ErrPolicy = errors.New("request denied by policy")
+)
+
+const (
+	// maxRequestSize is generous for a single cert.
+	maxRequestSize = 1 << 20
+
+	requestTimeout = 30 * time.Second
+
+	// serveOwner owns the CryptoAPI certs that the daemon injects, so that
+	// apply doesn't remove them.
+	serveOwner = "serve"
+
+	// sweepInterval is how often the daemon removes expired certs, so that
+	// they don't outlive their ttl when no client asks it to clean.
+	sweepInterval = time.Minute
+)
+
+// serveConfig is read by the serve command, e.g.:
+//
+//	socket = "/run/certinject/certinject.sock"
+//
+//	[p11kit]
+//	dir = "/etc/pki/ca-trust/source/certinject"
+//
+//	[[client]]
+//	name = "ncdns"
+//	token = "..."
+//	stores = ["p11kit"]
+//	names = [".bit"]
+//	eku = ["server"]
+//	max-ttl = "30m"
+//
+// The store sections are the same as in a manifest.  The socket is created
+// with socket-mode (default 0o600), but since it briefly has the umask's
+// mode, keep it in a directory that only the clients can reach.
+type serveConfig struct {
+	Socket     string             `toml:"socket"`
+	SocketMode uint32             `toml:"socket-mode"`
+	CryptoAPI  *manifestCryptoAPI `toml:"cryptoapi"`
+	NSS        *manifestNSS       `toml:"nss"`
+	P11Kit     *manifestP11Kit    `toml:"p11kit"`
+	Clients    []*serveClient     `toml:"client"`
+}
+
+// serveClient is the policy for one client:
+//
+//   - stores limits which trust stores it may inject into.
+//   - names, if set, limits the DNS names its certs may be valid for,
+//     including the hosts of email and URI names and the CN of certs
+//     without SANs; IP addresses aren't allowed.  CA certs must then be
+//     injected with name constraints within names for DNS, email and URI
+//     names that exclude every IP address, so only stores that can apply
+//     name constraints can be used for them.
+//   - eku, if set, requires its certs to be restricted to some of these
+//     extended key usages.
+//   - max-ttl, if set, limits how long its certs are kept before the
+//     daemon removes them.
+type serveClient struct {
+	Name   string   `toml:"name"`
+	Token  string   `toml:"token"`
+	Stores []string `toml:"stores"`
+	Names  []string `toml:"names"`
+	EKU    []string `toml:"eku"`
+	MaxTTL string   `toml:"max-ttl"`
+
+	maxTTL time.Duration
+}
+
+// servedCert is a cert that the daemon injected for a client.
+type servedCert struct {
+	client  string
+	cert    *manifestCert
+	expires time.Time
+}
+
+func (c *servedCert) info() client.CertInfo {
+	return client.CertInfo{Fingerprint: c.cert.fingerprintHex(), Stores: c.cert.Stores, Expires: c.expires}
+}
+
+// Server is a daemon that injects certs on behalf of clients connecting to
+// its Unix socket, as limited by each client's policy.  Clients can only
+// see and remove the certs that were injected for them.  Every
+// sweepInterval, it removes the certs whose ttl has passed, whether or not
+// their client is still connected.  The daemon doesn't remember its certs
+// across restarts, so the sweep also removes the expired certs that it
+// injected before then: CryptoAPI certs once their ttl has passed, and NSS
+// and p11-kit files once they're older than the expire flag allows.
+type Server struct {
+	config *serveConfig
+	stores *manifest
+
+	mu    sync.Mutex
+	certs map[string]*servedCert
+
+	listener net.Listener
+	closed   bool
+	stop     chan struct{}
+}
+
+// NewServer reads the daemon config at path.
+func NewServer(path string) (*Server, error) {
+	config := &serveConfig{}
+
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrServe)
+	}
+
+	// As with manifests, a typo could silently loosen a policy.
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("unknown keys %v in %s: %w", undecoded, path, ErrServe)
+	}
+
+	if config.SocketMode == 0 {
+		config.SocketMode = 0o600
+	}
+
+	// Reuse the manifest's defaults and checks for the store sections.
+	stores := &manifest{CryptoAPI: config.CryptoAPI, NSS: config.NSS, P11Kit: config.P11Kit, owner: serveOwner}
+
+	err = stores.setDefaults()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrServe)
+	}
+
+	tokens := map[string]bool{}
+
+	for _, c := range config.Clients {
+		err = c.validate(stores)
+		if err != nil {
+			return nil, fmt.Errorf("client %q: %w", c.Name, err)
+		}
+
+		if tokens[c.Token] {
+			return nil, fmt.Errorf("client %q reuses another client's token: %w", c.Name, ErrServe)
+		}
+
+		tokens[c.Token] = true
+	}
+
+	// Each request is checked against the policy file too, so refuse to
+	// start rather than deny every request if it's required but missing.
+	_, err = loadInjectPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{config: config, stores: stores, certs: map[string]*servedCert{}, stop: make(chan struct{})}, nil
+}
+
+func (c *serveClient) validate(stores *manifest) error {
+	if c.Name == "" || c.Token == "" {
+		return fmt.Errorf("name and token are required: %w", ErrServe)
+	}
+
+	if len(c.Stores) == 0 {
+		return fmt.Errorf("no stores listed: %w", ErrServe)
+	}
+
+	// A cert with nothing but the client's stores must pass the manifest's
+	// checks, e.g. that each store is configured.
+	probe := &manifestCert{}
+
+	for _, store := range c.Stores {
+		err := probe.checkStore(stores, store)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrServe)
+		}
+	}
+
+	_, err := parseExtKeyUsageNames(c.EKU)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrServe)
+	}
+
+	if c.MaxTTL != "" {
+		c.maxTTL, err = time.ParseDuration(c.MaxTTL)
+		if err != nil || c.maxTTL <= 0 {
+			return fmt.Errorf("invalid max-ttl %q: %w", c.MaxTTL, ErrServe)
+		}
+	}
+
+	return nil
+}
+
+// ListenAndServe listens on the configured socket and serves until Close is
+// called.
+func (s *Server) ListenAndServe() error {
+	if s.config.Socket == "" {
+		return fmt.Errorf("no socket configured: %w", ErrServe)
+	}
+
+	// Remove a socket left behind by a previous run, but nothing else.
+	if info, err := os.Lstat(s.config.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(s.config.Socket)
+	}
+
+	listener, err := net.Listen("unix", s.config.Socket)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't listen on %s: %w", err, s.config.Socket, ErrServe)
+	}
+
+	err = os.Chmod(s.config.Socket, os.FileMode(s.config.SocketMode))
+	if err != nil {
+		listener.Close()
+
+		return fmt.Errorf("%s: couldn't set mode of %s: %w", err, s.config.Socket, ErrServe)
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve handles connections on listener until Close is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	closed := s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return listener.Close()
+	}
+
+	// The owned certs gauge counts the stores the daemon injects into.
+	setMetricsStores(s.stores)
+
+	go s.sweepEvery(sweepInterval)
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrServe)
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops Serve.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		close(s.stop)
+	}
+
+	s.closed = true
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	req := &client.Request{}
+
+	var resp *client.Response
+
+	err := json.NewDecoder(io.LimitReader(conn, maxRequestSize)).Decode(req)
+	if err != nil {
+		resp = &client.Response{Error: fmt.Sprintf("couldn't decode request: %s", err)}
+	} else {
+		resp = s.handle(req)
+	}
+
+	err = json.NewEncoder(conn).Encode(resp)
+	if err != nil {
+		log.Warnf("Couldn't send response: %s", err)
+	}
+}
+
+func (s *Server) handle(req *client.Request) *client.Response {
+	c := s.authenticate(req.Token)
+	if c == nil {
+		log.Warnf("Rejected %s request with unknown token", req.Op)
+
+		return &client.Response{Error: fmt.Sprintf("unknown token: %s", ErrPolicy)}
+	}
+
+	// The stores aren't safe to change concurrently, e.g. certutil may
+	// fail while another certutil has the database open.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		certs []client.CertInfo
+		err   error
+	)
+
+	switch req.Op {
+	case client.OpInject:
+		certs, err = s.inject(c, req)
+	case client.OpRemove:
+		err = s.remove(c, req.Fingerprint)
+	case client.OpList:
+		certs = s.list(c, false)
+	case client.OpClean:
+		certs, err = s.clean(c)
+	default:
+		err = fmt.Errorf("unknown op %q (consider %s, %s, %s, %s): %w", req.Op,
+			client.OpInject, client.OpRemove, client.OpList, client.OpClean, ErrServe)
+	}
+
+	if err != nil {
+		log.Warnf("Client %s: %s failed: %s", c.Name, req.Op, err)
+
+		return &client.Response{Error: err.Error()}
+	}
+
+	return &client.Response{Certs: certs}
+}
+
+func (s *Server) authenticate(token string) *serveClient {
+	var result *serveClient
+
+	// Compare every token, so that timing doesn't say how many clients
+	// there are before the right one.
+	for _, c := range s.config.Clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			result = c
+		}
+	}
+
+	return result
+}
+
+func (s *Server) inject(c *serveClient, req *client.Request) ([]client.CertInfo, error) {
+	der, err := decodeCertFile(req.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &manifestCert{Path: "request", Stores: req.Stores, EKU: req.EKU, der: der, requester: c.Name}
+
+	if len(cert.Stores) == 0 {
+		cert.Stores = c.Stores
+	}
+
+	if req.NameConstraints != nil {
+		cert.NameConstraints = &nameConstraintsPolicy{
+			PermittedDNS:   req.NameConstraints.PermittedDNS,
+			ExcludedDNS:    req.NameConstraints.ExcludedDNS,
+			PermittedIP:    req.NameConstraints.PermittedIP,
+			ExcludedIP:     req.NameConstraints.ExcludedIP,
+			PermittedEmail: req.NameConstraints.PermittedEmail,
+			ExcludedEmail:  req.NameConstraints.ExcludedEmail,
+			PermittedURI:   req.NameConstraints.PermittedURI,
+			ExcludedURI:    req.NameConstraints.ExcludedURI,
+		}
+	}
+
+	err = cert.validate(s.stores)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := c.checkPolicy(cert, req.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// CryptoAPI records the expiry next to the cert, so that a sweep after a
+	// restart still removes it.
+	cert.ttl = ttl
+
+	policy, err := loadInjectPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != nil {
+		err = policy.checkManifestCert(s.stores, cert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fingerprintHex := cert.fingerprintHex()
+
+	others := [][]byte{}
+
+	for otherFingerprintHex, served := range s.certs {
+		if otherFingerprintHex != fingerprintHex {
+			others = append(others, served.cert.der)
+		}
+	}
+
+	err = lintGate(der, s.stores.lintTarget(cert, others))
+	if err != nil {
+		return nil, err
+	}
+
+	existing := s.certs[fingerprintHex]
+	if existing != nil && existing.client != c.Name {
+		return nil, fmt.Errorf("cert was injected for another client: %w", ErrPolicy)
+	}
+
+	for i, store := range cert.Stores {
+		err = observeInjection(store, func() error { return ensureCert(s.stores, cert, store) })
+		if err != nil {
+			// Don't leave a new cert in some stores but not others.
+			if existing == nil {
+				for _, done := range cert.Stores[:i] {
+					_ = removeCert(s.stores, cert, done)
+				}
+			}
+
+			return nil, fmt.Errorf("%s: %s", store, err)
+		}
+	}
+
+	served := &servedCert{client: c.Name, cert: cert}
+	if ttl != 0 {
+		served.expires = time.Now().Add(ttl)
+	}
+
+	s.certs[fingerprintHex] = served
+
+	log.Infof("Client %s: injected %s into %v", c.Name, fingerprintHex, cert.Stores)
+
+	return []client.CertInfo{served.info()}, nil
+}
+
+// checkPolicy checks a validated request cert against the client's policy,
+// and returns how long to keep the cert.
+func (c *serveClient) checkPolicy(cert *manifestCert, ttl time.Duration) (time.Duration, error) {
+	for _, store := range cert.Stores {
+		if !containsString(c.Stores, store) {
+			return 0, fmt.Errorf("store %s isn't allowed (consider %v): %w", store, c.Stores, ErrPolicy)
+		}
+	}
+
+	if len(c.Names) != 0 {
+		err := c.checkNames(cert)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.EKU) != 0 {
+		if len(cert.EKU) == 0 {
+			return 0, fmt.Errorf("eku is required (consider %v): %w", c.EKU, ErrPolicy)
+		}
+
+		for _, eku := range cert.EKU {
+			if !containsString(c.EKU, eku) {
+				return 0, fmt.Errorf("eku %s isn't allowed (consider %v): %w", eku, c.EKU, ErrPolicy)
+			}
+		}
+	}
+
+	if ttl == 0 {
+		ttl = c.maxTTL
+	}
+
+	if ttl < 0 || (c.maxTTL != 0 && ttl > c.maxTTL) {
+		return 0, fmt.Errorf("ttl %s isn't allowed (max %s): %w", ttl, c.maxTTL, ErrPolicy)
+	}
+
+	return ttl, nil
+}
+
+// checkNames makes sure that the cert can only vouch for names within the
+// client's names.  A leaf cert is limited by its own names, but a CA
+// cert could issue for any name unless it's injected with name constraints.
+func (c *serveClient) checkNames(cert *manifestCert) error {
+	parsed, err := x509.ParseCertificate(cert.der)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrPolicy)
+	}
+
+	err = checkCertNames(parsed, c.Names)
+	if err != nil {
+		return err
+	}
+
+	isCA := parsed.IsCA || !parsed.BasicConstraintsValid
+
+	if isCA || cert.nameConstraints != nil {
+		allowed := x509ext.DomainNameConstraints(c.Names)
+
+		if x509ext.NameConstraintsBroader(allowed, cert.nameConstraints) {
+			return fmt.Errorf("name constraints must limit the cert to within %v, for every name type: %w",
+				c.Names, ErrPolicy)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) remove(c *serveClient, fingerprintHex string) error {
+	served := s.certs[fingerprintHex]
+	if served == nil || served.client != c.Name {
+		return fmt.Errorf("no cert %q was injected for this client: %w", fingerprintHex, ErrPolicy)
+	}
+
+	for _, store := range served.cert.Stores {
+		err := removeCert(s.stores, served.cert, store)
+		if err != nil {
+			return fmt.Errorf("%s: %s", store, err)
+		}
+	}
+
+	delete(s.certs, fingerprintHex)
+
+	log.Infof("Client %s: removed %s", c.Name, fingerprintHex)
+
+	return nil
+}
+
+// list returns the client's certs, sorted by fingerprint.  If expiredOnly is
+// set, only those whose ttl has passed are returned.
+func (s *Server) list(c *serveClient, expiredOnly bool) []client.CertInfo {
+	result := []client.CertInfo{}
+	now := time.Now()
+
+	for _, served := range s.certs {
+		if served.client != c.Name {
+			continue
+		}
+
+		if expiredOnly && (served.expires.IsZero() || served.expires.After(now)) {
+			continue
+		}
+
+		result = append(result, served.info())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+
+	return result
+}
+
+func (s *Server) clean(c *serveClient) ([]client.CertInfo, error) {
+	expired := s.list(c, true)
+
+	for i, info := range expired {
+		err := s.remove(c, info.Fingerprint)
+		if err != nil {
+			return expired[:i], err
+		}
+	}
+
+	return expired, nil
+}
+
+// sweepEvery runs sweep every interval until Close is called.
+func (s *Server) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes every client's expired certs, and the expired certs that the
+// daemon injected before it started, which no client can remove any more.
+func (s *Server) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.config.Clients {
+		_, err := s.clean(c)
+		if err != nil {
+			log.Warnf("Client %s: removing expired certs failed: %s", c.Name, err)
+		}
+	}
+
+	held := []*manifestCert{}
+	for _, served := range s.certs {
+		held = append(held, served.cert)
+	}
+
+	sweepStores(s.stores, held)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
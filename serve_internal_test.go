@@ -0,0 +1,294 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject/client"
+)
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	anchors := filepath.Join(dir, "anchors")
+	socket := filepath.Join(dir, "certinject.sock")
+	configPath := filepath.Join(dir, "serve.toml")
+
+	err := os.Mkdir(anchors, 0o700)
+	if err != nil {
+		t.Fatalf("couldn't create anchor directory: %s", err)
+	}
+
+	err = os.WriteFile(configPath, []byte(`
+socket = "`+socket+`"
+
+[p11kit]
+dir = "`+anchors+`"
+
+[[client]]
+name = "resolver"
+token = "resolver-token"
+stores = ["p11kit"]
+names = [".bit"]
+eku = ["server"]
+max-ttl = "1h"
+
+[[client]]
+name = "other"
+token = "other-token"
+stores = ["p11kit"]
+`), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write config: %s", err)
+	}
+
+	server, err := NewServer(configPath)
+	if err != nil {
+		t.Fatalf("couldn't read config: %s", err)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+
+	done := make(chan error)
+
+	go func() { done <- server.Serve(listener) }()
+
+	defer func() {
+		_ = server.Close()
+
+		if err := <-done; err != nil {
+			t.Errorf("serve failed: %s", err)
+		}
+	}()
+
+	pemBytes, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+
+	resolver := client.New(socket, "resolver-token")
+
+	// The CA isn't constrained to .bit.
+	_, err = resolver.Inject(block.Bytes, client.InjectOptions{EKU: []string{"server"}})
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("unconstrained CA: expected ErrServer, got %v", err)
+	}
+
+	_, err = resolver.Inject(block.Bytes, client.InjectOptions{
+		NameConstraints: &client.NameConstraints{PermittedDNS: []string{".example.bit"}},
+	})
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("missing eku: expected ErrServer, got %v", err)
+	}
+
+	// Constrained only for DNS names, it could still issue for IP
+	// addresses, emails and URIs.
+	_, err = resolver.Inject(block.Bytes, client.InjectOptions{
+		EKU:             []string{"server"},
+		NameConstraints: &client.NameConstraints{PermittedDNS: []string{".example.bit"}},
+	})
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("CA constrained only for DNS names: expected ErrServer, got %v", err)
+	}
+
+	info, err := resolver.Inject(block.Bytes, client.InjectOptions{
+		EKU: []string{"server"},
+		NameConstraints: &client.NameConstraints{
+			PermittedDNS:   []string{".example.bit"},
+			ExcludedIP:     []string{"0.0.0.0/0", "::/0"},
+			PermittedEmail: []string{".example.bit"},
+			PermittedURI:   []string{".example.bit"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("couldn't inject: %s", err)
+	}
+
+	if info.Expires.IsZero() {
+		t.Errorf("expected max-ttl to be applied")
+	}
+
+	_, err = os.Stat(filepath.Join(anchors, info.Fingerprint+p11kitExtension))
+	if err != nil {
+		t.Errorf("anchor not written: %s", err)
+	}
+
+	err = client.New(socket, "other-token").Remove(info.Fingerprint)
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("other client's cert: expected ErrServer, got %v", err)
+	}
+
+	_, err = client.New(socket, "wrong-token").List()
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("wrong token: expected ErrServer, got %v", err)
+	}
+
+	certs, err := resolver.List()
+	if err != nil || len(certs) != 1 || certs[0].Fingerprint != info.Fingerprint {
+		t.Errorf("unexpected list %+v, %v", certs, err)
+	}
+
+	err = resolver.Remove(info.Fingerprint)
+	if err != nil {
+		t.Errorf("couldn't remove: %s", err)
+	}
+
+	_, err = os.Stat(filepath.Join(anchors, info.Fingerprint+p11kitExtension))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("anchor not removed: %v", err)
+	}
+}
+
+func TestServeConfigErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"unconfigured store": `
+[[client]]
+name = "resolver"
+token = "t"
+stores = ["p11kit"]
+`,
+		"duplicate token": `
+[p11kit]
+dir = "/anchors"
+[[client]]
+name = "a"
+token = "t"
+stores = ["p11kit"]
+[[client]]
+name = "b"
+token = "t"
+stores = ["p11kit"]
+`,
+		"unknown key": `
+[p11kit]
+dir = "/anchors"
+[[client]]
+name = "a"
+token = "t"
+stores = ["p11kit"]
+max-tll = "1h"
+`,
+	} {
+		path := filepath.Join(t.TempDir(), "serve.toml")
+
+		err := os.WriteFile(path, []byte(text), 0o600)
+		if err != nil {
+			t.Fatalf("couldn't write config: %s", err)
+		}
+
+		_, err = NewServer(path)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestServeSweep(t *testing.T) {
+	dir := t.TempDir()
+	anchors := filepath.Join(dir, "anchors")
+	configPath := filepath.Join(dir, "serve.toml")
+
+	err := os.Mkdir(anchors, 0o700)
+	if err != nil {
+		t.Fatalf("couldn't create anchor directory: %s", err)
+	}
+
+	err = os.WriteFile(configPath, []byte(`
+[p11kit]
+dir = "`+anchors+`"
+
+[[client]]
+name = "resolver"
+token = "resolver-token"
+stores = ["p11kit"]
+`), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write config: %s", err)
+	}
+
+	server, err := NewServer(configPath)
+	if err != nil {
+		t.Fatalf("couldn't read config: %s", err)
+	}
+
+	old := time.Now().Add(-time.Duration(certExpirePeriod.Value()+60) * time.Second)
+	served := map[string]time.Time{
+		"testdata/untrusted-root.badssl.com.ca.pem.cert": time.Now().Add(-time.Minute),
+		"testdata/github.com.ca.pem.cert":                {},
+	}
+	names := map[string]string{}
+
+	for path, expires := range served {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("couldn't read cert: %s", err)
+		}
+
+		der, err := decodeCertFile(data)
+		if err != nil {
+			t.Fatalf("couldn't decode cert: %s", err)
+		}
+
+		cert := &manifestCert{Path: path, Stores: []string{manifestStoreP11Kit}, der: der}
+
+		err = ensureCert(server.stores, cert, manifestStoreP11Kit)
+		if err != nil {
+			t.Fatalf("couldn't inject: %s", err)
+		}
+
+		names[path] = filepath.Join(anchors, cert.fingerprintHex()+p11kitExtension)
+		server.certs[cert.fingerprintHex()] = &servedCert{client: "resolver", cert: cert, expires: expires}
+
+		// A cert the daemon holds is only removed once its own ttl
+		// passes, however old its file is.
+		err = os.Chtimes(names[path], old, old)
+		if err != nil {
+			t.Fatalf("couldn't age file: %s", err)
+		}
+	}
+
+	// Left behind by a previous run, so no client can remove them.
+	leftover := filepath.Join(anchors, strings.Repeat("ab", 32)+p11kitExtension)
+	recent := filepath.Join(anchors, strings.Repeat("cd", 32)+p11kitExtension)
+
+	for _, path := range []string{leftover, recent} {
+		err = os.WriteFile(path, []byte{}, 0o600)
+		if err != nil {
+			t.Fatalf("couldn't write leftover: %s", err)
+		}
+	}
+
+	err = os.Chtimes(leftover, old, old)
+	if err != nil {
+		t.Fatalf("couldn't age file: %s", err)
+	}
+
+	server.sweep()
+
+	expired := names["testdata/untrusted-root.badssl.com.ca.pem.cert"]
+	held := names["testdata/github.com.ca.pem.cert"]
+
+	for path, removed := range map[string]bool{expired: true, held: false, leftover: true, recent: false} {
+		_, err = os.Stat(path)
+		if removed != errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected removed %t, got %v", path, removed, err)
+		}
+	}
+
+	if len(server.certs) != 1 {
+		t.Errorf("expected only the unexpired cert to be held, got %d", len(server.certs))
+	}
+}
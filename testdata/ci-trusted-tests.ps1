@@ -40,6 +40,19 @@ If (!$?) {
   exit 222
 }
 
+Write-Host "----- Untrusted root CA TLS website; dry run of injecting root CA PEM certificate into $physical_store/$logical_store -----"
+Write-Host "planning certificate injection"
+& "certinject.exe" "-capi.physical-store" "$physical_store" "-capi.logical-store" "$logical_store" "-certinject.cert" "testdata/untrusted-root.badssl.com.ca.pem.cert" "-certstore.cryptoapi" "-certstore.dry-run"
+If (!$?) {
+  Write-Host "certificate injection dry run failed"
+  exit 222
+}
+
+& "powershell" "-ExecutionPolicy" "Unrestricted" "-File" "testdata/try-tls-handshake.ps1" "-url" "https://untrusted-root.badssl.com/" "-fail"
+If (!$?) {
+  exit 222
+}
+
 Write-Host "----- Untrusted root CA TLS website; injecting root CA PEM certificate into $physical_store/$logical_store -----"
 Write-Host "injecting certificate into trust store"
 & "certinject.exe" "-capi.physical-store" "$physical_store" "-capi.logical-store" "$logical_store" "-certinject.cert" "testdata/untrusted-root.badssl.com.ca.pem.cert" "-certstore.cryptoapi"
@@ -0,0 +1,257 @@
+package certinject
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var transactional = cflag.Bool(flagGroup, "transactional", false,
+	"Inject into either all configured trust stores or none of them: if "+
+		"one fails, undo the changes made to the others")
+
+var (
+	ErrTransaction = errors.New("transactional injection failed")
+	ErrRollback    = fmt.Errorf("error rolling back: %w", ErrTransaction)
+)
+
+// InjectResult says what a transactional injection did to each trust store.
+type InjectResult struct {
+	// Committed lists the stores whose changes were kept.
+	Committed []string
+
+	// RolledBack lists the stores whose changes were undone because a
+	// later store failed.
+	RolledBack []string
+
+	// Failed is the store that failed, or empty if none did.
+	Failed string
+
+	// RollbackFailed is the store that couldn't be rolled back, or empty
+	// if none couldn't.  It may still have some or all of its changes.
+	RollbackFailed string
+}
+
+func (r *InjectResult) String() string {
+	result := fmt.Sprintf("committed: [%s]", strings.Join(r.Committed, ", "))
+
+	if r.Failed != "" {
+		result += fmt.Sprintf(", failed: %s, rolled back: [%s]", r.Failed, strings.Join(r.RolledBack, ", "))
+	}
+
+	if r.RollbackFailed != "" {
+		result += fmt.Sprintf(", rollback failed: %s", r.RollbackFailed)
+	}
+
+	return result
+}
+
+// transactionStep injects into one trust store.  prepare records whatever
+// is needed to undo the injection, and returns a function that undoes it.
+// It's called before inject, so that a partial injection can be undone too.
+type transactionStep struct {
+	store   string
+	prepare func() (undo func() error, err error)
+	inject  func() error
+}
+
+// InjectCertTransaction injects the given cert into all configured trust
+// stores, one at a time.  If one fails, the changes made to it and to every
+// store before it are undone, in reverse order, and an error wrapping
+// ErrTransaction is returned.  The result says which stores committed
+// either way.
+func InjectCertTransaction(derBytes []byte) (*InjectResult, error) {
+	return injectCertTransaction(derBytes, false)
+}
+
+// InjectExpirableCertTransaction is InjectCertTransaction for a short-lived
+// cert, as InjectExpirableCert is for InjectCert.  Once every store has
+// committed, the cert is touched, so that its age counts from now; an error
+// doing so is returned, but the injection isn't undone.
+func InjectExpirableCertTransaction(derBytes []byte) (*InjectResult, error) {
+	result, err := injectCertTransaction(derBytes, true)
+	if err != nil || dryRun.Value() {
+		return result, err
+	}
+
+	err = touchCert(derBytes)
+	if err != nil {
+		return result, fmt.Errorf("%s: couldn't touch the injected cert: %w", err, ErrTransaction)
+	}
+
+	return result, nil
+}
+
+func injectCertTransaction(derBytes []byte, expirable bool) (*InjectResult, error) {
+	err := checkInjection(derBytes)
+	if err != nil {
+		return &InjectResult{Committed: []string{}}, err
+	}
+
+	steps, err := transactionSteps(derBytes, expirable)
+	if err != nil {
+		return &InjectResult{Committed: []string{}}, err
+	}
+
+	return runTransaction(steps)
+}
+
+func runTransaction(steps []transactionStep) (*InjectResult, error) {
+	result := &InjectResult{Committed: []string{}, RolledBack: []string{}}
+	undos := []func() error{}
+
+	for _, step := range steps {
+		undo, err := step.prepare()
+		if err == nil {
+			undos = append(undos, undo)
+
+			err = observeInjection(step.store, step.inject)
+		}
+
+		if err == nil {
+			result.Committed = append(result.Committed, step.store)
+
+			continue
+		}
+
+		result.Failed = step.store
+		stepErr := fmt.Errorf("%s: %s: %w", step.store, err, ErrTransaction)
+
+		// Undo the failed store first, since it may be partly injected,
+		// then the committed ones, newest first.
+		stores := append(append([]string{}, result.Committed...), step.store)
+
+		for i := len(undos) - 1; i >= 0; i-- {
+			undoErr := undos[i]()
+			if undoErr != nil {
+				// Stop rather than undo older changes while a newer one
+				// is stuck.  This store and the ones before it still
+				// have their changes.
+				result.RollbackFailed = stores[i]
+
+				if i < len(result.Committed) {
+					result.Committed = result.Committed[:i+1]
+				}
+
+				return result, fmt.Errorf("%s; rolling back %s: %s: %w", stepErr, stores[i], undoErr, ErrRollback)
+			}
+
+			if i < len(result.Committed) {
+				result.RolledBack = append(result.RolledBack, stores[i])
+			}
+		}
+
+		result.Committed = result.Committed[:0]
+
+		return result, stepErr
+	}
+
+	return result, nil
+}
+
+// injectCertTransactional runs InjectCertTransaction for InjectCert, which
+// can only log.
+func injectCertTransactional(derBytes []byte, expirable bool) {
+	result, err := injectCertTransaction(derBytes, expirable)
+	if err != nil {
+		log.Errorf("Transactional injection failed (%s): %s", result, err)
+
+		return
+	}
+
+	log.Debugf("Transactional injection succeeded (%s)", result)
+}
+
+// prepareFileUndo returns a function that puts a file in dir back the way it
+// is now, deleting it if it doesn't exist yet.
+func prepareFileUndo(dir, name string) (func() error, error) {
+	old, err := backupFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if old != nil {
+			return restoreFile(dir, *old)
+		}
+
+		path := filepath.Join(dir, name)
+
+		if dryRun.Value() {
+			planf("delete %s", path)
+
+			return nil
+		}
+
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: couldn't delete %s: %w", err, path, ErrRollback)
+		}
+
+		return nil
+	}, nil
+}
+
+// prepareNSSUndo returns a function that puts the cert's NSS database entry
+// and cert file back the way they are now.
+func prepareNSSUndo(derBytes []byte) (func() error, error) {
+	if certDir.Value() == "" || nssDir.Value() == "" {
+		return nil, fmt.Errorf("nsscertdir and nssdbdir must both be set: %w", ErrNSS)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+
+	listed, err := listCertsNSS(nssDir.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	oldTrust := ""
+
+	for _, cert := range listed {
+		if cert.Nickname == nickname {
+			oldTrust = cert.Trust
+		}
+	}
+
+	undoFile, err := prepareFileUndo(certDir.Value(), fingerprintHex+".pem")
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		defer auditChangeNSS(auditRollback, "", nssDir.Value(), certDir.Value(), fingerprintHex)()
+
+		var err error
+
+		switch oldTrust {
+		case "":
+			// Also deletes the cert file, which undoFile then puts
+			// back if it was already there.
+			err = removeCertNSS(nssDir.Value(), certDir.Value(), fingerprintHex+".pem")
+		case nssDefaultTrust:
+			// Injecting didn't change the trust flags.
+		default:
+			var stdoutStderr []byte
+
+			stdoutStderr, err = runCertutil(nil, "-d", "sql:"+nssDir.Value(), "-M", "-t", oldTrust, "-n", nickname)
+			if err != nil {
+				err = fmt.Errorf("%s: %s: %w", err, stdoutStderr, ErrCertutil)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return undoFile()
+	}, nil
+}
@@ -0,0 +1,142 @@
+package certinject
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var errTestStep = errors.New("test step failed")
+
+// testStep returns a step that appends to log as it's prepared, injected and
+// undone, failing where asked.
+func testStep(store string, log *[]string, failInject, failUndo bool) transactionStep {
+	return transactionStep{
+		store: store,
+		prepare: func() (func() error, error) {
+			return func() error {
+				*log = append(*log, "undo "+store)
+
+				if failUndo {
+					return errTestStep
+				}
+
+				return nil
+			}, nil
+		},
+		inject: func() error {
+			*log = append(*log, "inject "+store)
+
+			if failInject {
+				return errTestStep
+			}
+
+			return nil
+		},
+	}
+}
+
+func TestRunTransaction(t *testing.T) {
+	log := []string{}
+
+	result, err := runTransaction([]transactionStep{
+		testStep("a", &log, false, false),
+		testStep("b", &log, false, false),
+	})
+	if err != nil || !reflect.DeepEqual(result.Committed, []string{"a", "b"}) {
+		t.Errorf("expected both to commit, got %s, %v", result, err)
+	}
+
+	log = []string{}
+
+	result, err = runTransaction([]transactionStep{
+		testStep("a", &log, false, false),
+		testStep("b", &log, false, false),
+		testStep("c", &log, true, false),
+		testStep("d", &log, false, false),
+	})
+	if !errors.Is(err, ErrTransaction) || errors.Is(err, ErrRollback) {
+		t.Errorf("expected ErrTransaction, got %v", err)
+	}
+
+	expectedLog := []string{"inject a", "inject b", "inject c", "undo c", "undo b", "undo a"}
+	if !reflect.DeepEqual(log, expectedLog) {
+		t.Errorf("expected %v, got %v", expectedLog, log)
+	}
+
+	if len(result.Committed) != 0 || result.Failed != "c" || !reflect.DeepEqual(result.RolledBack, []string{"b", "a"}) {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+func TestRunTransactionRollbackFailure(t *testing.T) {
+	log := []string{}
+
+	result, err := runTransaction([]transactionStep{
+		testStep("a", &log, false, false),
+		testStep("b", &log, false, true),
+		testStep("c", &log, true, false),
+	})
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("expected ErrRollback, got %v", err)
+	}
+
+	// b's undo failed, and a was never undone, so both still have their
+	// changes.
+	if !reflect.DeepEqual(result.Committed, []string{"a", "b"}) || len(result.RolledBack) != 0 ||
+		result.RollbackFailed != "b" {
+		t.Errorf("unexpected result %s", result)
+	}
+
+	log = []string{}
+
+	result, err = runTransaction([]transactionStep{
+		testStep("a", &log, false, false),
+		testStep("b", &log, true, true),
+	})
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("expected ErrRollback, got %v", err)
+	}
+
+	// b may be partly injected, and a was never undone.
+	if !reflect.DeepEqual(result.Committed, []string{"a"}) || result.Failed != "b" || result.RollbackFailed != "b" {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+func TestPrepareFileUndo(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "existing"), []byte("old"), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write file: %s", err)
+	}
+
+	undoExisting, err := prepareFileUndo(dir, "existing")
+	if err != nil {
+		t.Fatalf("couldn't prepare undo: %s", err)
+	}
+
+	undoNew, err := prepareFileUndo(dir, "new")
+	if err != nil {
+		t.Fatalf("couldn't prepare undo: %s", err)
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "existing"), []byte("changed"), 0o600)
+	_ = os.WriteFile(filepath.Join(dir, "new"), []byte("added"), 0o600)
+
+	if undoExisting() != nil || undoNew() != nil {
+		t.Fatalf("couldn't undo")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "existing"))
+	if err != nil || string(data) != "old" {
+		t.Errorf("existing file not restored: %q, %v", data, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("new file not deleted: %v", err)
+	}
+}
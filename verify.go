@@ -0,0 +1,67 @@
+package certinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrVerify     = errors.New("error verifying trust stores")
+	ErrNotTrusted = fmt.Errorf("trust store doesn't hold the cert as injected: %w", ErrVerify)
+)
+
+// storeVerifier checks that one trust store holds a cert as InjectCert
+// would leave it.
+type storeVerifier struct {
+	store  string
+	verify func() error
+}
+
+// verifyStores runs each verifier, and logs the result for each store.  All
+// of them run even if one fails, so that the log shows every problem.
+func verifyStores(verifiers []storeVerifier) error {
+	if len(verifiers) == 0 {
+		return fmt.Errorf("no trust store is configured: %w", ErrVerify)
+	}
+
+	failed := 0
+
+	for _, verifier := range verifiers {
+		err := verifier.verify()
+		if err != nil {
+			log.Errorf("Cert isn't trusted in %s: %s", verifier.store, err)
+
+			failed++
+
+			continue
+		}
+
+		log.Infof("Cert is trusted in %s", verifier.store)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d trust stores failed verification: %w", failed, len(verifiers), ErrNotTrusted)
+	}
+
+	return nil
+}
+
+// verifyFile checks that path holds exactly want.
+func verifyFile(path string, want []byte) error {
+	got, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is missing: %w", path, ErrNotTrusted)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrVerify)
+	}
+
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s doesn't hold what inject writes: %w", path, ErrNotTrusted)
+	}
+
+	return nil
+}
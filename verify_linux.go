@@ -0,0 +1,246 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyChain checks that Go's verifier builds a chain for hostname from the
+// given leaf cert to a cert that certinject injected into the configured NSS
+// and p11-kit trust stores.  Extensions stapled to p11-kit certs replace the
+// cert's own, as they do in p11-kit, so stapled name constraints and EKU
+// restrictions are enforced.  It returns an error wrapping ErrNotTrusted if
+// no chain can be built.
+func VerifyChain(leafDER []byte, hostname string) error {
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't parse leaf cert: %w", err, ErrVerify)
+	}
+
+	roots, err := storeRoots()
+	if err != nil {
+		return err
+	}
+
+	if len(roots) == 0 {
+		return fmt.Errorf("no injected certs are trusted in the configured trust stores: %w", ErrNotTrusted)
+	}
+
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{DNSName: hostname, Roots: pool})
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrNotTrusted)
+	}
+
+	names := []string{}
+	for _, cert := range chains[0] {
+		names = append(names, cert.Subject.String())
+	}
+
+	log.Infof("Chain for %s: %s", hostname, strings.Join(names, " <- "))
+
+	return nil
+}
+
+// storeRoots returns the certs that certinject injected into the configured
+// NSS and p11-kit trust stores, with any stapled extensions applied.
+func storeRoots() ([]*x509.Certificate, error) {
+	roots := []*x509.Certificate{}
+
+	if nssFlag.Value() {
+		if nssDir.Value() == "" {
+			return nil, fmt.Errorf("nssdbdir must be set: %w", ErrVerify)
+		}
+
+		certs, err := storeRootsNSS(nssDir.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		roots = append(roots, certs...)
+	}
+
+	if p11kitFlag.Value() {
+		if p11kitDir.Value() == "" {
+			return nil, fmt.Errorf("p11kitdir must be set: %w", ErrVerify)
+		}
+
+		certs, err := storeRootsP11Kit(p11kitDir.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		roots = append(roots, certs...)
+	}
+
+	return roots, nil
+}
+
+// storeRootsNSS returns the certinject certs in an NSS database that are
+// trusted for TLS, either as a CA (C) or as a peer (P).  NSS has no stapled
+// extensions, so they're used as they are.
+func storeRootsNSS(dbDir string) ([]*x509.Certificate, error) {
+	listed, err := listCertsNSS(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrVerify)
+	}
+
+	roots := []*x509.Certificate{}
+
+	for _, listedCert := range listed {
+		sslTrust := strings.SplitN(listedCert.Trust, ",", 2)[0]
+		if !strings.ContainsAny(sslTrust, "CP") {
+			continue
+		}
+
+		der, err := exportCertNSS(dbDir, listedCert.Nickname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrVerify)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't parse %s: %w", err, listedCert.Nickname, ErrVerify)
+		}
+
+		roots = append(roots, cert)
+	}
+
+	return roots, nil
+}
+
+// storeRootsP11Kit returns the certs in a p11-kit directory, with their
+// stapled extensions applied.
+func storeRootsP11Kit(dir string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't list %s: %w", err, dir, ErrVerify)
+	}
+
+	roots := []*x509.Certificate{}
+
+	for _, entry := range entries {
+		if !isP11KitFile(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't read %s: %w", err, path, ErrVerify)
+		}
+
+		der, exts, err := parseP11KitObjects(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", err, path, ErrVerify)
+		}
+
+		cert, err := stapleExtensions(der, exts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		roots = append(roots, cert)
+	}
+
+	return roots, nil
+}
+
+// tbsCertificate is the TBSCertificate of RFC 5280 section 4.1, with
+// everything but the extensions left encoded.
+type tbsCertificate struct {
+	Raw             asn1.RawContent
+	Version         int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber    asn1.RawValue
+	Signature       asn1.RawValue
+	Issuer          asn1.RawValue
+	Validity        asn1.RawValue
+	Subject         asn1.RawValue
+	PublicKey       asn1.RawValue
+	IssuerUniqueID  asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueID asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions      []pkix.Extension `asn1:"omitempty,optional,explicit,tag:3"`
+}
+
+type certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+// stapleExtensions returns the cert with each stapled extension replacing
+// the cert's own extension with the same OID, or added if it has none.
+// This breaks the cert's signature, which doesn't matter for a root, since
+// Go's verifier only checks the signatures that a root makes.
+func stapleExtensions(derBytes []byte, exts []pkix.Extension) (*x509.Certificate, error) {
+	var cert certificate
+
+	_, err := asn1.Unmarshal(derBytes, &cert)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse cert: %w", err, ErrVerify)
+	}
+
+	var tbs tbsCertificate
+
+	_, err = asn1.Unmarshal(cert.TBSCertificate.FullBytes, &tbs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse TBSCertificate: %w", err, ErrVerify)
+	}
+
+	stapled := map[string]pkix.Extension{}
+	for _, ext := range exts {
+		stapled[ext.Id.String()] = ext
+	}
+
+	merged := make([]pkix.Extension, 0, len(tbs.Extensions)+len(exts))
+
+	for _, ext := range tbs.Extensions {
+		if replacement, ok := stapled[ext.Id.String()]; ok {
+			ext = replacement
+
+			delete(stapled, ext.Id.String())
+		}
+
+		merged = append(merged, ext)
+	}
+
+	for _, ext := range exts {
+		if _, ok := stapled[ext.Id.String()]; ok {
+			merged = append(merged, ext)
+		}
+	}
+
+	// Extensions need a v3 cert.
+	tbs.Raw = nil
+	tbs.Version = 2
+	tbs.Extensions = merged
+
+	tbsBytes, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't marshal TBSCertificate: %w", err, ErrVerify)
+	}
+
+	cert.TBSCertificate = asn1.RawValue{FullBytes: tbsBytes}
+
+	result, err := asn1.Marshal(cert)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't marshal cert: %w", err, ErrVerify)
+	}
+
+	stapledCert, err := x509.ParseCertificate(result)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse stapled cert: %w", err, ErrVerify)
+	}
+
+	return stapledCert, nil
+}
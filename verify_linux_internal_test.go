@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package certinject
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject/x509ext"
+)
+
+func TestVerifyChainP11Kit(t *testing.T) {
+	dir := t.TempDir()
+
+	p11kitFlag.SetValue(true)
+	defer p11kitFlag.SetValue(false)
+
+	p11kitDir.SetValue(dir)
+	defer p11kitDir.SetValue("")
+
+	rootDER, leafDER := testChain(t, "www.example.bit")
+
+	err := VerifyChain(leafDER, "www.example.bit")
+	if !errors.Is(err, ErrNotTrusted) {
+		t.Errorf("chain verified with %v before injection, expected ErrNotTrusted", err)
+	}
+
+	writeTestAnchor(t, dir, rootDER, nil)
+
+	err = VerifyChain(leafDER, "www.example.bit")
+	if err != nil {
+		t.Errorf("chain didn't verify after injection: %s", err)
+	}
+
+	err = VerifyChain(leafDER, "www.example.com")
+	if !errors.Is(err, ErrNotTrusted) {
+		t.Errorf("chain verified with %v for the wrong hostname, expected ErrNotTrusted", err)
+	}
+
+	// A stapled name constraint that excludes the leaf's name is enforced.
+	constraints, err := x509ext.BuildNameConstraints(&x509.Certificate{PermittedDNSDomains: []string{"example.com"}})
+	if err != nil {
+		t.Fatalf("couldn't build name constraints: %s", err)
+	}
+
+	writeTestAnchor(t, dir, rootDER, []pkix.Extension{
+		{Id: x509ext.OIDExtensionNameConstraints, Critical: true, Value: constraints},
+	})
+
+	err = VerifyChain(leafDER, "www.example.bit")
+	if !errors.Is(err, ErrNotTrusted) {
+		t.Errorf("chain verified with %v despite a stapled name constraint, expected ErrNotTrusted", err)
+	}
+}
+
+func writeTestAnchor(t *testing.T, dir string, derBytes []byte, exts []pkix.Extension) {
+	t.Helper()
+
+	objects, err := marshalP11KitObjects(derBytes, exts)
+	if err != nil {
+		t.Fatalf("couldn't marshal anchor: %s", err)
+	}
+
+	path := filepath.Join(dir, (&manifestCert{der: derBytes}).fingerprintHex()+p11kitExtension)
+
+	err = os.WriteFile(path, objects, 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write anchor: %s", err)
+	}
+}
+
+// testChain returns a new root CA and a leaf cert that it issued for name.
+func testChain(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certinject test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create root: %s", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, rootTemplate, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create leaf: %s", err)
+	}
+
+	return rootDER, leafDER
+}
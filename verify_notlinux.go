@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package certinject
+
+import (
+	"fmt"
+)
+
+// VerifyChain isn't supported on this platform.  On Windows, CryptoAPI
+// builds chains itself, so VerifyCert is the closest check.
+func VerifyChain(_ []byte, _ string) error {
+	return fmt.Errorf("chain verification is only supported on Linux: %w", ErrVerify)
+}
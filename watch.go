@@ -0,0 +1,152 @@
+package certinject
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+var watchDebounce = cflag.Int(flagGroup, "watch-debounce", 1000,
+	"Milliseconds to wait for a trust store to stop changing before "+
+		"re-applying, in watch mode")
+
+var ErrWatch = errors.New("error watching trust stores")
+
+// notifier reports changes to trust stores.  A change that happens while
+// nobody is waiting is reported by the next Wait, so none are missed.
+type notifier interface {
+	// Wait blocks until something changes, and returns its name.  If ctx
+	// is done first, it returns ctx's error.
+	Wait(ctx context.Context) (string, error)
+
+	Close() error
+}
+
+// WatchStats counts what watch mode has done since the process started.
+type WatchStats struct {
+	// Notifications is the number of changes reported.
+	Notifications uint64
+
+	// Checks is the number of times the trust stores were checked, after
+	// coalescing bursts of notifications.
+	Checks uint64
+
+	// Repairs is the number of checks that had to change a trust store.
+	Repairs uint64
+
+	// Errors is the number of checks that failed.
+	Errors uint64
+}
+
+// watchStats is updated atomically.
+var watchStats WatchStats
+
+// WatchStatistics returns what watch mode has done so far.
+func WatchStatistics() WatchStats {
+	return WatchStats{
+		Notifications: atomic.LoadUint64(&watchStats.Notifications),
+		Checks:        atomic.LoadUint64(&watchStats.Checks),
+		Repairs:       atomic.LoadUint64(&watchStats.Repairs),
+		Errors:        atomic.LoadUint64(&watchStats.Errors),
+	}
+}
+
+// watchLoop calls apply whenever n reports a change, until ctx is done.
+// apply returns whether it had to change anything.
+//
+// Changes often come in bursts (e.g. sqlite writing cert9.db and its
+// journal, or CryptoAPI rewriting several values), so apply is only called
+// once no change has been seen for debounce.  apply's own writes show up as
+// changes too, so it must leave stores that are already right alone;
+// otherwise every apply would trigger the next one.
+func watchLoop(ctx context.Context, n notifier, debounce time.Duration, apply func() (bool, error)) error {
+	for {
+		// Wait for the first change of a burst.
+		name, err := n.Wait(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&watchStats.Notifications, 1)
+		log.Debugf("Trust store changed: %s", name)
+
+		err = waitQuiet(ctx, n, debounce)
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+
+		checkWatched(apply)
+	}
+}
+
+// checkWatched calls apply, and counts and logs the result.
+func checkWatched(apply func() (bool, error)) {
+	atomic.AddUint64(&watchStats.Checks, 1)
+
+	repaired, err := apply()
+	if err != nil {
+		atomic.AddUint64(&watchStats.Errors, 1)
+		log.Errorf("Error re-applying to trust stores: %s", err)
+	}
+
+	if repaired {
+		atomic.AddUint64(&watchStats.Repairs, 1)
+		log.Info("Trust store was changed; repaired it")
+	}
+}
+
+// waitQuiet waits until n reports no change for debounce, or ctx is done.
+func waitQuiet(ctx context.Context, n notifier, debounce time.Duration) error {
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, debounce)
+		name, err := n.Wait(waitCtx)
+
+		// If a change raced with the timeout, apply runs after it anyway.
+		quiet := waitCtx.Err() != nil
+
+		cancel()
+
+		if quiet {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&watchStats.Notifications, 1)
+		log.Debugf("Trust store changed: %s", name)
+	}
+}
+
+// channelNotifier is a notifier fed by a channel, which is closed if
+// notifications stop early.
+type channelNotifier struct {
+	changes <-chan string
+	close   func() error
+}
+
+func (n *channelNotifier) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case name, ok := <-n.changes:
+		if !ok {
+			return "", fmt.Errorf("change notifications stopped: %w", ErrWatch)
+		}
+
+		return name, nil
+	}
+}
+
+func (n *channelNotifier) Close() error {
+	return n.close()
+}
@@ -0,0 +1,139 @@
+package certinject
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNotifier reports whatever is sent to changes.
+type fakeNotifier struct {
+	changes chan string
+	closed  int32
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{changes: make(chan string)}
+}
+
+func (n *fakeNotifier) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case name, ok := <-n.changes:
+		if !ok {
+			return "", ErrWatch
+		}
+
+		return name, nil
+	}
+}
+
+func (n *fakeNotifier) Close() error {
+	atomic.StoreInt32(&n.closed, 1)
+
+	return nil
+}
+
+func TestWatchLoop(t *testing.T) {
+	const debounce = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := newFakeNotifier()
+	before := WatchStatistics()
+
+	var applied int32
+
+	// The store starts out broken, so the first check repairs it, and its
+	// own write is reported like any other change.  The second check
+	// finds nothing to do, so it doesn't write, and the loop settles.
+	apply := func() (bool, error) {
+		if atomic.AddInt32(&applied, 1) != 1 {
+			return false, nil
+		}
+
+		go func() {
+			n.changes <- "own write"
+		}()
+
+		return true, nil
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- watchLoop(ctx, n, debounce, apply)
+	}()
+
+	// A burst of changes is coalesced into one check.
+	for i := 0; i < 5; i++ {
+		n.changes <- "Root"
+	}
+
+	time.Sleep(10 * debounce)
+
+	if got := atomic.LoadInt32(&applied); got != 2 {
+		t.Errorf("checked %d times after a burst, expected 2", got)
+	}
+
+	stats := WatchStatistics()
+
+	if got := stats.Notifications - before.Notifications; got != 6 {
+		t.Errorf("counted %d notifications, expected 6", got)
+	}
+
+	if got := stats.Checks - before.Checks; got != 2 {
+		t.Errorf("counted %d checks, expected 2", got)
+	}
+
+	if got := stats.Repairs - before.Repairs; got != 1 {
+		t.Errorf("counted %d repairs, expected 1", got)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchLoop returned %s after cancel, expected nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watchLoop didn't return after cancel")
+	}
+}
+
+func TestWatchLoopErrors(t *testing.T) {
+	n := newFakeNotifier()
+	before := WatchStatistics()
+
+	done := make(chan error)
+
+	go func() {
+		done <- watchLoop(context.Background(), n, time.Millisecond, func() (bool, error) {
+			return false, errInjectTest
+		})
+	}()
+
+	n.changes <- "Root"
+
+	// Give the check time to run before notifications stop.
+	time.Sleep(20 * time.Millisecond)
+	close(n.changes)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrWatch) {
+			t.Errorf("watchLoop returned %v after notifications stopped, expected ErrWatch", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watchLoop didn't return after notifications stopped")
+	}
+
+	if got := WatchStatistics().Errors - before.Errors; got != 1 {
+		t.Errorf("counted %d errors, expected 1", got)
+	}
+}
+
+var errInjectTest = errors.New("test injection failed")
@@ -0,0 +1,355 @@
+package certinject
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the events that can mean an entry was removed or
+// overwritten, or that the directory itself was.  IN_CLOSE_WRITE is left
+// out, since certutil opens the database for writing even just to list
+// certs.
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// watchedDir is a directory to watch, and which of its files matter.
+type watchedDir struct {
+	path  string
+	match func(name string) bool
+}
+
+// WatchCert injects the given cert into the configured NSS and p11-kit
+// trust stores, then watches them with inotify, and injects it again
+// whenever they change, e.g. because certutil or Firefox removed or
+// overwrote certinject's entry.  It returns once ctx is done.
+//
+// Entries that are already right are left alone, so that checking them
+// doesn't count as a change.  In particular, the NSS cert file's
+// modification time isn't refreshed, so CleanCerts will still remove the
+// cert once it's too old, and then WatchCert puts it back.
+func WatchCert(ctx context.Context, derBytes []byte) error {
+	err := checkInjection(derBytes)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := watchedDirs()
+	if err != nil {
+		return err
+	}
+
+	// The first injection isn't a repair.
+	operation := auditInject
+
+	apply := func() (bool, error) {
+		var (
+			repaired bool
+			lastErr  error
+		)
+
+		defer func() { operation = auditRepair }()
+
+		if nssFlag.Value() {
+			changed, err := refreshCertNSS(derBytes, operation)
+			if err != nil {
+				log.Errorf("Error injecting cert to NSS: %s", err)
+
+				lastErr = err
+			}
+
+			repaired = repaired || changed
+		}
+
+		if p11kitFlag.Value() {
+			changed, err := refreshCertP11Kit(derBytes, operation)
+			if err != nil {
+				log.Errorf("Error injecting cert to p11-kit: %s", err)
+
+				lastErr = err
+			}
+
+			repaired = repaired || changed
+		}
+
+		return repaired, lastErr
+	}
+
+	// A dry run only prints the plan once, like the CryptoAPI watch mode.
+	if dryRun.Value() {
+		_, err = apply()
+
+		return err
+	}
+
+	// Start watching before the first injection, so that a change made
+	// while it runs isn't missed.
+	n, err := watchDirs(dirs)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+
+	_, err = apply()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Watching trust stores for changes...")
+
+	return watchLoop(ctx, n, time.Duration(watchDebounce.Value())*time.Millisecond, apply)
+}
+
+// refreshCertNSS injects a cert into NSS, unless it's already there with
+// the trust that InjectCert gives it, and returns whether it did.  Any
+// change is recorded in the audit log as operation.
+func refreshCertNSS(derBytes []byte, operation string) (bool, error) {
+	fingerprint := sha256.Sum256(derBytes)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+
+	defer auditChangeNSS(operation, "", nssDir.Value(), certDir.Value(), fingerprintHex)()
+
+	nickname := nicknameFromFingerprintHexNSS(fingerprintHex)
+	path := filepath.Join(certDir.Value(), fingerprintHex+".pem")
+
+	wrote, err := writeFileIfChanged(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", err, ErrNSS)
+	}
+
+	listed, err := listCertsNSS(nssDir.Value())
+	if err != nil {
+		return wrote, err
+	}
+
+	for _, cert := range listed {
+		if cert.Nickname != nickname {
+			continue
+		}
+
+		if cert.Trust == nssDefaultTrust {
+			return wrote, nil
+		}
+
+		stdoutStderr, err := runCertutil(nil, "-d", "sql:"+nssDir.Value(), "-M", "-t", nssDefaultTrust, "-n", nickname)
+		if err != nil {
+			return wrote, fmt.Errorf("%s: %s: %w", err, stdoutStderr, ErrCertutil)
+		}
+
+		return true, nil
+	}
+
+	err = addCertNSS(nssDir.Value(), nickname, nssDefaultTrust, path)
+	if err != nil {
+		return wrote, fmt.Errorf("%s: couldn't inject cert to NSS database: %w", err, ErrNSS)
+	}
+
+	return true, nil
+}
+
+// refreshCertP11Kit writes a cert's p11-kit file, unless it's already
+// there with the same contents, and returns whether it did.  Like
+// refreshCertNSS, any change is recorded as operation.
+func refreshCertP11Kit(derBytes []byte, operation string) (bool, error) {
+	exts, err := buildExtensionOverrides(derBytes)
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't build extension overrides: %w", err, ErrP11Kit)
+	}
+
+	objects, err := marshalP11KitObjects(derBytes, exts)
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't marshal p11-kit objects: %w", err, ErrP11Kit)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	name := hex.EncodeToString(fingerprint[:]) + p11kitExtension
+	path := filepath.Join(p11kitDir.Value(), name)
+
+	defer auditChangeP11Kit(operation, "", p11kitDir.Value(), name)()
+
+	wrote, err := writeFileIfChanged(path, objects)
+	if err != nil {
+		return false, fmt.Errorf("%s: couldn't write p11-kit file: %w", err, ErrP11Kit)
+	}
+
+	return wrote, nil
+}
+
+// writeFileIfChanged writes data to path, unless path already holds it, and
+// returns whether it did.
+func writeFileIfChanged(path string, data []byte) (bool, error) {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+
+	if dryRun.Value() {
+		planf("write %s (%d bytes)", path, len(data))
+
+		return true, nil
+	}
+
+	return true, os.WriteFile(path, data, 0o644)
+}
+
+// watchedDirs returns the directories of the configured trust stores.
+// Watching cert9.db's directory rather than the file itself also catches
+// sqlite's journal, and the database being replaced.
+func watchedDirs() ([]watchedDir, error) {
+	dirs := []watchedDir{}
+
+	if nssFlag.Value() {
+		if certDir.Value() == "" || nssDir.Value() == "" {
+			return nil, fmt.Errorf("nsscertdir and nssdbdir must both be set: %w", ErrWatch)
+		}
+
+		dirs = append(dirs,
+			watchedDir{nssDir.Value(), func(name string) bool { return strings.HasPrefix(name, "cert9.db") }},
+			watchedDir{certDir.Value(), func(name string) bool { return strings.HasSuffix(name, ".pem") }},
+		)
+	}
+
+	if p11kitFlag.Value() {
+		if p11kitDir.Value() == "" {
+			return nil, fmt.Errorf("p11kitdir must be set: %w", ErrWatch)
+		}
+
+		dirs = append(dirs, watchedDir{p11kitDir.Value(), isP11KitFile})
+	}
+
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no trust store to watch (consider nss or p11kit): %w", ErrWatch)
+	}
+
+	return dirs, nil
+}
+
+// watchDirs returns a notifier that reports the path of each matching file
+// that changes in dirs.
+func watchDirs(dirs []watchedDir) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't initialize inotify: %w", err, ErrWatch)
+	}
+
+	// A non-blocking fd is handled by the runtime poller, so closing the
+	// file interrupts a pending Read.
+	inotify := os.NewFile(uintptr(fd), "inotify")
+
+	watches := map[int32]watchedDir{}
+
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, dir.path, inotifyMask)
+		if err != nil {
+			inotify.Close()
+
+			return nil, fmt.Errorf("%s: couldn't watch %s: %w", err, dir.path, ErrWatch)
+		}
+
+		watches[int32(wd)] = dir
+	}
+
+	changes := make(chan string)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(changes)
+
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.PathMax))
+
+		for {
+			n, err := inotify.Read(buf)
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					log.Errorf("%s: couldn't read inotify events", err)
+				}
+
+				return
+			}
+
+			names, err := parseInotifyEvents(buf[:n], watches)
+
+			for _, name := range names {
+				select {
+				case changes <- name:
+				case <-done:
+					return
+				}
+			}
+
+			if err != nil {
+				log.Errorf("%s", err)
+
+				return
+			}
+		}
+	}()
+
+	closeWatch := func() error {
+		close(done)
+
+		return inotify.Close()
+	}
+
+	return &channelNotifier{changes: changes, close: closeWatch}, nil
+}
+
+// parseInotifyEvents returns the paths of the matching files in a buffer of
+// inotify events.  If a watched directory was removed or moved away, nothing
+// in it can be watched any more, so that's an error; the events before it
+// are still returned.
+func parseInotifyEvents(buf []byte, watches map[int32]watchedDir) ([]string, error) {
+	result := []string{}
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		offset = nameEnd
+
+		if nameEnd > len(buf) {
+			break
+		}
+
+		// Events were dropped, so any file might have changed.
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			result = append(result, "(inotify queue overflow)")
+
+			continue
+		}
+
+		dir, ok := watches[event.Wd]
+		if !ok {
+			continue
+		}
+
+		// IN_IGNORED follows IN_DELETE_SELF, but also comes alone if the
+		// directory's file system was unmounted.
+		if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0 {
+			return result, fmt.Errorf("%s was removed or moved, so it can't be watched any more: %w", dir.path,
+				ErrWatch)
+		}
+
+		name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+
+		if !dir.match(name) {
+			continue
+		}
+
+		result = append(result, filepath.Join(dir.path, name))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package certinject
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchCertP11Kit(t *testing.T) {
+	dir := t.TempDir()
+
+	p11kitFlag.SetValue(true)
+	defer p11kitFlag.SetValue(false)
+
+	p11kitDir.SetValue(dir)
+	defer p11kitDir.SetValue("")
+
+	watchDebounce.SetValue(20)
+	defer watchDebounce.SetValue(1000)
+
+	cert, err := os.ReadFile("testdata/untrusted-root.badssl.com.ca.pem.cert")
+	if err != nil {
+		t.Fatalf("couldn't read cert: %s", err)
+	}
+
+	der, err := decodeCertFile(cert)
+	if err != nil {
+		t.Fatalf("couldn't decode test cert: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- WatchCert(ctx, der)
+	}()
+
+	path := filepath.Join(dir, (&manifestCert{der: der}).fingerprintHex()+p11kitExtension)
+
+	waitForFile(t, path)
+
+	// Someone else removes our anchor; the watcher puts it back.
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatalf("couldn't remove anchor: %s", err)
+	}
+
+	waitForFile(t, path)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WatchCert returned %s after cancel, expected nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WatchCert didn't return after cancel")
+	}
+}
+
+func TestWatchDirsRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "anchors")
+
+	err := os.Mkdir(dir, 0o700)
+	if err != nil {
+		t.Fatalf("couldn't create dir: %s", err)
+	}
+
+	n, err := watchDirs([]watchedDir{{dir, isP11KitFile}})
+	if err != nil {
+		t.Fatalf("couldn't watch: %s", err)
+	}
+	defer n.Close()
+
+	err = os.Remove(dir)
+	if err != nil {
+		t.Fatalf("couldn't remove dir: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Nothing in the directory matches, so the only thing to report is
+	// that it's gone.
+	_, err = n.Wait(ctx)
+	if !errors.Is(err, ErrWatch) {
+		t.Errorf("removed dir: got %v, expected ErrWatch", err)
+	}
+}
+
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		_, err := os.Stat(path)
+		if err == nil {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("%s didn't appear", path)
+}
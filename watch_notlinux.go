@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package certinject
+
+import (
+	"context"
+	"fmt"
+)
+
+// WatchCert needs inotify or CryptoAPI change notifications, so it's only
+// supported on Linux and Windows.
+func WatchCert(_ context.Context, _ []byte) error {
+	return fmt.Errorf("watching trust stores is only supported on Linux and Windows: %w", ErrWatch)
+}
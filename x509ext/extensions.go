@@ -0,0 +1,189 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// OID's of the extensions that x509ext can build and validate.
+var (
+	OIDExtensionBasicConstraints    = asn1.ObjectIdentifier{2, 5, 29, 19}
+	OIDExtensionNameConstraints     = asn1.ObjectIdentifier{2, 5, 29, 30}
+	OIDExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	OIDExtensionPolicyConstraints   = asn1.ObjectIdentifier{2, 5, 29, 36}
+	OIDExtensionExtKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 37}
+	OIDExtensionInhibitAnyPolicy    = asn1.ObjectIdentifier{2, 5, 29, 54}
+)
+
+// From RFC 5280 section 4.2.1.9.  This matches how crypto/x509 encodes it.
+type basicConstraints struct {
+	IsCA       bool `asn1:"optional"`
+	MaxPathLen int  `asn1:"optional,default:-1"`
+}
+
+// From RFC 5280 section 4.2.1.11.  A value of -1 means the field is absent.
+type policyConstraints struct {
+	RequireExplicitPolicy int `asn1:"optional,tag:0,default:-1"`
+	InhibitPolicyMapping  int `asn1:"optional,tag:1,default:-1"`
+}
+
+// BuildBasicConstraints builds a Basic Constraints extension value from the
+// IsCA, MaxPathLen and MaxPathLenZero fields of template, with the same
+// semantics as crypto/x509.
+func BuildBasicConstraints(template *x509.Certificate) ([]byte, error) {
+	maxPathLen := template.MaxPathLen
+	if maxPathLen == 0 && !template.MaxPathLenZero {
+		maxPathLen = -1
+	}
+
+	if maxPathLen < -1 {
+		maxPathLen = -1
+	}
+
+	if maxPathLen != -1 && !template.IsCA {
+		return nil, fmt.Errorf("path length constraint on a non-CA: %w", ErrExtensionMarshal)
+	}
+
+	value, err := asn1.Marshal(basicConstraints{IsCA: template.IsCA, MaxPathLen: maxPathLen})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionMarshal)
+	}
+
+	return value, nil
+}
+
+// ParseBasicConstraints decodes a Basic Constraints extension value.  A
+// maxPathLen of -1 means there is no path length constraint.
+func ParseBasicConstraints(value []byte) (isCA bool, maxPathLen int, err error) {
+	var constraints basicConstraints
+
+	err = unmarshalExact(value, &constraints)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if constraints.MaxPathLen < -1 {
+		return false, 0, fmt.Errorf("negative path length: %w", ErrExtensionParse)
+	}
+
+	return constraints.IsCA, constraints.MaxPathLen, nil
+}
+
+// BuildPolicyConstraints builds a Policy Constraints extension value.  Pass
+// -1 to omit either field; at least one must be present.
+func BuildPolicyConstraints(requireExplicitPolicy, inhibitPolicyMapping int) ([]byte, error) {
+	if requireExplicitPolicy < -1 || inhibitPolicyMapping < -1 {
+		return nil, fmt.Errorf("negative skip count: %w", ErrExtensionMarshal)
+	}
+
+	if requireExplicitPolicy == -1 && inhibitPolicyMapping == -1 {
+		return nil, fmt.Errorf("empty policy constraints: %w", ErrExtensionMarshal)
+	}
+
+	value, err := asn1.Marshal(policyConstraints{
+		RequireExplicitPolicy: requireExplicitPolicy,
+		InhibitPolicyMapping:  inhibitPolicyMapping,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionMarshal)
+	}
+
+	return value, nil
+}
+
+// ParsePolicyConstraints decodes a Policy Constraints extension value.
+// Absent fields are returned as -1.
+func ParsePolicyConstraints(value []byte) (requireExplicitPolicy, inhibitPolicyMapping int, err error) {
+	var constraints policyConstraints
+
+	err = unmarshalExact(value, &constraints)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if constraints.RequireExplicitPolicy < -1 || constraints.InhibitPolicyMapping < -1 {
+		return 0, 0, fmt.Errorf("negative skip count: %w", ErrExtensionParse)
+	}
+
+	if constraints.RequireExplicitPolicy == -1 && constraints.InhibitPolicyMapping == -1 {
+		return 0, 0, fmt.Errorf("empty policy constraints: %w", ErrExtensionParse)
+	}
+
+	return constraints.RequireExplicitPolicy, constraints.InhibitPolicyMapping, nil
+}
+
+// BuildInhibitAnyPolicy builds an Inhibit anyPolicy extension value.
+func BuildInhibitAnyPolicy(skipCerts int) ([]byte, error) {
+	if skipCerts < 0 {
+		return nil, fmt.Errorf("negative skip count: %w", ErrExtensionMarshal)
+	}
+
+	value, err := asn1.Marshal(skipCerts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionMarshal)
+	}
+
+	return value, nil
+}
+
+// ParseInhibitAnyPolicy decodes an Inhibit anyPolicy extension value.
+func ParseInhibitAnyPolicy(value []byte) (int, error) {
+	var skipCerts int
+
+	err := unmarshalExact(value, &skipCerts)
+	if err != nil {
+		return 0, err
+	}
+
+	if skipCerts < 0 {
+		return 0, fmt.Errorf("negative skip count: %w", ErrExtensionParse)
+	}
+
+	return skipCerts, nil
+}
+
+// ValidateExtension checks that ext's value parses back correctly.
+// Extensions that x509ext knows are fully decoded; unknown ones are only
+// checked for being a single well-formed DER element.
+func ValidateExtension(ext pkix.Extension) error {
+	var err error
+
+	switch {
+	case ext.Id.Equal(OIDExtensionBasicConstraints):
+		_, _, err = ParseBasicConstraints(ext.Value)
+	case ext.Id.Equal(OIDExtensionNameConstraints):
+		_, err = ParseNameConstraints(ext.Value)
+	case ext.Id.Equal(OIDExtensionCertificatePolicies):
+		_, err = ParseCertificatePolicies(ext.Value)
+	case ext.Id.Equal(OIDExtensionPolicyConstraints):
+		_, _, err = ParsePolicyConstraints(ext.Value)
+	case ext.Id.Equal(OIDExtensionExtKeyUsage):
+		_, _, err = ParseExtKeyUsage(ext.Value)
+	case ext.Id.Equal(OIDExtensionInhibitAnyPolicy):
+		_, err = ParseInhibitAnyPolicy(ext.Value)
+	default:
+		var raw asn1.RawValue
+		err = unmarshalExact(ext.Value, &raw)
+	}
+
+	if err != nil {
+		return fmt.Errorf("extension %s: %w", ext.Id, err)
+	}
+
+	return nil
+}
+
+func unmarshalExact(value []byte, out interface{}) error {
+	rest, err := asn1.Unmarshal(value, out)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrExtensionParse)
+	}
+
+	if len(rest) != 0 {
+		return fmt.Errorf("trailing data: %w", ErrExtensionParse)
+	}
+
+	return nil
+}
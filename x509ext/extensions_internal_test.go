@@ -0,0 +1,106 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestBasicConstraintsRoundTrip(t *testing.T) {
+	tests := []struct {
+		template   *x509.Certificate
+		golden     string
+		maxPathLen int
+	}{
+		{&x509.Certificate{IsCA: true}, "30030101ff", -1},
+		{&x509.Certificate{IsCA: true, MaxPathLenZero: true}, "30060101ff020100", 0},
+		{&x509.Certificate{IsCA: true, MaxPathLen: 2}, "30060101ff020102", 2},
+		{&x509.Certificate{}, "3000", -1},
+	}
+
+	for _, test := range tests {
+		value, err := BuildBasicConstraints(test.template)
+		if err != nil {
+			t.Errorf("%s: couldn't build: %s", test.golden, err)
+
+			continue
+		}
+
+		if hex.EncodeToString(value) != test.golden {
+			t.Errorf("expected %s, got %x", test.golden, value)
+		}
+
+		isCA, maxPathLen, err := ParseBasicConstraints(value)
+		if err != nil || isCA != test.template.IsCA || maxPathLen != test.maxPathLen {
+			t.Errorf("%s: parsed as %t, %d, %v", test.golden, isCA, maxPathLen, err)
+		}
+	}
+
+	_, err := BuildBasicConstraints(&x509.Certificate{MaxPathLen: 1})
+	if !errors.Is(err, ErrExtensionMarshal) {
+		t.Errorf("path length on non-CA: expected ErrExtensionMarshal, got %v", err)
+	}
+}
+
+func TestPolicyConstraintsRoundTrip(t *testing.T) {
+	value, err := BuildPolicyConstraints(0, -1)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	if hex.EncodeToString(value) != "3003800100" {
+		t.Errorf("unexpected encoding %x", value)
+	}
+
+	requireExplicit, inhibitMapping, err := ParsePolicyConstraints(value)
+	if err != nil || requireExplicit != 0 || inhibitMapping != -1 {
+		t.Errorf("parsed as %d, %d, %v", requireExplicit, inhibitMapping, err)
+	}
+
+	_, err = BuildPolicyConstraints(-1, -1)
+	if !errors.Is(err, ErrExtensionMarshal) {
+		t.Errorf("empty: expected ErrExtensionMarshal, got %v", err)
+	}
+}
+
+func TestInhibitAnyPolicyRoundTrip(t *testing.T) {
+	value, err := BuildInhibitAnyPolicy(1)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	skipCerts, err := ParseInhibitAnyPolicy(value)
+	if err != nil || skipCerts != 1 {
+		t.Errorf("parsed as %d, %v", skipCerts, err)
+	}
+}
+
+func TestValidateExtension(t *testing.T) {
+	valid := []pkix.Extension{
+		{Id: OIDExtensionBasicConstraints, Value: []byte{0x30, 0x03, 0x01, 0x01, 0xff}},
+		{Id: OIDExtensionInhibitAnyPolicy, Value: []byte{0x02, 0x01, 0x00}},
+		{Id: []int{1, 2, 3}, Value: []byte{0x05, 0x00}},
+	}
+
+	for _, ext := range valid {
+		if err := ValidateExtension(ext); err != nil {
+			t.Errorf("%s: unexpected error %s", ext.Id, err)
+		}
+	}
+
+	invalid := []pkix.Extension{
+		{Id: OIDExtensionBasicConstraints, Value: []byte{0x02, 0x01, 0x00}},
+		{Id: OIDExtensionInhibitAnyPolicy, Value: []byte{0x02, 0x01, 0xff}},
+		{Id: OIDExtensionPolicyConstraints, Value: []byte{0x30, 0x00}},
+		{Id: OIDExtensionExtKeyUsage, Value: []byte{0x30, 0x00, 0x00}},
+		{Id: []int{1, 2, 3}, Value: []byte{0x05}},
+	}
+
+	for _, ext := range invalid {
+		if err := ValidateExtension(ext); !errors.Is(err, ErrExtensionParse) {
+			t.Errorf("%s %x: expected ErrExtensionParse, got %v", ext.Id, ext.Value, err)
+		}
+	}
+}
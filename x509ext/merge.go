@@ -0,0 +1,525 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MergeMode selects how a requested EKU or name constraints restriction is
+// combined with the one a cert already carries.
+type MergeMode int
+
+const (
+	// MergeReplace discards the existing restriction.
+	MergeReplace MergeMode = iota
+
+	// MergeIntersect keeps only what both restrictions allow.
+	MergeIntersect
+
+	// MergeUnion allows anything that either restriction allows.
+	MergeUnion
+)
+
+var (
+	ErrMerge             = errors.New("error merging restrictions")
+	ErrInvalidMergeMode  = fmt.Errorf("invalid merge mode (consider replace, intersect, union): %w", ErrMerge)
+	ErrEmptyIntersection = fmt.Errorf("intersection allows nothing: %w", ErrMerge)
+)
+
+var extKeyUsageAnyOID = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+
+// ParseMergeMode parses "replace", "intersect" or "union".
+func ParseMergeMode(mode string) (MergeMode, error) {
+	switch mode {
+	case "replace":
+		return MergeReplace, nil
+	case "intersect":
+		return MergeIntersect, nil
+	case "union":
+		return MergeUnion, nil
+	}
+
+	return 0, fmt.Errorf("%q: %w", mode, ErrInvalidMergeMode)
+}
+
+// In the merge functions below, a nil *x509.Certificate means "no
+// restriction", i.e. the property is absent.  The EKU functions use the
+// ExtKeyUsage and UnknownExtKeyUsage fields; the name constraints functions
+// use the Permitted* and Excluded* fields.
+
+// MergeExtKeyUsage combines existing and requested EKU restrictions.  A nil
+// result means the cert should be left unrestricted.
+func MergeExtKeyUsage(existing, requested *x509.Certificate, mode MergeMode) (*x509.Certificate, error) {
+	switch mode {
+	case MergeReplace:
+		return requested, nil
+	case MergeIntersect:
+		if existing == nil || ekuAllowsAny(existing) {
+			return requested, nil
+		}
+
+		if requested == nil || ekuAllowsAny(requested) {
+			return existing, nil
+		}
+
+		result := ekuFromOIDs(filterOIDs(ekuOIDs(requested), func(oid asn1.ObjectIdentifier) bool {
+			return containsOID(ekuOIDs(existing), oid)
+		}))
+
+		if len(result.ExtKeyUsage) == 0 && len(result.UnknownExtKeyUsage) == 0 {
+			return nil, fmt.Errorf("extended key usage: %w", ErrEmptyIntersection)
+		}
+
+		return result, nil
+	case MergeUnion:
+		if existing == nil || requested == nil {
+			return nil, nil
+		}
+
+		oids := ekuOIDs(existing)
+		for _, oid := range ekuOIDs(requested) {
+			if !containsOID(oids, oid) {
+				oids = append(oids, oid)
+			}
+		}
+
+		return ekuFromOIDs(oids), nil
+	}
+
+	return nil, ErrInvalidMergeMode
+}
+
+// ExtKeyUsageBroader reports whether updated allows any usage that old
+// didn't.
+func ExtKeyUsageBroader(old, updated *x509.Certificate) bool {
+	if old == nil || ekuAllowsAny(old) {
+		return false
+	}
+
+	if updated == nil || ekuAllowsAny(updated) {
+		return true
+	}
+
+	for _, oid := range ekuOIDs(updated) {
+		if !containsOID(ekuOIDs(old), oid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ekuOIDs(template *x509.Certificate) []asn1.ObjectIdentifier {
+	oids := []asn1.ObjectIdentifier{}
+
+	for _, usage := range template.ExtKeyUsage {
+		if oid, ok := oidFromExtKeyUsage(usage); ok {
+			oids = append(oids, oid)
+		}
+	}
+
+	return append(oids, template.UnknownExtKeyUsage...)
+}
+
+func ekuFromOIDs(oids []asn1.ObjectIdentifier) *x509.Certificate {
+	result := &x509.Certificate{}
+
+	for _, oid := range oids {
+		if usage, ok := extKeyUsageFromOID(oid); ok {
+			result.ExtKeyUsage = append(result.ExtKeyUsage, usage)
+		} else {
+			result.UnknownExtKeyUsage = append(result.UnknownExtKeyUsage, oid)
+		}
+	}
+
+	return result
+}
+
+func ekuAllowsAny(template *x509.Certificate) bool {
+	return containsOID(ekuOIDs(template), extKeyUsageAnyOID)
+}
+
+func containsOID(oids []asn1.ObjectIdentifier, oid asn1.ObjectIdentifier) bool {
+	for _, candidate := range oids {
+		if candidate.Equal(oid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func filterOIDs(oids []asn1.ObjectIdentifier, keep func(asn1.ObjectIdentifier) bool) []asn1.ObjectIdentifier {
+	result := []asn1.ObjectIdentifier{}
+
+	for _, oid := range oids {
+		if keep(oid) {
+			result = append(result, oid)
+		}
+	}
+
+	return result
+}
+
+// MergeNameConstraints combines existing and requested name constraints.
+// Each name type (DNS, IP, email, URI) is merged separately, since a type
+// with no permitted subtrees is unrestricted by the permitted list.  A nil
+// result means the cert should be left unconstrained.
+func MergeNameConstraints(existing, requested *x509.Certificate, mode MergeMode) (*x509.Certificate, error) {
+	switch mode {
+	case MergeReplace:
+		return requested, nil
+	case MergeIntersect:
+		if existing == nil {
+			return requested, nil
+		}
+
+		if requested == nil {
+			return existing, nil
+		}
+
+		return mergeNameConstraintsWith(existing, requested, intersectPermitted, unionExcluded)
+	case MergeUnion:
+		if existing == nil || requested == nil {
+			return nil, nil
+		}
+
+		result, err := mergeNameConstraintsWith(existing, requested, unionPermitted, intersectExcluded)
+		if err != nil || isEmptyNameConstraints(result) {
+			return nil, err
+		}
+
+		return result, nil
+	}
+
+	return nil, ErrInvalidMergeMode
+}
+
+// NameConstraintsBroader reports whether updated permits any name that old
+// didn't.
+func NameConstraintsBroader(old, updated *x509.Certificate) bool {
+	if old == nil {
+		return false
+	}
+
+	if updated == nil {
+		return !isEmptyNameConstraints(old)
+	}
+
+	oldLists, updatedLists := nameLists(old), nameLists(updated)
+
+	for i := range oldLists {
+		oldPermitted, updatedPermitted := oldLists[i].permitted, updatedLists[i].permitted
+
+		if len(oldPermitted) != 0 {
+			if len(updatedPermitted) == 0 || !allWithinAny(updatedPermitted, oldPermitted, oldLists[i].within) {
+				return true
+			}
+		}
+
+		if !allWithinAny(oldLists[i].excluded, updatedLists[i].excluded, oldLists[i].within) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A nameList holds the constraints for one name type, with each name
+// stringified so that all types can share the merge logic.
+type nameList struct {
+	permitted []string
+	excluded  []string
+	// within reports whether every name matching constraint a also
+	// matches constraint b.
+	within func(a, b string) bool
+}
+
+func nameLists(template *x509.Certificate) []nameList {
+	return []nameList{
+		{template.PermittedDNSDomains, template.ExcludedDNSDomains, domainWithin},
+		{ipNetStrings(template.PermittedIPRanges), ipNetStrings(template.ExcludedIPRanges), ipNetWithin},
+		{template.PermittedEmailAddresses, template.ExcludedEmailAddresses, emailWithin},
+		{template.PermittedURIDomains, template.ExcludedURIDomains, domainWithin},
+	}
+}
+
+type mergeFunc func(a, b []string, within func(a, b string) bool) ([]string, error)
+
+func mergeNameConstraintsWith(existing, requested *x509.Certificate,
+	mergePermitted, mergeExcluded mergeFunc,
+) (*x509.Certificate, error) {
+	existingLists, requestedLists := nameLists(existing), nameLists(requested)
+	merged := make([]nameList, len(existingLists))
+
+	for i := range existingLists {
+		permitted, err := mergePermitted(existingLists[i].permitted, requestedLists[i].permitted,
+			existingLists[i].within)
+		if err != nil {
+			return nil, err
+		}
+
+		excluded, err := mergeExcluded(existingLists[i].excluded, requestedLists[i].excluded,
+			existingLists[i].within)
+		if err != nil {
+			return nil, err
+		}
+
+		merged[i] = nameList{permitted: permitted, excluded: excluded}
+	}
+
+	permittedIPs, err := parseIPNetStrings(merged[1].permitted)
+	if err != nil {
+		return nil, err
+	}
+
+	excludedIPs, err := parseIPNetStrings(merged[1].excluded)
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		PermittedDNSDomains:     merged[0].permitted,
+		ExcludedDNSDomains:      merged[0].excluded,
+		PermittedIPRanges:       permittedIPs,
+		ExcludedIPRanges:        excludedIPs,
+		PermittedEmailAddresses: merged[2].permitted,
+		ExcludedEmailAddresses:  merged[2].excluded,
+		PermittedURIDomains:     merged[3].permitted,
+		ExcludedURIDomains:      merged[3].excluded,
+	}, nil
+}
+
+// intersectPermitted keeps the names that both lists permit.  An empty list
+// permits everything.
+func intersectPermitted(a, b []string, within func(a, b string) bool) ([]string, error) {
+	if len(a) == 0 {
+		return b, nil
+	}
+
+	if len(b) == 0 {
+		return a, nil
+	}
+
+	result := []string{}
+
+	for _, name := range a {
+		if anyWithin(name, b, within) {
+			result = appendUnique(result, name)
+		}
+	}
+
+	for _, name := range b {
+		if anyWithin(name, a, within) {
+			result = appendUnique(result, name)
+		}
+	}
+
+	// An empty permitted list would permit everything, which is the
+	// opposite of what the caller wants.
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no permitted names in common: %w", ErrEmptyIntersection)
+	}
+
+	return result, nil
+}
+
+// unionPermitted permits the names that either list permits.  An empty list
+// permits everything.
+func unionPermitted(a, b []string, _ func(a, b string) bool) ([]string, error) {
+	if len(a) == 0 || len(b) == 0 {
+		return nil, nil
+	}
+
+	return unionStrings(a, b), nil
+}
+
+// unionExcluded excludes the names that either list excludes.
+func unionExcluded(a, b []string, _ func(a, b string) bool) ([]string, error) {
+	return unionStrings(a, b), nil
+}
+
+// intersectExcluded excludes the names that both lists exclude.
+func intersectExcluded(a, b []string, within func(a, b string) bool) ([]string, error) {
+	result := []string{}
+
+	for _, name := range a {
+		if anyWithin(name, b, within) {
+			result = appendUnique(result, name)
+		}
+	}
+
+	for _, name := range b {
+		if anyWithin(name, a, within) {
+			result = appendUnique(result, name)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+func unionStrings(a, b []string) []string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+
+	result := []string{}
+	for _, name := range append(append([]string{}, a...), b...) {
+		result = appendUnique(result, name)
+	}
+
+	return result
+}
+
+func appendUnique(list []string, name string) []string {
+	for _, existing := range list {
+		if strings.EqualFold(existing, name) {
+			return list
+		}
+	}
+
+	return append(list, name)
+}
+
+func anyWithin(name string, constraints []string, within func(a, b string) bool) bool {
+	for _, constraint := range constraints {
+		if within(name, constraint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func allWithinAny(names, constraints []string, within func(a, b string) bool) bool {
+	for _, name := range names {
+		if !anyWithin(name, constraints, within) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// domainWithin uses crypto/x509's matching rules: "example.com" matches
+// itself and its subdomains, while ".example.com" only matches subdomains.
+func domainWithin(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+
+	if a == b {
+		return true
+	}
+
+	trimmedB := strings.TrimPrefix(b, ".")
+
+	return strings.HasSuffix(strings.TrimPrefix(a, "."), "."+trimmedB) ||
+		(strings.HasPrefix(a, ".") && !strings.HasPrefix(b, ".") && strings.TrimPrefix(a, ".") == b)
+}
+
+// emailWithin handles both mailbox ("user@example.com") and domain
+// ("example.com", ".example.com") constraints.
+func emailWithin(a, b string) bool {
+	if strings.Contains(b, "@") {
+		return strings.EqualFold(a, b)
+	}
+
+	if at := strings.LastIndex(a, "@"); at != -1 {
+		host := a[at+1:]
+
+		return strings.EqualFold(host, b) || domainWithin(host, b)
+	}
+
+	return domainWithin(a, b)
+}
+
+func ipNetWithin(a, b string) bool {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+
+	if errA != nil || errB != nil || len(netA.IP) != len(netB.IP) {
+		return false
+	}
+
+	onesA, _ := netA.Mask.Size()
+	onesB, _ := netB.Mask.Size()
+
+	return onesA >= onesB && netB.Contains(netA.IP)
+}
+
+func ipNetStrings(ipNets []*net.IPNet) []string {
+	result := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		result = append(result, ipNet.String())
+	}
+
+	return result
+}
+
+func parseIPNetStrings(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrMerge)
+		}
+
+		result = append(result, ipNet)
+	}
+
+	return result, nil
+}
+
+func isEmptyNameConstraints(template *x509.Certificate) bool {
+	for _, list := range nameLists(template) {
+		if len(list.permitted) != 0 || len(list.excluded) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DomainWithinAny reports whether the DNS name or constraint name is within
+// any of constraints, using crypto/x509's matching rules.
+func DomainWithinAny(name string, constraints []string) bool {
+	return anyWithin(name, constraints, domainWithin)
+}
+
+// DomainNameConstraints returns name constraints that confine a CA to
+// domains, in the form that DomainWithinAny takes, for every name type: DNS
+// names, and the hosts of email addresses and URIs, must be within domains,
+// and all IP addresses are excluded.  A constraint that NameConstraintsBroader
+// doesn't report as broader than it can't issue for anything else.
+func DomainNameConstraints(domains []string) *x509.Certificate {
+	_, allIPv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, allIPv6, _ := net.ParseCIDR("::/0")
+
+	// Email and URI constraints follow RFC 5280 rather than crypto/x509:
+	// "example.com" only matches that host, so its subdomains need
+	// ".example.com" as well.
+	var hosts []string
+
+	for _, domain := range domains {
+		hosts = append(hosts, domain)
+
+		if !strings.HasPrefix(domain, ".") {
+			hosts = append(hosts, "."+domain)
+		}
+	}
+
+	return &x509.Certificate{
+		PermittedDNSDomains:     domains,
+		ExcludedIPRanges:        []*net.IPNet{allIPv4, allIPv6},
+		PermittedEmailAddresses: hosts,
+		PermittedURIDomains:     hosts,
+	}
+}
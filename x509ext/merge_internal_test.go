@@ -0,0 +1,190 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func ekuTemplate(usages ...x509.ExtKeyUsage) *x509.Certificate {
+	return &x509.Certificate{ExtKeyUsage: usages}
+}
+
+func TestMergeExtKeyUsage(t *testing.T) {
+	docSigning := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 12}
+	serverCode := ekuTemplate(x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageCodeSigning)
+	serverDoc := &x509.Certificate{
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{docSigning},
+	}
+
+	tests := []struct {
+		name      string
+		existing  *x509.Certificate
+		requested *x509.Certificate
+		mode      MergeMode
+		expected  *x509.Certificate
+		broader   bool
+	}{
+		{"replace widens", ekuTemplate(x509.ExtKeyUsageServerAuth), serverCode, MergeReplace, serverCode, true},
+		{"intersect", serverCode, serverDoc, MergeIntersect, ekuTemplate(x509.ExtKeyUsageServerAuth), false},
+		{"intersect unrestricted", nil, serverCode, MergeIntersect, serverCode, false},
+		{"intersect any", ekuTemplate(x509.ExtKeyUsageAny), serverCode, MergeIntersect, serverCode, false},
+		{"union", serverCode, serverDoc, MergeUnion, &x509.Certificate{
+			ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageCodeSigning},
+			UnknownExtKeyUsage: []asn1.ObjectIdentifier{docSigning},
+		}, true},
+		{"union unrestricted", nil, serverCode, MergeUnion, nil, false},
+	}
+
+	for _, test := range tests {
+		merged, err := MergeExtKeyUsage(test.existing, test.requested, test.mode)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, merged)
+		}
+
+		if broader := ExtKeyUsageBroader(test.existing, merged); broader != test.broader {
+			t.Errorf("%s: expected broader=%t, got %t", test.name, test.broader, broader)
+		}
+	}
+
+	_, err := MergeExtKeyUsage(ekuTemplate(x509.ExtKeyUsageCodeSigning),
+		ekuTemplate(x509.ExtKeyUsageServerAuth), MergeIntersect)
+	if !errors.Is(err, ErrEmptyIntersection) {
+		t.Errorf("disjoint intersect: expected ErrEmptyIntersection, got %v", err)
+	}
+}
+
+func TestMergeNameConstraints(t *testing.T) {
+	_, privateNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+
+	existing := &x509.Certificate{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   []*net.IPNet{privateNet},
+	}
+	requested := &x509.Certificate{
+		PermittedDNSDomains: []string{"www.example.com", "example.org"},
+		ExcludedDNSDomains:  []string{".bit"},
+		PermittedIPRanges:   []*net.IPNet{subnet},
+	}
+
+	merged, err := MergeNameConstraints(existing, requested, MergeIntersect)
+	if err != nil {
+		t.Fatalf("intersect: unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(merged.PermittedDNSDomains, []string{"www.example.com"}) {
+		t.Errorf("intersect: wrong permitted DNS %v", merged.PermittedDNSDomains)
+	}
+
+	if !reflect.DeepEqual(merged.ExcludedDNSDomains, []string{"secret.example.com", ".bit"}) {
+		t.Errorf("intersect: wrong excluded DNS %v", merged.ExcludedDNSDomains)
+	}
+
+	if len(merged.PermittedIPRanges) != 1 || merged.PermittedIPRanges[0].String() != "10.1.0.0/16" {
+		t.Errorf("intersect: wrong permitted IPs %v", merged.PermittedIPRanges)
+	}
+
+	if NameConstraintsBroader(existing, merged) {
+		t.Errorf("intersect: result reported as broader")
+	}
+
+	merged, err = MergeNameConstraints(existing, requested, MergeUnion)
+	if err != nil {
+		t.Fatalf("union: unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(merged.PermittedDNSDomains,
+		[]string{"example.com", "www.example.com", "example.org"}) {
+		t.Errorf("union: wrong permitted DNS %v", merged.PermittedDNSDomains)
+	}
+
+	if len(merged.ExcludedDNSDomains) != 0 {
+		t.Errorf("union: wrong excluded DNS %v", merged.ExcludedDNSDomains)
+	}
+
+	if !NameConstraintsBroader(existing, merged) {
+		t.Errorf("union: result not reported as broader")
+	}
+
+	if !NameConstraintsBroader(existing, requested) {
+		t.Errorf("replace: result not reported as broader")
+	}
+
+	_, err = MergeNameConstraints(existing,
+		&x509.Certificate{PermittedDNSDomains: []string{"example.net"}}, MergeIntersect)
+	if !errors.Is(err, ErrEmptyIntersection) {
+		t.Errorf("disjoint intersect: expected ErrEmptyIntersection, got %v", err)
+	}
+}
+
+func TestNameWithin(t *testing.T) {
+	tests := []struct {
+		within      func(a, b string) bool
+		a, b        string
+		isContained bool
+	}{
+		{domainWithin, "www.example.com", "example.com", true},
+		{domainWithin, ".example.com", "example.com", true},
+		{domainWithin, "example.com", ".example.com", false},
+		{domainWithin, "badexample.com", "example.com", false},
+		{emailWithin, "user@example.com", "example.com", true},
+		{emailWithin, "user@example.com", "other@example.com", false},
+		{emailWithin, "example.com", "user@example.com", false},
+		{ipNetWithin, "10.1.0.0/16", "10.0.0.0/8", true},
+		{ipNetWithin, "10.0.0.0/8", "10.1.0.0/16", false},
+		{ipNetWithin, "::/0", "0.0.0.0/0", false},
+	}
+
+	for _, test := range tests {
+		if result := test.within(test.a, test.b); result != test.isContained {
+			t.Errorf("%s within %s: expected %t, got %t", test.a, test.b, test.isContained, result)
+		}
+	}
+}
+
+func TestDomainNameConstraints(t *testing.T) {
+	confined := DomainNameConstraints([]string{"example.bit"})
+
+	if !reflect.DeepEqual(confined.PermittedEmailAddresses, []string{"example.bit", ".example.bit"}) {
+		t.Errorf("wrong permitted emails %v", confined.PermittedEmailAddresses)
+	}
+
+	if NameConstraintsBroader(confined, confined) {
+		t.Errorf("constraints reported as broader than themselves")
+	}
+
+	dnsOnly := &x509.Certificate{PermittedDNSDomains: []string{"www.example.bit"}}
+	if !NameConstraintsBroader(confined, dnsOnly) {
+		t.Errorf("DNS-only constraints not reported as broader")
+	}
+
+	_, allIPv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, allIPv6, _ := net.ParseCIDR("::/0")
+	narrower := &x509.Certificate{
+		PermittedDNSDomains:     []string{"www.example.bit"},
+		ExcludedIPRanges:        []*net.IPNet{allIPv6, allIPv4},
+		PermittedEmailAddresses: []string{"example.bit"},
+		PermittedURIDomains:     []string{".example.bit"},
+	}
+
+	if NameConstraintsBroader(confined, narrower) {
+		t.Errorf("narrower constraints reported as broader")
+	}
+
+	narrower.ExcludedIPRanges = narrower.ExcludedIPRanges[:1]
+	if !NameConstraintsBroader(confined, narrower) {
+		t.Errorf("constraints permitting IPv4 not reported as broader")
+	}
+}
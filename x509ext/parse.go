@@ -0,0 +1,205 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrExtensionParse = errors.New("error parsing X.509 extension")
+
+// These tags are from the GeneralName CHOICE in RFC 5280 section 4.2.1.6.
+const (
+	nameTagEmail = 1
+	nameTagDNS   = 2
+	nameTagURI   = 6
+	nameTagIP    = 7
+)
+
+// These tags are from the NameConstraints SEQUENCE in RFC 5280 section
+// 4.2.1.10.
+const (
+	subtreesTagPermitted = 0
+	subtreesTagExcluded  = 1
+)
+
+var extKeyUsageOIDs = []struct {
+	usage x509.ExtKeyUsage
+	oid   asn1.ObjectIdentifier
+}{
+	{x509.ExtKeyUsageAny, asn1.ObjectIdentifier{2, 5, 29, 37, 0}},
+	{x509.ExtKeyUsageServerAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}},
+	{x509.ExtKeyUsageClientAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}},
+	{x509.ExtKeyUsageCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}},
+	{x509.ExtKeyUsageEmailProtection, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}},
+	{x509.ExtKeyUsageIPSECEndSystem, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 5}},
+	{x509.ExtKeyUsageIPSECTunnel, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 6}},
+	{x509.ExtKeyUsageIPSECUser, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 7}},
+	{x509.ExtKeyUsageTimeStamping, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}},
+	{x509.ExtKeyUsageOCSPSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}},
+	{x509.ExtKeyUsageMicrosoftServerGatedCrypto, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 3}},
+	{x509.ExtKeyUsageNetscapeServerGatedCrypto, asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 4, 1}},
+	{x509.ExtKeyUsageMicrosoftCommercialCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 22}},
+	{x509.ExtKeyUsageMicrosoftKernelCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 61, 1, 1}},
+}
+
+func extKeyUsageFromOID(oid asn1.ObjectIdentifier) (x509.ExtKeyUsage, bool) {
+	for _, pair := range extKeyUsageOIDs {
+		if oid.Equal(pair.oid) {
+			return pair.usage, true
+		}
+	}
+
+	return 0, false
+}
+
+// ParseExtKeyUsage decodes an Extended Key Usage extension value.  OID's that
+// don't correspond to an x509.ExtKeyUsage value are returned separately, in
+// the same way as x509.Certificate's UnknownExtKeyUsage field.
+func ParseExtKeyUsage(value []byte) ([]x509.ExtKeyUsage, []asn1.ObjectIdentifier, error) {
+	var oids []asn1.ObjectIdentifier
+
+	rest, err := asn1.Unmarshal(value, &oids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", err, ErrExtensionParse)
+	}
+
+	if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("trailing data after extended key usage: %w", ErrExtensionParse)
+	}
+
+	ekus := []x509.ExtKeyUsage{}
+	unknown := []asn1.ObjectIdentifier{}
+
+	for _, oid := range oids {
+		if usage, ok := extKeyUsageFromOID(oid); ok {
+			ekus = append(ekus, usage)
+		} else {
+			unknown = append(unknown, oid)
+		}
+	}
+
+	return ekus, unknown, nil
+}
+
+// ParseNameConstraints decodes a Name Constraints extension value.  Only the
+// name constraint fields of the returned certificate are populated, so that
+// the result can be passed back to BuildNameConstraints.
+func ParseNameConstraints(value []byte) (*x509.Certificate, error) {
+	var outer asn1.RawValue
+
+	rest, err := asn1.Unmarshal(value, &outer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionParse)
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after name constraints: %w", ErrExtensionParse)
+	}
+
+	if outer.Class != asn1.ClassUniversal || outer.Tag != asn1.TagSequence || !outer.IsCompound {
+		return nil, fmt.Errorf("name constraints isn't a SEQUENCE: %w", ErrExtensionParse)
+	}
+
+	result := &x509.Certificate{}
+
+	for rest = outer.Bytes; len(rest) > 0; {
+		var subtrees asn1.RawValue
+
+		rest, err = asn1.Unmarshal(rest, &subtrees)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrExtensionParse)
+		}
+
+		if subtrees.Class != asn1.ClassContextSpecific || !subtrees.IsCompound {
+			return nil, fmt.Errorf("unexpected element in name constraints: %w", ErrExtensionParse)
+		}
+
+		switch subtrees.Tag {
+		case subtreesTagPermitted:
+			err = parseGeneralSubtrees(subtrees.Bytes, &result.PermittedDNSDomains,
+				&result.PermittedIPRanges, &result.PermittedEmailAddresses, &result.PermittedURIDomains)
+		case subtreesTagExcluded:
+			err = parseGeneralSubtrees(subtrees.Bytes, &result.ExcludedDNSDomains,
+				&result.ExcludedIPRanges, &result.ExcludedEmailAddresses, &result.ExcludedURIDomains)
+		default:
+			err = fmt.Errorf("unexpected tag %d in name constraints: %w", subtrees.Tag, ErrExtensionParse)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func parseGeneralSubtrees(data []byte, dns *[]string, ips *[]*net.IPNet, emails, uris *[]string) error {
+	for len(data) > 0 {
+		var (
+			subtree asn1.RawValue
+			name    asn1.RawValue
+			err     error
+		)
+
+		data, err = asn1.Unmarshal(data, &subtree)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrExtensionParse)
+		}
+
+		if subtree.Class != asn1.ClassUniversal || subtree.Tag != asn1.TagSequence {
+			return fmt.Errorf("general subtree isn't a SEQUENCE: %w", ErrExtensionParse)
+		}
+
+		// The minimum and maximum fields are ignored, as they are by Go's
+		// crypto/x509 (RFC 5280 forbids them from being set).
+		_, err = asn1.Unmarshal(subtree.Bytes, &name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrExtensionParse)
+		}
+
+		if name.Class != asn1.ClassContextSpecific {
+			return fmt.Errorf("general name isn't context-specific: %w", ErrExtensionParse)
+		}
+
+		switch name.Tag {
+		case nameTagDNS:
+			*dns = append(*dns, string(name.Bytes))
+		case nameTagEmail:
+			*emails = append(*emails, string(name.Bytes))
+		case nameTagURI:
+			*uris = append(*uris, string(name.Bytes))
+		case nameTagIP:
+			ipNet, err := parseIPAndMask(name.Bytes)
+			if err != nil {
+				return err
+			}
+
+			*ips = append(*ips, ipNet)
+		default:
+			return fmt.Errorf("unsupported general name tag %d: %w", name.Tag, ErrExtensionParse)
+		}
+	}
+
+	return nil
+}
+
+func parseIPAndMask(data []byte) (*net.IPNet, error) {
+	if len(data) != 2*net.IPv4len && len(data) != 2*net.IPv6len {
+		return nil, fmt.Errorf("IP constraint has length %d: %w", len(data), ErrExtensionParse)
+	}
+
+	ipLen := len(data) / 2
+	mask := net.IPMask(append([]byte{}, data[ipLen:]...))
+
+	if _, bits := mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("IP constraint has non-contiguous mask %s: %w", mask, ErrExtensionParse)
+	}
+
+	return &net.IPNet{
+		IP:   net.IP(append([]byte{}, data[:ipLen]...)),
+		Mask: mask,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtKeyUsageRoundTrip(t *testing.T) {
+	docSigning := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 12}
+	template := &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+		},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{docSigning},
+	}
+
+	value, err := BuildExtKeyUsage(template)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	ekus, unknown, err := ParseExtKeyUsage(value)
+	if err != nil {
+		t.Fatalf("couldn't parse: %s", err)
+	}
+
+	if !reflect.DeepEqual(ekus, template.ExtKeyUsage) {
+		t.Errorf("expected EKUs %v, got %v", template.ExtKeyUsage, ekus)
+	}
+
+	if len(unknown) != 1 || !unknown[0].Equal(docSigning) {
+		t.Errorf("expected unknown EKUs [%s], got %v", docSigning, unknown)
+	}
+}
+
+func TestParseNameConstraintsRoundTrip(t *testing.T) {
+	_, ipv4, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ipv6, _ := net.ParseCIDR("fd00::/8")
+
+	template := &x509.Certificate{
+		PermittedDNSDomains:     []string{".bit", "example.com"},
+		ExcludedDNSDomains:      []string{"bad.bit"},
+		PermittedIPRanges:       []*net.IPNet{ipv4},
+		ExcludedIPRanges:        []*net.IPNet{ipv6},
+		PermittedEmailAddresses: []string{"example.org"},
+		ExcludedURIDomains:      []string{".example.net"},
+	}
+
+	value, err := BuildNameConstraints(template)
+	if err != nil {
+		t.Fatalf("couldn't build: %s", err)
+	}
+
+	parsed, err := ParseNameConstraints(value)
+	if err != nil {
+		t.Fatalf("couldn't parse: %s", err)
+	}
+
+	checks := []struct {
+		name     string
+		expected interface{}
+		got      interface{}
+	}{
+		{"permitted DNS", template.PermittedDNSDomains, parsed.PermittedDNSDomains},
+		{"excluded DNS", template.ExcludedDNSDomains, parsed.ExcludedDNSDomains},
+		{"permitted email", template.PermittedEmailAddresses, parsed.PermittedEmailAddresses},
+		{"excluded email", template.ExcludedEmailAddresses, parsed.ExcludedEmailAddresses},
+		{"permitted URI", template.PermittedURIDomains, parsed.PermittedURIDomains},
+		{"excluded URI", template.ExcludedURIDomains, parsed.ExcludedURIDomains},
+	}
+
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.expected, check.got) {
+			t.Errorf("%s: expected %v, got %v", check.name, check.expected, check.got)
+		}
+	}
+
+	if len(parsed.PermittedIPRanges) != 1 || parsed.PermittedIPRanges[0].String() != ipv4.String() {
+		t.Errorf("permitted IP: expected [%s], got %v", ipv4, parsed.PermittedIPRanges)
+	}
+
+	if len(parsed.ExcludedIPRanges) != 1 || parsed.ExcludedIPRanges[0].String() != ipv6.String() {
+		t.Errorf("excluded IP: expected [%s], got %v", ipv6, parsed.ExcludedIPRanges)
+	}
+}
+
+func TestParseNameConstraintsMalformed(t *testing.T) {
+	for _, value := range [][]byte{
+		{},
+		{0x30},
+		{0x30, 0x03, 0xa0, 0x01},
+		{0x04, 0x00},
+		{0x30, 0x00, 0x00},
+	} {
+		_, err := ParseNameConstraints(value)
+		if !errors.Is(err, ErrExtensionParse) {
+			t.Errorf("%x: expected ErrExtensionParse, got %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// From RFC 5280 section 4.2.1.4.  Policy qualifiers are passed through
+// undecoded, since CryptoAPI's root program properties don't use them.
+type policyInformation struct {
+	Policy     asn1.ObjectIdentifier
+	Qualifiers asn1.RawValue `asn1:"optional"`
+}
+
+// BuildCertificatePolicies builds a Certificate Policies extension value from
+// the PolicyIdentifiers field of template.
+func BuildCertificatePolicies(template *x509.Certificate) ([]byte, error) {
+	if len(template.PolicyIdentifiers) == 0 {
+		return nil, fmt.Errorf("no policy identifiers: %w", ErrExtensionMarshal)
+	}
+
+	policies := make([]policyInformation, 0, len(template.PolicyIdentifiers))
+	for _, oid := range template.PolicyIdentifiers {
+		policies = append(policies, policyInformation{Policy: oid})
+	}
+
+	value, err := asn1.Marshal(policies)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionMarshal)
+	}
+
+	return value, nil
+}
+
+// ParseCertificatePolicies decodes a Certificate Policies extension value
+// into its policy OID's.  Policy qualifiers are ignored.
+func ParseCertificatePolicies(value []byte) ([]asn1.ObjectIdentifier, error) {
+	var policies []policyInformation
+
+	rest, err := asn1.Unmarshal(value, &policies)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionParse)
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after certificate policies: %w", ErrExtensionParse)
+	}
+
+	result := make([]asn1.ObjectIdentifier, 0, len(policies))
+	for _, policy := range policies {
+		result = append(result, policy.Policy)
+	}
+
+	return result, nil
+}
+
+// ParseOID parses a dotted-decimal OID such as "1.3.6.1.5.5.7.3.1".
+func ParseOID(oid string) (asn1.ObjectIdentifier, error) {
+	components := strings.Split(strings.TrimSpace(oid), ".")
+	if len(components) < 2 {
+		return nil, fmt.Errorf("OID %q has fewer than 2 components: %w", oid, ErrExtensionParse)
+	}
+
+	result := make(asn1.ObjectIdentifier, 0, len(components))
+
+	for _, component := range components {
+		value, err := strconv.Atoi(component)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("OID %q has invalid component %q: %w", oid, component, ErrExtensionParse)
+		}
+
+		result = append(result, value)
+	}
+
+	if result[0] > 2 || (result[0] < 2 && result[1] >= 40) {
+		return nil, fmt.Errorf("OID %q has invalid leading arcs: %w", oid, ErrExtensionParse)
+	}
+
+	return result, nil
+}
@@ -1,68 +1,273 @@
 package x509ext
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
+	"encoding/asn1"
 	"errors"
 	"fmt"
-	"math/big"
+	"net"
+	"strings"
+	"unicode"
 )
 
 var ErrExtensionMarshal = errors.New("error marshaling X.509 extension")
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
+// The builders below encode extension values directly.  Their output is
+// byte-for-byte identical to what crypto/x509's CreateCertificate produces
+// for the same template, which is how they used to be implemented.
+
+// BuildExtKeyUsage builds an Extended Key Usage extension value from the
+// ExtKeyUsage and UnknownExtKeyUsage fields of template.
+func BuildExtKeyUsage(template *x509.Certificate) ([]byte, error) {
+	if len(template.ExtKeyUsage) == 0 && len(template.UnknownExtKeyUsage) == 0 {
+		return nil, fmt.Errorf("no extended key usages: %w", ErrExtensionMarshal)
 	}
-}
 
-func buildExtension(template *x509.Certificate, oid []int) ([]byte, error) {
-	// Fill in dummy values to the template so that CreateCertificate doesn't
-	// complain.
-	template.SerialNumber = big.NewInt(1)
-	template.Subject = pkix.Name{
-		CommonName:   "Dummy from x509ext",
-		SerialNumber: "Namecoin TLS Certificate",
+	oids := make([]asn1.ObjectIdentifier, 0, len(template.ExtKeyUsage)+len(template.UnknownExtKeyUsage))
+
+	for _, usage := range template.ExtKeyUsage {
+		oid, ok := oidFromExtKeyUsage(usage)
+		if !ok {
+			return nil, fmt.Errorf("unknown extended key usage %d: %w", usage, ErrExtensionMarshal)
+		}
+
+		oids = append(oids, oid)
 	}
 
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	oids = append(oids, template.UnknownExtKeyUsage...)
+
+	value, err := asn1.Marshal(oids)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to generate private key: %w", err, ErrExtensionMarshal)
+		return nil, fmt.Errorf("%s: %w", err, ErrExtensionMarshal)
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, publicKey(priv), priv)
+	return value, nil
+}
+
+// BuildNameConstraints builds a Name Constraints extension value from the
+// Permitted* and Excluded* fields of template.  Names that crypto/x509 would
+// refuse to parse are rejected rather than encoded, since CryptoAPI's
+// handling of them is unpredictable; see CheckNameConstraints.
+func BuildNameConstraints(template *x509.Certificate) ([]byte, error) {
+	err := CheckNameConstraints(template)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to create certificate: %w", err, ErrExtensionMarshal)
+		return nil, err
 	}
 
-	parsedCert, err := x509.ParseCertificate(derBytes)
-	if err != nil {
-		return nil, fmt.Errorf("%s: failed to parse certificate: %w", err, ErrExtensionMarshal)
+	permitted := buildGeneralSubtrees(template.PermittedDNSDomains, template.PermittedIPRanges,
+		template.PermittedEmailAddresses, template.PermittedURIDomains)
+	excluded := buildGeneralSubtrees(template.ExcludedDNSDomains, template.ExcludedIPRanges,
+		template.ExcludedEmailAddresses, template.ExcludedURIDomains)
+
+	if len(permitted) == 0 && len(excluded) == 0 {
+		return nil, fmt.Errorf("no name constraints: %w", ErrExtensionMarshal)
+	}
+
+	var subtrees []byte
+
+	if len(permitted) > 0 {
+		subtrees = append(subtrees, marshalTLV(asn1.ClassContextSpecific, subtreesTagPermitted, true, permitted)...)
+	}
+
+	if len(excluded) > 0 {
+		subtrees = append(subtrees, marshalTLV(asn1.ClassContextSpecific, subtreesTagExcluded, true, excluded)...)
 	}
 
-	for _, ext := range parsedCert.Extensions {
-		if ext.Id.Equal(oid) {
-			return ext.Value, nil
+	return marshalTLV(asn1.ClassUniversal, asn1.TagSequence, true, subtrees), nil
+}
+
+func oidFromExtKeyUsage(usage x509.ExtKeyUsage) (asn1.ObjectIdentifier, bool) {
+	for _, pair := range extKeyUsageOIDs {
+		if usage == pair.usage {
+			return pair.oid, true
 		}
 	}
 
-	return nil, fmt.Errorf("extension not found: %w", ErrExtensionMarshal)
+	return nil, false
 }
 
-func BuildExtKeyUsage(template *x509.Certificate) ([]byte, error) {
-	oidExtensionExtKeyUsage := []int{2, 5, 29, 37}
+// CheckNameConstraints makes sure that each of the Permitted* and Excluded*
+// names of template is well formed:
+//
+//   - DNS names are domain names with no empty labels, optionally with a
+//     leading "." to match only subdomains.
+//   - IP ranges are an IPv4 or IPv6 address with a mask of the same length
+//     and contiguous ones.
+//   - Emails are either a mailbox, or a domain name as for DNS names.
+//   - URIs are domain names as for DNS names, but not IP addresses.
+func CheckNameConstraints(template *x509.Certificate) error {
+	for _, names := range [][]string{template.PermittedDNSDomains, template.ExcludedDNSDomains} {
+		err := checkNames(names, "DNS", checkDomainConstraint)
+		if err != nil {
+			return err
+		}
+	}
 
-	return buildExtension(template, oidExtensionExtKeyUsage)
+	for _, ipNets := range [][]*net.IPNet{template.PermittedIPRanges, template.ExcludedIPRanges} {
+		for _, ipNet := range ipNets {
+			if !checkIPConstraint(ipNet) {
+				return fmt.Errorf("invalid IP range %s: %w", ipNet, ErrExtensionMarshal)
+			}
+		}
+	}
+
+	for _, names := range [][]string{template.PermittedEmailAddresses, template.ExcludedEmailAddresses} {
+		err := checkNames(names, "email", checkEmailConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, names := range [][]string{template.PermittedURIDomains, template.ExcludedURIDomains} {
+		err := checkNames(names, "URI", checkURIConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func BuildNameConstraints(template *x509.Certificate) ([]byte, error) {
-	oidExtensionNameConstraints := []int{2, 5, 29, 30}
+func checkNames(names []string, nameType string, check func(string) bool) error {
+	for _, name := range names {
+		if !isIA5String(name) {
+			return fmt.Errorf("%q cannot be encoded as an IA5String: %w", name, ErrExtensionMarshal)
+		}
+
+		if !check(name) {
+			return fmt.Errorf("invalid %s name constraint %q: %w", nameType, name, ErrExtensionMarshal)
+		}
+	}
+
+	return nil
+}
+
+// checkDomainConstraint returns whether name is a domain name, optionally
+// with a leading ".".
+func checkDomainConstraint(name string) bool {
+	return checkDomain(strings.TrimPrefix(name, "."))
+}
+
+func checkDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		// Like crypto/x509, allow any printable character, since
+		// existing roots' constraints are merged with ours.
+		for _, r := range label {
+			if r <= ' ' || r > '~' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// checkEmailConstraint returns whether name is a mailbox, or a domain name
+// as for DNS names.
+func checkEmailConstraint(name string) bool {
+	at := strings.LastIndex(name, "@")
+	if at == -1 {
+		return checkDomainConstraint(name)
+	}
+
+	local := name[:at]
+	if local == "" || strings.ContainsAny(local, "@ ") {
+		return false
+	}
+
+	return checkDomain(name[at+1:])
+}
+
+// checkURIConstraint returns whether name is a domain name as for DNS
+// names, but not an IP address, which RFC 5280 doesn't allow.
+func checkURIConstraint(name string) bool {
+	return net.ParseIP(name) == nil && checkDomainConstraint(name)
+}
+
+// checkIPConstraint returns whether ipNet is an address with a contiguous
+// mask of the same length, as crypto/x509 requires when parsing.
+func checkIPConstraint(ipNet *net.IPNet) bool {
+	if ipNet == nil {
+		return false
+	}
+
+	maskedIP := ipNet.IP.Mask(ipNet.Mask)
+	if len(maskedIP) != len(ipNet.Mask) || (len(maskedIP) != net.IPv4len && len(maskedIP) != net.IPv6len) {
+		return false
+	}
+
+	_, bits := ipNet.Mask.Size()
+
+	return bits != 0
+}
+
+// buildGeneralSubtrees returns the concatenated GeneralSubtree elements for
+// the given names, in the same order that crypto/x509 uses.  The names must
+// have been checked by CheckNameConstraints.
+func buildGeneralSubtrees(dns []string, ips []*net.IPNet, emails, uris []string) []byte {
+	var result []byte
+
+	appendStrings := func(names []string, tag int) {
+		for _, name := range names {
+			result = append(result, buildGeneralSubtree(tag, []byte(name))...)
+		}
+	}
+
+	appendStrings(dns, nameTagDNS)
+
+	for _, ipNet := range ips {
+		result = append(result, buildGeneralSubtree(nameTagIP, ipAndMask(ipNet))...)
+	}
+
+	appendStrings(emails, nameTagEmail)
+	appendStrings(uris, nameTagURI)
+
+	return result
+}
+
+func buildGeneralSubtree(tag int, name []byte) []byte {
+	generalName := marshalTLV(asn1.ClassContextSpecific, tag, false, name)
+
+	return marshalTLV(asn1.ClassUniversal, asn1.TagSequence, true, generalName)
+}
+
+func ipAndMask(ipNet *net.IPNet) []byte {
+	maskedIP := ipNet.IP.Mask(ipNet.Mask)
+
+	result := make([]byte, 0, len(maskedIP)+len(ipNet.Mask))
+	result = append(result, maskedIP...)
+	result = append(result, ipNet.Mask...)
+
+	return result
+}
+
+// marshalTLV encodes a single DER element.  Marshaling a RawValue can't
+// fail, so the error is ignored.
+func marshalTLV(class, tag int, compound bool, contents []byte) []byte {
+	result, _ := asn1.Marshal(asn1.RawValue{
+		Class:      class,
+		Tag:        tag,
+		IsCompound: compound,
+		Bytes:      contents,
+	})
+
+	return result
+}
+
+func isIA5String(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
 
-	return buildExtension(template, oidExtensionNameConstraints)
+	return true
 }
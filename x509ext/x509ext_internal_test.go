@@ -0,0 +1,211 @@
+package x509ext
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+// The golden values below were produced by the previous implementation,
+// which minted a throwaway certificate with crypto/x509 and extracted the
+// extension from it.
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("couldn't parse CIDR %q: %s", s, err)
+	}
+
+	return ipNet
+}
+
+func TestBuildExtKeyUsageGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		golden   string
+	}{
+		{
+			name:     "server",
+			template: &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+			golden:   "300a06082b06010505070301",
+		},
+		{
+			name:     "any",
+			template: &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}},
+			golden:   "30060604551d2500",
+		},
+		{
+			name: "all",
+			template: &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{
+				x509.ExtKeyUsageAny, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+				x509.ExtKeyUsageCodeSigning, x509.ExtKeyUsageEmailProtection, x509.ExtKeyUsageIPSECEndSystem,
+				x509.ExtKeyUsageIPSECTunnel, x509.ExtKeyUsageIPSECUser, x509.ExtKeyUsageTimeStamping,
+				x509.ExtKeyUsageOCSPSigning, x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+				x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+			}},
+			golden: "30780604551d250006082b0601050507030106082b0601050507030206082b06010505070303" +
+				"06082b0601050507030406082b0601050507030506082b0601050507030606082b06010505070307" +
+				"06082b0601050507030806082b06010505070309060a2b060104018237020116060a2b060104018237" +
+				"3d0101",
+		},
+		{
+			name: "unknown",
+			template: &x509.Certificate{
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				UnknownExtKeyUsage: []asn1.ObjectIdentifier{
+					{1, 3, 6, 1, 4, 1, 311, 10, 3, 12},
+					{1, 3, 6, 1, 4, 1, 311, 20, 2, 2},
+				},
+			},
+			golden: "302206082b06010505070301060a2b0601040182370a030c060a2b060104018237140202",
+		},
+	}
+
+	for _, test := range tests {
+		value, err := BuildExtKeyUsage(test.template)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+
+			continue
+		}
+
+		if hex.EncodeToString(value) != test.golden {
+			t.Errorf("%s: expected %s, got %x", test.name, test.golden, value)
+		}
+	}
+}
+
+func TestBuildNameConstraintsGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		golden   string
+	}{
+		{
+			name:     "permitted DNS",
+			template: &x509.Certificate{PermittedDNSDomains: []string{".bit"}},
+			golden:   "300aa008300682042e626974",
+		},
+		{
+			name:     "excluded DNS",
+			template: &x509.Certificate{ExcludedDNSDomains: []string{".bit"}},
+			golden:   "300aa108300682042e626974",
+		},
+		{
+			name: "excluded IP only",
+			template: &x509.Certificate{ExcludedIPRanges: []*net.IPNet{
+				mustParseCIDR(t, "0.0.0.0/0"), mustParseCIDR(t, "::/0"),
+			}},
+			golden: "3032a130300a87080000000000000000302287200000000000000000000000000000000000000000" +
+				"000000000000000000000000",
+		},
+		{
+			name: "IPv4 in 16-byte form",
+			template: &x509.Certificate{PermittedIPRanges: []*net.IPNet{
+				{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)},
+			}},
+			golden: "300ea00c300a87080a000000ff000000",
+		},
+		{
+			name: "mixed",
+			template: &x509.Certificate{
+				PermittedDNSDomains: []string{".bit", "example.com"},
+				ExcludedDNSDomains:  []string{"bad.bit"},
+				PermittedIPRanges: []*net.IPNet{
+					mustParseCIDR(t, "10.0.0.0/8"), mustParseCIDR(t, "fd00::/8"),
+				},
+				ExcludedIPRanges:        []*net.IPNet{mustParseCIDR(t, "192.168.1.0/24")},
+				PermittedEmailAddresses: []string{"example.org"},
+				ExcludedEmailAddresses:  []string{"user@example.org"},
+				PermittedURIDomains:     []string{".example.net"},
+				ExcludedURIDomains:      []string{"bad.example.net"},
+			},
+			golden: "3081a8a066300682042e626974300d820b6578616d706c652e636f6d300a87080a000000ff000000" +
+				"30228720fd000000000000000000000000000000ff000000000000000000000000000000300d810b65" +
+				"78616d706c652e6f7267300e860c2e6578616d706c652e6e6574a13e300982076261642e626974300a" +
+				"8708c0a80100ffffff003012811075736572406578616d706c652e6f72673011860f6261642e657861" +
+				"6d706c652e6e6574",
+		},
+	}
+
+	for _, test := range tests {
+		value, err := BuildNameConstraints(test.template)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+
+			continue
+		}
+
+		if hex.EncodeToString(value) != test.golden {
+			t.Errorf("%s: expected %s, got %x", test.name, test.golden, value)
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	_, err := BuildExtKeyUsage(&x509.Certificate{})
+	if !errors.Is(err, ErrExtensionMarshal) {
+		t.Errorf("empty EKU: expected ErrExtensionMarshal, got %v", err)
+	}
+
+	_, err = BuildNameConstraints(&x509.Certificate{})
+	if !errors.Is(err, ErrExtensionMarshal) {
+		t.Errorf("empty name constraints: expected ErrExtensionMarshal, got %v", err)
+	}
+
+	_, err = BuildNameConstraints(&x509.Certificate{PermittedDNSDomains: []string{"é.bit"}})
+	if !errors.Is(err, ErrExtensionMarshal) {
+		t.Errorf("non-IA5 name: expected ErrExtensionMarshal, got %v", err)
+	}
+}
+
+func TestBuildNameConstraintsMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+	}{
+		{"empty DNS label", &x509.Certificate{PermittedDNSDomains: []string{"a..b"}}},
+		{"empty DNS name", &x509.Certificate{ExcludedDNSDomains: []string{""}}},
+		{"DNS name with a space", &x509.Certificate{PermittedDNSDomains: []string{"example .bit"}}},
+		{"bare dot email", &x509.Certificate{PermittedEmailAddresses: []string{"."}}},
+		{"email without a local part", &x509.Certificate{ExcludedEmailAddresses: []string{"@example.org"}}},
+		{"email with an empty label", &x509.Certificate{PermittedEmailAddresses: []string{"user@example..org"}}},
+		{"URI of an IP address", &x509.Certificate{PermittedURIDomains: []string{"10.0.0.1"}}},
+		{"URI with a trailing dot", &x509.Certificate{ExcludedURIDomains: []string{"example.net."}}},
+		{"IPv4 with a 16-byte mask", &x509.Certificate{PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 128)},
+		}}},
+		{"IPv6 with a 4-byte mask", &x509.Certificate{ExcludedIPRanges: []*net.IPNet{
+			{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 32)},
+		}}},
+		{"non-contiguous mask", &x509.Certificate{PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.IPv4Mask(255, 0, 255, 0)},
+		}}},
+	}
+
+	for _, test := range tests {
+		value, err := BuildNameConstraints(test.template)
+		if !errors.Is(err, ErrExtensionMarshal) {
+			t.Errorf("%s: expected ErrExtensionMarshal, got %x, %v", test.name, value, err)
+		}
+	}
+}
+
+func TestBuildDoesNotModifyTemplate(t *testing.T) {
+	template := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+
+	_, err := BuildExtKeyUsage(template)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if template.SerialNumber != nil || template.Subject.CommonName != "" {
+		t.Errorf("template was modified: %+v", template)
+	}
+}